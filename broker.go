@@ -3,11 +3,9 @@ package kafka
 import (
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
-	"net"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/discord/zorkian-kafka/proto"
@@ -119,8 +117,32 @@ type BrokerConf struct {
 	// Defaults to False.
 	AllowTopicCreation bool
 
+	// ClientRack is the rack the client runs in. When set, consumers send it
+	// with version 11 fetch requests, which require Kafka 2.4, and fetch from
+	// the replica the broker prefers for that rack instead of the leader. The
+	// brokers must be configured with a replica.selector.class, or they keep
+	// serving fetches from the leader.
+	//
+	// Defaults to empty, always fetching from the leader.
+	ClientRack string
+
 	// Configuration specific to the connections to the cluster.
 	ClusterConnectionConf ClusterConnectionConf
+
+	// Metrics receives measurements of requests, connection pools, retries
+	// and metadata refreshes. Connection pools and cluster metadata are shared
+	// by all brokers of a cluster, so those report to the Metrics of the
+	// broker that created them first.
+	//
+	// Defaults to NopMetrics.
+	Metrics Metrics
+
+	// Logger receives the log messages of the broker and of everything created
+	// from it. Like Metrics, shared connection pools and cluster metadata log
+	// to the Logger of the broker that created them first.
+	//
+	// Defaults to the logger set with SetLogger.
+	Logger Logger
 }
 
 // NewBrokerConf constructs default configuration.
@@ -131,6 +153,7 @@ func NewBrokerConf(clientID string) BrokerConf {
 		LeaderRetryLimit:      10,
 		LeaderRetryWait:       500 * time.Millisecond,
 		ClusterConnectionConf: NewClusterConnectionConf(),
+		Metrics:               NopMetrics{},
 	}
 }
 
@@ -143,31 +166,89 @@ type Broker struct {
 	conf    BrokerConf
 	conns   *connectionPool
 	cluster *Cluster
+
+	// closed is set atomically by Close.
+	closed int32
 }
 
 // NewBroker returns a broker to a given list of kafka addresses.
 //
 // The returned broker is not necessarily initially connected to any kafka node.
 func NewBroker(clusterName string, nodeAddresses []string, conf BrokerConf) (*Broker, error) {
+	conf.Metrics = metricsOrNop(conf.Metrics)
+	conf.ClusterConnectionConf.metrics = conf.Metrics
+	conf.Logger = loggerOrDefault(conf.Logger)
+	conf.ClusterConnectionConf.logger = conf.Logger
+
 	metadata, err := getMetadataCache().getOrCreateMetadata(clusterName, nodeAddresses, conf.ClusterConnectionConf)
 	if err != nil {
-		log.Warningf("Failed to get cluster Metadata %s from cache", nodeAddresses)
+		conf.Logger.Warn("failed to get cluster metadata from cache",
+			"cluster", clusterName, "addrs", nodeAddresses, "err", err)
 		return nil, err
 	}
 
 	metadataConnPool, err := metadata.connectionPoolForClient(conf.ClientID, conf.ClusterConnectionConf)
 	if err != nil {
-		log.Warningf("Failed to get ConnectionPool for metadata from cache")
+		conf.Logger.Warn("failed to get connection pool from cache",
+			"cluster", clusterName, "err", err)
 		return nil, err
 	}
 
 	return &Broker{
-		conf,
-		metadataConnPool,
-		metadata,
+		conf:    conf,
+		conns:   metadataConnPool,
+		cluster: metadata,
 	}, nil
 }
 
+// Close releases the connections of the broker. Connection pools are shared by the brokers
+// with the same ClientID to the same cluster, so the pool is only closed, and its background
+// reaping stopped, when the last of them is closed. The broker must not be used afterwards.
+func (b *Broker) Close() {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return
+	}
+	b.cluster.releaseConnectionPool(b.conf.ClientID)
+}
+
+// TopicMetadata returns the leader, replicas, in-sync replicas and error of
+// every partition of a topic, as of the last metadata refresh. See
+// Cluster.TopicMetadata.
+func (b *Broker) TopicMetadata(topic string) ([]PartitionMetadata, error) {
+	return b.cluster.TopicMetadata(topic)
+}
+
+// UnderReplicatedPartitions returns the partitions with replicas that are not
+// in sync, as of the last metadata refresh.
+func (b *Broker) UnderReplicatedPartitions() []PartitionMetadata {
+	return b.cluster.UnderReplicatedPartitions()
+}
+
+// OfflinePartitions returns the partitions without a leader, as of the last
+// metadata refresh.
+func (b *Broker) OfflinePartitions() []PartitionMetadata {
+	return b.cluster.OfflinePartitions()
+}
+
+// ControllerID returns the node ID of the cluster controller. It is only known
+// with ClusterConnectionConf.MetadataVersion 1 and above.
+func (b *Broker) ControllerID() (int32, error) {
+	return b.cluster.ControllerID()
+}
+
+// Watch returns a channel receiving the changes of the cluster metadata seen
+// by this broker, and a function to stop watching. See Cluster.Watch.
+func (b *Broker) Watch() (<-chan ClusterEvent, func()) {
+	return b.cluster.Watch()
+}
+
+// CircuitStates returns the state of the circuit breaker guarding every known
+// broker, keyed by address. All brokers are closed if circuit breaking is
+// disabled.
+func (b *Broker) CircuitStates() map[string]CircuitState {
+	return b.conns.CircuitStates()
+}
+
 // Metadata returns a copy of the metadata. This does not require a lock as it's fetching
 // a new copy from Kafka, we never use our internal state.
 func (b *Broker) Metadata() (*proto.MetadataResp, error) {
@@ -192,9 +273,9 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 	}
 
 	// Endpoint is unknown, refresh metadata (synchronous, blocks a while)
-	if err := b.cluster.RefreshMetadata(); err != nil {
-		log.Warningf("[getLeaderEndpoint %s:%d] cannot refresh metadata: %s",
-			topic, partition, err)
+	if err := b.cluster.refreshTopicAfterError(topic); err != nil {
+		b.conf.Logger.Warn("cannot refresh metadata",
+			"topic", topic, "partition", partition, "err", err)
 		return 0, err
 	}
 
@@ -205,16 +286,16 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 
 	// If we're not allowed to create topics, exit now we're done
 	if !b.conf.AllowTopicCreation {
-		log.Warningf("[getLeaderEndpoint %s:%d] unknown topic or partition (no create)",
-			topic, partition)
+		b.conf.Logger.Warn("unknown topic or partition (no create)",
+			"topic", topic, "partition", partition)
 		return 0, proto.ErrUnknownTopicOrPartition
 	}
 
 	// Try to create the topic by requesting the metadata for that one specific topic
 	// (this is the hack Kafka uses to allow topics to be created on demand)
 	if _, err := b.cluster.Fetch(b.conf.ClientID, topic); err != nil {
-		log.Warningf("[getLeaderEndpoint %s:%d] failed to get metadata for topic: %s",
-			topic, partition, err)
+		b.conf.Logger.Warn("failed to get metadata for topic",
+			"topic", topic, "partition", partition, "err", err)
 		return 0, err
 	}
 
@@ -224,8 +305,8 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 	}
 
 	// This topic is dead to us, we failed to find it and failed to create it
-	log.Warningf("[getLeaderEndpoint %s:%d] unknown topic or partition (post-create)",
-		topic, partition)
+	b.conf.Logger.Warn("unknown topic or partition (post-create)",
+		"topic", topic, "partition", partition)
 	return 0, proto.ErrUnknownTopicOrPartition
 }
 
@@ -244,8 +325,9 @@ func (b *Broker) leaderConnection(topic string, partition int32) (*connection, e
 	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
 		if try != 0 {
 			sleepFor := retry.Duration()
-			log.Debugf("cannot get leader connection for %s:%d: retry=%d, sleep=%s",
-				topic, partition, try, sleepFor)
+			b.conf.Logger.Debug("cannot get leader connection",
+				"topic", topic, "partition", partition, "try", try, "sleep", sleepFor)
+			b.conf.Metrics.Counter("kafka_retries_total", 1, "op", "leader_connection")
 			time.Sleep(sleepFor)
 		}
 
@@ -260,14 +342,14 @@ func (b *Broker) leaderConnection(topic string, partition int32) (*connection, e
 		if addr := b.cluster.GetNodeAddress(nodeID); addr == "" {
 			// Forget the endpoint so we'll refresh metadata next try
 			resErr = errors.New("unknown broker id")
-			log.Warningf("[leaderConnection %s:%d] unknown broker ID: %d",
-				topic, partition, nodeID)
+			b.conf.Logger.Warn("unknown leader broker ID",
+				"topic", topic, "partition", partition, "node", nodeID)
 			b.cluster.ForgetEndpoint(topic, partition)
 		} else {
 			if conn, err := b.conns.GetConnectionByAddr(addr); err != nil {
 				resErr = err
-				log.Warningf("[leaderConnection %s:%d] failed to connect to %s: %s",
-					topic, partition, addr, err)
+				b.conf.Logger.Warn("failed to connect to leader",
+					"topic", topic, "partition", partition, "broker", addr, "err", err)
 				if _, ok := err.(*NoConnectionsAvailable); !ok {
 					// Forget the endpoint. It's possible this broker has failed and we want to wait
 					// for Kafka to elect a new leader. To trick our algorithm into working we have to
@@ -296,16 +378,18 @@ func (b *Broker) coordinatorConnection(consumerGroup string) (*connection, error
 	// Get group coordinator
 	resp, err := b.getGroupCoordinator(consumerGroup)
 	if err != nil {
-		log.Warningf("coordinatorConnection: failed to discover coordinator: %s", err)
+		b.conf.Logger.Warn("failed to discover coordinator",
+			"group", consumerGroup, "err", err)
 		return nil, proto.ErrNoCoordinator
 	}
 
 	// Now get connection to actual coordinator
-	addr := fmt.Sprintf("%s:%d", resp.CoordinatorHost, resp.CoordinatorPort)
+	addr := b.conf.ClusterConnectionConf.brokerAddress(
+		resp.CoordinatorID, resp.CoordinatorHost, resp.CoordinatorPort)
 	conn, err := b.conns.GetConnectionByAddr(addr)
 	if err != nil {
-		log.Errorf("coordinatorConnection: failed to reach node %d at %s: %s",
-			resp.CoordinatorID, addr, err)
+		b.conf.Logger.Error("failed to reach coordinator",
+			"group", consumerGroup, "node", resp.CoordinatorID, "broker", addr, "err", err)
 		return nil, proto.ErrNoCoordinator
 	}
 
@@ -330,7 +414,7 @@ func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordina
 		}
 	}
 	if conn == nil {
-		log.Warningf("coordinatorConnection: failed to connect to any broker")
+		b.conf.Logger.Warn("failed to connect to any broker", "group", consumerGroup)
 		return nil, errors.New("failed to connect to any broker")
 	}
 
@@ -343,13 +427,13 @@ func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordina
 		ConsumerGroup: consumerGroup,
 	})
 	if err != nil {
-		log.Errorf("coordinatorConnection: metadata error for %s: %s",
-			consumerGroup, err)
+		b.conf.Logger.Error("cannot get group coordinator",
+			"group", consumerGroup, "broker", conn.addr, "err", err)
 		return nil, err
 	}
 	if resp.Err != nil {
-		log.Errorf("coordinatorConnection: metadata response error for %s: %s",
-			consumerGroup, resp.Err)
+		b.conf.Logger.Error("group coordinator response error",
+			"group", consumerGroup, "broker", conn.addr, "err", resp.Err)
 		return nil, resp.Err
 	}
 	return resp, nil
@@ -357,7 +441,7 @@ func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordina
 
 // offset will return offset value for given partition. Use timems to specify
 // which offset value should be returned.
-func (b *Broker) offset(topic string, partition int32, timems int64) (int64, error) {
+func (b *Broker) offset(topic string, partition int32, timems int64) (_ int64, err error) {
 	req := &proto.OffsetReq{
 		ClientID:  b.conf.ClientID,
 		ReplicaID: -1, // any client
@@ -376,24 +460,30 @@ func (b *Broker) offset(topic string, partition int32, timems int64) (int64, err
 	}
 
 	var resErr error
+	var broker string
+	var attempt int
+	defer func() { err = wrapError("offset", topic, partition, broker, attempt, err) }()
+
 	retry := &backoff.Backoff{Min: b.conf.LeaderRetryWait, Jitter: true}
 offsetRetryLoop:
 	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
 		if try != 0 {
 			time.Sleep(retry.Duration())
 		}
+		attempt = try + 1
 
 		conn, err := b.leaderConnection(topic, partition)
 		if err != nil {
 			return 0, err
 		}
 		defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
+		broker = conn.addr
 
 		resp, err := conn.Offset(req)
 		if err != nil {
-			if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
-				log.Debugf("connection died while sending message to %s:%d: %s",
-					topic, partition, err)
+			if isConnectionError(err) {
+				b.conf.Logger.Debug("connection died while fetching offset",
+					"topic", topic, "partition", partition, "broker", conn.addr, "err", err)
 				_ = conn.Close()
 				resErr = err
 				continue
@@ -404,20 +494,20 @@ offsetRetryLoop:
 		for _, t := range resp.Topics {
 			for _, p := range t.Partitions {
 				if t.Name != topic || p.ID != partition {
-					log.Warningf("offset response with unexpected data for %s:%d",
-						t.Name, p.ID)
+					b.conf.Logger.Warn("offset response with unexpected data",
+						"topic", t.Name, "partition", p.ID, "broker", conn.addr)
 					continue
 				}
 				resErr = p.Err
 
-				switch p.Err {
-				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
-					proto.ErrBrokerNotAvailable, proto.ErrUnknownTopicOrPartition:
+				if RequiresMetadataRefresh(p.Err) {
 					// Failover happened, so we probably need to talk to a different broker. Let's
 					// kick off a metadata refresh.
-					log.Warningf("cannot fetch offset: %s", p.Err)
-					if err := b.cluster.RefreshMetadata(); err != nil {
-						log.Warningf("cannot refresh metadata: %s", err)
+					b.conf.Logger.Warn("cannot fetch offset",
+						"topic", topic, "partition", partition, "broker", conn.addr,
+						"try", try, "err", p.Err)
+					if err := b.cluster.refreshTopicAfterError(topic); err != nil {
+						b.conf.Logger.Warn("cannot refresh metadata", "err", err)
 					}
 					continue offsetRetryLoop
 				}
@@ -472,6 +562,10 @@ type ProducerConf struct {
 	//
 	// Defaults to 200ms.
 	RetryWait time.Duration
+
+	// Interceptor, if set, is called around every Produce call. See
+	// TracingInterceptor.
+	Interceptor ProduceInterceptor
 }
 
 // NewProducerConf returns a default producer configuration.
@@ -509,22 +603,33 @@ func (b *Broker) Producer(conf ProducerConf) Producer {
 func (p *producer) Produce(
 	topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
 
-	offset, err = p.produce(topic, partition, messages...)
-	switch err {
-	case nil:
+	sent := messages
+	if p.conf.Interceptor != nil {
+		// The interceptor may replace the messages it is given, without
+		// changing the caller's slice.
+		sent = append([]*proto.Message(nil), messages...)
+		if after := p.conf.Interceptor.BeforeProduce(topic, partition, sent); after != nil {
+			defer func() { after(offset, err) }()
+		}
+	}
+
+	offset, err = p.produce(topic, partition, sent...)
+	var noConns *NoConnectionsAvailable
+	switch {
+	case err == nil:
 		// offset is the offset value of first published messages
 		for i, msg := range messages {
 			msg.Offset = int64(i) + offset
 		}
-	case io.EOF, syscall.EPIPE:
+	case isConnectionError(err):
 		// Connection dying / network issues won't be fixed by a metadata refresh.
 	default:
 		// NoConnectionsAvailable also indicates the issue won't be fixed by metadata refresh.
-		if _, ok := err.(*NoConnectionsAvailable); !ok {
+		if !errors.As(err, &noConns) {
 			// Try to refresh metadata in the background, in case the produce failed due to stale
 			// leadership information.
 			go func() {
-				_ = p.broker.cluster.RefreshMetadata()
+				_ = p.broker.cluster.refreshTopicAfterError(topic)
 			}()
 		}
 	}
@@ -535,11 +640,15 @@ func (p *producer) Produce(
 func (p *producer) produce(
 	topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
 
+	var broker string
+	defer func() { err = wrapError("produce", topic, partition, broker, 1, err) }()
+
 	conn, err := p.broker.leaderConnection(topic, partition)
 	if err != nil {
 		return 0, err
 	}
 	defer func(lconn *connection) { go p.broker.conns.Idle(lconn) }(conn)
+	broker = conn.addr
 
 	req := proto.ProduceReq{
 		ClientID:     p.broker.conf.ClientID,
@@ -561,12 +670,12 @@ func (p *producer) produce(
 
 	resp, err := conn.Produce(&req)
 	if err != nil {
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		if isConnectionError(err) {
 			// Connection is broken, so should be closed, but the error is
 			// still valid and should be returned so that retry mechanism have
 			// chance to react.
-			log.Debugf("connection died while sending message to %s:%d: %s",
-				topic, partition, err)
+			p.broker.conf.Logger.Debug("connection died while sending message",
+				"topic", topic, "partition", partition, "broker", conn.addr, "err", err)
 			_ = conn.Close()
 		}
 		return 0, err
@@ -579,11 +688,12 @@ func (p *producer) produce(
 
 	// Presently we only handle producing to a single topic/partition so return it as
 	// soon as we've found it
+	logger := p.broker.conf.Logger
 	for _, t := range resp.Topics {
 		for _, p := range t.Partitions {
 			if t.Name != topic || p.ID != partition {
-				log.Warningf("produce response with unexpected data for %s:%d",
-					t.Name, p.ID)
+				logger.Warn("produce response with unexpected data",
+					"topic", t.Name, "partition", p.ID, "broker", conn.addr)
 				continue
 			}
 
@@ -653,6 +763,10 @@ type ConsumerConf struct {
 	//
 	// Default is StartOffsetOldest.
 	StartOffset int64
+
+	// Interceptor, if set, is called around the fetching of every batch of
+	// messages. See TracingInterceptor.
+	Interceptor ConsumeInterceptor
 }
 
 // NewConsumerConf returns the default consumer configuration.
@@ -681,6 +795,10 @@ type consumer struct {
 	mu     *sync.Mutex
 	offset int64 // offset of next NOT consumed message
 	msgbuf []*proto.Message
+
+	// replica is the node ID of the replica the leader told us to fetch
+	// from, or -1 to fetch from the leader.
+	replica int32
 }
 
 // Consumer creates a new consumer instance, bound to the broker.
@@ -714,11 +832,12 @@ func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
 		}
 	}
 	c := &consumer{
-		broker: b,
-		mu:     &sync.Mutex{},
-		conf:   conf,
-		msgbuf: make([]*proto.Message, 0),
-		offset: offset,
+		broker:  b,
+		mu:      &sync.Mutex{},
+		conf:    conf,
+		msgbuf:  make([]*proto.Message, 0),
+		offset:  offset,
+		replica: -1,
 	}
 	return c, nil
 }
@@ -731,11 +850,15 @@ func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
 // consume can retry sending request on common errors. This behaviour can
 // be configured with RetryErrLimit and RetryErrWait consumer configuration
 // attributes.
-func (c *consumer) consume() ([]*proto.Message, error) {
-	var msgbuf []*proto.Message
+func (c *consumer) consume() (msgbuf []*proto.Message, err error) {
+	if c.conf.Interceptor != nil {
+		if after := c.conf.Interceptor.BeforeConsume(c.conf.Topic, c.conf.Partition); after != nil {
+			defer func() { after(msgbuf, err) }()
+		}
+	}
+
 	var retry int
 	for len(msgbuf) == 0 {
-		var err error
 		msgbuf, err = c.fetch()
 		if err != nil {
 			return nil, err
@@ -797,15 +920,18 @@ func (c *consumer) SeekToLatest() error {
 	oldOffset := c.offset
 	c.offset = off
 	c.msgbuf = make([]*proto.Message, 0)
-	log.Infof("SeekToLatest moving [%s:%d] offset %d -> %d.",
-		c.conf.Topic, c.conf.Partition, oldOffset, c.offset)
+	c.broker.conf.Logger.Info("SeekToLatest moving offset",
+		"topic", c.conf.Topic, "partition", c.conf.Partition, "from", oldOffset, "to", c.offset)
 	return nil
 }
 
 // fetch and return next batch of messages. In case of certain set of errors,
 // retry sending fetch request. Retry behaviour can be configured with
 // RetryErrLimit and RetryErrWait consumer configuration attributes.
-func (c *consumer) fetch() ([]*proto.Message, error) {
+//
+// When the broker configuration has a ClientRack, messages are fetched from
+// the replica preferred by the leader, falling back to the leader on errors.
+func (c *consumer) fetch() (_ []*proto.Message, err error) {
 	req := proto.FetchReq{
 		ClientID:    c.broker.conf.ClientID,
 		MaxWaitTime: c.conf.RequestTimeout,
@@ -823,34 +949,57 @@ func (c *consumer) fetch() ([]*proto.Message, error) {
 			},
 		},
 	}
+	if c.broker.conf.ClientRack != "" {
+		req.Version = 11
+		req.RackID = c.broker.conf.ClientRack
+	}
 
 	var resErr error
+	var broker string
+	var attempt int
+	defer func() {
+		err = wrapError("fetch", c.conf.Topic, c.conf.Partition, broker, attempt, err)
+	}()
+
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+	redirected := false
 consumeRetryLoop:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
+			c.broker.conf.Metrics.Counter("kafka_retries_total", 1, "op", "fetch")
 			time.Sleep(retry.Duration())
 		}
+		attempt = try + 1
 
-		conn, err := c.broker.leaderConnection(c.conf.Topic, c.conf.Partition)
+		conn, err := c.replicaConnection()
 		if err != nil {
 			resErr = err
 			continue
 		}
 		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
+		broker = conn.addr
+		fromReplica := c.replica >= 0
 
 		resp, err := conn.Fetch(&req)
+		if err == nil && resp.Err != nil {
+			err = resp.Err
+		}
 		resErr = err
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
-			log.Debugf("connection died while fetching messages from %s:%d: %s",
-				c.conf.Topic, c.conf.Partition, err)
+		if isConnectionError(err) {
+			c.broker.conf.Logger.Debug("connection died while fetching messages",
+				"topic", c.conf.Topic, "partition", c.conf.Partition, "broker", conn.addr,
+				"try", try, "err", err)
 			_ = conn.Close()
+			c.fallBackToLeader(conn.addr, err)
 			continue
 		}
 
 		if err != nil {
-			log.Debugf("cannot fetch messages (try %d): %s", retry, err)
+			c.broker.conf.Logger.Debug("cannot fetch messages",
+				"topic", c.conf.Topic, "partition", c.conf.Partition, "broker", conn.addr,
+				"try", try, "err", err)
 			_ = conn.Close()
+			c.fallBackToLeader(conn.addr, err)
 			continue
 		}
 
@@ -858,22 +1007,41 @@ consumeRetryLoop:
 		for _, t := range resp.Topics {
 			for _, p := range t.Partitions {
 				if t.Name != c.conf.Topic || p.ID != c.conf.Partition {
-					log.Warningf("fetch response with unexpected data for %s:%d",
-						t.Name, p.ID)
+					c.broker.conf.Logger.Warn("fetch response with unexpected data",
+						"topic", t.Name, "partition", p.ID, "broker", conn.addr)
 					continue
 				}
 
-				switch p.Err {
-				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
-					proto.ErrBrokerNotAvailable, proto.ErrUnknownTopicOrPartition:
+				if p.Err != nil && fromReplica {
+					// The replica may be lagging behind or no longer be a
+					// replica. The leader knows better, so ask it again.
+					resErr = p.Err
+					c.fallBackToLeader(conn.addr, p.Err)
+					continue consumeRetryLoop
+				}
+
+				if RequiresMetadataRefresh(p.Err) {
 					// Failover happened, so we probably need to talk to a different broker. Let's
 					// kick off a metadata refresh.
-					log.Warningf("cannot fetch messages (try %d): %s", retry, p.Err)
-					if err := c.broker.cluster.RefreshMetadata(); err != nil {
-						log.Warningf("cannot refresh metadata: %s", err)
+					c.broker.conf.Logger.Warn("cannot fetch messages",
+						"topic", c.conf.Topic, "partition", c.conf.Partition, "broker", conn.addr,
+						"try", try, "err", p.Err)
+					if err := c.broker.cluster.refreshTopicAfterError(c.conf.Topic); err != nil {
+						c.broker.conf.Logger.Warn("cannot refresh metadata", "err", err)
 					}
 					continue consumeRetryLoop
 				}
+
+				if p.Err == nil && req.Version >= 11 && !redirected &&
+					c.followPreferredReplica(p.PreferredReadReplica) {
+					// The leader doesn't return messages along with a
+					// preferred replica: fetch again right away, without
+					// using up a try.
+					redirected = true
+					try--
+					retry.Reset()
+					continue consumeRetryLoop
+				}
 				return p.Messages, p.Err
 			}
 		}
@@ -883,6 +1051,75 @@ consumeRetryLoop:
 	return nil, resErr
 }
 
+// replicaConnection returns a connection to the preferred read replica if
+// there is one, or else to the leader of the consumed partition.
+func (c *consumer) replicaConnection() (*connection, error) {
+	if c.replica >= 0 {
+		addr := c.broker.cluster.GetNodeAddress(c.replica)
+		if addr == "" {
+			c.fallBackToLeader("", errors.New("unknown broker id"))
+		} else if conn, err := c.broker.conns.GetConnectionByAddr(addr); err != nil {
+			c.fallBackToLeader(addr, err)
+		} else {
+			return conn, nil
+		}
+	}
+	return c.broker.leaderConnection(c.conf.Topic, c.conf.Partition)
+}
+
+// followPreferredReplica starts fetching from the given replica, returning
+// whether it changed. Replicas that aren't in the cached metadata of the
+// partition are ignored, as there would be no address to connect to.
+func (c *consumer) followPreferredReplica(nodeID int32) bool {
+	if nodeID < 0 || nodeID == c.replica {
+		return false
+	}
+	parts, err := c.broker.cluster.TopicMetadata(c.conf.Topic)
+	if err != nil {
+		return false
+	}
+	for _, part := range parts {
+		if part.ID != c.conf.Partition {
+			continue
+		}
+		if !containsNode(part.Replicas, nodeID) || containsNode(part.OfflineReplicas, nodeID) ||
+			c.broker.cluster.GetNodeAddress(nodeID) == "" {
+			c.broker.conf.Logger.Warn("ignoring unknown preferred read replica",
+				"topic", c.conf.Topic, "partition", c.conf.Partition, "node", nodeID)
+			return false
+		}
+		c.broker.conf.Logger.Debug("fetching from preferred read replica",
+			"topic", c.conf.Topic, "partition", c.conf.Partition, "node", nodeID,
+			"rack", c.broker.cluster.GetNodeRack(nodeID))
+		c.replica = nodeID
+		return true
+	}
+	return false
+}
+
+// fallBackToLeader stops fetching from the preferred read replica, if any, so
+// that the next fetch goes to the leader.
+func (c *consumer) fallBackToLeader(addr string, err error) {
+	if c.replica < 0 {
+		return
+	}
+	c.broker.conf.Logger.Info("cannot fetch from preferred read replica, falling back to leader",
+		"topic", c.conf.Topic, "partition", c.conf.Partition, "node", c.replica,
+		"broker", addr, "err", err)
+	c.broker.conf.Metrics.Counter("kafka_replica_fetch_fallbacks_total", 1, "topic", c.conf.Topic)
+	c.replica = -1
+}
+
+// containsNode returns whether nodeID is in nodes.
+func containsNode(nodes []int32, nodeID int32) bool {
+	for _, id := range nodes {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
 // OffsetCoordinatorConf is configuration for the offset coordinatior.
 type OffsetCoordinatorConf struct {
 	ConsumerGroup string
@@ -893,6 +1130,10 @@ type OffsetCoordinatorConf struct {
 	// RetryErrWait controls wait duration between retries after failed fetch
 	// request. By default 500ms.
 	RetryErrWait time.Duration
+
+	// Interceptor, if set, is called around every Commit and CommitFull call.
+	// See TracingInterceptor.
+	Interceptor CommitInterceptor
 }
 
 // NewOffsetCoordinatorConf returns default OffsetCoordinator configuration.
@@ -954,11 +1195,26 @@ func (c *offsetCoordinator) commit(
 			offset, topic, partition)
 	}
 
+	if c.conf.Interceptor != nil {
+		after := c.conf.Interceptor.BeforeCommit(c.conf.ConsumerGroup, topic, partition, offset)
+		if after != nil {
+			defer func() { after(resErr) }()
+		}
+	}
+
+	var broker string
+	var attempt int
+	defer func() {
+		resErr = wrapError("commit", topic, partition, broker, attempt, resErr)
+	}()
+
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
+			c.broker.conf.Metrics.Counter("kafka_retries_total", 1, "op", "commit")
 			time.Sleep(retry.Duration())
 		}
+		attempt = try + 1
 
 		// get a copy of our connection with the lock, this might establish a new
 		// connection so can take a bit
@@ -968,6 +1224,7 @@ func (c *offsetCoordinator) commit(
 			continue
 		}
 		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
+		broker = conn.addr
 
 		resp, err := conn.OffsetCommit(&proto.OffsetCommitReq{
 			ClientID:      c.broker.conf.ClientID,
@@ -983,9 +1240,10 @@ func (c *offsetCoordinator) commit(
 		})
 		resErr = err
 
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
-			log.Debugf("connection died while committing on %s:%d for %s: %s",
-				topic, partition, c.conf.ConsumerGroup, err)
+		if isConnectionError(err) {
+			c.broker.conf.Logger.Debug("connection died while committing",
+				"topic", topic, "partition", partition, "group", c.conf.ConsumerGroup,
+				"broker", conn.addr, "err", err)
 			_ = conn.Close()
 
 		} else if err == nil {
@@ -993,8 +1251,8 @@ func (c *offsetCoordinator) commit(
 			for _, t := range resp.Topics {
 				for _, p := range t.Partitions {
 					if t.Name != topic || p.ID != partition {
-						log.Warningf("commit response with unexpected data for %s:%d",
-							t.Name, p.ID)
+						c.broker.conf.Logger.Warn("commit response with unexpected data",
+							"topic", t.Name, "partition", p.ID, "broker", conn.addr)
 						continue
 					}
 					return p.Err
@@ -1016,11 +1274,18 @@ func (c *offsetCoordinator) Offset(
 	topic string, partition int32) (
 	offset int64, metadata string, resErr error) {
 
+	var broker string
+	var attempt int
+	defer func() {
+		resErr = wrapError("offset_fetch", topic, partition, broker, attempt, resErr)
+	}()
+
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
 			time.Sleep(retry.Duration())
 		}
+		attempt = try + 1
 
 		// get a copy of our connection with the lock, this might establish a new
 		// connection so can take a bit
@@ -1030,6 +1295,7 @@ func (c *offsetCoordinator) Offset(
 			continue
 		}
 		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
+		broker = conn.addr
 
 		resp, err := conn.OffsetFetch(&proto.OffsetFetchReq{
 			ConsumerGroup: c.conf.ConsumerGroup,
@@ -1042,18 +1308,19 @@ func (c *offsetCoordinator) Offset(
 		})
 		resErr = err
 
-		switch err {
-		case io.EOF, syscall.EPIPE:
-			log.Debugf("connection died while fetching offsets on %s:%d for %s: %s",
-				topic, partition, c.conf.ConsumerGroup, err)
+		switch {
+		case isConnectionError(err):
+			c.broker.conf.Logger.Debug("connection died while fetching committed offset",
+				"topic", topic, "partition", partition, "group", c.conf.ConsumerGroup,
+				"broker", conn.addr, "err", err)
 			_ = conn.Close()
 
-		case nil:
+		case err == nil:
 			for _, t := range resp.Topics {
 				for _, p := range t.Partitions {
 					if t.Name != topic || p.ID != partition {
-						log.Warningf("offset response with unexpected data for %s:%d",
-							t.Name, p.ID)
+						c.broker.conf.Logger.Warn("offset fetch response with unexpected data",
+							"topic", t.Name, "partition", p.ID, "broker", conn.addr)
 						continue
 					}
 
@@ -1065,8 +1332,8 @@ func (c *offsetCoordinator) Offset(
 					// where Kafka returns -1 erroneously. Not sure how to handle this yet,
 					// but adding debugging in the meantime.
 					if p.Offset < 0 {
-						log.Errorf("negative offset response %d for %s:%d",
-							p.Offset, t.Name, p.ID)
+						c.broker.conf.Logger.Error("negative offset in offset fetch response",
+							"topic", t.Name, "partition", p.ID, "offset", p.Offset)
 					}
 					return p.Offset, p.Metadata, nil
 				}
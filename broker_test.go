@@ -1,7 +1,9 @@
 package kafka
 
 import (
+	"context"
 	"fmt"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -128,7 +130,7 @@ func waitForMetadataEpoch(c *C, Prod Producer, epoch int) {
 		e := atomic.LoadInt64(prod.broker.cluster.epoch)
 		switch {
 		case e == int64(epoch):
-			log.Debugf("Metadata epoch reached %d", e)
+			log.Debug("metadata epoch reached", "epoch", e)
 			return
 		case e > int64(epoch):
 			// This is a programmer error / mistake in the test logic.
@@ -212,6 +214,63 @@ func (s *BrokerSuite) TestDialConnectionPoolCached(c *C) {
 	c.Assert(brokerDifferent1, Not(Equals), brokerDifferent2)
 }
 
+// numReapers returns the number of goroutines reaping idle connections.
+func numReapers() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return strings.Count(string(buf), "(*backend).reap(")
+}
+
+// waitForReapers waits until n goroutines are reaping idle connections.
+func waitForReapers(c *C, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for numReapers() != n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(numReapers(), Equals, n)
+}
+
+func (s *BrokerSuite) TestCloseReleasesConnectionPool(c *C) {
+	InitializeMetadataCache()
+	defer uninitializeMetadataCache()
+
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	reapers := numReapers()
+
+	conf := s.newTestBrokerConf("tester")
+	conf.ClusterConnectionConf.MaxIdleTime = time.Minute
+	broker1, err := NewBroker("test-cluster-close", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	broker2, err := NewBroker("test-cluster-close", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	c.Assert(broker1.conns, Equals, broker2.conns)
+	be := broker1.conns.getBackend(srv.Address())
+	c.Assert(be, NotNil)
+	// One reaper for the metadata pool of the cluster, one for the brokers.
+	waitForReapers(c, reapers+2)
+
+	// The pool is shared, so it stays open until the last broker is closed.
+	broker1.Close()
+	broker1.Close()
+	c.Assert(broker2.conns.getBackend(srv.Address()), Equals, be)
+	conn, err := broker2.conns.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	broker2.conns.Idle(conn)
+
+	broker2.Close()
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(broker2.conns.GetAllAddrs(), HasLen, 0)
+	waitForReapers(c, reapers+1)
+
+	// A new broker gets a new pool.
+	broker3, err := NewBroker("test-cluster-close", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	defer broker3.Close()
+	c.Assert(broker3.conns, Not(Equals), broker2.conns)
+}
+
 // Tests to ensure that our dial function is randomly selecting brokers from the
 // list of available brokers
 func (s *BrokerSuite) TestDialRandomized(c *C) {
@@ -263,7 +322,7 @@ func (s *BrokerSuite) TestProducer(c *C) {
 		{Value: []byte("second")},
 	}
 	_, err = producer.Produce("does-not-exist", 42142, messages...)
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	var handleErr error
 	var createdMsgs int
@@ -332,7 +391,7 @@ func (s *BrokerSuite) TestProducerWithNoAck(c *C) {
 		{Value: []byte("second")},
 	}
 	_, err = producer.Produce("does-not-exist", 42142, messages...)
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	errc := make(chan error)
 	var createdMsgs int
@@ -406,6 +465,340 @@ func (s *BrokerSuite) TestMetadataRefreshSerialization(c *C) {
 	c.Assert(broker.cluster.RefreshMetadata(), NotNil)
 }
 
+func (s *BrokerSuite) TestTopicMetadataRefresh(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	mdh := NewMetadataHandler(srv, false)
+	mdh.topics["other"] = true
+	srv.Handle(MetadataRequest, mdh.Handler())
+
+	broker, err := NewBroker(
+		"test-cluster-topic-metadata-refresh",
+		[]string{srv.Address()},
+		s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	c.Assert(mdh.NumGeneralFetches(), Equals, 1)
+
+	c.Assert(broker.cluster.RefreshTopicMetadata("test"), IsNil)
+	c.Assert(mdh.NumGeneralFetches(), Equals, 1)
+	c.Assert(mdh.NumSpecificFetches(), Equals, 1)
+	c.Assert(atomic.LoadInt64(broker.cluster.epoch), Equals, int64(1))
+	count, err := broker.cluster.PartitionCount("other")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int32(2))
+
+	// Concurrent refreshes are coalesced: the first one goes through, all the
+	// others wait for it and are then done in a single request.
+	mdh.SetRequestDelay(100 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		topic := []string{"test", "other"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(broker.cluster.RefreshTopicMetadata(topic), IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(mdh.NumSpecificFetches() <= 3, Equals, true,
+		Commentf("%d specific fetches", mdh.NumSpecificFetches()))
+	mdh.SetRequestDelay(0)
+
+	// Unknown topics may be created by a topic request, so they cause a full refresh.
+	c.Assert(broker.cluster.RefreshTopicMetadata("unknown"), IsNil)
+	c.Assert(mdh.NumGeneralFetches(), Equals, 2)
+
+	// Topics the brokers don't know anymore are removed, others are kept.
+	events, stop := broker.Watch()
+	defer stop()
+	broker.cluster.cacheTopics(&proto.MetadataResp{
+		Topics: []proto.MetadataRespTopic{
+			{Name: "other", Err: proto.ErrUnknownTopicOrPartition},
+		},
+	})
+	_, err = broker.cluster.PartitionCount("other")
+	c.Assert(err, NotNil)
+	_, err = broker.cluster.GetEndpoint("other", 0)
+	c.Assert(err, NotNil)
+	nodeID, err := broker.cluster.GetEndpoint("test", 1)
+	c.Assert(err, IsNil)
+	c.Assert(nodeID, Equals, int32(1))
+	c.Assert(<-events, DeepEquals, ClusterEvent{
+		Type: EventTopicDeleted, Topic: "other", OldPartitionCount: 2})
+}
+
+func (s *BrokerSuite) TestBootstrapSeedFallback(c *C) {
+	seed := NewServer()
+	seed.Start()
+	defer seed.Close()
+	replaced := NewServer()
+	replaced.Start()
+
+	// The seed first advertises a broker that then goes away, as if the whole
+	// cluster was replaced.
+	var mu sync.Mutex
+	advertised := replaced
+	handler := func(request Serializable) Serializable {
+		mu.Lock()
+		defer mu.Unlock()
+
+		host, port := advertised.HostPort()
+		return &proto.MetadataResp{
+			CorrelationID: request.(*proto.MetadataReq).CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+		}
+	}
+	seed.Handle(MetadataRequest, handler)
+	replaced.Handle(MetadataRequest, handler)
+
+	_, port := seed.HostPort()
+	broker, err := NewBroker("test-cluster-seed-fallback",
+		[]string{fmt.Sprintf("localhost:%d", port)}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	c.Assert(broker.cluster.GetNodes(), DeepEquals, NodeMap{1: replaced.Address()})
+
+	var lookups []string
+	broker.cluster.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups = append(lookups, host)
+		return []string{"127.0.0.1"}, nil
+	}
+	replaced.Close()
+	mu.Lock()
+	advertised = seed
+	mu.Unlock()
+
+	c.Assert(broker.cluster.RefreshMetadata(), IsNil)
+	c.Assert(lookups, DeepEquals, []string{"localhost"})
+	c.Assert(broker.cluster.GetNodes(), DeepEquals, NodeMap{1: seed.Address()})
+}
+
+func (s *BrokerSuite) TestMetadataVersion(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	host, port := srv.HostPort()
+	var versions []int16
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		versions = append(versions, req.Version)
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port), Rack: "rack-1"},
+			},
+			ClusterID:    "cluster-1",
+			ControllerID: 1,
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1, 2}, Isrs: []int32{1},
+							OfflineReplicas: []int32{2}},
+					},
+				},
+				{Name: "__consumer_offsets", IsInternal: true},
+			},
+		}
+	})
+
+	conf := s.newTestBrokerConf("tester")
+	conf.ClusterConnectionConf.MetadataVersion = 5
+	broker, err := NewBroker("test-cluster-metadata-version", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, []int16{5})
+
+	controller, err := broker.ControllerID()
+	c.Assert(err, IsNil)
+	c.Assert(controller, Equals, int32(1))
+	c.Assert(broker.cluster.ClusterID(), Equals, "cluster-1")
+	c.Assert(broker.cluster.GetNodeRack(1), Equals, "rack-1")
+	c.Assert(broker.cluster.GetNodeRack(2), Equals, "")
+	c.Assert(broker.cluster.IsInternalTopic("__consumer_offsets"), Equals, true)
+	c.Assert(broker.cluster.IsInternalTopic("test"), Equals, false)
+	parts, err := broker.TopicMetadata("test")
+	c.Assert(err, IsNil)
+	c.Assert(parts[0].OfflineReplicas, DeepEquals, []int32{2})
+
+	// The controller isn't known with version 0.
+	conf.ClusterConnectionConf.MetadataVersion = 0
+	broker, err = NewBroker("test-cluster-metadata-version-0", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	_, err = broker.ControllerID()
+	c.Assert(err, NotNil)
+	c.Assert(broker.cluster.GetNodeRack(1), Equals, "")
+}
+
+func (s *BrokerSuite) TestFollowerFetching(c *C) {
+	leader := NewServer()
+	leader.Start()
+	defer leader.Close()
+
+	follower := NewServer()
+	follower.Start()
+	defer follower.Close()
+
+	host1, port1 := leader.HostPort()
+	host2, port2 := follower.HostPort()
+	metadataHandler := func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host1, Port: int32(port1), Rack: "rack-1"},
+				{NodeID: 2, Host: host2, Port: int32(port2), Rack: "rack-2"},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1, 2}, Isrs: []int32{1, 2}},
+					},
+				},
+			},
+		}
+	}
+	leader.Handle(MetadataRequest, metadataHandler)
+	follower.Handle(MetadataRequest, metadataHandler)
+
+	fetchResp := func(req *proto.FetchReq, part proto.FetchRespPartition) *proto.FetchResp {
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.FetchRespTopic{
+				{Name: "test", Partitions: []proto.FetchRespPartition{part}},
+			},
+		}
+	}
+
+	var leaderFetches, followerFetches int
+	var racks []string
+	leader.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		leaderFetches++
+		racks = append(racks, req.RackID)
+		c.Check(req.Version, Equals, int16(11))
+		if req.Topics[0].Partitions[0].FetchOffset == 0 {
+			return fetchResp(req, proto.FetchRespPartition{
+				ID: 0, TipOffset: 3, PreferredReadReplica: 2})
+		}
+		return fetchResp(req, proto.FetchRespPartition{
+			ID: 0, TipOffset: 3, PreferredReadReplica: -1,
+			Messages: []*proto.Message{{Offset: 2, Value: []byte("from leader")}}})
+	})
+	follower.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		followerFetches++
+		if req.Topics[0].Partitions[0].FetchOffset > 0 {
+			// The follower is lagging behind.
+			return fetchResp(req, proto.FetchRespPartition{
+				ID: 0, Err: proto.ErrOffsetOutOfRange, TipOffset: 2, PreferredReadReplica: -1})
+		}
+		return fetchResp(req, proto.FetchRespPartition{
+			ID: 0, TipOffset: 2, PreferredReadReplica: -1,
+			Messages: []*proto.Message{
+				{Offset: 0, Value: []byte("from follower")},
+				{Offset: 1, Value: []byte("from follower")},
+			}})
+	})
+
+	metrics := newRecordingMetrics()
+	conf := s.newTestBrokerConf("tester")
+	conf.ClientRack = "rack-2"
+	conf.Metrics = metrics
+	broker, err := NewBroker("test-cluster-follower-fetching", []string{leader.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = 0
+	consConf.RetryErrWait = time.Millisecond
+	consumer, err := broker.BatchConsumer(consConf)
+	c.Assert(err, IsNil)
+
+	// The leader sends us to the follower, without using up a try.
+	batch, err := consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch, HasLen, 2)
+	c.Assert(string(batch[0].Value), Equals, "from follower")
+	c.Assert(leaderFetches, Equals, 1)
+	c.Assert(followerFetches, Equals, 1)
+	c.Assert(metrics.Reports("kafka_retries_total"), Equals, 0)
+
+	// An error from the follower sends us back to the leader.
+	batch, err = consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch, HasLen, 1)
+	c.Assert(string(batch[0].Value), Equals, "from leader")
+	c.Assert(leaderFetches, Equals, 2)
+	c.Assert(followerFetches, Equals, 2)
+	c.Assert(metrics.Reports("kafka_replica_fetch_fallbacks_total"), Equals, 1)
+	c.Assert(racks, DeepEquals, []string{"rack-2", "rack-2"})
+}
+
+func (s *BrokerSuite) TestFollowerFetchingUnknownReplica(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	host, port := srv.HostPort()
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{
+							ID: 0, TipOffset: 1, PreferredReadReplica: 7,
+							Messages: []*proto.Message{{Offset: 0, Value: []byte("from leader")}},
+						},
+					},
+				},
+			},
+		}
+	})
+
+	conf := s.newTestBrokerConf("tester")
+	conf.ClientRack = "rack-7"
+	broker, err := NewBroker("test-cluster-follower-unknown", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = 0
+	consumer, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+
+	// Node 7 isn't a replica of the partition, so it is ignored.
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "from leader")
+}
+
 func (s *BrokerSuite) TestProduceWhileLeaderChange(c *C) {
 	srv1 := NewServer()
 	srv1.Start()
@@ -608,10 +1001,10 @@ func (s *BrokerSuite) TestConsumer(c *C) {
 	c.Assert(err, IsNil)
 
 	_, err = broker.Consumer(NewConsumerConf("does-not-exists", 413))
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	_, err = broker.Consumer(NewConsumerConf("test", 1))
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	consConf := NewConsumerConf("test", 413)
 	consConf.RetryWait = time.Millisecond
@@ -713,10 +1106,10 @@ func (s *BrokerSuite) TestBatchConsumer(c *C) {
 	c.Assert(err, IsNil)
 
 	_, err = broker.BatchConsumer(NewConsumerConf("does-not-exists", 413))
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	_, err = broker.BatchConsumer(NewConsumerConf("test", 1))
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	consConf := NewConsumerConf("test", 413)
 	consConf.RetryWait = time.Millisecond
@@ -1562,7 +1955,7 @@ func (s *BrokerSuite) TestLeaderConnectionFailover(c *C) {
 	c.Assert(err, IsNil)
 
 	_, err = broker.leaderConnection("does-not-exist", 123456)
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	conn, err := broker.leaderConnection("test", 0)
 	c.Assert(conn, NotNil)
@@ -1640,7 +2033,7 @@ func (s *BrokerSuite) TestProducerFailoverRequestTimeout(c *C) {
 		"test", 0,
 		&proto.Message{Value: []byte("first")},
 		&proto.Message{Value: []byte("second")})
-	c.Assert(err, Equals, proto.ErrRequestTimeout)
+	c.Assert(err, ErrorIs, proto.ErrRequestTimeout)
 	c.Assert(requestsCount, Equals, 1)
 }
 
@@ -1770,7 +2163,7 @@ func (s *BrokerSuite) TestProducerNoCreateTopic(c *C) {
 		"test2", 0,
 		&proto.Message{Value: []byte("first")},
 		&proto.Message{Value: []byte("second")})
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 	c.Assert(md.NumSpecificFetches(), Equals, 0)
 	c.Assert(produces, Equals, 0)
 }
@@ -2071,9 +2464,9 @@ func (s *BrokerSuite) TestProducerBrokenPipe(c *C) {
 	srv2.Start()
 
 	host1, port1 := srv1.HostPort()
-	log.Infof("server1 %s:%d", host1, port1)
+	log.Info("server1", "host", host1, "port", port1)
 	host2, port2 := srv2.HostPort()
-	log.Infof("server2 %s:%d", host2, port2)
+	log.Info("server2", "host", host2, "port", port2)
 
 	srv1.Handle(MetadataRequest, func(request Serializable) Serializable {
 		req := request.(*proto.MetadataReq)
@@ -2457,7 +2850,7 @@ func (s *BrokerSuite) TestOffsetCoordinator(c *C) {
 		c.Fatalf("expected error, got %d, %q", off, meta)
 	}
 	_, _, err = coordinator.Offset("first-topic", 0)
-	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
 
 	err = coordinator.Commit("first-topic", 0, 421)
 	c.Assert(err, IsNil)
@@ -2495,7 +2888,7 @@ func (s *BrokerSuite) TestOffsetCoordinatorNoCoordinatorError(c *C) {
 	c.Assert(err, IsNil)
 
 	err = oc.Commit("foo", int32(0), 10)
-	c.Assert(err, Equals, proto.ErrNoCoordinator)
+	c.Assert(err, ErrorIs, proto.ErrNoCoordinator)
 }
 
 func (s *BrokerSuite) BenchmarkConsumer_10Msgs(c *C)    { s.benchmarkConsumer(c, 10) }
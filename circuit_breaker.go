@@ -0,0 +1,159 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker guarding a broker.
+type CircuitState int32
+
+const (
+	// CircuitClosed means the broker is healthy and requests go through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means the broker failed repeatedly and requests fail fast
+	// with a CircuitOpenError until the cooldown expires.
+	CircuitOpen
+	// CircuitHalfOpen means the cooldown expired and a single probe is let
+	// through to find out whether the broker recovered.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int32(s))
+	}
+}
+
+// CircuitOpenError is returned instead of dialing a broker whose circuit
+// breaker is open.
+type CircuitOpenError struct {
+	Broker string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for broker %s (did not attempt to connect)", e.Broker)
+}
+
+// circuitBreaker counts the consecutive failures of a broker. Once threshold
+// is reached it opens for cooldown, then lets a single probe through: the
+// circuit closes if the probe succeeds and opens again if it fails. A nil
+// circuitBreaker is always closed.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	onChange  func(CircuitState)
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probeAt  time.Time
+}
+
+// newCircuitBreaker returns a circuit breaker, or nil if threshold isn't
+// positive. onChange, if not nil, is called with every new state while the
+// breaker's lock is held.
+func newCircuitBreaker(threshold int, cooldown time.Duration,
+	onChange func(CircuitState)) *circuitBreaker {
+
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		onChange:  onChange,
+	}
+}
+
+// State returns the current state of the breaker.
+func (cb *circuitBreaker) State() CircuitState {
+	if cb == nil {
+		return CircuitClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+// Allow returns whether a new attempt may be made. When the cooldown of an
+// open breaker expires, the first caller is let through as the probe. A probe
+// that didn't report back within cooldown is considered lost and replaced.
+func (cb *circuitBreaker) Allow() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+	switch cb.state {
+	case CircuitOpen:
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.setState(CircuitHalfOpen)
+		cb.probeAt = now
+		return true
+	case CircuitHalfOpen:
+		if now.Sub(cb.probeAt) < cb.cooldown {
+			return false
+		}
+		cb.probeAt = now
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a successful dial or request and closes the breaker.
+func (cb *circuitBreaker) Success() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	if cb.state != CircuitClosed {
+		cb.setState(CircuitClosed)
+	}
+}
+
+// Failure records a failed dial or request, opening the breaker once
+// threshold consecutive failures happened or if the probe failed.
+func (cb *circuitBreaker) Failure() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = cb.now()
+		if cb.state != CircuitOpen {
+			cb.setState(CircuitOpen)
+		}
+	}
+}
+
+// setState changes the state. Must be called with the mutex held.
+func (cb *circuitBreaker) setState(state CircuitState) {
+	cb.state = state
+	if cb.onChange != nil {
+		cb.onChange(state)
+	}
+}
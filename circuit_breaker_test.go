@@ -0,0 +1,100 @@
+package kafka
+
+import (
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&CircuitBreakerSuite{})
+
+type CircuitBreakerSuite struct{}
+
+func (s *CircuitBreakerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *CircuitBreakerSuite) TestStateMachine(c *C) {
+	var states []CircuitState
+	now := time.Unix(1000, 0)
+	cb := newCircuitBreaker(2, time.Second, func(state CircuitState) {
+		states = append(states, state)
+	})
+	cb.now = func() time.Time { return now }
+
+	// Successes reset the count of consecutive failures.
+	cb.Failure()
+	cb.Success()
+	cb.Failure()
+	c.Assert(cb.State(), Equals, CircuitClosed)
+	c.Assert(cb.Allow(), Equals, true)
+
+	cb.Failure()
+	c.Assert(cb.State(), Equals, CircuitOpen)
+	c.Assert(cb.Allow(), Equals, false)
+
+	// Only one probe is let through after the cooldown, a failed probe
+	// opens the circuit again.
+	now = now.Add(time.Second)
+	c.Assert(cb.Allow(), Equals, true)
+	c.Assert(cb.State(), Equals, CircuitHalfOpen)
+	c.Assert(cb.Allow(), Equals, false)
+	cb.Failure()
+	c.Assert(cb.State(), Equals, CircuitOpen)
+	c.Assert(cb.Allow(), Equals, false)
+
+	// A probe that never reports back is replaced after the cooldown.
+	now = now.Add(time.Second)
+	c.Assert(cb.Allow(), Equals, true)
+	now = now.Add(time.Second)
+	c.Assert(cb.Allow(), Equals, true)
+	cb.Success()
+	c.Assert(cb.State(), Equals, CircuitClosed)
+	c.Assert(cb.Allow(), Equals, true)
+
+	c.Assert(states, DeepEquals, []CircuitState{
+		CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed})
+}
+
+func (s *CircuitBreakerSuite) TestDisabled(c *C) {
+	cb := newCircuitBreaker(0, time.Second, nil)
+	c.Assert(cb, IsNil)
+	for i := 0; i < 10; i++ {
+		cb.Failure()
+	}
+	c.Assert(cb.Allow(), Equals, true)
+	c.Assert(cb.State(), Equals, CircuitClosed)
+}
+
+func (s *CircuitBreakerSuite) TestConnectionPool(c *C) {
+	srv := NewServer()
+	srv.Start()
+	addr := srv.Address()
+	srv.Close()
+
+	metrics := newRecordingMetrics()
+	conf := NewBrokerConf("foo")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	conf.ClusterConnectionConf.CircuitBreakerThreshold = 2
+	conf.ClusterConnectionConf.CircuitBreakerCooldown = time.Hour
+	conf.ClusterConnectionConf.metrics = metrics
+	cp := newConnectionPool(conf.ClusterConnectionConf, []string{addr})
+	defer cp.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := cp.GetConnectionByAddr(addr)
+		c.Assert(err, NotNil)
+		var circuitOpen *CircuitOpenError
+		c.Assert(errors.As(err, &circuitOpen), Equals, false)
+	}
+	c.Assert(cp.CircuitStates(), DeepEquals, map[string]CircuitState{addr: CircuitOpen})
+	c.Assert(metrics.Reports("kafka_circuit_state"), Equals, 1)
+	c.Assert(metrics.Tags("kafka_circuit_state"), DeepEquals, []string{"broker", addr})
+
+	start := time.Now()
+	_, err := cp.GetConnectionByAddr(addr)
+	c.Assert(err, DeepEquals, &CircuitOpenError{Broker: addr})
+	c.Assert(IsRetriable(err), Equals, true)
+	c.Assert(time.Since(start) < 100*time.Millisecond, Equals, true)
+}
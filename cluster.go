@@ -1,8 +1,11 @@
 package kafka
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,9 +34,41 @@ type Cluster struct {
 	nodes      NodeMap                  // node ID to address
 	endpoints  map[topicPartition]int32 // partition to leader node ID
 	partitions map[string]int32         // topic to number of partitions
+
+	// leaders is the partition to leader node ID mapping of the last metadata
+	// response. Unlike endpoints it isn't changed by ForgetEndpoint, so that
+	// leader changes can be reported to watchers.
+	leaders  map[topicPartition]int32
+	watchers clusterWatchers
+
+	// topicMetadata is the full metadata of every partition, by topic.
+	topicMetadata map[string][]PartitionMetadata
+
+	// controllerID, clusterID, racks and internalTopics are only known with
+	// MetadataVersion 1 and above.
+	controllerID   int32
+	clusterID      string
+	racks          map[int32]string
+	internalTopics map[string]bool
+
+	// seeds are the bootstrap addresses given to NewCluster. They are used
+	// to find the cluster again when none of the known brokers answers, and
+	// resolved with lookupHost every time.
+	seeds      []string
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	// topicEpochs counts the topic refreshes of every topic, and pendingTopics
+	// holds the topics waiting to be refreshed, so that concurrent calls to
+	// RefreshTopicMetadata are coalesced like RefreshMetadata calls are with
+	// epoch. Both are protected by mu.
+	topicEpochs   map[string]int64
+	pendingTopics map[string]struct{}
 }
 
 func newCluster(conf ClusterConnectionConf, pool *connectionPool, connPoolCache *connectionPoolCache) *Cluster {
+	conf.metrics = metricsOrNop(conf.metrics)
+	conf.logger = loggerOrDefault(conf.logger)
+	conf.Dialer = dialerOrDefault(conf.Dialer)
 	result := &Cluster{
 		mu:               &sync.RWMutex{},
 		timeout:          conf.MetadataRefreshTimeout,
@@ -42,15 +77,19 @@ func newCluster(conf ClusterConnectionConf, pool *connectionPool, connPoolCache
 		metadataConnPool: pool,
 		connPoolCache:    connPoolCache,
 		conf:             conf,
+		topicEpochs:      make(map[string]int64),
+		pendingTopics:    make(map[string]struct{}),
+		lookupHost:       net.DefaultResolver.LookupHost,
+		controllerID:     -1,
 	}
 	if conf.MetadataRefreshFrequency > 0 {
 		go func() {
-			log.Infof("Periodically refreshing metadata (frequency=%s)",
-				conf.MetadataRefreshFrequency)
+			conf.logger.Info("periodically refreshing metadata",
+				"frequency", conf.MetadataRefreshFrequency)
 			for {
 				select {
 				case <-time.After(conf.MetadataRefreshFrequency):
-					log.Debug("Initiating periodic metadata refresh.")
+					conf.logger.Debug("initiating periodic metadata refresh")
 					_ = result.RefreshMetadata()
 				}
 			}
@@ -61,7 +100,12 @@ func newCluster(conf ClusterConnectionConf, pool *connectionPool, connPoolCache
 
 // NewCluster connects to a cluster from a given list of kafka addresses and after successful
 // metadata fetch, returns Cluster.
+//
+// The addresses are kept after the brokers of the cluster are discovered, and
+// tried again when none of the brokers answers, so they may be DNS names
+// pointing at whichever brokers are currently serving the cluster.
 func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, error) {
+	conf.logger = loggerOrDefault(conf.logger)
 	connPoolCache := newConnPoolCache()
 	metadataConnPool, err := connPoolCache.getOrCreateConnectionPool(
 		metadataCacheClientID, conf, nodeAddresses)
@@ -69,6 +113,7 @@ func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, e
 		return nil, err
 	}
 	clusterMetadata := newCluster(conf, metadataConnPool, connPoolCache)
+	clusterMetadata.seeds = append([]string(nil), nodeAddresses...)
 
 	// Attempt to connect to the cluster but we want to do this with backoff and make sure we
 	// don't exceed the limits.  Use the same configuration from connection pool for DialRetry.
@@ -76,8 +121,8 @@ func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, e
 	for try := 0; try < conf.DialRetryLimit; try++ {
 		if try > 0 {
 			sleepFor := retry.Duration()
-			log.Infof("cannot fetch metadata from any connection (try %d, sleep %s)",
-				try, sleepFor)
+			conf.logger.Info("cannot fetch metadata from any connection",
+				"try", try, "sleep", sleepFor)
 			time.Sleep(sleepFor)
 		}
 
@@ -92,9 +137,9 @@ func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, e
 				// Metadata has been refreshed, so this is ready to go
 				return clusterMetadata, nil
 			}
-			log.Errorf("cannot fetch metadata: %s", err)
+			conf.logger.Error("cannot fetch metadata", "try", try, "err", err)
 		case <-time.After(conf.DialTimeout):
-			log.Error("timeout fetching metadata")
+			conf.logger.Error("timeout fetching metadata", "try", try)
 		}
 	}
 	return nil, errors.New("cannot connect (exhausted retries)")
@@ -107,34 +152,62 @@ func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, e
 // set of metadata in the response!
 func (cm *Cluster) cache(resp *proto.MetadataResp) {
 	if len(resp.Brokers) <= 0 {
-		log.Errorf("Refusing to cache new metadata: %+v", resp)
+		cm.conf.logger.Error("refusing to cache metadata without brokers",
+			"metadata", fmt.Sprintf("%+v", resp))
 		return
 	}
 
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	log.Debugf("Caching new metadata: %+v", resp)
+	cm.conf.logger.Debug("caching new metadata", "metadata", fmt.Sprintf("%+v", resp))
 
+	oldNodes, oldLeaders, oldPartitions := cm.nodes, cm.leaders, cm.partitions
 	cm.created = time.Now()
 	cm.nodes = make(NodeMap)
 	cm.endpoints = make(map[topicPartition]int32)
+	cm.leaders = make(map[topicPartition]int32)
 	cm.partitions = make(map[string]int32)
+	cm.topicMetadata = make(map[string][]PartitionMetadata)
+	cm.racks = make(map[int32]string)
+	cm.internalTopics = make(map[string]bool)
+	cm.cacheCluster(resp)
 
 	addrs := make([]string, 0)
 	for _, node := range resp.Brokers {
-		addr := fmt.Sprintf("%s:%d", node.Host, node.Port)
+		addr := cm.conf.brokerAddress(node.NodeID, node.Host, node.Port)
 		addrs = append(addrs, addr)
 		cm.nodes[node.NodeID] = addr
+		cm.racks[node.NodeID] = node.Rack
 	}
 	for _, topic := range resp.Topics {
+		cm.internalTopics[topic.Name] = topic.IsInternal
 		for _, part := range topic.Partitions {
 			dest := topicPartition{topic.Name, part.ID}
 			cm.endpoints[dest] = part.Leader
+			cm.leaders[dest] = part.Leader
 		}
 		cm.partitions[topic.Name] = int32(len(topic.Partitions))
+		cm.topicMetadata[topic.Name] = newTopicMetadata(topic)
 	}
 	cm.connPoolCache.reinitializeAddrs(addrs)
+
+	// The first metadata isn't a change.
+	if oldNodes != nil {
+		cm.notify(diffMetadata(oldNodes, cm.nodes, oldLeaders, cm.leaders,
+			oldPartitions, cm.partitions))
+	}
+}
+
+// cacheCluster stores the cluster wide information of a metadata response.
+// Must be called with the mutex held.
+func (cm *Cluster) cacheCluster(resp *proto.MetadataResp) {
+	if resp.Version >= 1 {
+		cm.controllerID = resp.ControllerID
+	}
+	if resp.Version >= 2 {
+		cm.clusterID = resp.ClusterID
+	}
 }
 
 // connectionPoolForClient returns the connectionPool to this cluster for the given client ID.
@@ -142,6 +215,12 @@ func (cm *Cluster) connectionPoolForClient(clientID string, conf ClusterConnecti
 	return cm.connPoolCache.getOrCreateConnectionPool(clientID, conf, cm.metadataConnPool.GetAllAddrs())
 }
 
+// releaseConnectionPool releases the connectionPool returned by connectionPoolForClient,
+// closing it once no broker uses it anymore.
+func (cm *Cluster) releaseConnectionPool(clientID string) {
+	cm.connPoolCache.releaseConnectionPool(clientID)
+}
+
 // RefreshMetadata is requesting metadata information from any node and refresh
 // internal cached representation. This method can block for a long time depending
 // on how long it takes to update metadata.
@@ -165,7 +244,8 @@ func (cm *Cluster) RefreshMetadata() error {
 		}
 
 		// The counter has not updated, so it's on us to update metadata.
-		log.Debug("refreshing metadata")
+		cm.conf.logger.Debug("refreshing metadata")
+		defer observeDuration(cm.conf.metrics, "kafka_metadata_refresh_seconds", time.Now())
 		if meta, err := cm.Fetch(metadataCacheClientID); err == nil {
 			// Update metadata + update counter to be old value plus one.
 			cm.cache(meta)
@@ -175,6 +255,68 @@ func (cm *Cluster) RefreshMetadata() error {
 			// An error, note we do not update the epoch. This means that the next person to
 			// get the lock will try again, but we definitely return an error for this
 			// particular caller.
+			cm.conf.metrics.Counter("kafka_metadata_refresh_errors_total", 1)
+			updateChan <- err
+		}
+	}()
+
+	select {
+	case err := <-updateChan:
+		return err
+	case <-time.After(cm.getTimeout()):
+		return errors.New("timed out refreshing metadata")
+	}
+}
+
+// RefreshTopicMetadata is like RefreshMetadata, but only requests the metadata
+// of the given topics and merges it into the cached representation, leaving
+// other topics untouched. This is much cheaper on clusters with many
+// partitions. Brokers are only ever added by this method: a full refresh is
+// needed to notice removed brokers.
+//
+// Requesting metadata for a topic may create it on brokers allowing automatic
+// topic creation, so if any of the topics isn't known yet, a full refresh is
+// done instead.
+func (cm *Cluster) RefreshTopicMetadata(topics ...string) error {
+	if len(topics) == 0 || !cm.knowsTopics(topics) {
+		return cm.RefreshMetadata()
+	}
+
+	updateChan := make(chan error, 1)
+	go func() {
+		// Register the topics as pending before taking the lock, so that whoever
+		// holds it next refreshes them along with its own. A full refresh
+		// happening in the meantime also covers them.
+		epoch := atomic.LoadInt64(cm.epoch)
+		cm.mu.Lock()
+		topicEpochs := make(map[string]int64, len(topics))
+		for _, topic := range topics {
+			topicEpochs[topic] = cm.topicEpochs[topic]
+			cm.pendingTopics[topic] = struct{}{}
+		}
+		cm.mu.Unlock()
+
+		cm.refLock.Lock()
+		defer cm.refLock.Unlock()
+
+		if atomic.LoadInt64(cm.epoch) > epoch {
+			updateChan <- nil
+			return
+		}
+		fetch := cm.takePendingTopics(topicEpochs)
+		if len(fetch) == 0 {
+			// Someone else refreshed all our topics while we waited for the lock.
+			updateChan <- nil
+			return
+		}
+
+		cm.conf.logger.Debug("refreshing topic metadata", "topics", fetch)
+		defer observeDuration(cm.conf.metrics, "kafka_metadata_refresh_seconds", time.Now())
+		if meta, err := cm.fetch(metadataCacheClientID, fetch, false); err == nil {
+			cm.cacheTopics(meta)
+			updateChan <- nil
+		} else {
+			cm.conf.metrics.Counter("kafka_metadata_refresh_errors_total", 1)
 			updateChan <- err
 		}
 	}()
@@ -187,33 +329,206 @@ func (cm *Cluster) RefreshMetadata() error {
 	}
 }
 
+// refreshTopicAfterError refreshes the metadata after an operation on the
+// topic failed because of stale metadata. Only the topic is refreshed if
+// IncrementalMetadataRefresh is enabled.
+func (cm *Cluster) refreshTopicAfterError(topic string) error {
+	if cm.conf.IncrementalMetadataRefresh {
+		return cm.RefreshTopicMetadata(topic)
+	}
+	return cm.RefreshMetadata()
+}
+
+// knowsTopics returns whether all the topics are in the cached metadata.
+func (cm *Cluster) knowsTopics(topics []string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	for _, topic := range topics {
+		if _, ok := cm.partitions[topic]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// takePendingTopics returns the topics to refresh and clears the pending ones.
+// If none of the given topics was refreshed since its epoch was read, all the
+// pending topics are returned along with them; otherwise nothing is returned.
+// Must be called with refLock held.
+func (cm *Cluster) takePendingTopics(topicEpochs map[string]int64) []string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	stale := false
+	for topic, epoch := range topicEpochs {
+		if cm.topicEpochs[topic] == epoch {
+			stale = true
+			cm.pendingTopics[topic] = struct{}{}
+		}
+	}
+	if !stale {
+		return nil
+	}
+
+	topics := make([]string, 0, len(cm.pendingTopics))
+	for topic := range cm.pendingTopics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	cm.pendingTopics = make(map[string]struct{})
+	return topics
+}
+
+// cacheTopics merges the topics and brokers of a partial metadata response
+// into the internal metadata representation. Topics the brokers don't know
+// about anymore are removed.
+func (cm *Cluster) cacheTopics(resp *proto.MetadataResp) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.conf.logger.Debug("caching new topic metadata", "metadata", fmt.Sprintf("%+v", resp))
+
+	// Only the part of the metadata that changes is compared to notify watchers.
+	oldNodes := make(NodeMap, len(cm.nodes))
+	for nodeID, addr := range cm.nodes {
+		oldNodes[nodeID] = addr
+	}
+	oldLeaders := make(map[topicPartition]int32)
+	newLeaders := make(map[topicPartition]int32)
+	oldPartitions := make(map[string]int32)
+	newPartitions := make(map[string]int32)
+
+	cm.cacheCluster(resp)
+	addrsChanged := false
+	for _, node := range resp.Brokers {
+		cm.racks[node.NodeID] = node.Rack
+		addr := cm.conf.brokerAddress(node.NodeID, node.Host, node.Port)
+		if cm.nodes[node.NodeID] != addr {
+			cm.nodes[node.NodeID] = addr
+			addrsChanged = true
+		}
+	}
+
+	for _, topic := range resp.Topics {
+		if topic.Err != nil && topic.Err != proto.ErrUnknownTopicOrPartition &&
+			len(topic.Partitions) == 0 {
+			// Keep what we know rather than forgetting the topic on a transient error.
+			continue
+		}
+		if count, ok := cm.partitions[topic.Name]; ok {
+			oldPartitions[topic.Name] = count
+			for id := int32(0); id < count; id++ {
+				tp := topicPartition{topic.Name, id}
+				if leader, ok := cm.leaders[tp]; ok {
+					oldLeaders[tp] = leader
+				}
+				delete(cm.leaders, tp)
+				delete(cm.endpoints, tp)
+			}
+		}
+		cm.topicEpochs[topic.Name]++
+		if topic.Err == proto.ErrUnknownTopicOrPartition {
+			delete(cm.partitions, topic.Name)
+			delete(cm.topicMetadata, topic.Name)
+			delete(cm.internalTopics, topic.Name)
+			continue
+		}
+		cm.internalTopics[topic.Name] = topic.IsInternal
+
+		for _, part := range topic.Partitions {
+			dest := topicPartition{topic.Name, part.ID}
+			cm.endpoints[dest] = part.Leader
+			cm.leaders[dest] = part.Leader
+			newLeaders[dest] = part.Leader
+		}
+		cm.partitions[topic.Name] = int32(len(topic.Partitions))
+		cm.topicMetadata[topic.Name] = newTopicMetadata(topic)
+		newPartitions[topic.Name] = int32(len(topic.Partitions))
+	}
+
+	if addrsChanged {
+		addrs := make([]string, 0, len(cm.nodes))
+		for _, addr := range cm.nodes {
+			addrs = append(addrs, addr)
+		}
+		cm.connPoolCache.reinitializeAddrs(addrs)
+	}
+
+	cm.notify(diffMetadata(oldNodes, cm.nodes, oldLeaders, newLeaders,
+		oldPartitions, newPartitions))
+}
+
 // Fetch is requesting metadata information from any node and return
 // protocol response if successful. This will attempt to talk to every node at
 // least once until one returns a successful response. We walk the nodes in
 // a random order.
 //
+// If none of the known nodes answers, the bootstrap addresses given to
+// NewCluster are resolved again and tried, so that the cluster can be found
+// even if all of its brokers were replaced.
+//
 // If "topics" are specified, only fetch metadata for those topics (can be
 // used to create a topic)
 func (cm *Cluster) Fetch(clientID string, topics ...string) (*proto.MetadataResp, error) {
+	return cm.fetch(clientID, topics, true)
+}
+
+// fetch implements Fetch. allowCreate is only honored by Metadata version 4
+// and above.
+func (cm *Cluster) fetch(clientID string, topics []string, allowCreate bool) (
+	*proto.MetadataResp, error) {
+
+	req := proto.MetadataReq{
+		ClientID:               clientID,
+		Version:                cm.conf.MetadataVersion,
+		Topics:                 topics,
+		AllowAutoTopicCreation: allowCreate,
+	}
+
 	// Get all addresses, then walk the array in permuted random order.
 	addrs := cm.metadataConnPool.GetAllAddrs()
-	log.Debugf("metadata fetch addrs: %s", addrs)
+	cm.conf.logger.Debug("fetching metadata", "addrs", addrs)
+	if resp, err := cm.fetchFrom(addrs, req); err == nil {
+		return resp, nil
+	}
+
+	seeds := cm.resolveSeeds()
+	if len(seeds) == 0 || sameAddrs(seeds, addrs) {
+		return nil, errors.New("cannot fetch metadata")
+	}
+	cm.conf.logger.Warn("all known brokers failed, falling back to bootstrap addresses",
+		"addrs", addrs, "seeds", seeds)
+	cm.conf.metrics.Counter("kafka_metadata_seed_fallbacks_total", 1)
+	resp, err := cm.fetchFrom(seeds, req)
+	if err != nil {
+		return nil, errors.New("cannot fetch metadata (including from bootstrap addresses)")
+	}
+	cm.conf.logger.Info("fetched metadata from bootstrap addresses", "seeds", seeds)
+	return resp, nil
+}
+
+// fetchFrom requests metadata from the given addresses in random order,
+// returning the first successful response.
+func (cm *Cluster) fetchFrom(addrs []string, req proto.MetadataReq) (*proto.MetadataResp, error) {
 	// split the timeout so that we can try getting the metadata from more than one broker.
 	perBrokerTimeout := cm.getTimeout() / 2
 	for _, idx := range rndPerm(len(addrs)) {
 		// Directly connect, ignoring connection pool limits. This connection must be closed here.
-		conn, err := newTCPConnection(addrs[idx], perBrokerTimeout)
+		conn, err := newConnection(cm.conf.Dialer, addrs[idx], perBrokerTimeout)
 		if err != nil {
-			log.Warningf("metadata fetch failed to connect to node %s: %s", addrs[idx], err)
+			cm.conf.logger.Warn("metadata fetch failed to connect to node",
+				"broker", addrs[idx], "err", err)
 			continue
 		}
-		resp, err := conn.Metadata(&proto.MetadataReq{
-			ClientID: clientID,
-			Topics:   topics,
-		})
+		conn.metrics = cm.conf.metrics
+		conn.logger = cm.conf.logger
+		req := req
+		resp, err := conn.Metadata(&req)
 		_ = conn.Close()
 		if err != nil {
-			log.Warningf("cannot fetch metadata from node %s: %s", addrs[idx], err)
+			cm.conf.logger.Warn("cannot fetch metadata from node",
+				"broker", addrs[idx], "err", err)
 			continue
 		}
 		return resp, nil
@@ -222,6 +537,62 @@ func (cm *Cluster) Fetch(clientID string, topics ...string) (*proto.MetadataResp
 	return nil, errors.New("cannot fetch metadata")
 }
 
+// resolveSeeds returns the bootstrap addresses, with host names replaced by
+// all the addresses they currently resolve to. Seeds are returned as-is if
+// they can't be resolved, and if a custom Dialer is used, as it may resolve
+// names differently (through a proxy for example).
+func (cm *Cluster) resolveSeeds() []string {
+	if _, ok := cm.conf.Dialer.(*net.Dialer); !ok {
+		return cm.seeds
+	}
+
+	seen := make(map[string]struct{})
+	var addrs []string
+	add := func(addr string) {
+		if _, ok := seen[addr]; !ok {
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, seed := range cm.seeds {
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil || net.ParseIP(host) != nil {
+			add(seed)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cm.conf.DialTimeout)
+		ips, err := cm.lookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			cm.conf.logger.Warn("cannot resolve bootstrap address", "seed", seed, "err", err)
+			add(seed)
+			continue
+		}
+		for _, ip := range ips {
+			add(net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs
+}
+
+// sameAddrs returns whether a and b hold the same addresses, in any order.
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]struct{}, len(a))
+	for _, addr := range a {
+		set[addr] = struct{}{}
+	}
+	for _, addr := range b {
+		if _, ok := set[addr]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // PartitionCount returns how many partitions a given topic has. If a topic
 // is not known, 0 and an error are returned.
 func (cm *Cluster) PartitionCount(topic string) (int32, error) {
@@ -267,6 +638,48 @@ func (cm *Cluster) GetNodes() NodeMap {
 	return nodes
 }
 
+// GetNodeRack returns the rack of a node, or an empty string if it's unknown
+// or the node has no rack. Racks are only known with MetadataVersion 1 and
+// above.
+func (cm *Cluster) GetNodeRack(nodeID int32) string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return cm.racks[nodeID]
+}
+
+// ControllerID returns the node ID of the cluster controller, which handles
+// administrative requests. An error is returned if there is no controller or
+// it isn't known, which is always the case with MetadataVersion 0.
+func (cm *Cluster) ControllerID() (int32, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if cm.controllerID < 0 {
+		return -1, errors.New("controller not found in metadata")
+	}
+	return cm.controllerID, nil
+}
+
+// ClusterID returns the ID of the cluster, or an empty string if it's not
+// known. It's only known with MetadataVersion 2 and above.
+func (cm *Cluster) ClusterID() string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return cm.clusterID
+}
+
+// IsInternalTopic returns whether the topic is used internally by Kafka, such
+// as __consumer_offsets. Internal topics are only known with MetadataVersion 1
+// and above.
+func (cm *Cluster) IsInternalTopic(topic string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return cm.internalTopics[topic]
+}
+
 // GetNodeAddress returns the address to a node if we know it.
 func (cm *Cluster) GetNodeAddress(nodeID int32) string {
 	cm.mu.RLock()
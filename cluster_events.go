@@ -0,0 +1,194 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ClusterEventType is the kind of change described by a ClusterEvent.
+type ClusterEventType int
+
+const (
+	// EventBrokerAdded is sent when a broker joins the cluster or changes
+	// its address.
+	EventBrokerAdded ClusterEventType = iota + 1
+	// EventTopicCreated is sent when a topic appears in the metadata.
+	EventTopicCreated
+	// EventPartitionCountChanged is sent when the number of partitions of a
+	// topic changed.
+	EventPartitionCountChanged
+	// EventLeaderChanged is sent when a partition is led by a different
+	// broker. Leader is -1 if the partition has no leader.
+	EventLeaderChanged
+	// EventTopicDeleted is sent when a topic disappears from the metadata.
+	EventTopicDeleted
+	// EventBrokerRemoved is sent when a broker leaves the cluster.
+	EventBrokerRemoved
+)
+
+func (t ClusterEventType) String() string {
+	switch t {
+	case EventBrokerAdded:
+		return "broker_added"
+	case EventTopicCreated:
+		return "topic_created"
+	case EventPartitionCountChanged:
+		return "partition_count_changed"
+	case EventLeaderChanged:
+		return "leader_changed"
+	case EventTopicDeleted:
+		return "topic_deleted"
+	case EventBrokerRemoved:
+		return "broker_removed"
+	default:
+		return fmt.Sprintf("ClusterEventType(%d)", int(t))
+	}
+}
+
+// ClusterEvent describes a change between two consecutive metadata refreshes.
+// Only the fields relevant to Type are set.
+type ClusterEvent struct {
+	Type ClusterEventType
+
+	// Topic is set for all events but broker events. Partition, OldLeader
+	// and Leader are set for EventLeaderChanged.
+	Topic     string
+	Partition int32
+	OldLeader int32
+	Leader    int32
+
+	// OldPartitionCount and PartitionCount are set for
+	// EventPartitionCountChanged, EventTopicCreated and EventTopicDeleted.
+	OldPartitionCount int32
+	PartitionCount    int32
+
+	// NodeID and Addr are set for EventBrokerAdded and EventBrokerRemoved.
+	NodeID int32
+	Addr   string
+}
+
+// watchBufferSize is how many events a watcher may lag behind before events
+// are dropped.
+const watchBufferSize = 256
+
+// clusterWatchers keeps the channels returned by Cluster.Watch.
+type clusterWatchers struct {
+	mu       sync.Mutex
+	watchers map[chan ClusterEvent]struct{}
+}
+
+// Watch returns a channel receiving the changes found every time the cluster
+// metadata is refreshed, and a function that stops the watch and closes the
+// channel. Changes are only noticed when metadata is refreshed, either after
+// an error or every MetadataRefreshFrequency.
+//
+// Events are sent without blocking: if the channel isn't drained and its
+// buffer fills up, events are dropped and logged.
+func (cm *Cluster) Watch() (<-chan ClusterEvent, func()) {
+	ch := make(chan ClusterEvent, watchBufferSize)
+
+	cm.watchers.mu.Lock()
+	if cm.watchers.watchers == nil {
+		cm.watchers.watchers = make(map[chan ClusterEvent]struct{})
+	}
+	cm.watchers.watchers[ch] = struct{}{}
+	cm.watchers.mu.Unlock()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cm.watchers.mu.Lock()
+			defer cm.watchers.mu.Unlock()
+
+			delete(cm.watchers.watchers, ch)
+			close(ch)
+		})
+	}
+	return ch, stop
+}
+
+// notify sends events to every watcher.
+func (cm *Cluster) notify(events []ClusterEvent) {
+	if len(events) == 0 {
+		return
+	}
+	cm.watchers.mu.Lock()
+	defer cm.watchers.mu.Unlock()
+
+	for ch := range cm.watchers.watchers {
+		for _, event := range events {
+			select {
+			case ch <- event:
+			default:
+				cm.conf.logger.Warn("dropping cluster event, watcher is too slow",
+					"event", event.Type, "topic", event.Topic, "partition", event.Partition)
+				cm.conf.metrics.Counter("kafka_cluster_events_dropped_total", 1)
+			}
+		}
+	}
+}
+
+// diffMetadata returns the events needed to go from the old to the new nodes,
+// leaders and partition counts. They are sorted by type, so that brokers and
+// topics are announced before the partitions that refer to them.
+func diffMetadata(
+	oldNodes, newNodes NodeMap,
+	oldLeaders, newLeaders map[topicPartition]int32,
+	oldPartitions, newPartitions map[string]int32) []ClusterEvent {
+
+	var events []ClusterEvent
+
+	for nodeID, addr := range newNodes {
+		if oldAddr, ok := oldNodes[nodeID]; !ok || oldAddr != addr {
+			events = append(events, ClusterEvent{Type: EventBrokerAdded, NodeID: nodeID, Addr: addr})
+		}
+	}
+	for nodeID, addr := range oldNodes {
+		if _, ok := newNodes[nodeID]; !ok {
+			events = append(events, ClusterEvent{Type: EventBrokerRemoved, NodeID: nodeID, Addr: addr})
+		}
+	}
+
+	for topic, count := range newPartitions {
+		oldCount, ok := oldPartitions[topic]
+		switch {
+		case !ok:
+			events = append(events, ClusterEvent{
+				Type: EventTopicCreated, Topic: topic, PartitionCount: count})
+		case oldCount != count:
+			events = append(events, ClusterEvent{
+				Type: EventPartitionCountChanged, Topic: topic,
+				OldPartitionCount: oldCount, PartitionCount: count})
+		}
+	}
+	for topic, oldCount := range oldPartitions {
+		if _, ok := newPartitions[topic]; !ok {
+			events = append(events, ClusterEvent{
+				Type: EventTopicDeleted, Topic: topic, OldPartitionCount: oldCount})
+		}
+	}
+
+	for tp, leader := range newLeaders {
+		if oldLeader, ok := oldLeaders[tp]; ok && oldLeader != leader {
+			events = append(events, ClusterEvent{
+				Type: EventLeaderChanged, Topic: tp.topic, Partition: tp.partition,
+				OldLeader: oldLeader, Leader: leader})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		if a.Partition != b.Partition {
+			return a.Partition < b.Partition
+		}
+		return a.NodeID < b.NodeID
+	})
+	return events
+}
@@ -0,0 +1,107 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&ClusterEventsSuite{})
+
+type ClusterEventsSuite struct{}
+
+func (s *ClusterEventsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *ClusterEventsSuite) TestDiffMetadata(c *C) {
+	events := diffMetadata(
+		NodeMap{1: "a:9092", 2: "b:9092", 3: "c:9092"},
+		NodeMap{1: "a:9092", 2: "b2:9092", 4: "d:9092"},
+		map[topicPartition]int32{{"foo", 0}: 1, {"foo", 1}: 2, {"bar", 0}: 3},
+		map[topicPartition]int32{{"foo", 0}: 1, {"foo", 1}: 4, {"foo", 2}: 1, {"baz", 0}: 1},
+		map[string]int32{"foo": 2, "bar": 1},
+		map[string]int32{"foo": 3, "baz": 1},
+	)
+	c.Assert(events, DeepEquals, []ClusterEvent{
+		{Type: EventBrokerAdded, NodeID: 2, Addr: "b2:9092"},
+		{Type: EventBrokerAdded, NodeID: 4, Addr: "d:9092"},
+		{Type: EventTopicCreated, Topic: "baz", PartitionCount: 1},
+		{Type: EventPartitionCountChanged, Topic: "foo", OldPartitionCount: 2, PartitionCount: 3},
+		{Type: EventLeaderChanged, Topic: "foo", Partition: 1, OldLeader: 2, Leader: 4},
+		{Type: EventTopicDeleted, Topic: "bar", OldPartitionCount: 1},
+		{Type: EventBrokerRemoved, NodeID: 3, Addr: "c:9092"},
+	})
+
+	c.Assert(diffMetadata(
+		NodeMap{1: "a:9092"}, NodeMap{1: "a:9092"},
+		map[topicPartition]int32{{"foo", 0}: 1}, map[topicPartition]int32{{"foo", 0}: 1},
+		map[string]int32{"foo": 1}, map[string]int32{"foo": 1},
+	), HasLen, 0)
+}
+
+func (s *ClusterEventsSuite) TestWatch(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	host, port := srv.HostPort()
+	var mu sync.Mutex
+	leader := int32(1)
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		mu.Lock()
+		defer mu.Unlock()
+
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+				{NodeID: 2, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: leader, Replicas: []int32{1, 2}, Isrs: []int32{1, 2}},
+					},
+				},
+			},
+		}
+	})
+
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-watch", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	events, stop := broker.Watch()
+
+	// Refreshing unchanged metadata sends nothing.
+	c.Assert(broker.cluster.RefreshMetadata(), IsNil)
+	select {
+	case event := <-events:
+		c.Fatalf("unexpected event %+v", event)
+	default:
+	}
+
+	mu.Lock()
+	leader = 2
+	mu.Unlock()
+	c.Assert(broker.cluster.RefreshMetadata(), IsNil)
+	select {
+	case event := <-events:
+		c.Assert(event, DeepEquals, ClusterEvent{
+			Type: EventLeaderChanged, Topic: "test", Partition: 0, OldLeader: 1, Leader: 2})
+	case <-time.After(time.Second):
+		c.Fatal("no event received")
+	}
+
+	stop()
+	stop()
+	_, ok := <-events
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var kindNames = map[int16]string{
+	proto.ProduceReqKind:          "produce",
+	proto.FetchReqKind:            "fetch",
+	proto.OffsetReqKind:           "offset",
+	proto.MetadataReqKind:         "metadata",
+	proto.OffsetCommitReqKind:     "offset_commit",
+	proto.OffsetFetchReqKind:      "offset_fetch",
+	proto.GroupCoordinatorReqKind: "group_coordinator",
+	proto.JoinGroupReqKind:        "join_group",
+	proto.HeartbeatReqKind:        "heartbeat",
+	proto.LeaveGroupReqKind:       "leave_group",
+	proto.SyncGroupReqKind:        "sync_group",
+}
+
+// maxVersions are the highest versions that can be decoded, for the kinds
+// supporting more than version 0.
+var maxVersions = map[int16]int16{
+	proto.FetchReqKind:    proto.FetchMaxVersion,
+	proto.OffsetReqKind:   proto.OffsetMaxVersion,
+	proto.MetadataReqKind: proto.MetadataMaxVersion,
+}
+
+// exchange is a request with its response. Either may be missing, in which
+// case the kind of a response is unknown.
+type exchange struct {
+	conn          string
+	kind          int16
+	version       int16
+	correlationID int32
+	request       *frame
+	response      *frame
+}
+
+// pairFrames pairs requests with their response, using the connection they
+// were sent on and their correlation ID. Exchanges are returned in the order
+// of their first frame.
+func pairFrames(frames []frame) []*exchange {
+	type key struct {
+		conn          string
+		correlationID int32
+	}
+	var exchanges []*exchange
+	pending := make(map[key]*exchange)
+	for i := range frames {
+		f := &frames[i]
+		if f.Dir != dirRequest && len(f.Data) >= 8 {
+			k := key{f.Conn, int32(binary.BigEndian.Uint32(f.Data[4:]))}
+			if ex, ok := pending[k]; ok {
+				ex.response = f
+				delete(pending, k)
+				continue
+			}
+		}
+		if f.Dir == dirResponse || !looksLikeRequest(f.Data) {
+			ex := &exchange{conn: f.Conn, kind: -1, response: f}
+			if len(f.Data) >= 8 {
+				ex.correlationID = int32(binary.BigEndian.Uint32(f.Data[4:]))
+			}
+			exchanges = append(exchanges, ex)
+			continue
+		}
+		ex := &exchange{
+			conn:          f.Conn,
+			kind:          int16(binary.BigEndian.Uint16(f.Data[4:])),
+			version:       int16(binary.BigEndian.Uint16(f.Data[6:])),
+			correlationID: int32(binary.BigEndian.Uint32(f.Data[8:])),
+			request:       f,
+		}
+		exchanges = append(exchanges, ex)
+		pending[key{f.Conn, ex.correlationID}] = ex
+	}
+	return exchanges
+}
+
+// looksLikeRequest returns whether a frame starts with a request header: a
+// known request kind, a version and correlation ID, and a client ID.
+func looksLikeRequest(b []byte) bool {
+	if len(b) < 14 {
+		return false
+	}
+	if _, ok := kindNames[int16(binary.BigEndian.Uint16(b[4:]))]; !ok {
+		return false
+	}
+	clientIDLen := int16(binary.BigEndian.Uint16(b[12:]))
+	return clientIDLen >= -1 && 14+int(clientIDLen) <= len(b)
+}
+
+// decodeRequest decodes a request of the given kind and version.
+func decodeRequest(kind, version int16, b []byte) (interface{}, error) {
+	if version < 0 || version > maxVersions[kind] {
+		return nil, fmt.Errorf("unsupported %s request version %d", kindName(kind), version)
+	}
+	r := bytes.NewReader(b)
+	switch kind {
+	case proto.ProduceReqKind:
+		return proto.ReadProduceReq(r)
+	case proto.FetchReqKind:
+		return proto.ReadFetchReq(r)
+	case proto.OffsetReqKind:
+		return proto.ReadOffsetReq(r)
+	case proto.MetadataReqKind:
+		return proto.ReadMetadataReq(r)
+	case proto.OffsetCommitReqKind:
+		return proto.ReadOffsetCommitReq(r)
+	case proto.OffsetFetchReqKind:
+		return proto.ReadOffsetFetchReq(r)
+	case proto.GroupCoordinatorReqKind:
+		return proto.ReadGroupCoordinatorReq(r)
+	case proto.JoinGroupReqKind:
+		return proto.ReadJoinGroupReq(r)
+	case proto.HeartbeatReqKind:
+		return proto.ReadHeartbeatReq(r)
+	case proto.LeaveGroupReqKind:
+		return proto.ReadLeaveGroupReq(r)
+	case proto.SyncGroupReqKind:
+		return proto.ReadSyncGroupReq(r)
+	}
+	return nil, fmt.Errorf("unknown request kind %d", kind)
+}
+
+// decodeResponse decodes the response to a request of the given kind and
+// version.
+func decodeResponse(kind, version int16, b []byte) (interface{}, error) {
+	if version < 0 || version > maxVersions[kind] {
+		return nil, fmt.Errorf("unsupported %s response version %d", kindName(kind), version)
+	}
+	var r io.Reader = bytes.NewReader(b)
+	switch kind {
+	case proto.ProduceReqKind:
+		return proto.ReadProduceResp(r)
+	case proto.FetchReqKind:
+		return proto.ReadVersionedFetchResp(r, version)
+	case proto.OffsetReqKind:
+		return proto.ReadVersionedOffsetResp(r, version)
+	case proto.MetadataReqKind:
+		return proto.ReadVersionedMetadataResp(r, version)
+	case proto.OffsetCommitReqKind:
+		return proto.ReadOffsetCommitResp(r)
+	case proto.OffsetFetchReqKind:
+		return proto.ReadOffsetFetchResp(r)
+	case proto.GroupCoordinatorReqKind:
+		return proto.ReadGroupCoordinatorResp(r)
+	case proto.JoinGroupReqKind:
+		return proto.ReadJoinGroupResp(r)
+	case proto.HeartbeatReqKind:
+		return proto.ReadHeartbeatResp(r)
+	case proto.LeaveGroupReqKind:
+		return proto.ReadLeaveGroupResp(r)
+	case proto.SyncGroupReqKind:
+		return proto.ReadSyncGroupResp(r)
+	}
+	return nil, fmt.Errorf("unknown request kind %d", kind)
+}
+
+func kindName(kind int16) string {
+	if name, ok := kindNames[kind]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// json returns the exchange as a JSON object. Frames that cannot be decoded
+// are shown in hex with the decoding error.
+func (ex *exchange) json(conv converter) object {
+	obj := object{{"kind", kindName(ex.kind)}}
+	if ex.request != nil {
+		obj = append(obj, field{"version", ex.version})
+	}
+	obj = append(obj, field{"correlation_id", ex.correlationID})
+	if ex.conn != "" {
+		obj = append(obj, field{"conn", ex.conn})
+	}
+	if ex.request != nil {
+		req, err := decodeRequest(ex.kind, ex.version, ex.request.Data)
+		obj = append(obj, conv.frame("request", ex.request, req, err)...)
+	}
+	if ex.response != nil {
+		var resp interface{}
+		err := fmt.Errorf("no request for correlation ID %d", ex.correlationID)
+		if ex.request != nil {
+			resp, err = decodeResponse(ex.kind, ex.version, ex.response.Data)
+		}
+		obj = append(obj, conv.frame("response", ex.response, resp, err)...)
+	}
+	return obj
+}
+
+// converter converts decoded structures to JSON values.
+type converter struct {
+	// text prints byte strings as text instead of base64.
+	text bool
+}
+
+// frame returns the fields describing a decoded frame.
+func (conv converter) frame(name string, f *frame, decoded interface{}, err error) object {
+	var obj object
+	if !f.Time.IsZero() {
+		obj = append(obj, field{name + "_time", f.Time.UTC().Format(time.RFC3339Nano)})
+	}
+	if err != nil {
+		return append(obj,
+			field{name + "_error", err.Error()},
+			field{name + "_hex", fmt.Sprintf("%x", f.Data)})
+	}
+	return append(obj, field{name, conv.value(reflect.ValueOf(decoded))})
+}
+
+var (
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// value converts a decoded value to a value that can be encoded in JSON:
+// errors are shown by their message, durations as strings and byte strings
+// as text or base64. Struct fields keep their order.
+func (conv converter) value(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(errorType) && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface().(error).Error()
+	}
+	switch v.Type() {
+	case durationType:
+		return v.Interface().(time.Duration).String()
+	case timeType:
+		t := v.Interface().(time.Time)
+		if t.IsZero() {
+			return nil
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return conv.value(v.Elem())
+	case reflect.Struct:
+		obj := object{}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			obj = append(obj, field{v.Type().Field(i).Name, conv.value(v.Field(i))})
+		}
+		return obj
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if conv.text {
+				return string(v.Bytes())
+			}
+			return base64.StdEncoding.EncodeToString(v.Bytes())
+		}
+		fallthrough
+	case reflect.Array:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = conv.value(v.Index(i))
+		}
+		return list
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = conv.value(iter.Value())
+		}
+		return m
+	}
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	return v.Interface()
+}
+
+// object is a JSON object whose fields keep their order.
+type object []field
+
+type field struct {
+	name  string
+	value interface{}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
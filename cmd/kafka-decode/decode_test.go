@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&DecodeSuite{})
+
+type DecodeSuite struct{}
+
+type serializable interface {
+	Bytes() ([]byte, error)
+}
+
+func mustBytes(c *C, msgs ...serializable) []byte {
+	var b []byte
+	for _, msg := range msgs {
+		data, err := msg.Bytes()
+		c.Assert(err, IsNil)
+		b = append(b, data...)
+	}
+	return b
+}
+
+func encode(c *C, v interface{}) string {
+	b, err := json.Marshal(v)
+	c.Assert(err, IsNil)
+	return string(b)
+}
+
+func (s *DecodeSuite) TestPairing(c *C) {
+	input := mustBytes(c,
+		&proto.MetadataReq{CorrelationID: 1, ClientID: "test", Version: 1, Topics: []string{"foo"}},
+		&proto.GroupCoordinatorReq{CorrelationID: 2, ClientID: "test", ConsumerGroup: "group"},
+		&proto.GroupCoordinatorResp{CorrelationID: 2, Err: proto.ErrNoCoordinator},
+		&proto.MetadataResp{CorrelationID: 1, Version: 1, ControllerID: 3,
+			Brokers: []proto.MetadataRespBroker{{NodeID: 3, Host: "broker", Port: 9092}}},
+		&proto.HeartbeatResp{CorrelationID: 9},
+	)
+	frames, err := readStream(input)
+	c.Assert(err, IsNil)
+	exchanges := pairFrames(frames)
+	c.Assert(exchanges, HasLen, 3)
+
+	c.Assert(exchanges[0].kind, Equals, int16(proto.MetadataReqKind))
+	c.Assert(exchanges[0].version, Equals, int16(1))
+	out := encode(c, exchanges[0].json(converter{}))
+	c.Assert(out, Matches, `\{"kind":"metadata","version":1,"correlation_id":1,"request":\{"CorrelationID":1,"ClientID":"test","Version":1,"Topics":\["foo"\].*\},"response":\{.*"ControllerID":3.*\}\}`)
+
+	out = encode(c, exchanges[1].json(converter{}))
+	c.Assert(out, Matches, `\{"kind":"group_coordinator",.*"response":\{"CorrelationID":2,"Err":"\[transient\] consumer coordinator not available.*",.*\}\}`)
+
+	// A response without request cannot be decoded.
+	out = encode(c, exchanges[2].json(converter{}))
+	c.Assert(out, Matches, `\{"kind":"unknown","correlation_id":9,"response_error":"no request for correlation ID 9","response_hex":"[0-9a-f]+"\}`)
+
+	_, err = readStream(input[:len(input)-1])
+	c.Assert(err, ErrorMatches, "incomplete frame of .* bytes at the end of the input")
+}
+
+func (s *DecodeSuite) TestValues(c *C) {
+	req := &proto.ProduceReq{
+		CorrelationID: 5,
+		ClientID:      "test",
+		RequiredAcks:  proto.RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []proto.ProduceReqTopic{{
+			Name: "foo",
+			Partitions: []proto.ProduceReqPartition{{
+				ID:       0,
+				Messages: []*proto.Message{{Key: []byte("k"), Value: []byte("hello")}},
+			}},
+		}},
+	}
+	frames, err := readStream(mustBytes(c, req))
+	c.Assert(err, IsNil)
+	ex := pairFrames(frames)[0]
+
+	out := encode(c, ex.json(converter{}))
+	c.Assert(out, Matches, `.*"Timeout":"1s".*"Key":"aw==","Value":"aGVsbG8=".*`)
+	out = encode(c, ex.json(converter{text: true}))
+	c.Assert(out, Matches, `.*"Key":"k","Value":"hello".*`)
+}
+
+func (s *DecodeSuite) TestUnsupportedVersion(c *C) {
+	b := mustBytes(c, &proto.HeartbeatReq{CorrelationID: 1, ClientID: "test", GroupID: "group"})
+	b[7] = 3
+	frames, err := readStream(b)
+	c.Assert(err, IsNil)
+	out := encode(c, pairFrames(frames)[0].json(converter{}))
+	c.Assert(out, Matches, `\{"kind":"heartbeat","version":3,"correlation_id":1,"request_error":"unsupported heartbeat request version 3","request_hex":"[0-9a-f]+"\}`)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/discord/zorkian-kafka"
+)
+
+// direction tells whether a frame was sent to or by a broker, when known.
+type direction int
+
+const (
+	dirUnknown direction = iota
+	dirRequest
+	dirResponse
+)
+
+// frame is a request or response read from the input.
+type frame struct {
+	// Time is when the frame was captured, or zero if unknown.
+	Time time.Time
+	// Conn identifies the connection the frame was sent on, if known.
+	Conn string
+	Dir  direction
+	// Data is the whole frame, including its size.
+	Data []byte
+}
+
+// detectFormat guesses the format of the input.
+func detectFormat(input []byte) string {
+	if bytes.HasPrefix(input, []byte("KREC")) {
+		return "recording"
+	}
+	if len(input) >= 4 {
+		switch binary.LittleEndian.Uint32(input) {
+		case pcapMagicMicro, pcapMagicNano, swapped(pcapMagicMicro), swapped(pcapMagicNano):
+			return "pcap"
+		}
+	}
+	for _, c := range input {
+		if (c < ' ' || c > '~') && c != '\n' && c != '\r' && c != '\t' {
+			return "raw"
+		}
+	}
+	return "hex"
+}
+
+// readFrames reads the frames of the input in the given format. The frames
+// read before an error are returned with it.
+func readFrames(format string, input []byte, port uint16) ([]frame, error) {
+	switch format {
+	case "raw":
+		return readStream(input)
+	case "hex":
+		b, err := parseHex(input)
+		if err != nil {
+			return nil, err
+		}
+		return readStream(b)
+	case "pcap":
+		return readPcap(input, port)
+	case "recording":
+		recorded, err := kafka.ReadRecording(bytes.NewReader(input))
+		frames := make([]frame, len(recorded))
+		for i, f := range recorded {
+			frames[i] = frame{
+				Time: f.Time,
+				Conn: strconv.Itoa(int(f.ConnID)) + " " + f.Addr,
+				Dir:  dirResponse,
+				Data: f.Data,
+			}
+			if f.Request {
+				frames[i].Dir = dirRequest
+			}
+		}
+		return frames, err
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// readStream reads frames written one after another.
+func readStream(b []byte) ([]frame, error) {
+	data, rest, err := splitFrames(b)
+	frames := make([]frame, len(data))
+	for i, d := range data {
+		frames[i] = frame{Data: d}
+	}
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("incomplete frame of %d bytes at the end of the input", len(rest))
+	}
+	return frames, err
+}
+
+// splitFrames returns the complete frames at the start of b, and the bytes
+// left.
+func splitFrames(b []byte) (frames [][]byte, rest []byte, err error) {
+	for len(b) >= 4 {
+		size := int32(binary.BigEndian.Uint32(b))
+		if size < 0 {
+			return frames, b, fmt.Errorf("invalid frame size %d", size)
+		}
+		if len(b)-4 < int(size) {
+			break
+		}
+		frames = append(frames, b[:4+size])
+		b = b[4+size:]
+	}
+	return frames, b, nil
+}
+
+// xxdLine matches a line written by xxd, capturing its hex bytes.
+var xxdLine = regexp.MustCompile(`^[0-9a-fA-F]+: ((?:[0-9a-fA-F]+ ?)+)(?:  .*)?$`)
+
+// parseHex parses a hex dump, either plain with any whitespace, or written
+// by xxd.
+func parseHex(input []byte) ([]byte, error) {
+	var digits strings.Builder
+	for i, line := range strings.Split(string(input), "\n") {
+		line = strings.TrimSpace(line)
+		if m := xxdLine.FindStringSubmatch(line); m != nil {
+			line = m[1]
+		}
+		for _, field := range strings.Fields(line) {
+			field = strings.TrimPrefix(field, "0x")
+			if _, err := hex.DecodeString(strings.Repeat("0", len(field)%2) + field); err != nil {
+				return nil, fmt.Errorf("line %d: invalid hex %q", i+1, field)
+			}
+			digits.WriteString(field)
+		}
+	}
+	if digits.Len()%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits")
+	}
+	return hex.DecodeString(digits.String())
+}
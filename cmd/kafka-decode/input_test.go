@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&InputSuite{})
+
+type InputSuite struct{}
+
+func (s *InputSuite) TestHex(c *C) {
+	b, err := parseHex([]byte("0000 0002\n0x01 ff\n"))
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0, 0, 0, 2, 1, 0xff})
+
+	// output of xxd
+	b, err = parseHex([]byte("" +
+		"00000000: 0000 000a 0003 0001 0000 0001 0000 ffff  ................\n" +
+		"00000010: ffff                                     ..\n"))
+	c.Assert(err, IsNil)
+	c.Assert(hex.EncodeToString(b), Equals, "0000000a00030001000000010000ffffffff")
+
+	_, err = parseHex([]byte("00 zz"))
+	c.Assert(err, ErrorMatches, `line 1: invalid hex "zz"`)
+	_, err = parseHex([]byte("000"))
+	c.Assert(err, ErrorMatches, "odd number of hex digits")
+}
+
+func (s *InputSuite) TestDetectFormat(c *C) {
+	c.Assert(detectFormat([]byte("KREC\x00\x01")), Equals, "recording")
+	c.Assert(detectFormat([]byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0}), Equals, "pcap")
+	c.Assert(detectFormat([]byte{0xa1, 0xb2, 0x3c, 0x4d, 0, 2}), Equals, "pcap")
+	c.Assert(detectFormat([]byte("00000000: 0000 000a  ....\n")), Equals, "hex")
+	c.Assert(detectFormat([]byte{0, 0, 0, 2, 1, 2}), Equals, "raw")
+}
+
+func (s *InputSuite) TestRecording(c *C) {
+	var buf bytes.Buffer
+	recorder := kafka.NewRecorder(&buf)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn, err := recorder.Dialer(pipeDialer{client}).DialContext(context.Background(), "tcp", "broker:9092")
+	c.Assert(err, IsNil)
+
+	req := mustBytes(c, &proto.HeartbeatReq{CorrelationID: 4, ClientID: "test", GroupID: "group"})
+	resp := mustBytes(c, &proto.HeartbeatResp{CorrelationID: 4, Err: proto.ErrRebalanceInProgress})
+	go func() {
+		_, _ = server.Read(make([]byte, len(req)))
+		_, _ = server.Write(resp)
+	}()
+	_, err = conn.Write(req)
+	c.Assert(err, IsNil)
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+
+	c.Assert(detectFormat(buf.Bytes()), Equals, "recording")
+	frames, err := readFrames("recording", buf.Bytes(), 9092)
+	c.Assert(err, IsNil)
+	c.Assert(frames, HasLen, 2)
+	c.Assert(frames[0].Conn, Equals, "1 broker:9092")
+	c.Assert(frames[0].Dir, Equals, dirRequest)
+	c.Assert(frames[1].Dir, Equals, dirResponse)
+	exchanges := pairFrames(frames)
+	c.Assert(exchanges, HasLen, 1)
+	c.Assert(encode(c, exchanges[0].json(converter{})), Matches,
+		`.*"conn":"1 broker:9092","request_time":.*"response":\{"CorrelationID":4,"Err":"group is rebalancing.*"\}\}`)
+}
+
+func (s *InputSuite) TestPcap(c *C) {
+	req1 := mustBytes(c, &proto.HeartbeatReq{CorrelationID: 1, ClientID: "test", GroupID: "group"})
+	req2 := mustBytes(c, &proto.LeaveGroupReq{CorrelationID: 2, ClientID: "test", GroupID: "group"})
+	resp1 := mustBytes(c, &proto.HeartbeatResp{CorrelationID: 1})
+	resp2 := mustBytes(c, &proto.LeaveGroupResp{CorrelationID: 2})
+	// a response to no request
+	stray := mustBytes(c, &proto.HeartbeatResp{CorrelationID: 3})
+
+	p := newPcapWriter()
+	client := endpoint{net.IPv4(10, 0, 0, 1), 51000}
+	broker := endpoint{net.IPv4(10, 0, 0, 2), 9093}
+	p.packet(client, broker, 100, tcpSyn, nil)
+	p.packet(broker, client, 500, tcpSyn|tcpAck, nil)
+	// the first request is split, and its second half arrives first
+	p.packet(client, broker, 101+5, tcpAck, req1[5:])
+	p.packet(client, broker, 101, tcpAck, req1[:5])
+	// retransmission
+	p.packet(client, broker, 101, tcpAck, req1[:5])
+	p.packet(broker, client, 501, tcpAck, append(append([]byte(nil), resp1...), stray...))
+
+	// A connection whose handshake was not captured uses the broker port.
+	other := endpoint{net.IPv4(10, 0, 0, 3), 52000}
+	p.packet(other, broker, 7000, tcpAck, req2)
+	p.packet(broker, other, 9000, tcpAck, resp2)
+
+	c.Assert(detectFormat(p.buf.Bytes()), Equals, "pcap")
+	frames, err := readFrames("pcap", p.buf.Bytes(), 9093)
+	c.Assert(err, IsNil)
+	c.Assert(frames, HasLen, 5)
+	c.Assert(frames[0].Data, DeepEquals, req1)
+	c.Assert(frames[0].Dir, Equals, dirRequest)
+	c.Assert(frames[0].Conn, Equals, "10.0.0.1:51000 10.0.0.2:9093")
+	c.Assert(frames[0].Time.Equal(time.Unix(1000, 3000)), Equals, true)
+	c.Assert(frames[2].Data, DeepEquals, stray)
+	c.Assert(frames[2].Dir, Equals, dirResponse)
+	c.Assert(frames[3].Dir, Equals, dirRequest)
+	c.Assert(frames[4].Dir, Equals, dirResponse)
+
+	exchanges := pairFrames(frames)
+	c.Assert(exchanges, HasLen, 3)
+	c.Assert(exchanges[0].response, NotNil)
+	c.Assert(exchanges[1].kind, Equals, int16(-1))
+	c.Assert(exchanges[2].kind, Equals, int16(proto.LeaveGroupReqKind))
+	c.Assert(exchanges[2].response, NotNil)
+
+	_, err = readFrames("pcap", p.buf.Bytes()[:p.buf.Len()-1], 9093)
+	c.Assert(err, ErrorMatches, "packet 7: truncated")
+}
+
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+type endpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+const (
+	tcpSyn = 0x02
+	tcpAck = 0x10
+)
+
+// pcapWriter writes a capture of IPv4 packets over Ethernet, one
+// microsecond apart.
+type pcapWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func newPcapWriter() *pcapWriter {
+	p := &pcapWriter{}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, pcapMagicMicro)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkEthernet)
+	p.buf.Write(header)
+	return p
+}
+
+func (p *pcapWriter) packet(src, dst endpoint, seq uint32, flags byte, payload []byte) {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp, src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], src.ip.To4())
+	copy(ip[16:], dst.ip.To4())
+	ip = append(ip, tcp...)
+
+	eth := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(eth[12:], 0x0800)
+	eth = append(eth, ip...)
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record, 1000)
+	binary.LittleEndian.PutUint32(record[4:], uint32(p.n))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(eth)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(eth)))
+	p.buf.Write(record)
+	p.buf.Write(eth)
+	p.n++
+}
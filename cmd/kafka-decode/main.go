@@ -0,0 +1,86 @@
+/*
+Command kafka-decode decodes Kafka requests and responses captured on the wire
+and prints them as JSON, one exchange per line.
+
+Usage:
+
+	kafka-decode [-format auto|raw|hex|pcap|recording] [-values base64|text] [-port 9092] [file]
+
+The input is read from file, or from stdin if no file is given. It can be:
+
+	raw        frames as sent on the wire, one after another
+	hex        the same frames as a hex dump, either plain or written by xxd
+	pcap       a packet capture of TCP connections to brokers, as written by
+	           tcpdump -w
+	recording  a recording written by kafka.Recorder
+
+With -format auto, the format is guessed from the content. Requests are paired
+with their response using the connection they were sent on and their
+correlation ID, so that responses are decoded with the kind and version of the
+request. Raw frames and hex dumps have no direction, so frames that do not
+answer a pending request are decoded as requests. In packet captures, the side
+of a connection listening on -port is the broker if the capture does not start
+with the TCP handshake.
+
+Message keys and values, and all other byte strings, are printed in base64,
+or as text with -values text.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	format := flag.String("format", "auto", "input format: auto, raw, hex, pcap or recording")
+	values := flag.String("values", "base64", "how to print byte strings: base64 or text")
+	port := flag.Int("port", 9092, "port of the brokers in packet captures")
+	flag.Parse()
+
+	if *values != "base64" && *values != "text" {
+		fatalf("invalid -values %q", *values)
+	}
+
+	var input []byte
+	var err error
+	switch flag.NArg() {
+	case 0:
+		input, err = ioutil.ReadAll(os.Stdin)
+	case 1:
+		input, err = ioutil.ReadFile(flag.Arg(0))
+	default:
+		fatalf("too many arguments")
+	}
+	if err != nil {
+		fatalf("cannot read input: %s", err)
+	}
+
+	if *format == "auto" {
+		*format = detectFormat(input)
+	}
+	frames, err := readFrames(*format, input, uint16(*port))
+	if err != nil {
+		// print what could be read before the error
+		fmt.Fprintf(os.Stderr, "kafka-decode: %s\n", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	conv := converter{text: *values == "text"}
+	for _, ex := range pairFrames(frames) {
+		if err := enc.Encode(ex.json(conv)); err != nil {
+			fatalf("cannot write output: %s", err)
+		}
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "kafka-decode: "+format+"\n", args...)
+	os.Exit(2)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRaw       = 101
+	linkLinuxSLL  = 113
+	linkLinuxSLL2 = 276
+)
+
+func swapped(v uint32) uint32 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+// tcpStream is the reassembled payload sent by one side of a connection.
+type tcpStream struct {
+	started bool
+	nextSeq uint32
+	// pending are the segments received ahead of nextSeq, by sequence number.
+	pending map[uint32][]byte
+	buf     []byte
+	// broken is set once the stream cannot be split into frames anymore.
+	broken bool
+}
+
+// tcpConn is a connection between a client and a broker.
+type tcpConn struct {
+	id string
+	// client is the endpoint of the client, once known.
+	client  string
+	streams map[string]*tcpStream
+}
+
+// readPcap reads the frames exchanged over the TCP connections of a packet
+// capture in the libpcap format.
+func readPcap(input []byte, port uint16) ([]frame, error) {
+	if len(input) < 24 {
+		return nil, fmt.Errorf("pcap header too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(input)
+	if magic == swapped(pcapMagicMicro) || magic == swapped(pcapMagicNano) {
+		order = binary.BigEndian
+		magic = order.Uint32(input)
+	}
+	if magic != pcapMagicMicro && magic != pcapMagicNano {
+		return nil, fmt.Errorf("not a pcap file")
+	}
+	linkType := order.Uint32(input[20:]) & 0xffff
+
+	var frames []frame
+	conns := make(map[string]*tcpConn)
+	input = input[24:]
+	for n := 0; len(input) > 0; n++ {
+		if len(input) < 16 {
+			return frames, fmt.Errorf("packet %d: header too short", n)
+		}
+		sec, frac := order.Uint32(input), order.Uint32(input[4:])
+		capLen := order.Uint32(input[8:])
+		if uint32(len(input)-16) < capLen {
+			return frames, fmt.Errorf("packet %d: truncated", n)
+		}
+		packet := input[16 : 16+capLen]
+		input = input[16+capLen:]
+
+		ts := time.Unix(int64(sec), int64(frac)*1000)
+		if magic == pcapMagicNano {
+			ts = time.Unix(int64(sec), int64(frac))
+		}
+		seg, ok := parsePacket(linkType, packet)
+		if !ok {
+			continue
+		}
+		frames = append(frames, seg.feed(conns, ts, port)...)
+	}
+	return frames, nil
+}
+
+// tcpSegment is a TCP segment with the endpoints it was sent from and to.
+type tcpSegment struct {
+	src, dst string
+	srcPort  uint16
+	dstPort  uint16
+	seq      uint32
+	syn, ack bool
+	payload  []byte
+}
+
+// parsePacket returns the TCP segment carried by a captured packet.
+func parsePacket(linkType uint32, b []byte) (tcpSegment, bool) {
+	var ethType uint16
+	switch linkType {
+	case linkEthernet:
+		if len(b) < 14 {
+			return tcpSegment{}, false
+		}
+		ethType, b = binary.BigEndian.Uint16(b[12:]), b[14:]
+		for ethType == 0x8100 && len(b) >= 4 {
+			ethType, b = binary.BigEndian.Uint16(b[2:]), b[4:]
+		}
+	case linkLinuxSLL:
+		if len(b) < 16 {
+			return tcpSegment{}, false
+		}
+		ethType, b = binary.BigEndian.Uint16(b[14:]), b[16:]
+	case linkLinuxSLL2:
+		if len(b) < 20 {
+			return tcpSegment{}, false
+		}
+		ethType, b = binary.BigEndian.Uint16(b), b[20:]
+	case linkNull, linkRaw:
+		if linkType == linkNull {
+			if len(b) < 4 {
+				return tcpSegment{}, false
+			}
+			b = b[4:]
+		}
+		if len(b) == 0 {
+			return tcpSegment{}, false
+		}
+		ethType = 0x0800
+		if b[0]>>4 == 6 {
+			ethType = 0x86dd
+		}
+	default:
+		return tcpSegment{}, false
+	}
+
+	var seg tcpSegment
+	switch ethType {
+	case 0x0800:
+		if len(b) < 20 || b[9] != 6 {
+			return seg, false
+		}
+		hdrLen, total := int(b[0]&0x0f)*4, int(binary.BigEndian.Uint16(b[2:]))
+		if hdrLen < 20 || total < hdrLen || len(b) < total {
+			return seg, false
+		}
+		seg.src, seg.dst = net.IP(b[12:16]).String(), net.IP(b[16:20]).String()
+		b = b[hdrLen:total]
+	case 0x86dd:
+		if len(b) < 40 || b[6] != 6 {
+			return seg, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(b[4:]))
+		if len(b) < total {
+			return seg, false
+		}
+		seg.src, seg.dst = net.IP(b[8:24]).String(), net.IP(b[24:40]).String()
+		b = b[40:total]
+	default:
+		return seg, false
+	}
+
+	if len(b) < 20 {
+		return seg, false
+	}
+	hdrLen := int(b[12]>>4) * 4
+	if hdrLen < 20 || len(b) < hdrLen {
+		return seg, false
+	}
+	seg.srcPort = binary.BigEndian.Uint16(b)
+	seg.dstPort = binary.BigEndian.Uint16(b[2:])
+	seg.seq = binary.BigEndian.Uint32(b[4:])
+	seg.syn = b[13]&0x02 != 0
+	seg.ack = b[13]&0x10 != 0
+	seg.payload = b[hdrLen:]
+	return seg, true
+}
+
+// feed adds the segment to its connection and returns the frames it
+// completes.
+func (seg tcpSegment) feed(conns map[string]*tcpConn, ts time.Time, port uint16) []frame {
+	src := net.JoinHostPort(seg.src, strconv.Itoa(int(seg.srcPort)))
+	dst := net.JoinHostPort(seg.dst, strconv.Itoa(int(seg.dstPort)))
+	id := src + " " + dst
+	if dst < src {
+		id = dst + " " + src
+	}
+	conn, ok := conns[id]
+	if !ok {
+		conn = &tcpConn{id: id, streams: make(map[string]*tcpStream)}
+		conns[id] = conn
+	}
+	if conn.client == "" {
+		switch {
+		case seg.syn && !seg.ack:
+			conn.client = src
+		case seg.syn && seg.ack:
+			conn.client = dst
+		case seg.dstPort == port:
+			conn.client = src
+		case seg.srcPort == port:
+			conn.client = dst
+		}
+	}
+	s, ok := conn.streams[src]
+	if !ok {
+		s = &tcpStream{pending: make(map[uint32][]byte)}
+		conn.streams[src] = s
+	}
+
+	if seg.syn {
+		s.started, s.nextSeq = true, seg.seq+1
+		return nil
+	}
+	if len(seg.payload) == 0 || s.broken {
+		return nil
+	}
+	if !s.started {
+		s.started, s.nextSeq = true, seg.seq
+	}
+	s.pending[seg.seq] = seg.payload
+	s.reassemble()
+
+	data, rest, err := splitFrames(s.buf)
+	if err != nil {
+		s.broken = true
+	}
+	s.buf = append([]byte(nil), rest...)
+
+	dir := dirUnknown
+	switch conn.client {
+	case "":
+	case src:
+		dir = dirRequest
+	default:
+		dir = dirResponse
+	}
+	frames := make([]frame, len(data))
+	for i, d := range data {
+		frames[i] = frame{Time: ts, Conn: conn.id, Dir: dir, Data: d}
+	}
+	return frames
+}
+
+// reassemble appends the pending segments that follow the stream to its
+// buffer, dropping retransmitted data.
+func (s *tcpStream) reassemble() {
+	for progress := true; progress; {
+		progress = false
+		for seq, payload := range s.pending {
+			offset := int32(s.nextSeq - seq)
+			if offset < 0 {
+				continue
+			}
+			delete(s.pending, seq)
+			if int(offset) < len(payload) {
+				s.buf = append(s.buf, payload[offset:]...)
+				s.nextSeq += uint32(len(payload)) - uint32(offset)
+				progress = true
+			}
+		}
+	}
+}
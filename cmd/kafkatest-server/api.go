@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/discord/zorkian-kafka/kafkatest"
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// api is the HTTP control API of the server.
+type api struct {
+	srv *kafkatest.Server
+
+	mu        sync.Mutex
+	faults    map[int]func()
+	nextFault int
+}
+
+func newAPI(srv *kafkatest.Server) *api {
+	return &api{
+		srv:       srv,
+		faults:    make(map[int]func()),
+		nextFault: 1,
+	}
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "" && r.Method == http.MethodGet:
+		a.srv.ServeHTTP(w, r)
+	case path[0] == "topics":
+		a.serveTopics(w, r, path[1:])
+	case path[0] == "offsets":
+		a.serveOffsets(w, r, path[1:])
+	case path[0] == "faults":
+		a.serveFaults(w, r, path[1:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *api) serveTopics(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case len(path) == 0 && r.Method == http.MethodDelete:
+		a.srv.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		a.srv.ResetTopic(path[0])
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && r.Method == http.MethodPost:
+		partition, err := parsePartition(path[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var msgs []message
+		if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+			http.Error(w, fmt.Sprintf("cannot decode messages: %s", err), http.StatusBadRequest)
+			return
+		}
+		a.srv.AddMessages(path[0], partition, protoMessages(msgs)...)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *api) serveOffsets(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) != 3 || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	partition, err := parsePartition(path[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, metadata, ok := a.srv.CommittedOffset(path[0], path[1], partition)
+	if !ok {
+		http.Error(w, "no committed offset", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"offset":   offset,
+		"metadata": metadata,
+	})
+}
+
+func (a *api) serveFaults(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case len(path) == 0 && r.Method == http.MethodPost:
+		var spec faultSpec
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			http.Error(w, fmt.Sprintf("cannot decode fault: %s", err), http.StatusBadRequest)
+			return
+		}
+		fault, err := spec.fault()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.mu.Lock()
+		id := a.nextFault
+		a.nextFault++
+		a.faults[id] = a.srv.AddFault(fault)
+		a.mu.Unlock()
+
+		writeJSON(w, http.StatusCreated, map[string]int{"id": id})
+	case len(path) == 0 && r.Method == http.MethodDelete:
+		a.mu.Lock()
+		a.srv.ClearFaults()
+		a.faults = make(map[int]func())
+		a.mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		id, _ := strconv.Atoi(path[0])
+
+		a.mu.Lock()
+		remove, ok := a.faults[id]
+		delete(a.faults, id)
+		a.mu.Unlock()
+
+		if !ok {
+			http.Error(w, "unknown fault", http.StatusNotFound)
+			return
+		}
+		remove()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// faultSpec is the JSON form of a kafkatest.Fault.
+type faultSpec struct {
+	Action      string  `json:"action"`
+	Kinds       []int16 `json:"kinds"`
+	Topic       string  `json:"topic"`
+	Partitions  []int32 `json:"partitions"`
+	Nodes       []int32 `json:"nodes"`
+	Probability float64 `json:"probability"`
+	Count       int     `json:"count"`
+	Delay       string  `json:"delay"`
+	Error       int16   `json:"error"`
+	TruncateTo  int     `json:"truncate_to"`
+}
+
+func (s faultSpec) fault() (kafkatest.Fault, error) {
+	f := kafkatest.Fault{
+		Kinds:       s.Kinds,
+		Topic:       s.Topic,
+		Partitions:  s.Partitions,
+		Nodes:       s.Nodes,
+		Probability: s.Probability,
+		Count:       s.Count,
+		TruncateTo:  s.TruncateTo,
+	}
+	for action := kafkatest.FaultDelay; action <= kafkatest.FaultHang; action++ {
+		if action.String() == s.Action {
+			f.Action = action
+		}
+	}
+	if f.Action == 0 {
+		return f, fmt.Errorf("unknown fault action %q", s.Action)
+	}
+	if s.Delay != "" {
+		delay, err := time.ParseDuration(s.Delay)
+		if err != nil {
+			return f, fmt.Errorf("invalid delay: %s", err)
+		}
+		f.Delay = delay
+	}
+	if s.Error != 0 {
+		kerr, ok := proto.ErrorFromNo(s.Error)
+		if !ok {
+			return f, fmt.Errorf("unknown kafka error %d", s.Error)
+		}
+		f.Err = kerr
+	}
+	return f, nil
+}
+
+func parsePartition(s string) (int32, error) {
+	partition, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || partition < 0 {
+		return 0, fmt.Errorf("invalid partition %q", s)
+	}
+	return int32(partition), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
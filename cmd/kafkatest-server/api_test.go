@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/kafkatest"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&APISuite{})
+
+type APISuite struct {
+	srv *kafkatest.Server
+	api *api
+}
+
+func (s *APISuite) SetUpSuite(c *C) {
+	kafkatest.SetLogger(kafka.NewStdLogger(stdlog.New(ioutil.Discard, "", 0), kafka.LogLevelError))
+}
+
+func (s *APISuite) SetUpTest(c *C) {
+	s.srv = kafkatest.NewServer()
+	s.srv.MustSpawn()
+	s.api = newAPI(s.srv)
+}
+
+func (s *APISuite) TearDownTest(c *C) {
+	_ = s.srv.Close()
+}
+
+func (s *APISuite) request(c *C, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.api.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// state returns the values of the messages of a partition from the state dump.
+func (s *APISuite) state(c *C, topic, partition string) []string {
+	w := s.request(c, "GET", "/", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var state struct {
+		Topics map[string]map[string][]*proto.Message
+	}
+	c.Assert(json.NewDecoder(w.Body).Decode(&state), IsNil)
+	var values []string
+	for _, msg := range state.Topics[topic][partition] {
+		values = append(values, string(msg.Value))
+	}
+	return values
+}
+
+// commit commits an offset for test:0 with a raw request, and returns the
+// error of the partition.
+func (s *APISuite) commit(c *C, offset int64) error {
+	conn, err := net.Dial("tcp", s.srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	req := &proto.OffsetCommitReq{
+		ConsumerGroup: "group",
+		Topics: []proto.OffsetCommitReqTopic{{
+			Name:       "test",
+			Partitions: []proto.OffsetCommitReqPartition{{ID: 0, Offset: offset, Metadata: "meta"}},
+		}},
+	}
+	_, err = req.WriteTo(conn)
+	c.Assert(err, IsNil)
+	_, b, err := proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+	resp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	return resp.Topics[0].Partitions[0].Err
+}
+
+func (s *APISuite) TestPreload(c *C) {
+	path := filepath.Join(c.MkDir(), "preload.json")
+	err := ioutil.WriteFile(path, []byte(`{"topics": {
+		"test": {"partitions": 2, "messages": {"1": [{"key": "a", "value": "first"}, {"value": null}]}},
+		"other": {}
+	}}`), 0644)
+	c.Assert(err, IsNil)
+	p, err := readPreload(path)
+	c.Assert(err, IsNil)
+	p.apply(s.srv)
+
+	c.Assert(s.state(c, "test", "0"), HasLen, 0)
+	c.Assert(s.state(c, "test", "1"), DeepEquals, []string{"first", ""})
+	w := s.request(c, "GET", "/", "")
+	c.Assert(w.Body.String(), Matches, `(?s).*"other":\{"0":\[\]\}.*`)
+
+	for _, content := range []string{
+		`{"topics": {"test": {"messages": {"1": []}}}}`,
+		`{"topics": {"test": {"partitions": 2, "messages": {"01": []}}}}`,
+		`{"topics": {"test": {"partitions": -1}}}`,
+		`{"topic": {}}`,
+	} {
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		_, err = readPreload(path)
+		c.Assert(err, NotNil, Commentf("%s", content))
+	}
+	_, err = readPreload(filepath.Join(c.MkDir(), "missing.json"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *APISuite) TestPreloadYAML(c *C) {
+	path := filepath.Join(c.MkDir(), "preload.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+topics:
+  test:
+    partitions: 2
+    messages:
+      1:
+        - {key: a, value: first}
+        - value: null
+  other: {}
+`), 0644)
+	c.Assert(err, IsNil)
+	p, err := readPreload(path)
+	c.Assert(err, IsNil)
+	p.apply(s.srv)
+
+	c.Assert(s.state(c, "test", "0"), HasLen, 0)
+	c.Assert(s.state(c, "test", "1"), DeepEquals, []string{"first", ""})
+	w := s.request(c, "GET", "/", "")
+	c.Assert(w.Body.String(), Matches, `(?s).*"other":\{"0":\[\]\}.*`)
+
+	for _, content := range []string{
+		"topics: {test: {partitions: 2, messages: {2: []}}}",
+		"topics: {test: {partitions: -1}}",
+		"topic: {}",
+		"topics: [",
+	} {
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		_, err = readPreload(path)
+		c.Assert(err, NotNil, Commentf("%s", content))
+	}
+}
+
+func (s *APISuite) TestTopics(c *C) {
+	w := s.request(c, "POST", "/topics/test/0", `[{"value": "a"}, {"key": "k", "value": "b"}]`)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+	c.Assert(s.request(c, "POST", "/topics/other/0", `[{"value": "c"}]`).Code, Equals, http.StatusNoContent)
+	c.Assert(s.state(c, "test", "0"), DeepEquals, []string{"a", "b"})
+
+	c.Assert(s.request(c, "POST", "/topics/test/x", `[]`).Code, Equals, http.StatusBadRequest)
+	c.Assert(s.request(c, "POST", "/topics/test/0", `{`).Code, Equals, http.StatusBadRequest)
+
+	c.Assert(s.request(c, "DELETE", "/topics/test", "").Code, Equals, http.StatusNoContent)
+	c.Assert(s.state(c, "test", "0"), HasLen, 0)
+	c.Assert(s.state(c, "other", "0"), DeepEquals, []string{"c"})
+
+	c.Assert(s.request(c, "DELETE", "/topics", "").Code, Equals, http.StatusNoContent)
+	c.Assert(s.state(c, "other", "0"), HasLen, 0)
+}
+
+func (s *APISuite) TestOffsets(c *C) {
+	c.Assert(s.request(c, "GET", "/offsets/group/test/0", "").Code, Equals, http.StatusNotFound)
+	c.Assert(s.commit(c, 42), IsNil)
+
+	w := s.request(c, "GET", "/offsets/group/test/0", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, `{"metadata":"meta","offset":42}`+"\n")
+	c.Assert(s.request(c, "GET", "/offsets/other/test/0", "").Code, Equals, http.StatusNotFound)
+}
+
+func (s *APISuite) TestFaults(c *C) {
+	w := s.request(c, "POST", "/faults", `{"action": "error", "kinds": [8], "error": 16}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	c.Assert(w.Body.String(), Equals, `{"id":1}`+"\n")
+	c.Assert(s.commit(c, 1), Equals, proto.ErrNotCoordinator)
+
+	c.Assert(s.request(c, "DELETE", "/faults/1", "").Code, Equals, http.StatusNoContent)
+	c.Assert(s.request(c, "DELETE", "/faults/1", "").Code, Equals, http.StatusNotFound)
+	c.Assert(s.commit(c, 1), IsNil)
+
+	w = s.request(c, "POST", "/faults", `{"action": "error", "kinds": [8]}`)
+	c.Assert(w.Body.String(), Equals, `{"id":2}`+"\n")
+	c.Assert(s.commit(c, 1), Equals, proto.ErrUnknown)
+	c.Assert(s.request(c, "DELETE", "/faults", "").Code, Equals, http.StatusNoContent)
+	c.Assert(s.commit(c, 1), IsNil)
+
+	for _, body := range []string{
+		`{"action": "explode"}`,
+		`{"action": "delay", "delay": "soon"}`,
+		`{"action": "error", "error": 1000}`,
+		`{"action": "error", "err": 1}`,
+	} {
+		w = s.request(c, "POST", "/faults", body)
+		c.Assert(w.Code, Equals, http.StatusBadRequest, Commentf("%s", body))
+	}
+}
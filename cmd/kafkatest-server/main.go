@@ -0,0 +1,80 @@
+/*
+Command kafkatest-server runs a kafkatest.Server as a standalone process, so
+that tests written in other languages can use it as a stand-in kafka broker.
+
+Usage:
+
+	kafkatest-server [-addr 127.0.0.1:9092] [-http 127.0.0.1:9093] [-preload topics.json]
+
+The server advertises the host and port it listens on in metadata responses,
+so addr must be reachable by the clients.
+
+The file given with -preload creates topics before the server starts. It is
+decoded as YAML if its extension is .yaml or .yml, and as JSON otherwise:
+
+	{
+	  "topics": {
+	    "events": {
+	      "partitions": 2,
+	      "messages": {"0": [{"key": "a", "value": "first"}, {"value": "second"}]}
+	    }
+	  }
+	}
+
+or, in YAML:
+
+	topics:
+	  events:
+	    partitions: 2
+	    messages:
+	      "0":
+	        - {key: a, value: first}
+	        - value: second
+
+The server is controlled with the following HTTP endpoints:
+
+	GET    /                                server state, see kafkatest.Server.ServeHTTP
+	POST   /topics/{topic}/{partition}      append the JSON list of messages in the body
+	DELETE /topics                          remove all topics and committed offsets
+	DELETE /topics/{topic}                  remove the messages and committed offsets of a topic
+	GET    /offsets/{group}/{topic}/{part}  offset and metadata committed by a group
+	POST   /faults                          inject the fault in the body, returns its id
+	DELETE /faults                          remove all faults
+	DELETE /faults/{id}                     remove a fault
+
+Faults are JSON objects with the fields of kafkatest.Fault in snake case. The
+action is the name of a kafkatest.FaultAction, the delay a duration such as
+"100ms" and the error a kafka error code:
+
+	{"action": "error", "kinds": [1], "topic": "events", "error": 6, "count": 2}
+*/
+package main
+
+import (
+	"flag"
+	stdlog "log"
+	"net/http"
+
+	"github.com/discord/zorkian-kafka/kafkatest"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9092", "address of the kafka server")
+	httpAddr := flag.String("http", "127.0.0.1:9093", "address of the HTTP control API")
+	preloadPath := flag.String("preload", "", "JSON or YAML file with the topics to create")
+	flag.Parse()
+
+	srv := kafkatest.NewServer()
+	if *preloadPath != "" {
+		p, err := readPreload(*preloadPath)
+		if err != nil {
+			stdlog.Fatalf("cannot read %s: %s", *preloadPath, err)
+		}
+		p.apply(srv)
+	}
+
+	go func() {
+		stdlog.Fatal(http.ListenAndServe(*httpAddr, newAPI(srv)))
+	}()
+	stdlog.Fatal(srv.Run(*addr))
+}
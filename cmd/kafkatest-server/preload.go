@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/discord/zorkian-kafka/kafkatest"
+	"github.com/discord/zorkian-kafka/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// preload is the content of the file given with -preload.
+type preload struct {
+	Topics map[string]topicPreload `json:"topics" yaml:"topics"`
+}
+
+type topicPreload struct {
+	// Partitions is the number of partitions of the topic, 1 if unset.
+	Partitions int32 `json:"partitions" yaml:"partitions"`
+	// Messages are the messages of each partition, keyed by partition ID.
+	Messages map[string][]message `json:"messages" yaml:"messages"`
+}
+
+// message is the JSON or YAML form of a message. Keys and values are strings,
+// and a null value is a tombstone.
+type message struct {
+	Key   *string `json:"key" yaml:"key"`
+	Value *string `json:"value" yaml:"value"`
+}
+
+func (m message) proto() *proto.Message {
+	msg := &proto.Message{}
+	if m.Key != nil {
+		msg.Key = []byte(*m.Key)
+	}
+	if m.Value != nil {
+		msg.Value = []byte(*m.Value)
+	}
+	return msg
+}
+
+func protoMessages(msgs []message) []*proto.Message {
+	res := make([]*proto.Message, len(msgs))
+	for i, m := range msgs {
+		res[i] = m.proto()
+	}
+	return res
+}
+
+// readPreload reads and validates a preload file. Files with a .yaml or .yml
+// extension are decoded as YAML, others as JSON.
+func readPreload(path string) (*preload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p preload
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(&p)
+	default:
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode: %s", err)
+	}
+	for name, topic := range p.Topics {
+		if topic.Partitions < 0 {
+			return nil, fmt.Errorf("topic %s: invalid number of partitions %d", name, topic.Partitions)
+		}
+		for part := range topic.Messages {
+			id, err := strconv.ParseInt(part, 10, 32)
+			if err != nil || strconv.Itoa(int(id)) != part || id < 0 || id >= int64(topic.partitions()) {
+				return nil, fmt.Errorf("topic %s: invalid partition %q", name, part)
+			}
+		}
+	}
+	return &p, nil
+}
+
+func (t topicPreload) partitions() int32 {
+	if t.Partitions == 0 {
+		return 1
+	}
+	return t.Partitions
+}
+
+// apply creates the topics of the preload file in the server, in name order.
+func (p *preload) apply(srv *kafkatest.Server) {
+	names := make([]string, 0, len(p.Topics))
+	for name := range p.Topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		topic := p.Topics[name]
+		for part := int32(0); part < topic.partitions(); part++ {
+			msgs := topic.Messages[strconv.Itoa(int(part))]
+			srv.AddMessages(name, part, protoMessages(msgs)...)
+		}
+	}
+}
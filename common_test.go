@@ -1,13 +1,35 @@
 package kafka
 
 import (
+	"errors"
 	"testing"
 
-	"github.com/op/go-logging"
 	"gopkg.in/check.v1"
 )
 
 func Test(t *testing.T) {
-	logging.SetLevel(logging.CRITICAL, "KafkaClient") // Suppress logs in tests.
+	logTest.SetQuiet(true) // Suppress logs in tests.
 	check.TestingT(t)
 }
+
+// ErrorIs checks that the obtained error matches the expected one with
+// errors.Is, so that wrapped errors can be compared to their cause.
+var ErrorIs check.Checker = &errorIsChecker{
+	&check.CheckerInfo{Name: "ErrorIs", Params: []string{"obtained", "expected"}},
+}
+
+type errorIsChecker struct {
+	*check.CheckerInfo
+}
+
+func (checker *errorIsChecker) Check(params []interface{}, names []string) (bool, string) {
+	obtained, ok := params[0].(error)
+	if !ok {
+		return false, "obtained value is not an error"
+	}
+	expected, ok := params[1].(error)
+	if !ok {
+		return false, "expected value is not an error"
+	}
+	return errors.Is(obtained, expected), ""
+}
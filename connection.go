@@ -3,9 +3,9 @@ package kafka
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"net"
 	"sync/atomic"
@@ -17,26 +17,48 @@ import (
 // ErrClosed is returned as result of any request made using closed connection.
 var ErrClosed = errors.New("closed")
 
-type readResp struct {
-	bytes *bytes.Reader
-	err   error
-}
-
 // Low level abstraction over connection to Kafka. This structure is NOT THREAD
 // SAFE and must be only owned by one caller at a time.
 type connection struct {
 	addr      string
 	startTime time.Time
-	rw        io.ReadWriteCloser
+	rw        net.Conn
 	rd        *bufio.Reader
 	rnd       *rand.Rand
 	timeout   time.Duration
 	closed    *int32
+	metrics   Metrics
+	logger    Logger
+
+	// breaker, if set, is told about the outcome of every request.
+	breaker *circuitBreaker
+
+	// idleSince is when the connection was last returned to its pool.
+	idleSince time.Time
+}
+
+// Dialer establishes the network connections to Kafka brokers. *net.Dialer
+// implements it, as do most proxy dialers, such as the ones returned by
+// golang.org/x/net/proxy.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
-// newConnection returns new, initialized connection or error
-func newTCPConnection(address string, timeout time.Duration) (*connection, error) {
-	conn, err := net.DialTimeout("tcp", address, timeout)
+// dialerOrDefault returns d, or a plain net.Dialer if d is nil.
+func dialerOrDefault(d Dialer) Dialer {
+	if d == nil {
+		return &net.Dialer{}
+	}
+	return d
+}
+
+// newConnection returns new, initialized connection or error. The connection
+// is established with the given dialer, which must return within timeout.
+func newConnection(dialer Dialer, address string, timeout time.Duration) (*connection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +73,8 @@ func newTCPConnection(address string, timeout time.Duration) (*connection, error
 		closed:    new(int32),
 		startTime: time.Now(),
 		timeout:   timeout,
+		metrics:   NopMetrics{},
+		logger:    log,
 	}
 	return c, nil
 }
@@ -74,33 +98,57 @@ func (c *connection) Close() error {
 	return nil
 }
 
-// sendRequest calls sendRequestHelper with timeout, closing the connection if it is hit.
+// requestTimeout returns how long a request may take, from the moment it is
+// written until its response is read. Requests that the broker holds on
+// purpose, such as fetches waiting for data or produces waiting for acks, get
+// that time on top.
+func (c *connection) requestTimeout(req proto.Request) time.Duration {
+	timeout := 2 * c.timeout
+	switch req := req.(type) {
+	case *proto.FetchReq:
+		timeout += req.MaxWaitTime
+	case *proto.ProduceReq:
+		timeout += req.Timeout
+	}
+	return timeout
+}
+
+// sendRequest writes the request and reads its response, with the socket
+// deadline set from requestTimeout. The connection is closed on any error.
 func (c *connection) sendRequest(req proto.Request, reqID int32) (*bytes.Reader, error) {
-	readRespChan := make(chan readResp, 1)
-	go func() {
-		bytes, err := c.sendRequestHelper(req, reqID)
-		readRespChan <- readResp{bytes, err}
-	}()
-	select {
-	case result := <-readRespChan:
-		if result.err != nil {
-			c.Close()
-		}
-		return result.bytes, result.err
-	case <-time.After(2 * c.timeout):
-		_ = c.Close()
-		log.Warning("sendRequest hit timeout")
+	api := requestKindName(req)
+	defer observeDuration(c.metrics, "kafka_request_duration_seconds", time.Now(),
+		"api", api, "broker", c.addr)
+
+	timeout := c.requestTimeout(req)
+	b, err := c.sendRequestHelper(req, reqID, timeout)
+	if err == nil {
+		c.breaker.Success()
+		return b, nil
+	}
+
+	c.metrics.Counter("kafka_request_errors_total", 1, "api", api, "broker", c.addr)
+	c.breaker.Failure()
+	_ = c.Close()
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.logger.Warn("request timed out", "api", api, "broker", c.addr, "timeout", timeout)
 		return nil, proto.ErrRequestTimeout
 	}
+	return nil, err
 }
 
 // sendRequestHelper handles the raw material of sending a request up to Kafka and
 // receiving the response.
-func (c *connection) sendRequestHelper(req proto.Request, reqID int32) (
+func (c *connection) sendRequestHelper(req proto.Request, reqID int32, timeout time.Duration) (
 	*bytes.Reader, error) {
 
+	if err := c.rw.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
 	if _, err := req.WriteTo(c.rw); err != nil {
-		log.Errorf("cannot write: %s", err)
+		c.logger.Error("cannot write request", "broker", c.addr, "err", err)
 		return nil, err
 	}
 
@@ -108,7 +156,6 @@ func (c *connection) sendRequestHelper(req proto.Request, reqID int32) (
 		return nil, err
 	} else {
 		if correlationID != reqID {
-			_ = c.Close()
 			return nil, fmt.Errorf("got unexpected correlation ID %d instead of %d",
 				correlationID, reqID)
 		}
@@ -126,7 +173,7 @@ func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, erro
 	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
 		return nil, err
 	} else {
-		return proto.ReadMetadataResp(b)
+		return proto.ReadVersionedMetadataResp(b, req.Version)
 	}
 }
 
@@ -142,6 +189,9 @@ func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error)
 	// This sad, dumb degenerate case is one where the server will never send us
 	// a response. We write blindly and return.
 	if req.RequiredAcks == proto.RequiredAcksNone {
+		if err := c.rw.SetWriteDeadline(time.Now().Add(2 * c.timeout)); err != nil {
+			return nil, err
+		}
 		_, err := req.WriteTo(c.rw)
 		return nil, err
 	}
@@ -165,7 +215,7 @@ func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
 	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
 		return nil, err
 	} else {
-		if resp, err = proto.ReadFetchResp(b); err != nil {
+		if resp, err = proto.ReadVersionedFetchResp(b, req.Version); err != nil {
 			return nil, err
 		}
 	}
@@ -207,7 +257,7 @@ func (c *connection) Offset(req *proto.OffsetReq) (*proto.OffsetResp, error) {
 	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
 		return nil, err
 	} else {
-		return proto.ReadOffsetResp(b)
+		return proto.ReadVersionedOffsetResp(b, req.Version)
 	}
 }
 
@@ -8,6 +8,9 @@ import (
 type connectionPoolCache struct {
 	lock              sync.Mutex
 	connectionPoolMap map[string]*connectionPool
+	// refs counts the users of every cached ConnectionPool, which is closed
+	// once the last of them releases it.
+	refs map[string]int
 }
 
 // connectionPoolCache is a threadsafe cache of ConnectionPool by clientID.  One connectionPoolCache
@@ -18,6 +21,7 @@ func newConnPoolCache() *connectionPoolCache {
 	return &connectionPoolCache{
 		lock:              sync.Mutex{},
 		connectionPoolMap: make(map[string]*connectionPool),
+		refs:              make(map[string]int),
 	}
 
 }
@@ -31,17 +35,38 @@ func (c *connectionPoolCache) getOrCreateConnectionPool(
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	log.Infof("Retrieving connection pool for clientID %s from LockingMap", clientID)
+	logger := loggerOrDefault(conf.logger)
+	logger.Info("retrieving connection pool from cache", "client", clientID)
 	if connectionPool, ok := c.connectionPoolMap[clientID]; ok {
+		c.refs[clientID]++
 		return connectionPool, nil
 	}
-	log.Infof("ConnectionPool for cluster %s being created.", nodeAddresses)
+	logger.Info("creating connection pool", "client", clientID, "addrs", nodeAddresses)
 
 	connPool := newConnectionPool(conf, nodeAddresses)
 	c.connectionPoolMap[clientID] = connPool
+	c.refs[clientID] = 1
 	return connPool, nil
 }
 
+// releaseConnectionPool releases a ConnectionPool returned by getOrCreateConnectionPool. The
+// last release removes it from the cache and closes it.
+func (c *connectionPoolCache) releaseConnectionPool(clientID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	connPool, ok := c.connectionPoolMap[clientID]
+	if !ok {
+		return
+	}
+	if c.refs[clientID]--; c.refs[clientID] > 0 {
+		return
+	}
+	delete(c.connectionPoolMap, clientID)
+	delete(c.refs, clientID)
+	connPool.Close()
+}
+
 func (c *connectionPoolCache) reinitializeAddrs(nodeAddresses []string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -2,6 +2,8 @@ package kafka
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"sync"
 	"time"
 )
@@ -20,6 +22,14 @@ type backend struct {
 	addr    string
 	channel chan *connection
 
+	// breaker is shared by all connections to this backend. It is nil if
+	// circuit breaking is disabled.
+	breaker *circuitBreaker
+
+	// stop is closed by Close to terminate the reaper, if any.
+	stop     chan struct{}
+	stopOnce *sync.Once
+
 	// Used for storing links to all connections we ever make, this is a debugging
 	// tool to try to help find leaks of connections. All access is protected by mu.
 	mu             *sync.Mutex
@@ -32,13 +42,16 @@ type backend struct {
 // getIdleConnection returns a connection if and only if there is an active, idle connection
 // that already exists.
 func (b *backend) GetIdleConnection() *connection {
+	if b.breaker.State() == CircuitOpen {
+		return nil
+	}
 	for {
 		select {
 		case conn := <-b.channel:
-			if !conn.IsClosed() {
+			if b.usable(conn, time.Now()) {
 				return conn
 			}
-			b.removeConnection(conn)
+			b.discardConnection(conn)
 
 		default:
 			return nil
@@ -46,6 +59,30 @@ func (b *backend) GetIdleConnection() *connection {
 	}
 }
 
+// usable returns whether an idle connection can still be handed out, that is
+// if it's open and hasn't exceeded MaxConnectionLifetime or MaxIdleTime.
+func (b *backend) usable(conn *connection, now time.Time) bool {
+	if conn.IsClosed() {
+		return false
+	}
+	if b.conf.MaxConnectionLifetime > 0 &&
+		now.Sub(conn.StartTime()) >= b.conf.MaxConnectionLifetime {
+		return false
+	}
+	if b.conf.MaxIdleTime > 0 && !conn.idleSince.IsZero() &&
+		now.Sub(conn.idleSince) >= b.conf.MaxIdleTime {
+		return false
+	}
+	return true
+}
+
+// discardConnection closes a connection taken out of the idle channel and
+// stops tracking it.
+func (b *backend) discardConnection(conn *connection) {
+	_ = conn.Close()
+	b.removeConnection(conn)
+}
+
 // GetConnection does a full connection logic: attempt to return an idle connection, if
 // none are available then wait for up to the IdleConnectionWait time for one, else finally
 // establish a new connection if we aren't at the limit. If we are, then continue waiting
@@ -53,12 +90,17 @@ func (b *backend) GetIdleConnection() *connection {
 // a new connection. This could potentially block up to twice the DialTimeout.
 //
 // If the error returned is NoConnectionsAvailable, the caller should treat it as transient
-// and not consider the backend/addr unhealthy.
+// and not consider the backend/addr unhealthy. If it is CircuitOpenError, the backend
+// failed repeatedly and was not tried.
 func (b *backend) GetConnection() (*connection, error) {
+	if !b.breaker.Allow() {
+		return nil, &CircuitOpenError{Broker: b.addr}
+	}
+	defer observeDuration(b.conf.metrics, "kafka_pool_wait_seconds", time.Now(), "broker", b.addr)
 	// dialTimeout must be longer than the configured timeout from the user to
 	// differentiate the case where 'the pool is full' and 'the remote server is
 	// not responding'. Since the b.conf.DialTimeout is used by the underlying
-	// newTCPConnection method, we need to still be alive and waiting if it returns
+	// newConnection method, we need to still be alive and waiting if it returns
 	// an error at that point -- hence waiting for twice the configured timeout
 	// in this method.
 	dialTimeout := time.After(2 * b.conf.DialTimeout)
@@ -74,10 +116,10 @@ func (b *backend) GetConnection() (*connection, error) {
 		// Optimal case: a connection is immediately available in the the channel
 		// where we keep idle connections.
 		case conn := <-b.channel:
-			if !conn.IsClosed() {
+			if b.usable(conn, time.Now()) {
 				return conn, nil
 			}
-			b.removeConnection(conn)
+			b.discardConnection(conn)
 
 		// Wait a small amount of time for an idle connection. If nothing arrives,
 		// attempt to make a new connection. This might fail if we're at the connection
@@ -104,11 +146,11 @@ func (b *backend) debugHitMaxConnections() {
 	}
 	b.debugTime = now.Add(30 * time.Second)
 
-	log.Debugf("DEBUG: hit max connections (%d, %d, now %d times)",
-		b.counter, len(b.conns), b.debugNumHitMax)
+	b.conf.logger.Debug("hit max connections", "broker", b.addr,
+		"counter", b.counter, "conns", len(b.conns), "times", b.debugNumHitMax)
 	for idx, conn := range b.conns {
-		log.Debugf("DEBUG: connection %d: addr=%s, closed=%v, age=%s",
-			idx, conn.addr, conn.IsClosed(), now.Sub(conn.StartTime()))
+		b.conf.logger.Debug("connection at max connections", "broker", conn.addr,
+			"index", idx, "closed", conn.IsClosed(), "age", now.Sub(conn.StartTime()))
 	}
 }
 
@@ -142,16 +184,31 @@ func (b *backend) getNewConnection() (*connection, error) {
 		// counter and move forward with setup
 		b.conns = newConns
 		b.counter = len(newConns)
+		b.reportOpenConnections()
 	}
 
-	conn, err := newTCPConnection(b.addr, b.conf.DialTimeout)
-	if err == nil {
+	// A successful dial doesn't close the circuit breaker: half-dead brokers often
+	// accept connections and then never answer, so only requests count as successes.
+	conn, err := newConnection(b.conf.Dialer, b.addr, b.conf.DialTimeout)
+	if err != nil {
+		b.breaker.Failure()
+	} else {
+		conn.metrics = b.conf.metrics
+		conn.logger = b.conf.logger
+		conn.breaker = b.breaker
 		b.counter++
 		b.conns = append(b.conns, conn)
+		b.reportOpenConnections()
 	}
 	return conn, err
 }
 
+// reportOpenConnections updates the open connections gauge. Must be called with
+// the mutex held.
+func (b *backend) reportOpenConnections() {
+	b.conf.metrics.Gauge("kafka_pool_open_connections", float64(b.counter), "broker", b.addr)
+}
+
 // removeConnection removes the given connection from our tracking. It also decrements the
 // open connection count. This takes the mutex.
 func (b *backend) removeConnection(conn *connection) {
@@ -162,6 +219,7 @@ func (b *backend) removeConnection(conn *connection) {
 		if c == conn {
 			b.counter--
 			b.conns = append(b.conns[0:idx], b.conns[idx+1:]...)
+			b.reportOpenConnections()
 			return
 		}
 	}
@@ -176,18 +234,35 @@ func (b *backend) Idle(conn *connection) {
 		return
 	}
 
+	conn.idleSince = time.Now()
 	select {
 	case b.channel <- conn:
 		// Do nothing, connection was requeued.
 	default:
 		// In theory this can never happen because it means we allocated more connections than
 		// the ConnectionLimit allows.
-		log.Warningf("connection pool with excess connections, closing: %s", b.addr)
+		b.conf.logger.Warn("connection pool with excess connections, closing", "broker", b.addr)
 		b.removeConnection(conn)
 		_ = conn.Close()
 	}
 }
 
+// CircuitState returns the state of the backend's circuit breaker.
+func (b *backend) CircuitState() CircuitState {
+	return b.breaker.State()
+}
+
+// reportCircuitState logs and reports a change of the circuit breaker state.
+func (b *backend) reportCircuitState(state CircuitState) {
+	b.conf.metrics.Gauge("kafka_circuit_state", float64(state), "broker", b.addr)
+	if state == CircuitOpen {
+		b.conf.logger.Warn("circuit breaker opened", "broker", b.addr,
+			"cooldown", b.conf.CircuitBreakerCooldown)
+	} else {
+		b.conf.logger.Info("circuit breaker changed state", "broker", b.addr, "state", state)
+	}
+}
+
 // NumOpenConnections returns a counter of how may connections are open.
 func (b *backend) NumOpenConnections() int {
 	b.mu.Lock()
@@ -196,8 +271,98 @@ func (b *backend) NumOpenConnections() int {
 	return b.counter
 }
 
+// reapInterval returns how often the reaper should run, or 0 if it isn't
+// needed.
+func (b *backend) reapInterval() time.Duration {
+	var interval time.Duration
+	for _, d := range []time.Duration{b.conf.MaxConnectionLifetime, b.conf.MaxIdleTime} {
+		if d > 0 && (interval == 0 || d/2 < interval) {
+			interval = d / 2
+		}
+	}
+	if interval == 0 && b.conf.MinIdleConnections > 0 {
+		interval = 10 * time.Second
+	}
+	if interval > 0 && interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// reap runs until the backend is closed, periodically closing the idle
+// connections that are no longer usable and opening new ones to keep
+// MinIdleConnections.
+func (b *backend) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.reapIdleConnections()
+			b.warmUp()
+		}
+	}
+}
+
+// reapIdleConnections checks every connection currently idle once, closing
+// the expired ones and requeueing the others.
+func (b *backend) reapIdleConnections() {
+	now := time.Now()
+	for i := len(b.channel); i > 0; i-- {
+		var conn *connection
+		select {
+		case conn = <-b.channel:
+		default:
+			return
+		}
+
+		if !b.usable(conn, now) {
+			b.conf.logger.Debug("closing expired connection", "broker", b.addr,
+				"age", now.Sub(conn.StartTime()), "idle", now.Sub(conn.idleSince))
+			b.discardConnection(conn)
+			continue
+		}
+		select {
+		case b.channel <- conn:
+		default:
+			b.discardConnection(conn)
+		}
+	}
+}
+
+// warmUp opens connections until MinIdleConnections are open, never going
+// above ConnectionLimit.
+func (b *backend) warmUp() {
+	min := b.conf.MinIdleConnections
+	if min > b.conf.ConnectionLimit {
+		min = b.conf.ConnectionLimit
+	}
+	for b.NumOpenConnections() < min && b.breaker.State() == CircuitClosed {
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+
+		conn, err := b.getNewConnection()
+		if err != nil {
+			b.conf.logger.Debug("cannot open warm connection", "broker", b.addr, "err", err)
+			return
+		}
+		if conn == nil {
+			return
+		}
+		b.Idle(conn)
+	}
+}
+
 // Close shuts down all connections.
 func (b *backend) Close() {
+	b.stopOnce.Do(func() { close(b.stop) })
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -205,6 +370,7 @@ func (b *backend) Close() {
 		_ = conn.Close()
 	}
 	b.counter = 0
+	b.reportOpenConnections()
 }
 
 // ClusterConnectionConf is configuration for the cluster connection pool.
@@ -261,6 +427,79 @@ type ClusterConnectionConf struct {
 	//
 	// Defaults to 0 which means disabled.
 	MetadataRefreshFrequency time.Duration
+
+	// MetadataVersion is the version of the Metadata API used to discover the
+	// cluster, up to proto.MetadataMaxVersion. Version 1 and above require
+	// Kafka 0.10.0 and report the controller, broker racks and internal
+	// topics; see Cluster.ControllerID and Cluster.GetNodeRack.
+	//
+	// Defaults to 0.
+	MetadataVersion int16
+
+	// IncrementalMetadataRefresh makes the metadata refreshes triggered by
+	// errors such as ErrNotLeaderForPartition only request the affected
+	// topic, instead of all topics of the cluster. Set MetadataRefreshFrequency
+	// to keep refreshing everything periodically, as topic refreshes don't
+	// notice removed brokers.
+	//
+	// Defaults to false.
+	IncrementalMetadataRefresh bool
+
+	// Dialer is used to establish every connection to the cluster, for
+	// example to go through a SOCKS proxy or a sidecar listening on a Unix
+	// socket. It is always called with the "tcp" network and the broker
+	// address; DialTimeout is enforced through the context.
+	//
+	// Defaults to a net.Dialer.
+	Dialer Dialer
+
+	// MaxConnectionLifetime is how long a connection may be reused after it
+	// was established. Older connections are closed by a background reaper
+	// while idle, or when they are checked out, and replaced by new ones.
+	//
+	// Defaults to 0 which means no limit.
+	MaxConnectionLifetime time.Duration
+
+	// MaxIdleTime is how long a connection may stay unused in the pool before
+	// it is closed, so that sockets dropped by brokers or middleboxes are
+	// noticed before a request is sent on them.
+	//
+	// Defaults to 0 which means no limit.
+	MaxIdleTime time.Duration
+
+	// MinIdleConnections is the number of connections the background reaper
+	// keeps open to every known broker, to avoid paying the dial latency on
+	// the first requests. It is capped at ConnectionLimit.
+	//
+	// Defaults to 0.
+	MinIdleConnections int
+
+	// CircuitBreakerThreshold is the number of consecutive failed dials or
+	// requests after which a broker is considered down. Connections to it then
+	// fail immediately with a CircuitOpenError, shared by every user of the
+	// cluster, until CircuitBreakerCooldown has passed. A single probe is then
+	// let through: its success closes the circuit, its failure opens it again.
+	//
+	// Defaults to 0 which means disabled.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown is how long an open circuit fails fast before
+	// the broker is probed again.
+	//
+	// Defaults to 10 seconds.
+	CircuitBreakerCooldown time.Duration
+
+	// BrokerAddress, if set, maps the host and port advertised by a broker in
+	// metadata and group coordinator responses to the address that is
+	// dialed. Use it when brokers advertise hosts that aren't reachable from
+	// the client. The addresses given to NewBroker are used as-is.
+	//
+	// Defaults to nil, which dials host:port.
+	BrokerAddress func(nodeID int32, host string, port int32) string
+
+	// metrics and logger are set from BrokerConf by NewBroker.
+	metrics Metrics
+	logger  Logger
 }
 
 // NewClusterConnectionConf constructs a default configuration.
@@ -273,7 +512,18 @@ func NewClusterConnectionConf() ClusterConnectionConf {
 		DialRetryWait:            500 * time.Millisecond,
 		MetadataRefreshTimeout:   30 * time.Second,
 		MetadataRefreshFrequency: 0,
+		Dialer:                   &net.Dialer{},
+		CircuitBreakerCooldown:   10 * time.Second,
+	}
+}
+
+// brokerAddress returns the address to dial for a broker advertising the
+// given host and port.
+func (conf ClusterConnectionConf) brokerAddress(nodeID int32, host string, port int32) string {
+	if conf.BrokerAddress != nil {
+		return conf.BrokerAddress(nodeID, host, port)
 	}
+	return fmt.Sprintf("%s:%d", host, port)
 }
 
 // ConnectionPool is a way for us to manage multiple connections to a Kafka broker in a way
@@ -293,6 +543,12 @@ type connectionPool struct {
 
 // newConnectionPool creates a connection pool and initializes it.
 func newConnectionPool(conf ClusterConnectionConf, nodes []string) *connectionPool {
+	conf.metrics = metricsOrNop(conf.metrics)
+	conf.logger = loggerOrDefault(conf.logger)
+	conf.Dialer = dialerOrDefault(conf.Dialer)
+	if conf.CircuitBreakerCooldown <= 0 {
+		conf.CircuitBreakerCooldown = 10 * time.Second
+	}
 	connPool := connectionPool{
 		conf:     conf,
 		mu:       &sync.RWMutex{},
@@ -306,12 +562,20 @@ func newConnectionPool(conf ClusterConnectionConf, nodes []string) *connectionPo
 
 // newBackend creates a new backend structure.
 func (cp *connectionPool) newBackend(addr string) *backend {
-	return &backend{
-		mu:      &sync.Mutex{},
-		conf:    cp.conf,
-		addr:    addr,
-		channel: make(chan *connection, cp.conf.ConnectionLimit),
+	be := &backend{
+		mu:       &sync.Mutex{},
+		conf:     cp.conf,
+		addr:     addr,
+		channel:  make(chan *connection, cp.conf.ConnectionLimit),
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+	be.breaker = newCircuitBreaker(cp.conf.CircuitBreakerThreshold,
+		cp.conf.CircuitBreakerCooldown, be.reportCircuitState)
+	if interval := be.reapInterval(); interval > 0 {
+		go be.reap(interval)
 	}
+	return be
 }
 
 // getBackend fetches a backend for a given address or nil if none exists.
@@ -352,12 +616,12 @@ func (cp *connectionPool) InitializeAddrs(addrs []string) {
 	for _, addr := range addrs {
 		delete(deletedAddrs, addr)
 		if _, ok := cp.backends[addr]; !ok {
-			log.Infof("Initializing backend to addr: %s", addr)
+			cp.conf.logger.Info("initializing backend", "broker", addr)
 			cp.backends[addr] = cp.newBackend(addr)
 		}
 	}
 	for addr := range deletedAddrs {
-		log.Warningf("Removing backend for addr: %s", addr)
+		cp.conf.logger.Warn("removing backend", "broker", addr)
 		if backend, ok := cp.backends[addr]; ok {
 			backend.Close()
 			delete(cp.backends, addr)
@@ -380,6 +644,19 @@ func (cp *connectionPool) GetIdleConnection() *connection {
 	return nil
 }
 
+// CircuitStates returns the state of the circuit breaker of every backend,
+// keyed by address.
+func (cp *connectionPool) CircuitStates() map[string]CircuitState {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	states := make(map[string]CircuitState, len(cp.backends))
+	for addr, backend := range cp.backends {
+		states[addr] = backend.CircuitState()
+	}
+	return states
+}
+
 // GetConnectionByAddr takes an address and returns a valid/open connection to this server.
 // We attempt to reuse connections if we can, but if a connection is not available within
 // IdleConnectionWait then we'll establish a new one. This can block a long time.
@@ -406,3 +683,15 @@ func (cp *connectionPool) Idle(conn *connection) {
 		_ = conn.Close()
 	}
 }
+
+// Close shuts down all backends, closing their connections and stopping their
+// reapers.
+func (cp *connectionPool) Close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	for addr, backend := range cp.backends {
+		backend.Close()
+		delete(cp.backends, addr)
+	}
+}
@@ -142,3 +142,90 @@ func (s *ConnectionPoolSuite) TestTrimDeadAddrs(c *C) {
 	c.Assert(cp.getBackend("qux"), NotNil)
 	c.Assert(cp.getBackend("foo"), IsNil)
 }
+
+func (s *ConnectionPoolSuite) TestMaxLifetimeOnCheckout(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewBrokerConf("foo")
+	conf.ClusterConnectionConf.DialTimeout = 1 * time.Second
+	conf.ClusterConnectionConf.MaxConnectionLifetime = time.Hour
+	addresses := []string{srv.Address()}
+	cp := newConnectionPool(conf.ClusterConnectionConf, addresses)
+	cp.InitializeAddrs(addresses)
+	defer cp.Close()
+	be := cp.getBackend(srv.Address())
+
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	cp.Idle(conn)
+
+	// Pretend the connection has been around for longer than allowed, it
+	// must be closed and replaced on checkout.
+	be.conf.MaxConnectionLifetime = time.Nanosecond
+	conn2, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	c.Assert(conn2, Not(Equals), conn)
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(conn2.IsClosed(), Equals, false)
+	c.Assert(be.NumOpenConnections(), Equals, 1)
+}
+
+func (s *ConnectionPoolSuite) TestIdleReaping(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewBrokerConf("foo")
+	conf.ClusterConnectionConf.DialTimeout = 1 * time.Second
+	conf.ClusterConnectionConf.MaxIdleTime = 50 * time.Millisecond
+	addresses := []string{srv.Address()}
+	cp := newConnectionPool(conf.ClusterConnectionConf, addresses)
+	cp.InitializeAddrs(addresses)
+	defer cp.Close()
+	be := cp.getBackend(srv.Address())
+
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	cp.Idle(conn)
+	c.Assert(be.NumOpenConnections(), Equals, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for be.NumOpenConnections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(be.NumOpenConnections(), Equals, 0)
+	c.Assert(conn.IsClosed(), Equals, true)
+}
+
+func (s *ConnectionPoolSuite) TestMinIdleConnections(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewBrokerConf("foo")
+	conf.ClusterConnectionConf.ConnectionLimit = 2
+	conf.ClusterConnectionConf.DialTimeout = 1 * time.Second
+	conf.ClusterConnectionConf.MaxIdleTime = 50 * time.Millisecond
+	conf.ClusterConnectionConf.MinIdleConnections = 5
+	addresses := []string{srv.Address()}
+	cp := newConnectionPool(conf.ClusterConnectionConf, addresses)
+	cp.InitializeAddrs(addresses)
+	defer cp.Close()
+	be := cp.getBackend(srv.Address())
+
+	// The warm pool is capped at ConnectionLimit and expired connections
+	// are replaced.
+	deadline := time.Now().Add(2 * time.Second)
+	for be.NumOpenConnections() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(be.NumOpenConnections(), Equals, 2)
+
+	conn := cp.GetIdleConnection()
+	c.Assert(conn, NotNil)
+	c.Assert(conn.IsClosed(), Equals, false)
+	cp.Idle(conn)
+	c.Assert(be.NumOpenConnections() <= 2, Equals, true)
+}
@@ -1,9 +1,14 @@
 package kafka
 
 import (
+	"context"
+	"encoding/binary"
+	"io"
 	"net"
 	"reflect"
 	"strings"
+	"sync"
+	"testing"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -139,7 +144,7 @@ func (s *ConnectionSuite) TestConnectionMetadata(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -198,7 +203,7 @@ func (s *ConnectionSuite) TestConnectionProduce(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -290,10 +295,11 @@ func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 				Name: "foo",
 				Partitions: []proto.FetchRespPartition{
 					{
-						ID:        1,
-						Err:       nil,
-						TipOffset: 20,
-						Messages:  messages,
+						ID:                   1,
+						Err:                  nil,
+						TipOffset:            20,
+						PreferredReadReplica: -1,
+						Messages:             messages,
 					},
 				},
 			},
@@ -301,10 +307,11 @@ func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 				Name: "bar",
 				Partitions: []proto.FetchRespPartition{
 					{
-						ID:        6,
-						Err:       proto.ErrUnknownTopicOrPartition,
-						TipOffset: -1,
-						Messages:  []*proto.Message{},
+						ID:                   6,
+						Err:                  proto.ErrUnknownTopicOrPartition,
+						TipOffset:            -1,
+						PreferredReadReplica: -1,
+						Messages:             []*proto.Message{},
 					},
 				},
 			},
@@ -314,7 +321,7 @@ func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -377,7 +384,7 @@ func (s *ConnectionSuite) TestConnectionOffset(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -410,7 +417,7 @@ func (s *ConnectionSuite) TestConnectionProduceNoAck(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -455,7 +462,7 @@ func (s *ConnectionSuite) TestClosedConnectionWriter(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -494,7 +501,7 @@ func (s *ConnectionSuite) TestClosedConnectionReader(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -533,7 +540,7 @@ func (s *ConnectionSuite) TestConnectionReaderAfterEOF(c *C) {
 		_ = ln.Close()
 	}()
 
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -567,3 +574,182 @@ func (s *ConnectionSuite) TestConnectionReaderAfterEOF(c *C) {
 		c.Fatal("fetching from closed connection succeeded")
 	}
 }
+
+// recordingDialer dials with a net.Dialer and keeps the dialed addresses.
+type recordingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func (d *recordingDialer) Addrs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]string(nil), d.addrs...)
+}
+
+func (s *ConnectionSuite) TestDialerAndBrokerAddress(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	// The broker advertises a host that the client can't resolve
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: "kafka-1.invalid", Port: 9092},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.ProduceRespPartition{{ID: 0, Offset: 5}},
+				},
+			},
+		}
+	})
+
+	dialer := &recordingDialer{}
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	conf.ClusterConnectionConf.Dialer = dialer
+	conf.ClusterConnectionConf.BrokerAddress = func(nodeID int32, host string, port int32) string {
+		if nodeID == 1 && host == "kafka-1.invalid" && port == 9092 {
+			return srv.Address()
+		}
+		return "unexpected.invalid:1"
+	}
+	broker, err := NewBroker("test-cluster-dialer", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	offset, err := broker.Producer(NewProducerConf()).Produce("test", 0,
+		&proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(5))
+
+	addrs := dialer.Addrs()
+	c.Assert(len(addrs) >= 2, Equals, true)
+	for _, addr := range addrs {
+		c.Assert(addr, Equals, srv.Address())
+	}
+}
+
+// delayedServer answers every request it reads with resp after delay.
+func delayedServer(resp serializableMessage, delay time.Duration) (net.Listener, error) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			cli, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer func() { _ = conn.Close() }()
+
+				var size [4]byte
+				for {
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					req := make([]byte, binary.BigEndian.Uint32(size[:]))
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+					time.Sleep(delay)
+					if _, err := conn.Write(b); err != nil {
+						return
+					}
+				}
+			}(cli)
+		}
+	}()
+	return ln, nil
+}
+
+func (s *ConnectionSuite) TestRequestTimeout(c *C) {
+	ln, err := delayedServer(&proto.MetadataResp{CorrelationID: 1}, 300*time.Millisecond)
+	c.Assert(err, IsNil)
+	defer func() { _ = ln.Close() }()
+
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), 50*time.Millisecond)
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	_, err = conn.Metadata(&proto.MetadataReq{CorrelationID: 1})
+	c.Assert(err, Equals, proto.ErrRequestTimeout)
+	c.Assert(time.Since(start) < 250*time.Millisecond, Equals, true)
+	c.Assert(conn.IsClosed(), Equals, true)
+}
+
+func (s *ConnectionSuite) TestFetchTimeoutIncludesMaxWaitTime(c *C) {
+	ln, err := delayedServer(&proto.FetchResp{CorrelationID: 1}, 150*time.Millisecond)
+	c.Assert(err, IsNil)
+	defer func() { _ = ln.Close() }()
+
+	// The broker may hold the fetch for up to MaxWaitTime, which is longer
+	// than the connection timeout alone allows.
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), 50*time.Millisecond)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	resp, err := conn.Fetch(&proto.FetchReq{CorrelationID: 1, MaxWaitTime: time.Second})
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(1))
+	c.Assert(conn.IsClosed(), Equals, false)
+}
+
+func BenchmarkConnectionRequest(b *testing.B) {
+	ln, err := delayedServer(&proto.MetadataResp{CorrelationID: 1}, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	conn, err := newConnection(&net.Dialer{}, ln.Addr().String(), time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	req := &proto.MetadataReq{CorrelationID: 1}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Metadata(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -39,11 +39,15 @@ type PartitionCountSource interface {
 // PartitionFetchTimeout: optional. Controls how long Distribute will wait
 // to get a partition in the case where they are all unavailable due to
 // error averse backoff.
+// Metrics: optional. Receives a count of partition suspensions.
+// Logger: optional. Defaults to the logger set with SetLogger.
 type errorAverseRRProducerConf struct {
 	PartitionCountSource  PartitionCountSource
 	Producer              Producer
 	ErrorAverseBackoff    *backoff.Backoff
 	PartitionFetchTimeout time.Duration
+	Metrics               Metrics
+	Logger                Logger
 }
 
 func NewErrorAverseRRProducerConf() *errorAverseRRProducerConf {
@@ -57,6 +61,7 @@ func NewErrorAverseRRProducerConf() *errorAverseRRProducerConf {
 			Jitter: true,
 		},
 		PartitionFetchTimeout: time.Duration(10 * time.Second),
+		Metrics:               NopMetrics{},
 	}
 }
 
@@ -67,17 +72,22 @@ type errorAverseRRProducer struct {
 	partitionCountSource PartitionCountSource
 	producer             Producer
 	partitionManager     *partitionManager
+	logger               Logger
 }
 
 func NewErrorAverseRRProducer(conf *errorAverseRRProducerConf) DistributingProducer {
+	logger := loggerOrDefault(conf.Logger)
 	return &errorAverseRRProducer{
 		partitionCountSource: conf.PartitionCountSource,
 		producer:             conf.Producer,
+		logger:               logger,
 		partitionManager: &partitionManager{
 			availablePartitions: make(map[string]chan *partitionData),
 			lock:                &sync.RWMutex{},
 			sharedRetry:         conf.ErrorAverseBackoff,
 			getTimeout:          conf.PartitionFetchTimeout,
+			metrics:             metricsOrNop(conf.Metrics),
+			logger:              logger,
 		}}
 }
 
@@ -92,7 +102,7 @@ func (d *errorAverseRRProducer) Distribute(topic string, messages ...*proto.Mess
 
 	partitionData, err := d.partitionManager.GetPartition(topic)
 	if err != nil {
-		log.Error(err.Error())
+		d.logger.Error("cannot get partition", "topic", topic, "err", err)
 		return 0, 0, ErrNoPartitionsAvailable
 	}
 
@@ -100,7 +110,8 @@ func (d *errorAverseRRProducer) Distribute(topic string, messages ...*proto.Mess
 	var offset int64
 	offset, err = d.producer.Produce(topic, partitionData.Partition, messages...)
 	if err != nil {
-		log.Errorf("Failed to produce [%s:%d]: %s", topic, partitionData.Partition, err)
+		d.logger.Error("failed to produce",
+			"topic", topic, "partition", partitionData.Partition, "err", err)
 		partitionData.Failure()
 		return 0, 0, err
 	}
@@ -130,6 +141,8 @@ type partitionData struct {
 	successiveFailures  uint64
 	availablePartitions chan *partitionData
 	topic               string // Just for debugging
+	metrics             Metrics
+	logger              Logger
 }
 
 func (d *partitionData) Success() {
@@ -137,8 +150,8 @@ func (d *partitionData) Success() {
 	// a successful produce definitely happened in some sort of proximity to
 	// a failed produce.
 	if successiveFailures := atomic.LoadUint64(&d.successiveFailures); successiveFailures > 0 {
-		log.Infof("Resetting partition successiveFailures for %d of %s, was %d",
-			d.Partition, d.topic, successiveFailures)
+		d.logger.Info("resetting partition successive failures",
+			"topic", d.topic, "partition", d.Partition, "failures", successiveFailures)
 	}
 	atomic.StoreUint64(&d.successiveFailures, 0)
 	select {
@@ -163,22 +176,24 @@ func (d *partitionData) reEnqueue() {
 		if successiveFailures := atomic.LoadUint64(&d.successiveFailures); successiveFailures > 0 {
 			// The interface to ForAttempt is that the first failure should be #0.
 			t := d.sharedRetry.ForAttempt(float64(successiveFailures - 1))
-			log.Warningf("Suspending partition %d of %s for %s (%d)",
-				d.Partition, d.topic, t, successiveFailures)
+			d.logger.Warn("suspending partition",
+				"topic", d.topic, "partition", d.Partition, "duration", t,
+				"failures", successiveFailures)
+			d.metrics.Counter("kafka_partition_suspensions_total", 1, "topic", d.topic)
 			select {
 			case <-time.After(t):
 				// This is a race and might see a reset from a call to Success a long time ago, but
 				// the successiveFailures count will keep counting upwards so the impact is minimal.
 			case <-d.reset:
 			}
-			log.Warningf("Re-enqueueing partition %d of %s after %s",
-				d.Partition, d.topic, t)
+			d.logger.Warn("re-enqueueing partition",
+				"topic", d.topic, "partition", d.Partition, "duration", t)
 		}
 		select {
 		case d.availablePartitions <- d:
 		default:
-			log.Errorf("Programmer error in reEnqueue(%s, %d)! This should never happen.",
-				d.topic, d.Partition)
+			d.logger.Error("programmer error in reEnqueue, this should never happen",
+				"topic", d.topic, "partition", d.Partition)
 		}
 	}()
 }
@@ -192,6 +207,8 @@ type partitionManager struct {
 	lock                *sync.RWMutex
 	sharedRetry         *backoff.Backoff
 	getTimeout          time.Duration
+	metrics             Metrics
+	logger              Logger
 }
 
 // GetPartitionCount returns the size of a topic's availablePartitions chan.
@@ -218,12 +235,12 @@ func (p *partitionManager) SetPartitionCount(topic string, partitionCount int32)
 	defer p.lock.Unlock()
 
 	if availablePartitions, ok := p.availablePartitions[topic]; ok && int32(cap(availablePartitions)) == partitionCount {
-		log.Errorf("partitionManager(%s) hit slow path on SetPartitionCount but "+
-			"there is now no work to do. Count %d", topic, partitionCount)
+		p.logger.Error("partitionManager hit slow path on SetPartitionCount but "+
+			"there is now no work to do", "topic", topic, "count", partitionCount)
 		return
 	} else {
-		log.Infof("partitionManager adjusting partition count for %s: %d -> %d",
-			topic, cap(availablePartitions), partitionCount)
+		p.logger.Info("partitionManager adjusting partition count",
+			"topic", topic, "from", cap(availablePartitions), "to", partitionCount)
 
 		availablePartitions = make(chan *partitionData, partitionCount)
 		// Randomize the order of partitions to decorrelate publish partitions when many producers are restarted at once
@@ -234,6 +251,8 @@ func (p *partitionManager) SetPartitionCount(topic string, partitionCount int32)
 				sharedRetry:         p.sharedRetry,
 				availablePartitions: availablePartitions,
 				topic:               topic,
+				metrics:             p.metrics,
+				logger:              p.logger,
 			}
 		}
 		p.availablePartitions[topic] = availablePartitions
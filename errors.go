@@ -0,0 +1,102 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// Error is returned by producers, consumers, offset coordinators and offset
+// lookups when an operation on a partition fails. It records where the failure
+// happened and wraps the underlying error, so that errors.Is and errors.As
+// work as usual:
+//
+//	if errors.Is(err, proto.ErrOffsetOutOfRange) { ... }
+type Error struct {
+	// Op is the failed operation: "produce", "fetch", "offset", "commit" or
+	// "offset_fetch".
+	Op        string
+	Topic     string
+	Partition int32
+
+	// Broker is the address of the last broker the operation was sent to, or
+	// empty if no broker could be reached.
+	Broker string
+
+	// Attempt is the number of attempts made before giving up.
+	Attempt int
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	broker := e.Broker
+	if broker == "" {
+		broker = "no broker"
+	}
+	return fmt.Sprintf("kafka: %s [%s:%d] on %s (attempt %d): %s",
+		e.Op, e.Topic, e.Partition, broker, e.Attempt, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError returns err wrapped in an Error, unless it is nil, ErrNoData or
+// already an Error.
+func wrapError(op, topic string, partition int32, broker string, attempt int, err error) error {
+	if err == nil || err == ErrNoData {
+		return err
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{
+		Op:        op,
+		Topic:     topic,
+		Partition: partition,
+		Broker:    broker,
+		Attempt:   attempt,
+		Err:       err,
+	}
+}
+
+// isConnectionError returns true if err means that the connection it was
+// returned by is broken and must be closed.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, syscall.EPIPE)
+}
+
+// IsRetriable returns true if the operation that returned err may succeed if
+// it is tried again. This is the case for retriable Kafka errors, broken
+// connections, full connection pools and open circuit breakers.
+func IsRetriable(err error) bool {
+	var noConns *NoConnectionsAvailable
+	var circuitOpen *CircuitOpenError
+	return proto.IsRetriable(err) || isConnectionError(err) ||
+		errors.Is(err, ErrClosed) || errors.As(err, &noConns) || errors.As(err, &circuitOpen)
+}
+
+// IsTransient returns true if err is caused by a temporary condition that is
+// expected to clear by itself, such as a leader election, a full connection
+// pool or a timeout. Transient errors are always retriable.
+func IsTransient(err error) bool {
+	var noConns *NoConnectionsAvailable
+	var netErr net.Error
+	return proto.IsTransient(err) || errors.As(err, &noConns) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// RequiresMetadataRefresh returns true if err means that the cached
+// leadership information is stale, so the operation should only be retried
+// after refreshing the metadata. Broken connections and full connection pools
+// are not fixed by a metadata refresh.
+func RequiresMetadataRefresh(err error) bool {
+	return proto.RequiresMetadataRefresh(err)
+}
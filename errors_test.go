@@ -0,0 +1,113 @@
+package kafka
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&ErrorsSuite{})
+
+type ErrorsSuite struct{}
+
+func (s *ErrorsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *ErrorsSuite) TestPredicates(c *C) {
+	opErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	wrapped := wrapError("fetch", "test", 1, "localhost:9092", 2, proto.ErrNotLeaderForPartition)
+
+	for _, tc := range []struct {
+		err       error
+		retriable bool
+		transient bool
+		refresh   bool
+	}{
+		{proto.ErrNotLeaderForPartition, true, true, true},
+		{wrapped, true, true, true},
+		{proto.ErrBrokerNotAvailable, true, false, true},
+		{proto.ErrNoCoordinator, true, true, false},
+		{proto.ErrOffsetOutOfRange, false, false, false},
+		{&NoConnectionsAvailable{}, true, true, false},
+		{io.EOF, true, false, false},
+		{syscall.EPIPE, true, false, false},
+		{opErr, true, false, false},
+		{ErrClosed, true, false, false},
+		{ErrNoData, false, false, false},
+		{errors.New("something else"), false, false, false},
+	} {
+		c.Assert(IsRetriable(tc.err), Equals, tc.retriable, Commentf("%s", tc.err))
+		c.Assert(IsTransient(tc.err), Equals, tc.transient, Commentf("%s", tc.err))
+		c.Assert(RequiresMetadataRefresh(tc.err), Equals, tc.refresh, Commentf("%s", tc.err))
+	}
+}
+
+func (s *ErrorsSuite) TestWrapError(c *C) {
+	c.Assert(wrapError("fetch", "test", 1, "", 1, nil), IsNil)
+	c.Assert(wrapError("fetch", "test", 1, "", 1, ErrNoData), Equals, ErrNoData)
+
+	err := wrapError("fetch", "test", 1, "localhost:9092", 2, proto.ErrOffsetOutOfRange)
+	c.Assert(err, ErrorMatches,
+		`kafka: fetch \[test:1\] on localhost:9092 \(attempt 2\): offset out of range \(1\)`)
+	c.Assert(wrapError("produce", "other", 0, "", 1, err), Equals, err)
+
+	var kerr *Error
+	c.Assert(errors.As(err, &kerr), Equals, true)
+	c.Assert(*kerr, DeepEquals, Error{
+		Op:        "fetch",
+		Topic:     "test",
+		Partition: 1,
+		Broker:    "localhost:9092",
+		Attempt:   2,
+		Err:       proto.ErrOffsetOutOfRange,
+	})
+}
+
+func (s *ErrorsSuite) TestOperationErrors(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, Err: proto.ErrOffsetOutOfRange},
+					},
+				},
+			},
+		}
+	})
+
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-errors", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = 10
+	consumer, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+
+	_, err = consumer.Consume()
+	c.Assert(err, ErrorIs, proto.ErrOffsetOutOfRange)
+	var kerr *Error
+	c.Assert(errors.As(err, &kerr), Equals, true)
+	c.Assert(kerr.Op, Equals, "fetch")
+	c.Assert(kerr.Topic, Equals, "test")
+	c.Assert(kerr.Partition, Equals, int32(0))
+	c.Assert(kerr.Broker, Equals, srv.Address())
+	c.Assert(kerr.Attempt, Equals, 1)
+}
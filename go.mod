@@ -8,4 +8,5 @@ require (
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	gopkg.in/check.v1 v1.0.0-20200902074654-038fdea0a05b
+	gopkg.in/yaml.v3 v3.0.1
 )
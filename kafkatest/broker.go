@@ -3,6 +3,7 @@ package kafkatest
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,91 +17,320 @@ var (
 	ErrNotImplemented = errors.New("not implemented")
 
 	// test implementation should implement the interface
-	_ kafka.Client   = &Broker{}
-	_ kafka.Producer = &Producer{}
-	_ kafka.Consumer = &Consumer{}
+	_ kafka.Client        = &Broker{}
+	_ kafka.Producer      = &Producer{}
+	_ kafka.Consumer      = &Consumer{}
+	_ kafka.BatchConsumer = &Consumer{}
 )
 
+// brokerNodeID, brokerHost and brokerPort describe the only broker of the
+// metadata of a Broker.
+const (
+	brokerNodeID = 1
+	brokerHost   = "localhost"
+	brokerPort   = 9092
+)
+
+// partitionError wraps err in a *kafka.Error, like the errors the real client
+// returns for operations on a partition.
+func partitionError(op, topic string, partition int32, err error) error {
+	return &kafka.Error{
+		Op:        op,
+		Topic:     topic,
+		Partition: partition,
+		Broker:    fmt.Sprintf("%s:%d", brokerHost, brokerPort),
+		Attempt:   1,
+		Err:       err,
+	}
+}
+
 // Broker is mock version of kafka's broker. It's implementing Broker interface
 // and provides easy way of mocking server actions.
+//
+// Messages produced through the broker are appended to an in-memory log kept
+// for every partition. Partitions are created the first time they are
+// produced to or consumed from, or with AddMessages. Consumers of a broker
+// created with NewLogBroker read from those logs with the same offset
+// semantics as the real client, while consumers of a broker created with
+// NewBroker only return what is pushed through their Messages and Errors
+// channels.
 type Broker struct {
-	produced chan *ProducedMessages
-
-	mu        sync.Mutex
-	consumers map[string]map[int32]*Consumer
+	mu sync.Mutex
+	// consumeLog is set if consumers read from the partition logs.
+	consumeLog bool
+	// updated is closed and replaced whenever messages are appended or
+	// produce calls recorded.
+	updated  chan struct{}
+	logs     map[string][]*partitionLog
+	produced []*ProducedMessages
+	scripts  map[topicPartition]*consumerScript
+	// offsets are the offsets committed by every consumer group.
+	offsets map[string]map[topicPartition]committedOffset
 
 	// OffsetEarliestHandler is callback function called whenever
 	// OffsetEarliest method of the broker is called. Overwrite to change
-	// default behaviour -- always returning ErrUnknownTopicOrPartition
+	// default behaviour -- returning the offset of the first message in the
+	// partition log, or a *kafka.Error wrapping ErrUnknownTopicOrPartition if
+	// there is no such partition.
 	OffsetEarliestHandler func(string, int32) (int64, error)
 
 	// OffsetLatestHandler is callback function called whenever OffsetLatest
 	// method of the broker is called. Overwrite to change default behaviour --
-	// always returning ErrUnknownTopicOrPartition
+	// returning the offset the next message of the partition log will get, or
+	// a *kafka.Error wrapping ErrUnknownTopicOrPartition if there is no such
+	// partition.
 	OffsetLatestHandler func(string, int32) (int64, error)
 }
 
+// consumerScript holds the channels shared by all consumers of a partition.
+type consumerScript struct {
+	messages chan *proto.Message
+	errors   chan error
+}
+
+type committedOffset struct {
+	offset   int64
+	metadata string
+}
+
+// NewBroker returns a broker whose consumers are scripted through their
+// Messages and Errors channels.
 func NewBroker() *Broker {
 	return &Broker{
-		consumers: make(map[string]map[int32]*Consumer),
-		produced:  make(chan *ProducedMessages),
+		updated: make(chan struct{}),
+		logs:    make(map[string][]*partitionLog),
+		scripts: make(map[topicPartition]*consumerScript),
+		offsets: make(map[string]map[topicPartition]committedOffset),
 	}
 }
 
+// NewLogBroker returns a broker whose consumers read the messages produced
+// through it from the partition logs, like real consumers would. Messages and
+// errors pushed through the consumers' channels are still returned while
+// they wait for new messages.
+func NewLogBroker() *Broker {
+	b := NewBroker()
+	b.consumeLog = true
+	return b
+}
+
 // Close is no operation method, required by Broker interface.
 func (b *Broker) Close() {
 }
 
+// notify wakes up everyone waiting for the broker to be updated. The caller
+// must hold the lock.
+func (b *Broker) notify() {
+	close(b.updated)
+	b.updated = make(chan struct{})
+}
+
+// partition returns the log of given partition, creating it and the lower
+// numbered partitions of the topic if needed. The caller must hold the lock.
+func (b *Broker) partition(topic string, partition int32) *partitionLog {
+	logs := b.logs[topic]
+	for int32(len(logs)) <= partition {
+		logs = append(logs, newPartitionLog())
+	}
+	b.logs[topic] = logs
+	return logs[partition]
+}
+
+// existingPartition returns the log of given partition, or nil if there is no
+// such partition. The caller must hold the lock.
+func (b *Broker) existingPartition(topic string, partition int32) *partitionLog {
+	logs := b.logs[topic]
+	if partition < 0 || partition >= int32(len(logs)) {
+		return nil
+	}
+	return logs[partition]
+}
+
+// AddMessages appends messages to the log of given partition, as if they were
+// produced, and returns the offset of the first one. The messages' Offset
+// and Crc attributes are set.
+func (b *Broker) AddMessages(topic string, partition int32, messages ...*proto.Message) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.append(topic, partition, messages)
+}
+
+// append adds messages to the partition log. The caller must hold the lock.
+func (b *Broker) append(topic string, partition int32, messages []*proto.Message) int64 {
+	log := b.partition(topic, partition)
+	off := log.next
+	stored := make([]*proto.Message, len(messages))
+	for i, msg := range messages {
+		msg.Offset = off + int64(i)
+		msg.Crc = proto.ComputeCrc(msg, proto.CompressionNone)
+
+		m := *msg
+		m.Topic = topic
+		m.Partition = partition
+		stored[i] = &m
+	}
+	log.append(time.Now(), proto.CompressionNone, stored...)
+	b.notify()
+	return off
+}
+
+// read returns copies of the messages of the partition starting at given
+// offset, with the channel closed on the next update.
+func (b *Broker) read(topic string, partition int32, offset int64) ([]*proto.Message, <-chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log := b.existingPartition(topic, partition)
+	if log == nil {
+		return nil, nil, partitionError("fetch", topic, partition, proto.ErrUnknownTopicOrPartition)
+	}
+	if offset < log.start || offset > log.next {
+		return nil, nil, partitionError("fetch", topic, partition, proto.ErrOffsetOutOfRange)
+	}
+	msgs := make([]*proto.Message, 0, log.next-offset)
+	for _, batch := range log.from(offset) {
+		for _, msg := range batch.Messages {
+			m := *msg
+			msgs = append(msgs, &m)
+		}
+	}
+	return msgs, b.updated, nil
+}
+
 // OffsetEarliest return result of OffsetEarliestHandler callback set on the
-// broker. If not set, always return ErrUnknownTopicOrPartition
+// broker. If not set, return the offset of the first message in the partition
+// log.
 func (b *Broker) OffsetEarliest(topic string, partition int32) (int64, error) {
 	if b.OffsetEarliestHandler != nil {
 		return b.OffsetEarliestHandler(topic, partition)
 	}
-	return 0, proto.ErrUnknownTopicOrPartition
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log := b.existingPartition(topic, partition)
+	if log == nil {
+		return 0, partitionError("offset", topic, partition, proto.ErrUnknownTopicOrPartition)
+	}
+	return log.start, nil
 }
 
 // OffsetLatest return result of OffsetLatestHandler callback set on the
-// broker. If not set, always return ErrUnknownTopicOrPartition
+// broker. If not set, return the offset the next message appended to the
+// partition log will get.
 func (b *Broker) OffsetLatest(topic string, partition int32) (int64, error) {
 	if b.OffsetLatestHandler != nil {
 		return b.OffsetLatestHandler(topic, partition)
 	}
-	return 0, proto.ErrUnknownTopicOrPartition
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log := b.existingPartition(topic, partition)
+	if log == nil {
+		return 0, partitionError("offset", topic, partition, proto.ErrUnknownTopicOrPartition)
+	}
+	return log.next, nil
 }
 
-// Consumer returns consumer mock and never error.
-//
-// At most one consumer for every topic-partition pair can be created --
-// calling this for the same topic-partition will always return the same
-// consumer instance.
-func (b *Broker) Consumer(conf kafka.ConsumerConf) (kafka.Consumer, error) {
+// Metadata returns the topics and partitions of the broker, all led by a
+// single broker.
+func (b *Broker) Metadata() (*proto.MetadataResp, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resp := &proto.MetadataResp{
+		Brokers:      []proto.MetadataRespBroker{{NodeID: brokerNodeID, Host: brokerHost, Port: brokerPort}},
+		ControllerID: brokerNodeID,
+	}
+	for name, logs := range b.logs {
+		topic := proto.MetadataRespTopic{
+			Name:       name,
+			Partitions: make([]proto.MetadataRespPartition, len(logs)),
+		}
+		for i := range logs {
+			topic.Partitions[i] = proto.MetadataRespPartition{
+				ID:       int32(i),
+				Leader:   brokerNodeID,
+				Replicas: []int32{brokerNodeID},
+				Isrs:     []int32{brokerNodeID},
+			}
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	sort.Slice(resp.Topics, func(i, j int) bool { return resp.Topics[i].Name < resp.Topics[j].Name })
+	return resp, nil
+}
+
+// PartitionCount returns the number of partitions of the topic.
+func (b *Broker) PartitionCount(topic string) (int32, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if t, ok := b.consumers[conf.Topic]; ok {
-		if c, ok := t[conf.Partition]; ok {
-			return c, nil
+	if logs, ok := b.logs[topic]; ok {
+		return int32(len(logs)), nil
+	}
+	return 0, fmt.Errorf("topic %s not found in metadata", topic)
+}
+
+// Consumer returns consumer mock. If the broker was created with
+// NewLogBroker, the consumer reads from the partition log starting at the
+// configured StartOffset. Otherwise it never fails, and the start offset is
+// ignored.
+//
+// All consumers of the same topic-partition share their Messages and Errors
+// channels, so that messages and errors can be pushed through any of them.
+func (b *Broker) Consumer(conf kafka.ConsumerConf) (kafka.Consumer, error) {
+	return b.consumer(conf)
+}
+
+// BatchConsumer returns batch consumer mock. See Consumer.
+func (b *Broker) BatchConsumer(conf kafka.ConsumerConf) (kafka.BatchConsumer, error) {
+	return b.consumer(conf)
+}
+
+func (b *Broker) consumer(conf kafka.ConsumerConf) (*Consumer, error) {
+	b.mu.Lock()
+	b.partition(conf.Topic, conf.Partition)
+	tp := topicPartition{conf.Topic, conf.Partition}
+	script, ok := b.scripts[tp]
+	if !ok {
+		script = &consumerScript{
+			messages: make(chan *proto.Message),
+			errors:   make(chan error),
+		}
+		b.scripts[tp] = script
+	}
+	b.mu.Unlock()
+
+	offset := conf.StartOffset
+	if b.consumeLog && offset < 0 {
+		var err error
+		switch offset {
+		case kafka.StartOffsetNewest:
+			offset, err = b.OffsetLatest(conf.Topic, conf.Partition)
+		case kafka.StartOffsetOldest:
+			offset, err = b.OffsetEarliest(conf.Topic, conf.Partition)
+		default:
+			err = fmt.Errorf("invalid start offset: %d", conf.StartOffset)
+		}
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		b.consumers[conf.Topic] = make(map[int32]*Consumer)
 	}
 
-	c := &Consumer{
+	return &Consumer{
 		conf:     conf,
+		offset:   offset,
 		Broker:   b,
-		Messages: make(chan *proto.Message),
-		Errors:   make(chan error),
-	}
-	b.consumers[conf.Topic][conf.Partition] = c
-	return c, nil
+		Messages: script.messages,
+		Errors:   script.errors,
+	}, nil
 }
 
 // Producer returns producer mock instance.
 func (b *Broker) Producer(kafka.ProducerConf) kafka.Producer {
 	return &Producer{
-		Broker:         b,
-		ResponseOffset: 1,
+		Broker: b,
 	}
 }
 
@@ -108,32 +338,53 @@ func (b *Broker) Producer(kafka.ProducerConf) kafka.Producer {
 // successful, so you can always ignore returned error.
 func (b *Broker) OffsetCoordinator(conf kafka.OffsetCoordinatorConf) (kafka.OffsetCoordinator, error) {
 	c := &OffsetCoordinator{
-		Broker: b,
-		conf:   conf,
+		Broker:  b,
+		conf:    conf,
+		Offsets: make(map[string]int64),
 	}
 	return c, nil
 }
 
 // ReadProducers return ProduceMessages representing produce call of one of
-// created by broker producers or ErrTimeout.
+// created by broker producers or ErrTimeout. Produce calls are returned in
+// the order they were made, each of them once.
 func (b *Broker) ReadProducers(timeout time.Duration) (*ProducedMessages, error) {
-	select {
-	case p := <-b.produced:
-		return p, nil
-	case <-time.After(timeout):
-		return nil, ErrTimeout
+	deadline := time.After(timeout)
+	for {
+		b.mu.Lock()
+		if len(b.produced) > 0 {
+			p := b.produced[0]
+			b.produced[0] = nil
+			b.produced = b.produced[1:]
+			b.mu.Unlock()
+			return p, nil
+		}
+		updated := b.updated
+		b.mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-deadline:
+			return nil, ErrTimeout
+		}
 	}
 }
 
-// Consumer mocks kafka's consumer. Use Messages and Errors channels to mock
-// Consume method results.
+// Consumer mocks kafka's consumer. It returns messages and errors pushed
+// through its Messages and Errors channels, and reads messages from the
+// partition log if its broker was created with NewLogBroker.
 type Consumer struct {
 	conf kafka.ConsumerConf
 
+	mu     sync.Mutex
+	offset int64
+	msgbuf []*proto.Message
+
 	Broker *Broker
 
 	// Messages is channel consumed by fetch method call. Pushing message into
-	// this channel will result in Consume method call returning message data.
+	// this channel will result in Consume method call returning message data,
+	// without changing the consumer's offset.
 	Messages chan *proto.Message
 
 	// Errors is channel consumed by fetch method call. Pushing error into this
@@ -141,42 +392,145 @@ type Consumer struct {
 	Errors chan error
 }
 
-// Consume returns message or error pushed through consumers Messages and Errors
-// channel. Function call will block until data on at least one of those
-// channels is available.
+// consume returns the next batch of messages. If the consumer doesn't read
+// from the partition log, it waits for a message or an error pushed through
+// the Messages and Errors channels. Otherwise, while the partition log has no
+// message at the consumer's offset, it waits for one to be appended or pushed
+// through the Messages channel, or for an error pushed through the Errors
+// channel. Like the real consumer it gives up with kafka.ErrNoData after
+// RetryLimit empty fetches, RetryWait apart, unless RetryLimit is -1.
+//
+// fromLog is false if the batch is a message pushed through Messages.
+func (c *Consumer) consume() (batch []*proto.Message, fromLog bool, err error) {
+	if !c.Broker.consumeLog {
+		select {
+		case msg := <-c.Messages:
+			return []*proto.Message{c.scripted(msg)}, false, nil
+		case err := <-c.Errors:
+			return nil, false, err
+		}
+	}
+
+	for retry := 0; ; {
+		msgs, updated, err := c.Broker.read(c.conf.Topic, c.conf.Partition, c.offset)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(msgs) > 0 {
+			return msgs, true, nil
+		}
+		if c.conf.RetryLimit != -1 && retry >= c.conf.RetryLimit {
+			return nil, false, kafka.ErrNoData
+		}
+
+		var wait <-chan time.Time
+		if c.conf.RetryLimit != -1 {
+			wait = time.After(c.conf.RetryWait)
+		}
+		select {
+		case msg := <-c.Messages:
+			return []*proto.Message{c.scripted(msg)}, false, nil
+		case err := <-c.Errors:
+			return nil, false, err
+		case <-updated:
+		case <-wait:
+			retry++
+		}
+	}
+}
+
+// scripted sets the topic and partition of a message pushed through Messages.
+func (c *Consumer) scripted(msg *proto.Message) *proto.Message {
+	msg.Topic = c.conf.Topic
+	msg.Partition = c.conf.Partition
+	return msg
+}
+
+// Consume returns the next message of the partition log, or message or error
+// pushed through consumers Messages and Errors channel. Function call will
+// block until one of those is available, or RetryLimit is reached.
 func (c *Consumer) Consume() (*proto.Message, error) {
-	select {
-	case msg := <-c.Messages:
-		msg.Topic = c.conf.Topic
-		msg.Partition = c.conf.Partition
-		return msg, nil
-	case err := <-c.Errors:
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.msgbuf) == 0 {
+		batch, fromLog, err := c.consume()
+		if err != nil {
+			return nil, err
+		}
+		if !fromLog {
+			return batch[0], nil
+		}
+		c.msgbuf = batch
+	}
+
+	msg := c.msgbuf[0]
+	c.msgbuf[0] = nil
+	c.msgbuf = c.msgbuf[1:]
+	c.offset = msg.Offset + 1
+	return msg, nil
+}
+
+// ConsumeBatch works like Consume, but returns all messages available at once.
+func (c *Consumer) ConsumeBatch() ([]*proto.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.msgbuf) > 0 {
+		batch := c.msgbuf
+		c.msgbuf = nil
+		c.offset = batch[len(batch)-1].Offset + 1
+		return batch, nil
+	}
+	batch, fromLog, err := c.consume()
+	if err != nil {
 		return nil, err
 	}
+	if fromLog {
+		c.offset = batch[len(batch)-1].Offset + 1
+	}
+	return batch, nil
 }
 
-// SeekToLatest discards all messages currently enqueued, unless an error is available first.
+// SeekToLatest discards all messages currently enqueued, unless an error is
+// available first. If the consumer reads from the partition log, its offset is
+// moved to the end of the log.
 func (c *Consumer) SeekToLatest() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	select {
 	case err := <-c.Errors:
 		return err
 	default:
-		for {
-			select {
-			case _ = <-c.Messages:
-			default:
-				return nil
-			}
+	}
+	for drained := false; !drained; {
+		select {
+		case <-c.Messages:
+		default:
+			drained = true
 		}
 	}
+	if !c.Broker.consumeLog {
+		return nil
+	}
+
+	off, err := c.Broker.OffsetLatest(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return err
+	}
+	c.offset = off
+	c.msgbuf = nil
+	return nil
 }
 
 // Producer mocks kafka's producer.
 type Producer struct {
 	Broker *Broker
 
-	// ResponseOffset is offset counter returned and incremented by every
-	// Produce method call. By default set to 1.
+	// ResponseOffset, if set, is offset counter returned and incremented by
+	// every Produce method call instead of the offsets assigned by the
+	// partition log. By default 0, which is not used.
 	ResponseOffset int64
 
 	// ResponseError if set, force Produce method call to instantly return
@@ -192,26 +546,31 @@ type ProducedMessages struct {
 	Messages  []*proto.Message
 }
 
-// Produce is settings messages Crc and Offset attributes and pushing all
-// passed arguments to broker. Produce call is blocking until pushed message
-// will be read with broker's ReadProduces.
+// Produce appends messages to the partition log, setting their Crc and Offset
+// attributes, and records the call so that it can be read with broker's
+// ReadProducers. Produce doesn't block until the call is read.
 func (p *Producer) Produce(topic string, partition int32, messages ...*proto.Message) (int64, error) {
 	if p.ResponseError != nil {
 		return 0, p.ResponseError
 	}
-	off := p.ResponseOffset
 
-	for i, msg := range messages {
-		msg.Offset = off + int64(i)
-		msg.Crc = proto.ComputeCrc(msg, proto.CompressionNone)
-	}
-
-	p.Broker.produced <- &ProducedMessages{
+	b := p.Broker
+	b.mu.Lock()
+	off := b.append(topic, partition, messages)
+	b.produced = append(b.produced, &ProducedMessages{
 		Topic:     topic,
 		Partition: partition,
 		Messages:  messages,
+	})
+	b.mu.Unlock()
+
+	if p.ResponseOffset != 0 {
+		off = p.ResponseOffset
+		for i, msg := range messages {
+			msg.Offset = off + int64(i)
+		}
+		p.ResponseOffset += int64(len(messages))
 	}
-	p.ResponseOffset += int64(len(messages))
 	return off, nil
 }
 
@@ -219,45 +578,82 @@ type OffsetCoordinator struct {
 	conf   kafka.OffsetCoordinatorConf
 	Broker *Broker
 
-	// Offsets is used to store all offset commits when using mocked
-	// coordinator's default behaviour.
+	// Offsets mirrors the offsets committed through this coordinator when
+	// using mocked coordinator's default behaviour, keyed by "topic:partition".
+	// Committed offsets are stored by the broker, and shared by all
+	// coordinators of the same consumer group. Offsets set directly in this
+	// map are returned when the group has no committed offset.
 	Offsets map[string]int64
 
 	// CommitHandler is callback function called whenever Commit method of the
 	// OffsetCoordinator is called. If CommitHandler is nil, Commit method will
-	// return data using Offset attribute as store.
+	// store the offset in the broker.
 	CommitHandler func(consumerGroup string, topic string, partition int32, offset int64) error
 
 	// OffsetHandler is callback function called whenever Offset method of the
-	// OffsetCoordinator is called. If OffsetHandler is nil, Commit method will
-	// use Offset attribute to retrieve the offset.
+	// OffsetCoordinator is called. If OffsetHandler is nil, Offset method will
+	// return the offset stored in the broker.
 	OffsetHandler func(consumerGroup string, topic string, partition int32) (offset int64, metadata string, err error)
 }
 
 // Commit return result of CommitHandler callback set on coordinator. If
-// handler is nil, this method will use Offsets attribute to store data for
-// further use.
+// handler is nil, the offset is stored in the broker for further use.
+// Negative offsets are rejected like the real client does.
 func (c *OffsetCoordinator) Commit(topic string, partition int32, offset int64) error {
+	return c.CommitFull(topic, partition, offset, "")
+}
+
+// CommitFull works exactly like Commit method, but store extra metadata
+// string together with offset information. The metadata is not passed to
+// CommitHandler.
+func (c *OffsetCoordinator) CommitFull(topic string, partition int32, offset int64, metadata string) error {
+	if offset < 0 {
+		return fmt.Errorf("cannot commit negative offset %d for [%s:%d]",
+			offset, topic, partition)
+	}
 	if c.CommitHandler != nil {
 		return c.CommitHandler(c.conf.ConsumerGroup, topic, partition, offset)
 	}
+
+	b := c.Broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	group, ok := b.offsets[c.conf.ConsumerGroup]
+	if !ok {
+		group = make(map[topicPartition]committedOffset)
+		b.offsets[c.conf.ConsumerGroup] = group
+	}
+	group[topicPartition{topic, partition}] = committedOffset{offset, metadata}
+	if c.Offsets == nil {
+		c.Offsets = make(map[string]int64)
+	}
 	c.Offsets[fmt.Sprintf("%s:%d", topic, partition)] = offset
 	return nil
 }
 
 // Offset return result of OffsetHandler callback set on coordinator. If
-// handler is nil, this method will use Offsets attribute to retrieve committed
-// offset. If no offset for given topic and partition pair was saved,
-// proto.ErrUnknownTopicOrPartition is returned.
+// handler is nil, this method returns the offset and metadata committed by
+// the consumer group, or else the offset set in the Offsets attribute. If no
+// offset for given topic and partition pair was saved, a *kafka.Error
+// wrapping proto.ErrUnknownTopicOrPartition is returned.
 func (c *OffsetCoordinator) Offset(topic string, partition int32) (offset int64, metadata string, err error) {
 	if c.OffsetHandler != nil {
 		return c.OffsetHandler(c.conf.ConsumerGroup, topic, partition)
 	}
-	off, ok := c.Offsets[fmt.Sprintf("%s:%d", topic, partition)]
-	if !ok {
-		return 0, "", proto.ErrUnknownTopicOrPartition
+
+	b := c.Broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	committed, ok := b.offsets[c.conf.ConsumerGroup][topicPartition{topic, partition}]
+	if ok {
+		return committed.offset, committed.metadata, nil
+	}
+	if off, ok := c.Offsets[fmt.Sprintf("%s:%d", topic, partition)]; ok {
+		return off, "", nil
 	}
-	return off, "", nil
+	return 0, "", partitionError("offset_fetch", topic, partition, proto.ErrUnknownTopicOrPartition)
 }
 
 func (c *OffsetCoordinator) Close() {
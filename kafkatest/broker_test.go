@@ -0,0 +1,296 @@
+package kafkatest
+
+import (
+	"errors"
+	"time"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+// ErrorIs checks that the obtained error matches the expected one with
+// errors.Is, so that wrapped errors can be compared to their cause.
+var ErrorIs Checker = &errorIsChecker{
+	&CheckerInfo{Name: "ErrorIs", Params: []string{"obtained", "expected"}},
+}
+
+type errorIsChecker struct {
+	*CheckerInfo
+}
+
+func (checker *errorIsChecker) Check(params []interface{}, names []string) (bool, string) {
+	obtained, ok := params[0].(error)
+	if !ok {
+		return false, "obtained value is not an error"
+	}
+	expected, ok := params[1].(error)
+	if !ok {
+		return false, "expected value is not an error"
+	}
+	return errors.Is(obtained, expected), ""
+}
+
+var _ = Suite(&BrokerSuite{})
+
+type BrokerSuite struct {
+	broker *Broker
+}
+
+func (s *BrokerSuite) SetUpTest(c *C) {
+	s.broker = NewLogBroker()
+}
+
+func (s *BrokerSuite) produce(c *C, topic string, partition int32, values ...string) int64 {
+	messages := make([]*proto.Message, len(values))
+	for i, value := range values {
+		messages[i] = &proto.Message{Value: []byte(value)}
+	}
+	off, err := s.broker.Producer(kafka.NewProducerConf()).Produce(topic, partition, messages...)
+	c.Assert(err, IsNil)
+	for i, msg := range messages {
+		c.Assert(msg.Offset, Equals, off+int64(i))
+	}
+	return off
+}
+
+func (s *BrokerSuite) consumer(c *C, startOffset int64) *Consumer {
+	conf := kafka.NewConsumerConf("test", 0)
+	conf.StartOffset = startOffset
+	conf.RetryLimit = 1
+	conf.RetryWait = time.Millisecond
+	consumer, err := s.broker.Consumer(conf)
+	c.Assert(err, IsNil)
+	return consumer.(*Consumer)
+}
+
+func consumeValues(c *C, consume func() (*proto.Message, error), n int) []string {
+	var values []string
+	for i := 0; i < n; i++ {
+		msg, err := consume()
+		c.Assert(err, IsNil)
+		values = append(values, string(msg.Value))
+	}
+	return values
+}
+
+func (s *BrokerSuite) TestProduceConsume(c *C) {
+	c.Assert(s.produce(c, "test", 0, "a", "b"), Equals, int64(0))
+	c.Assert(s.produce(c, "test", 0, "c"), Equals, int64(2))
+
+	earliest, err := s.broker.OffsetEarliest("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(earliest, Equals, int64(0))
+	latest, err := s.broker.OffsetLatest("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(latest, Equals, int64(3))
+
+	oldest := s.consumer(c, kafka.StartOffsetOldest)
+	msg, err := oldest.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(msg.Topic, Equals, "test")
+	c.Assert(msg.Offset, Equals, int64(0))
+	c.Assert(consumeValues(c, oldest.Consume, 2), DeepEquals, []string{"b", "c"})
+	_, err = oldest.Consume()
+	c.Assert(err, Equals, kafka.ErrNoData)
+
+	newest := s.consumer(c, kafka.StartOffsetNewest)
+	_, err = newest.Consume()
+	c.Assert(err, Equals, kafka.ErrNoData)
+	s.produce(c, "test", 0, "d")
+	c.Assert(consumeValues(c, newest.Consume, 1), DeepEquals, []string{"d"})
+	c.Assert(consumeValues(c, oldest.Consume, 1), DeepEquals, []string{"d"})
+
+	c.Assert(consumeValues(c, s.consumer(c, 1).Consume, 3), DeepEquals, []string{"b", "c", "d"})
+	_, err = s.consumer(c, 5).Consume()
+	c.Assert(err, ErrorIs, proto.ErrOffsetOutOfRange)
+	var kerr *kafka.Error
+	c.Assert(errors.As(err, &kerr), Equals, true)
+	c.Assert(kerr.Op, Equals, "fetch")
+	c.Assert(kerr.Topic, Equals, "test")
+	c.Assert(kerr.Partition, Equals, int32(0))
+
+	_, err = s.broker.Consumer(kafka.ConsumerConf{Topic: "test", StartOffset: -3})
+	c.Assert(err, ErrorMatches, "invalid start offset: -3")
+}
+
+func (s *BrokerSuite) TestConsumeWaits(c *C) {
+	conf := kafka.NewConsumerConf("test", 0)
+	consumer, err := s.broker.Consumer(conf)
+	c.Assert(err, IsNil)
+
+	done := make(chan string)
+	go func() {
+		msg, err := consumer.Consume()
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		done <- string(msg.Value)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.produce(c, "test", 0, "a")
+	select {
+	case value := <-done:
+		c.Assert(value, Equals, "a")
+	case <-time.After(time.Second):
+		c.Fatal("consumer not woken up by produced message")
+	}
+}
+
+func (s *BrokerSuite) TestBatchConsumer(c *C) {
+	conf := kafka.NewConsumerConf("test", 0)
+	conf.RetryLimit = 0
+	consumer, err := s.broker.BatchConsumer(conf)
+	c.Assert(err, IsNil)
+	_, err = consumer.ConsumeBatch()
+	c.Assert(err, Equals, kafka.ErrNoData)
+
+	s.produce(c, "test", 0, "a", "b")
+	s.produce(c, "test", 0, "c")
+	batch, err := consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch, HasLen, 3)
+	c.Assert(batch[2].Offset, Equals, int64(2))
+	_, err = consumer.ConsumeBatch()
+	c.Assert(err, Equals, kafka.ErrNoData)
+}
+
+func (s *BrokerSuite) TestSeekToLatest(c *C) {
+	s.produce(c, "test", 0, "a", "b")
+	consumer := s.consumer(c, kafka.StartOffsetOldest)
+	c.Assert(consumeValues(c, consumer.Consume, 1), DeepEquals, []string{"a"})
+
+	c.Assert(consumer.SeekToLatest(), IsNil)
+	_, err := consumer.Consume()
+	c.Assert(err, Equals, kafka.ErrNoData)
+	s.produce(c, "test", 0, "c")
+	c.Assert(consumeValues(c, consumer.Consume, 1), DeepEquals, []string{"c"})
+}
+
+func (s *BrokerSuite) TestScripting(c *C) {
+	s.broker = NewBroker()
+	s.produce(c, "test", 0, "a")
+	produced, err := s.broker.ReadProducers(time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(produced.Topic, Equals, "test")
+	c.Assert(produced.Messages, HasLen, 1)
+	_, err = s.broker.ReadProducers(time.Millisecond)
+	c.Assert(err, Equals, ErrTimeout)
+
+	// produced messages are not consumed, only the scripted ones
+	consumer, err := s.broker.Consumer(kafka.NewConsumerConf("test", 0))
+	c.Assert(err, IsNil)
+	// consumers of a partition share their channels
+	other := s.consumer(c, kafka.StartOffsetOldest)
+	go func() {
+		other.Messages <- &proto.Message{Value: []byte("scripted")}
+		other.Errors <- errors.New("scripted error")
+	}()
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "scripted")
+	c.Assert(msg.Partition, Equals, int32(0))
+	_, err = consumer.Consume()
+	c.Assert(err, ErrorMatches, "scripted error")
+
+	producer := s.broker.Producer(kafka.NewProducerConf()).(*Producer)
+	producer.ResponseOffset = 100
+	msgs := []*proto.Message{{Value: []byte("c")}, {Value: []byte("d")}}
+	off, err := producer.Produce("test", 0, msgs...)
+	c.Assert(err, IsNil)
+	c.Assert(off, Equals, int64(100))
+	c.Assert(msgs[1].Offset, Equals, int64(101))
+	latest, err := s.broker.OffsetLatest("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(latest, Equals, int64(3))
+
+	producer.ResponseError = errors.New("produce failed")
+	_, err = producer.Produce("test", 0, msgs...)
+	c.Assert(err, ErrorMatches, "produce failed")
+}
+
+func (s *BrokerSuite) TestLogScripting(c *C) {
+	conf := kafka.NewConsumerConf("test", 0)
+	conf.StartOffset = kafka.StartOffsetNewest
+	consumer, err := s.broker.Consumer(conf)
+	c.Assert(err, IsNil)
+	go func() {
+		consumer.(*Consumer).Messages <- &proto.Message{Value: []byte("scripted")}
+	}()
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "scripted")
+
+	// scripted messages leave the offset unchanged
+	s.produce(c, "test", 0, "a")
+	c.Assert(consumeValues(c, consumer.Consume, 1), DeepEquals, []string{"a"})
+}
+
+func (s *BrokerSuite) TestMetadata(c *C) {
+	s.produce(c, "b", 2, "x")
+	s.produce(c, "a", 0, "x")
+
+	count, err := s.broker.PartitionCount("b")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int32(3))
+	_, err = s.broker.PartitionCount("c")
+	c.Assert(err, ErrorMatches, "topic c not found in metadata")
+	_, err = s.broker.OffsetEarliest("c", 0)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
+	c.Assert(err, ErrorMatches, `kafka: offset \[c:0\] on localhost:9092 \(attempt 1\): .*`)
+	_, err = s.broker.OffsetLatest("c", 1)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
+
+	meta, err := s.broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Brokers, HasLen, 1)
+	c.Assert(meta.Topics, HasLen, 2)
+	c.Assert(meta.Topics[0].Name, Equals, "a")
+	c.Assert(meta.Topics[1].Partitions, HasLen, 3)
+	c.Assert(meta.Topics[1].Partitions[2].Leader, Equals, meta.Brokers[0].NodeID)
+}
+
+func (s *BrokerSuite) TestOffsetCoordinator(c *C) {
+	conf := kafka.NewOffsetCoordinatorConf("group")
+	coordinator, err := s.broker.OffsetCoordinator(conf)
+	c.Assert(err, IsNil)
+	mock := coordinator.(*OffsetCoordinator)
+
+	_, _, err = coordinator.Offset("test", 0)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
+	c.Assert(coordinator.Commit("test", 0, -1), ErrorMatches,
+		`cannot commit negative offset -1 for \[test:0\]`)
+	c.Assert(mock.CommitFull("test", 0, 5, "meta"), IsNil)
+	c.Assert(mock.Offsets["test:0"], Equals, int64(5))
+
+	// committed offsets are shared by the coordinators of the group
+	same, err := s.broker.OffsetCoordinator(conf)
+	c.Assert(err, IsNil)
+	off, meta, err := same.Offset("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(off, Equals, int64(5))
+	c.Assert(meta, Equals, "meta")
+
+	other, err := s.broker.OffsetCoordinator(kafka.NewOffsetCoordinatorConf("other"))
+	c.Assert(err, IsNil)
+	_, _, err = other.Offset("test", 0)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
+}
+
+func (s *BrokerSuite) TestSeededOffsets(c *C) {
+	coordinator, err := s.broker.OffsetCoordinator(kafka.NewOffsetCoordinatorConf("group"))
+	c.Assert(err, IsNil)
+	coordinator.(*OffsetCoordinator).Offsets["test:0"] = 5
+
+	off, _, err := coordinator.Offset("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(off, Equals, int64(5))
+	_, _, err = coordinator.Offset("test", 1)
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
+
+	c.Assert(coordinator.Commit("test", 0, 7), IsNil)
+	off, _, err = coordinator.Offset("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(off, Equals, int64(7))
+}
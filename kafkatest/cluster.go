@@ -0,0 +1,348 @@
+package kafkatest
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// Cluster is a fake kafka cluster of several brokers sharing a single log
+// store. Every partition is replicated to all brokers and led by one of them:
+// brokers that don't lead a partition answer requests for it with
+// proto.ErrNotLeaderForPartition, like a real cluster does after a leader
+// moved.
+type Cluster struct {
+	server *Server
+
+	mu      *sync.Mutex
+	brokers map[int32]*clusterBroker
+	leaders map[topicPartition]int32
+	closed  bool
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// clusterBroker is a single broker of a Cluster. Its address is kept when it
+// is stopped, so that it can be started again on the same one.
+type clusterBroker struct {
+	id    int32
+	addr  string
+	ln    net.Listener // nil when stopped
+	conns map[net.Conn]struct{}
+}
+
+// NewCluster starts a cluster of n brokers, with node IDs 1 to n, listening on
+// random local ports. Middlewares are called for the requests received by any
+// of the brokers, see NewServer. It panics if a broker cannot be started.
+// Use Close method to stop the cluster.
+func NewCluster(n int, middlewares ...Middleware) *Cluster {
+	if n < 1 {
+		panic(fmt.Sprintf("invalid number of brokers: %d", n))
+	}
+	c := &Cluster{
+		server:  NewServer(middlewares...),
+		mu:      &sync.Mutex{},
+		brokers: make(map[int32]*clusterBroker),
+		leaders: make(map[topicPartition]int32),
+	}
+	c.server.cluster = c
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id := int32(1); id <= int32(n); id++ {
+		b := &clusterBroker{id: id, addr: "127.0.0.1:0"}
+		if err := c.listen(b); err != nil {
+			panic(fmt.Sprintf("cannot start broker %d: %s", id, err))
+		}
+		c.brokers[id] = b
+	}
+	return c
+}
+
+// listen starts accepting connections for the broker. Must be called with the
+// mutex held.
+func (c *Cluster) listen(b *clusterBroker) error {
+	ln, err := net.Listen("tcp4", b.addr)
+	if err != nil {
+		return err
+	}
+	b.addr = ln.Addr().String()
+	b.ln = ln
+	b.conns = make(map[net.Conn]struct{})
+	go c.serve(b, ln)
+	return nil
+}
+
+func (c *Cluster) serve(b *clusterBroker, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		if b.ln != ln {
+			// stopped in the meantime
+			c.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		b.conns[conn] = struct{}{}
+		c.mu.Unlock()
+
+		go func() {
+			c.server.handleClient(b.id, conn)
+
+			c.mu.Lock()
+			delete(b.conns, conn)
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// Addrs returns the addresses of the running brokers, sorted by node ID.
+func (c *Cluster) Addrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var addrs []string
+	for _, id := range c.nodeIDs() {
+		if b := c.brokers[id]; b.ln != nil {
+			addrs = append(addrs, b.addr)
+		}
+	}
+	return addrs
+}
+
+// Addr returns the address of a broker, even if it is stopped, or an empty
+// string if there is no such broker.
+func (c *Cluster) Addr(nodeID int32) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b, ok := c.brokers[nodeID]; ok {
+		return b.addr
+	}
+	return ""
+}
+
+// Leader returns the node ID of the leader of a partition, or -1 if all its
+// replicas are stopped.
+func (c *Cluster) Leader(topic string, partition int32) int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.leader(topic, partition)
+}
+
+// MoveLeader makes the given broker the leader of a partition. Clients only
+// notice when the old leader rejects their requests, or when they refresh
+// their metadata.
+func (c *Cluster) MoveLeader(topic string, partition int32, nodeID int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.brokers[nodeID]
+	if !ok {
+		return fmt.Errorf("unknown broker %d", nodeID)
+	}
+	if b.ln == nil {
+		return fmt.Errorf("broker %d is stopped", nodeID)
+	}
+	old := c.leader(topic, partition)
+	c.leaders[topicPartition{topic, partition}] = nodeID
+	log.Info("moved leader", "topic", topic, "partition", partition, "from", old, "to", nodeID)
+	return nil
+}
+
+// StopBroker closes the listener and all the connections of a broker. The
+// partitions it led are moved to the next running replica.
+func (c *Cluster) StopBroker(nodeID int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.brokers[nodeID]
+	if !ok {
+		return fmt.Errorf("unknown broker %d", nodeID)
+	}
+	if b.ln == nil {
+		return nil
+	}
+	err := b.ln.Close()
+	b.ln = nil
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+	b.conns = nil
+
+	for tp, leader := range c.leaders {
+		if leader == nodeID {
+			delete(c.leaders, tp)
+		}
+	}
+	log.Info("stopped broker", "node", nodeID, "addr", b.addr)
+	return err
+}
+
+// StartBroker starts a stopped broker again, on the address it had before.
+// It doesn't take back the leadership of any partition.
+func (c *Cluster) StartBroker(nodeID int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.brokers[nodeID]
+	if !ok {
+		return fmt.Errorf("unknown broker %d", nodeID)
+	}
+	if c.closed {
+		return fmt.Errorf("cluster closed")
+	}
+	if b.ln != nil {
+		return nil
+	}
+	if err := c.listen(b); err != nil {
+		return fmt.Errorf("cannot start broker %d: %s", nodeID, err)
+	}
+	log.Info("started broker", "node", nodeID, "addr", b.addr)
+	return nil
+}
+
+// Close stops all brokers. It is safe to call it more than once.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	ids := c.nodeIDs()
+	c.closed = true
+	c.mu.Unlock()
+
+	// The shared store has no listener; closing it ends the requests waiting
+	// for a group.
+	_ = c.server.Close()
+
+	var resErr error
+	for _, id := range ids {
+		if err := c.StopBroker(id); err != nil && resErr == nil {
+			resErr = err
+		}
+	}
+	return resErr
+}
+
+// AddMessages appends messages to the given topic/partition, creating them
+// if needed. See Server.AddMessages.
+func (c *Cluster) AddMessages(topic string, partition int32, messages ...*proto.Message) {
+	c.server.AddMessages(topic, partition, messages...)
+}
+
+// CommittedOffset returns the offset and metadata last committed by a
+// consumer group for a partition, see Server.CommittedOffset.
+func (c *Cluster) CommittedOffset(group, topic string, partition int32) (int64, string, bool) {
+	return c.server.CommittedOffset(group, topic, partition)
+}
+
+// Reset clears out all messages and topics.
+func (c *Cluster) Reset() {
+	c.server.Reset()
+}
+
+// SetClock replaces the clock of the cluster, see Server.SetClock.
+func (c *Cluster) SetClock(now func() time.Time) {
+	c.server.SetClock(now)
+}
+
+// nodeIDs returns the IDs of all brokers, sorted. Must be called with the
+// mutex held.
+func (c *Cluster) nodeIDs() []int32 {
+	ids := make([]int32, 0, len(c.brokers))
+	for id := range c.brokers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// replicas returns the replicas of a partition: all brokers, starting with the
+// preferred leader so that leadership is spread across brokers. Must be called
+// with the mutex held.
+func (c *Cluster) replicas(partition int32) []int32 {
+	ids := c.nodeIDs()
+	start := int(partition) % len(ids)
+	return append(append([]int32(nil), ids[start:]...), ids[:start]...)
+}
+
+// leader returns the leader of a partition, electing the first running
+// replica if it has none. Must be called with the mutex held.
+func (c *Cluster) leader(topic string, partition int32) int32 {
+	tp := topicPartition{topic, partition}
+	if leader, ok := c.leaders[tp]; ok {
+		return leader
+	}
+	for _, id := range c.replicas(partition) {
+		if c.brokers[id].ln != nil {
+			c.leaders[tp] = id
+			return id
+		}
+	}
+	return -1
+}
+
+// leads returns whether nodeID leads the partition.
+func (c *Cluster) leads(nodeID int32, topic string, partition int32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.leader(topic, partition) == nodeID
+}
+
+// partitionMetadata returns the leader, replicas and in-sync replicas of a
+// partition. Stopped brokers are not in sync.
+func (c *Cluster) partitionMetadata(topic string, partition int32) proto.MetadataRespPartition {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := proto.MetadataRespPartition{
+		ID:       partition,
+		Leader:   c.leader(topic, partition),
+		Replicas: c.replicas(partition),
+		Isrs:     []int32{},
+	}
+	for _, id := range p.Replicas {
+		if c.brokers[id].ln != nil {
+			p.Isrs = append(p.Isrs, id)
+		}
+	}
+	if p.Leader < 0 {
+		p.Err = proto.ErrLeaderNotAvailable
+	}
+	return p
+}
+
+// runningBrokers returns the running brokers, sorted by node ID.
+func (c *Cluster) runningBrokers() []proto.MetadataRespBroker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var brokers []proto.MetadataRespBroker
+	for _, id := range c.nodeIDs() {
+		b := c.brokers[id]
+		if b.ln == nil {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(b.addr)
+		prt, _ := strconv.Atoi(port)
+		brokers = append(brokers, proto.MetadataRespBroker{
+			NodeID: id,
+			Host:   host,
+			Port:   int32(prt),
+		})
+	}
+	return brokers
+}
@@ -0,0 +1,129 @@
+package kafkatest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&ClusterSuite{})
+
+type ClusterSuite struct{}
+
+func (s *ClusterSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *ClusterSuite) newBroker(c *C, name string, cluster *Cluster) *kafka.Broker {
+	conf := kafka.NewBrokerConf("tester")
+	conf.LeaderRetryWait = time.Millisecond
+	conf.ClusterConnectionConf.DialTimeout = 200 * time.Millisecond
+	broker, err := kafka.NewBroker(name, cluster.Addrs(), conf)
+	c.Assert(err, IsNil)
+	return broker
+}
+
+func (s *ClusterSuite) newProducer(broker *kafka.Broker) kafka.Producer {
+	conf := kafka.NewProducerConf()
+	conf.RetryWait = time.Millisecond
+	return broker.Producer(conf)
+}
+
+// produce retries producing a message until it succeeds, as the producer
+// doesn't retry by itself after the leader moved.
+func (s *ClusterSuite) produce(c *C, producer kafka.Producer, value string) int64 {
+	var err error
+	for try := 0; try < 20; try++ {
+		var offset int64
+		offset, err = producer.Produce("test", 0, &proto.Message{Value: []byte(value)})
+		if err == nil {
+			return offset
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("cannot produce %q: %s", value, err)
+	return 0
+}
+
+func (s *ClusterSuite) TestMetadata(c *C) {
+	cluster := NewCluster(3)
+	defer cluster.Close()
+	cluster.AddMessages("test", 2)
+
+	broker := s.newBroker(c, "kafkatest-cluster-metadata", cluster)
+	parts, err := broker.TopicMetadata("test")
+	c.Assert(err, IsNil)
+	c.Assert(parts, HasLen, 3)
+	for i, part := range parts {
+		// leaders are spread across brokers
+		c.Assert(part.Leader, Equals, int32(i+1))
+		c.Assert(part.Leader, Equals, cluster.Leader("test", int32(i)))
+		c.Assert(part.Replicas, HasLen, 3)
+		c.Assert(part.Isrs, HasLen, 3)
+	}
+	c.Assert(cluster.Addrs(), HasLen, 3)
+	c.Assert(cluster.Addr(2), Equals, cluster.Addrs()[1])
+	c.Assert(cluster.Addr(4), Equals, "")
+}
+
+func (s *ClusterSuite) TestMoveLeader(c *C) {
+	cluster := NewCluster(3)
+	defer cluster.Close()
+	cluster.AddMessages("test", 0)
+	c.Assert(cluster.Leader("test", 0), Equals, int32(1))
+
+	broker := s.newBroker(c, "kafkatest-cluster-move-leader", cluster)
+	producer := s.newProducer(broker)
+	c.Assert(s.produce(c, producer, "first"), Equals, int64(0))
+
+	// The old leader rejects the next message, so the producer refreshes its
+	// metadata and finds the new leader.
+	c.Assert(cluster.MoveLeader("test", 0, 3), IsNil)
+	_, err := producer.Produce("test", 0, &proto.Message{Value: []byte("rejected")})
+	c.Assert(err, NotNil)
+	c.Assert(s.produce(c, producer, "second"), Equals, int64(1))
+	parts, err := broker.TopicMetadata("test")
+	c.Assert(err, IsNil)
+	c.Assert(parts[0].Leader, Equals, int32(3))
+
+	c.Assert(cluster.MoveLeader("test", 0, 4), NotNil)
+
+	consConf := kafka.NewConsumerConf("test", 0)
+	consConf.StartOffset = kafka.StartOffsetOldest
+	consumer, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+	for _, value := range []string{"first", "second"} {
+		msg, err := consumer.Consume()
+		c.Assert(err, IsNil)
+		c.Assert(string(msg.Value), Equals, value)
+	}
+}
+
+func (s *ClusterSuite) TestStopBroker(c *C) {
+	cluster := NewCluster(2)
+	defer cluster.Close()
+	cluster.AddMessages("test", 0)
+
+	broker := s.newBroker(c, "kafkatest-cluster-stop-broker", cluster)
+	producer := s.newProducer(broker)
+	c.Assert(s.produce(c, producer, "first"), Equals, int64(0))
+
+	// Stopping the leader moves the partition to the other replica.
+	c.Assert(cluster.StopBroker(1), IsNil)
+	c.Assert(cluster.Leader("test", 0), Equals, int32(2))
+	c.Assert(cluster.Addrs(), DeepEquals, []string{cluster.Addr(2)})
+	c.Assert(s.produce(c, producer, "second"), Equals, int64(1))
+
+	// Without running replicas, the partition has no leader.
+	c.Assert(cluster.StopBroker(2), IsNil)
+	c.Assert(cluster.Leader("test", 0), Equals, int32(-1))
+
+	c.Assert(cluster.StartBroker(1), IsNil)
+	c.Assert(cluster.Leader("test", 0), Equals, int32(1))
+	c.Assert(s.produce(c, producer, "third"), Equals, int64(2))
+}
@@ -2,7 +2,17 @@
 
 Package kafkatest provides mock objects for high level kafka interface.
 
-Use NewBroker function to create mock broker object and standard methods to create producers and consumers.
+Use NewBroker function to create mock broker object and standard methods to create producers and consumers. The broker keeps an in-memory log of every partition, so that produced messages get the offsets a real broker would give them. Producers are scripted with ReadProducers, and consumers with their Messages and Errors channels. Consumers of a broker created with NewLogBroker also read the produced messages back from the logs.
+
+Use NewServer or NewCluster to run fake kafka brokers that real clients connect to over the network. A Cluster runs several brokers sharing a log store, whose partition leaders can be moved and brokers stopped at runtime.
+
+Messages are kept forever unless a RetentionPolicy is set for their topic. DeleteRecordsBefore and Compact delete messages explicitly, so that clients see the earliest offset move and get proto.ErrOffsetOutOfRange. Compaction keeps the last tombstone of every key, which CompactWithDeleteRetention removes once it is old enough.
+
+Messages are stamped with their append time, which is taken from the clock set with SetClock, so that retention by age and offset requests by timestamp can be tested without waiting.
+
+Servers also act as the coordinator of consumer groups. Sessions expire and rebalances time out according to the same clock, and Rebalance forces the members of a group to join again.
+
+A Replayer answers requests with the responses of a recording made with kafka.Recorder, so that a session with real brokers can be reproduced by a server in a unit test.
 
 */
 package kafkatest
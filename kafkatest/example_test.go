@@ -16,26 +16,23 @@ func ExampleBroker_Producer() {
 
 	producer := broker.Producer(kafka.NewProducerConf())
 
-	// mock server actions, handling any produce call
-	go func() {
-		resp, err := broker.ReadProducers(time.Millisecond * 20)
-		if err != nil {
-			panic(fmt.Sprintf("failed reading producers: %s", err))
-		}
-		if len(resp.Messages) != 1 {
-			panic("expected single message")
-		}
-		if !reflect.DeepEqual(resp.Messages[0], msg) {
-			panic("expected different message")
-		}
-	}()
-
-	// provide data for above goroutine
 	_, err := producer.Produce("my-topic", 0, msg)
 	if err != nil {
 		panic(fmt.Sprintf("cannot produce message: %s", err))
 	}
 
+	// mock server actions, checking the produce call
+	resp, err := broker.ReadProducers(time.Millisecond * 20)
+	if err != nil {
+		panic(fmt.Sprintf("failed reading producers: %s", err))
+	}
+	if len(resp.Messages) != 1 {
+		panic("expected single message")
+	}
+	if !reflect.DeepEqual(resp.Messages[0], msg) {
+		panic("expected different message")
+	}
+
 	mockProducer := producer.(*Producer)
 
 	// test error handling by forcing producer to return error,
@@ -63,7 +60,8 @@ func ExampleBroker_Consumer() {
 		c.Messages <- msg
 
 		// every consumer fetch call is blocking untill there is either message
-		// or error ready to return, this way we can test slow consumers
+		// or error ready to return, unless a RetryLimit is configured -- this
+		// way we can test slow consumers
 		time.Sleep(time.Millisecond * 20)
 
 		// ...as well as push errors to mock failure
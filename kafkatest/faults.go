@@ -0,0 +1,387 @@
+package kafkatest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// FaultAction is what a server does with a request matched by a Fault.
+type FaultAction int
+
+const (
+	// FaultDelay waits for Fault.Delay before handling the request.
+	FaultDelay FaultAction = iota + 1
+	// FaultCloseConnection closes the connection without responding.
+	FaultCloseConnection
+	// FaultError responds with Fault.Err for every matched partition, or for
+	// the whole response if it has no partitions.
+	FaultError
+	// FaultTruncate writes the first Fault.TruncateTo bytes of the response,
+	// or half of it if TruncateTo is zero, then closes the connection.
+	FaultTruncate
+	// FaultCorrupt flips the last byte of the response, which corrupts the
+	// CRC of the last message of a fetch response.
+	FaultCorrupt
+	// FaultHang never responds, and keeps reading and dropping requests until
+	// the client closes the connection.
+	FaultHang
+)
+
+func (a FaultAction) String() string {
+	switch a {
+	case FaultDelay:
+		return "delay"
+	case FaultCloseConnection:
+		return "close_connection"
+	case FaultError:
+		return "error"
+	case FaultTruncate:
+		return "truncate"
+	case FaultCorrupt:
+		return "corrupt"
+	case FaultHang:
+		return "hang"
+	default:
+		return fmt.Sprintf("FaultAction(%d)", int(a))
+	}
+}
+
+// Fault is a rule injecting a failure in the handling of the requests it
+// matches. Empty filters match everything.
+type Fault struct {
+	// Kinds are the request kinds to match, such as proto.FetchReqKind.
+	Kinds []int16
+
+	// Topic and Partitions only match requests about the given topic and
+	// partitions. Requests without partitions, like metadata requests, only
+	// match if Partitions is empty.
+	Topic      string
+	Partitions []int32
+
+	// Nodes only match requests received by the given brokers of a Cluster.
+	Nodes []int32
+
+	// Probability of applying the fault to a matched request, or zero to
+	// always apply it.
+	Probability float64
+
+	// Count is how many times the fault is applied before it is removed, or
+	// zero to never remove it.
+	Count int
+
+	Action FaultAction
+
+	// Delay is used by FaultDelay.
+	Delay time.Duration
+	// Err is used by FaultError. Defaults to proto.ErrUnknown.
+	Err *proto.KafkaError
+	// TruncateTo is used by FaultTruncate.
+	TruncateTo int
+}
+
+// matches returns whether the fault applies to a request, ignoring its
+// probability. Must be called with the mutex of the fault set held.
+func (f *Fault) matches(nodeID int32, kind int16, topics map[string][]int32) bool {
+	if len(f.Kinds) > 0 && !containsKind(f.Kinds, kind) {
+		return false
+	}
+	if len(f.Nodes) > 0 && !containsID(f.Nodes, nodeID) {
+		return false
+	}
+	if f.Topic == "" && len(f.Partitions) == 0 {
+		return true
+	}
+	for topic, partitions := range topics {
+		if f.Topic != "" && topic != f.Topic {
+			continue
+		}
+		if len(f.Partitions) == 0 {
+			return true
+		}
+		for _, partition := range partitions {
+			if containsID(f.Partitions, partition) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesPartition returns whether the fault applies to a single partition
+// of a response.
+func (f *Fault) matchesPartition(topic string, partition int32) bool {
+	return (f.Topic == "" || topic == f.Topic) &&
+		(len(f.Partitions) == 0 || containsID(f.Partitions, partition))
+}
+
+// faultSet keeps the faults added to a server.
+type faultSet struct {
+	mu     sync.Mutex
+	faults []*Fault
+	rnd    *rand.Rand
+}
+
+// AddFault injects a fault in the handling of the requests it matches. Faults
+// are tried in the order they were added and at most one applies to every
+// request, before any middleware is called. The returned function removes the
+// fault.
+func (s *Server) AddFault(f Fault) func() {
+	fault := &f
+
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+
+	s.faults.faults = append(s.faults.faults, fault)
+	return func() {
+		s.faults.mu.Lock()
+		defer s.faults.mu.Unlock()
+
+		s.faults.remove(fault)
+	}
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+
+	s.faults.faults = nil
+}
+
+// AddFault injects a fault in the handling of the requests received by the
+// brokers of the cluster, see Server.AddFault.
+func (c *Cluster) AddFault(f Fault) func() {
+	return c.server.AddFault(f)
+}
+
+// ClearFaults removes all faults.
+func (c *Cluster) ClearFaults() {
+	c.server.ClearFaults()
+}
+
+// remove removes a fault. Must be called with the mutex held.
+func (fs *faultSet) remove(fault *Fault) {
+	for i, f := range fs.faults {
+		if f == fault {
+			fs.faults = append(fs.faults[:i], fs.faults[i+1:]...)
+			return
+		}
+	}
+}
+
+// match returns a copy of the first fault applying to the request, or nil.
+func (fs *faultSet) match(nodeID int32, kind int16, b []byte) *Fault {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.faults) == 0 {
+		return nil
+	}
+	topics := requestTopics(kind, b)
+	for _, f := range fs.faults {
+		if !f.matches(nodeID, kind, topics) {
+			continue
+		}
+		if f.Probability > 0 && fs.rnd.Float64() >= f.Probability {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				fs.remove(f)
+			}
+		}
+		fault := *f
+		log.Info("injecting fault", "action", fault.Action, "node", nodeID, "kind", kind)
+		return &fault
+	}
+	return nil
+}
+
+// requestTopics returns the partitions of every topic a request is about.
+// Topics without partitions, like in metadata requests, map to nil.
+func requestTopics(kind int16, b []byte) map[string][]int32 {
+	topics := make(map[string][]int32)
+	switch kind {
+	case proto.ProduceReqKind:
+		if req, err := proto.ReadProduceReq(bytes.NewBuffer(b)); err == nil {
+			for _, t := range req.Topics {
+				for _, p := range t.Partitions {
+					topics[t.Name] = append(topics[t.Name], p.ID)
+				}
+			}
+		}
+	case proto.FetchReqKind:
+		if req, err := proto.ReadFetchReq(bytes.NewBuffer(b)); err == nil {
+			for _, t := range req.Topics {
+				for _, p := range t.Partitions {
+					topics[t.Name] = append(topics[t.Name], p.ID)
+				}
+			}
+		}
+	case proto.OffsetReqKind:
+		if req, err := proto.ReadOffsetReq(bytes.NewBuffer(b)); err == nil {
+			for _, t := range req.Topics {
+				for _, p := range t.Partitions {
+					topics[t.Name] = append(topics[t.Name], p.ID)
+				}
+			}
+		}
+	case proto.OffsetCommitReqKind:
+		if req, err := proto.ReadOffsetCommitReq(bytes.NewBuffer(b)); err == nil {
+			for _, t := range req.Topics {
+				for _, p := range t.Partitions {
+					topics[t.Name] = append(topics[t.Name], p.ID)
+				}
+			}
+		}
+	case proto.OffsetFetchReqKind:
+		if req, err := proto.ReadOffsetFetchReq(bytes.NewBuffer(b)); err == nil {
+			for _, t := range req.Topics {
+				topics[t.Name] = append(topics[t.Name], t.Partitions...)
+			}
+		}
+	case proto.MetadataReqKind:
+		if req, err := proto.ReadMetadataReq(bytes.NewBuffer(b)); err == nil {
+			for _, name := range req.Topics {
+				topics[name] = nil
+			}
+		}
+	}
+	return topics
+}
+
+// applyBefore applies the actions happening before the request is handled.
+// It returns false if the request must not be handled.
+func (f *Fault) applyBefore(conn io.Reader) bool {
+	switch f.Action {
+	case FaultDelay:
+		time.Sleep(f.Delay)
+	case FaultCloseConnection:
+		return false
+	case FaultHang:
+		_, _ = io.Copy(ioutil.Discard, conn)
+		return false
+	}
+	return true
+}
+
+// applyError sets the error of the fault on every matched partition of the
+// response.
+func (f *Fault) applyError(resp response) {
+	var err error = proto.ErrUnknown
+	if f.Err != nil {
+		err = f.Err
+	}
+	switch resp := resp.(type) {
+	case *proto.ProduceResp:
+		for ti := range resp.Topics {
+			t := &resp.Topics[ti]
+			for pi := range t.Partitions {
+				if f.matchesPartition(t.Name, t.Partitions[pi].ID) {
+					t.Partitions[pi].Err = err
+					t.Partitions[pi].Offset = -1
+				}
+			}
+		}
+	case *proto.FetchResp:
+		for ti := range resp.Topics {
+			t := &resp.Topics[ti]
+			for pi := range t.Partitions {
+				if f.matchesPartition(t.Name, t.Partitions[pi].ID) {
+					t.Partitions[pi].Err = err
+					t.Partitions[pi].Messages = nil
+					t.Partitions[pi].Batches = nil
+				}
+			}
+		}
+	case *proto.OffsetResp:
+		for ti := range resp.Topics {
+			t := &resp.Topics[ti]
+			for pi := range t.Partitions {
+				if f.matchesPartition(t.Name, t.Partitions[pi].ID) {
+					t.Partitions[pi].Err = err
+					t.Partitions[pi].Offsets = nil
+				}
+			}
+		}
+	case *proto.OffsetCommitResp:
+		for ti := range resp.Topics {
+			t := &resp.Topics[ti]
+			for pi := range t.Partitions {
+				if f.matchesPartition(t.Name, t.Partitions[pi].ID) {
+					t.Partitions[pi].Err = err
+				}
+			}
+		}
+	case *proto.OffsetFetchResp:
+		for ti := range resp.Topics {
+			t := &resp.Topics[ti]
+			for pi := range t.Partitions {
+				if f.matchesPartition(t.Name, t.Partitions[pi].ID) {
+					t.Partitions[pi].Err = err
+				}
+			}
+		}
+	case *proto.MetadataResp:
+		for ti := range resp.Topics {
+			if f.Topic == "" || resp.Topics[ti].Name == f.Topic {
+				resp.Topics[ti].Err = err
+				resp.Topics[ti].Partitions = nil
+			}
+		}
+	case *proto.GroupCoordinatorResp:
+		resp.Err = err
+	case *proto.JoinGroupResp:
+		resp.Err = err
+	case *proto.SyncGroupResp:
+		resp.Err = err
+	case *proto.HeartbeatResp:
+		resp.Err = err
+	case *proto.LeaveGroupResp:
+		resp.Err = err
+	}
+}
+
+// applyAfter changes the serialized response. It returns false if the
+// connection must be closed after writing it.
+func (f *Fault) applyAfter(b []byte) ([]byte, bool) {
+	switch f.Action {
+	case FaultTruncate:
+		n := f.TruncateTo
+		if n <= 0 || n > len(b) {
+			n = len(b) / 2
+		}
+		return b[:n], false
+	case FaultCorrupt:
+		if len(b) > 0 {
+			b[len(b)-1] ^= 0xff
+		}
+	}
+	return b, true
+}
+
+func containsKind(kinds []int16, kind int16) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func containsID(ids []int32, id int32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
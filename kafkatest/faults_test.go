@@ -0,0 +1,177 @@
+package kafkatest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&FaultsSuite{})
+
+type FaultsSuite struct {
+	srv *Server
+}
+
+func (s *FaultsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+	s.srv = NewServer()
+	s.srv.MustSpawn()
+	s.srv.AddMessages("test", 1,
+		&proto.Message{Value: []byte("first")},
+		&proto.Message{Value: []byte("second")})
+}
+
+func (s *FaultsSuite) TearDownTest(c *C) {
+	_ = s.srv.Close()
+}
+
+// fetch sends a fetch request for test:1 on conn and returns the raw response.
+func (s *FaultsSuite) fetch(c *C, conn net.Conn) ([]byte, error) {
+	req := &proto.FetchReq{
+		CorrelationID: 1,
+		MaxWaitTime:   time.Millisecond,
+		Topics: []proto.FetchReqTopic{
+			{Name: "test", Partitions: []proto.FetchReqPartition{{ID: 1, MaxBytes: 1024}}},
+		},
+	}
+	_, err := req.WriteTo(conn)
+	c.Assert(err, IsNil)
+	c.Assert(conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)), IsNil)
+	_, b, err := proto.ReadResp(conn)
+	return b, err
+}
+
+func (s *FaultsSuite) dial(c *C) net.Conn {
+	conn, err := net.Dial("tcp", s.srv.Addr())
+	c.Assert(err, IsNil)
+	return conn
+}
+
+func (s *FaultsSuite) TestError(c *C) {
+	s.srv.AddFault(Fault{
+		Kinds:  []int16{proto.FetchReqKind},
+		Topic:  "test",
+		Count:  1,
+		Action: FaultError,
+		Err:    proto.ErrNotLeaderForPartition,
+	})
+	conn := s.dial(c)
+	defer conn.Close()
+
+	b, err := s.fetch(c, conn)
+	c.Assert(err, IsNil)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotLeaderForPartition)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 0)
+
+	// The fault was only applied once.
+	b, err = s.fetch(c, conn)
+	c.Assert(err, IsNil)
+	resp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 2)
+}
+
+func (s *FaultsSuite) TestFilters(c *C) {
+	// None of these match a fetch of test:1.
+	s.srv.AddFault(Fault{Kinds: []int16{proto.ProduceReqKind}, Action: FaultCloseConnection})
+	s.srv.AddFault(Fault{Topic: "other", Action: FaultCloseConnection})
+	s.srv.AddFault(Fault{Topic: "test", Partitions: []int32{0}, Action: FaultCloseConnection})
+	s.srv.AddFault(Fault{Nodes: []int32{1}, Action: FaultCloseConnection})
+	remove := s.srv.AddFault(Fault{Partitions: []int32{1}, Action: FaultCloseConnection})
+
+	conn := s.dial(c)
+	defer conn.Close()
+	_, err := s.fetch(c, conn)
+	c.Assert(err, Equals, io.EOF)
+
+	remove()
+	conn = s.dial(c)
+	defer conn.Close()
+	_, err = s.fetch(c, conn)
+	c.Assert(err, IsNil)
+}
+
+func (s *FaultsSuite) TestDelay(c *C) {
+	s.srv.AddFault(Fault{Action: FaultDelay, Delay: 50 * time.Millisecond})
+	conn := s.dial(c)
+	defer conn.Close()
+
+	start := time.Now()
+	_, err := s.fetch(c, conn)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+}
+
+func (s *FaultsSuite) TestHang(c *C) {
+	s.srv.AddFault(Fault{Action: FaultHang})
+	conn := s.dial(c)
+	defer conn.Close()
+
+	_, err := s.fetch(c, conn)
+	c.Assert(err, NotNil)
+	netErr, ok := err.(net.Error)
+	c.Assert(ok, Equals, true)
+	c.Assert(netErr.Timeout(), Equals, true)
+}
+
+func (s *FaultsSuite) TestTruncate(c *C) {
+	s.srv.AddFault(Fault{Action: FaultTruncate, TruncateTo: 10})
+	conn := s.dial(c)
+	defer conn.Close()
+
+	_, err := s.fetch(c, conn)
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func (s *FaultsSuite) TestCorrupt(c *C) {
+	s.srv.AddFault(Fault{Kinds: []int16{proto.FetchReqKind}, Action: FaultCorrupt, Count: 1})
+
+	conf := kafka.NewBrokerConf("tester")
+	broker, err := kafka.NewBroker("kafkatest-faults-corrupt", []string{s.srv.Addr()}, conf)
+	c.Assert(err, IsNil)
+	consConf := kafka.NewConsumerConf("test", 1)
+	consumer, err := broker.BatchConsumer(consConf)
+	c.Assert(err, IsNil)
+
+	// The corrupted message is dropped, and fetched again.
+	batch, err := consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch, HasLen, 1)
+	c.Assert(string(batch[0].Value), Equals, "first")
+	batch, err = consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch, HasLen, 1)
+	c.Assert(string(batch[0].Value), Equals, "second")
+}
+
+func (s *FaultsSuite) TestClusterNodes(c *C) {
+	cluster := NewCluster(2)
+	defer cluster.Close()
+	cluster.AddMessages("test", 0)
+	cluster.AddFault(Fault{
+		Kinds:  []int16{proto.ProduceReqKind},
+		Nodes:  []int32{1},
+		Count:  2,
+		Action: FaultError,
+		Err:    proto.ErrNotEnoughReplicas,
+	})
+
+	conf := kafka.NewBrokerConf("tester")
+	broker, err := kafka.NewBroker("kafkatest-faults-cluster", cluster.Addrs(), conf)
+	c.Assert(err, IsNil)
+	producer := broker.Producer(kafka.NewProducerConf())
+	for i := 0; i < 2; i++ {
+		_, err = producer.Produce("test", 0, &proto.Message{Value: []byte("value")})
+		c.Assert(err, ErrorMatches, ".*not enough in-sync replicas.*")
+	}
+	_, err = producer.Produce("test", 0, &proto.Message{Value: []byte("value")})
+	c.Assert(err, IsNil)
+}
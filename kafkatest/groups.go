@@ -0,0 +1,595 @@
+package kafkatest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// groupTick is how often requests waiting for a rebalance check the session
+// and rebalance timeouts against the clock of the server.
+const groupTick = 10 * time.Millisecond
+
+// GroupState is the state of a consumer group, as kept by its coordinator.
+type GroupState int
+
+const (
+	// GroupEmpty has no members, but may have committed offsets.
+	GroupEmpty GroupState = iota
+	// GroupPreparingRebalance waits for all members to join again, or for
+	// the rebalance timeout, which is the longest session timeout of its
+	// members.
+	GroupPreparingRebalance
+	// GroupCompletingRebalance waits for the assignment of the leader.
+	GroupCompletingRebalance
+	// GroupStable has all members assigned.
+	GroupStable
+)
+
+func (s GroupState) String() string {
+	switch s {
+	case GroupEmpty:
+		return "Empty"
+	case GroupPreparingRebalance:
+		return "PreparingRebalance"
+	case GroupCompletingRebalance:
+		return "CompletingRebalance"
+	case GroupStable:
+		return "Stable"
+	default:
+		return fmt.Sprintf("GroupState(%d)", int(s))
+	}
+}
+
+// GroupInfo describes a consumer group.
+type GroupInfo struct {
+	State        GroupState
+	GenerationID int32
+	ProtocolType string
+	Protocol     string
+	LeaderID     string
+	Members      []string // sorted
+}
+
+// groupCoordinator implements the group membership protocol for all groups of
+// a server.
+type groupCoordinator struct {
+	mu     sync.Mutex
+	groups map[string]*group
+	nextID int
+}
+
+type group struct {
+	id           string
+	state        GroupState
+	generation   int32
+	protocolType string
+	protocol     string
+	leader       string
+	members      map[string]*groupMember
+
+	// deadline is when the rebalance completes without the members that
+	// didn't join again, while preparing a rebalance.
+	deadline time.Time
+}
+
+type groupMember struct {
+	id             string
+	sessionTimeout time.Duration
+	protocols      []proto.GroupProtocol
+	assignment     []byte
+	heartbeat      time.Time
+
+	// join and sync are set while the member waits for the rebalance to
+	// complete, and for the assignment of the leader.
+	join chan *proto.JoinGroupResp
+	sync chan *proto.SyncGroupResp
+}
+
+func newGroupCoordinator() *groupCoordinator {
+	return &groupCoordinator{
+		groups: make(map[string]*group),
+	}
+}
+
+// Group returns the state of a consumer group, after expiring the members
+// whose session timed out.
+func (s *Server) Group(groupID string) (GroupInfo, bool) {
+	now := s.clock()
+	c := s.groups
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(now)
+	g, ok := c.groups[groupID]
+	if !ok {
+		return GroupInfo{}, false
+	}
+	info := GroupInfo{
+		State:        g.state,
+		GenerationID: g.generation,
+		ProtocolType: g.protocolType,
+		Protocol:     g.protocol,
+		LeaderID:     g.leader,
+		Members:      make([]string, 0, len(g.members)),
+	}
+	for id := range g.members {
+		info.Members = append(info.Members, id)
+	}
+	sort.Strings(info.Members)
+	return info, true
+}
+
+// Rebalance forces a rebalance of a consumer group, like a new member joining
+// it does. Members are told with proto.ErrRebalanceInProgress on their next
+// heartbeat, and must join the group again.
+func (s *Server) Rebalance(groupID string) error {
+	now := s.clock()
+	c := s.groups
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(now)
+	g, ok := c.groups[groupID]
+	if !ok {
+		return fmt.Errorf("unknown group %q", groupID)
+	}
+	if g.state != GroupPreparingRebalance {
+		g.prepareRebalance(now, "forced")
+	}
+	g.maybeCompleteJoin(now)
+	return nil
+}
+
+// Group returns the state of a consumer group, see Server.Group.
+func (c *Cluster) Group(groupID string) (GroupInfo, bool) {
+	return c.server.Group(groupID)
+}
+
+// Rebalance forces a rebalance of a consumer group, see Server.Rebalance.
+func (c *Cluster) Rebalance(groupID string) error {
+	return c.server.Rebalance(groupID)
+}
+
+// tick expires the members whose session timed out, and completes the
+// rebalances whose timeout passed. Must be called with the mutex held.
+func (c *groupCoordinator) tick(now time.Time) {
+	for _, g := range c.groups {
+		if g.state == GroupStable || g.state == GroupCompletingRebalance {
+			for _, m := range g.members {
+				if now.Sub(m.heartbeat) > m.sessionTimeout {
+					log.Info("member session expired", "group", g.id, "member", m.id)
+					g.removeMember(m)
+					g.prepareRebalance(now, "member expired")
+				}
+			}
+		}
+		g.maybeCompleteJoin(now)
+	}
+}
+
+// join adds or updates a member, and returns the channel its join response
+// is sent on once the rebalance completes.
+func (c *groupCoordinator) join(now time.Time, req *proto.JoinGroupReq) (<-chan *proto.JoinGroupResp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(now)
+	if req.GroupID == "" {
+		return nil, proto.ErrInvalidGroupID
+	}
+	if req.SessionTimeout <= 0 {
+		return nil, proto.ErrInvalidSessionTimeout
+	}
+	g, ok := c.groups[req.GroupID]
+	if !ok {
+		if req.MemberID != "" {
+			return nil, proto.ErrUnknownConsumerID
+		}
+		g = &group{
+			id:      req.GroupID,
+			state:   GroupEmpty,
+			members: make(map[string]*groupMember),
+		}
+		c.groups[req.GroupID] = g
+	}
+	if len(g.members) == 0 {
+		g.protocolType = req.ProtocolType
+	} else if req.ProtocolType != g.protocolType || !g.supportsProtocols(req.Protocols) {
+		return nil, proto.ErrInconsistentPartitionAssignmentStrategy
+	}
+
+	m, ok := g.members[req.MemberID]
+	if !ok && req.MemberID != "" {
+		return nil, proto.ErrUnknownConsumerID
+	}
+	ch := make(chan *proto.JoinGroupResp, 1)
+	if !ok {
+		c.nextID++
+		m = &groupMember{id: fmt.Sprintf("%s-%d", req.ClientID, c.nextID)}
+		g.members[m.id] = m
+		log.Info("member joined group", "group", g.id, "member", m.id)
+	} else if m.join != nil {
+		// replaced by the new request
+		m.join <- &proto.JoinGroupResp{Err: proto.ErrRebalanceInProgress, GenerationID: -1}
+	}
+	unchanged := ok && sameProtocols(m.protocols, req.Protocols)
+	m.sessionTimeout = req.SessionTimeout
+	m.protocols = req.Protocols
+	m.heartbeat = now
+
+	switch g.state {
+	case GroupCompletingRebalance, GroupStable:
+		if unchanged && (g.state == GroupCompletingRebalance || m.id != g.leader) {
+			// nothing changed, so the member gets the current generation
+			ch <- g.joinResponse(m)
+			return ch, nil
+		}
+		m.join = ch
+		g.prepareRebalance(now, "member joined")
+	case GroupEmpty:
+		m.join = ch
+		g.prepareRebalance(now, "member joined")
+	case GroupPreparingRebalance:
+		m.join = ch
+	}
+	g.maybeCompleteJoin(now)
+	return ch, nil
+}
+
+// sync returns the channel the assignment of a member is sent on, once the
+// leader sent the assignments of the group.
+func (c *groupCoordinator) sync(now time.Time, req *proto.SyncGroupReq) (<-chan *proto.SyncGroupResp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(now)
+	g, m, err := c.member(req.GroupID, req.MemberID)
+	if err != nil {
+		return nil, err
+	}
+	if req.GenerationID != g.generation {
+		return nil, proto.ErrIllegalGeneration
+	}
+	if g.state == GroupPreparingRebalance {
+		return nil, proto.ErrRebalanceInProgress
+	}
+	m.heartbeat = now
+
+	ch := make(chan *proto.SyncGroupResp, 1)
+	if g.state == GroupStable {
+		ch <- &proto.SyncGroupResp{Assignment: m.assignment}
+		return ch, nil
+	}
+	m.sync = ch
+	if m.id == g.leader {
+		for _, a := range req.Assignments {
+			if am, ok := g.members[a.MemberID]; ok {
+				am.assignment = a.Assignment
+			}
+		}
+		g.state = GroupStable
+		log.Info("group stable", "group", g.id, "generation", g.generation)
+		for _, gm := range g.members {
+			if gm.sync != nil {
+				gm.sync <- &proto.SyncGroupResp{Assignment: gm.assignment}
+				gm.sync = nil
+			}
+		}
+	}
+	return ch, nil
+}
+
+// heartbeat keeps the session of a member alive.
+func (c *groupCoordinator) heartbeat(now time.Time, req *proto.HeartbeatReq) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(now)
+	g, m, err := c.member(req.GroupID, req.MemberID)
+	if err != nil {
+		return err
+	}
+	switch g.state {
+	case GroupCompletingRebalance:
+		return proto.ErrRebalanceInProgress
+	case GroupPreparingRebalance:
+		if req.GenerationID != g.generation {
+			return proto.ErrIllegalGeneration
+		}
+		m.heartbeat = now
+		return proto.ErrRebalanceInProgress
+	}
+	if req.GenerationID != g.generation {
+		return proto.ErrIllegalGeneration
+	}
+	m.heartbeat = now
+	return nil
+}
+
+// leave removes a member from its group, which rebalances.
+func (c *groupCoordinator) leave(now time.Time, req *proto.LeaveGroupReq) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(now)
+	g, m, err := c.member(req.GroupID, req.MemberID)
+	if err != nil {
+		return err
+	}
+	log.Info("member left group", "group", g.id, "member", m.id)
+	g.removeMember(m)
+	if g.state != GroupPreparingRebalance {
+		g.prepareRebalance(now, "member left")
+	}
+	g.maybeCompleteJoin(now)
+	return nil
+}
+
+// member returns a member and its group. Must be called with the mutex held.
+func (c *groupCoordinator) member(groupID, memberID string) (*group, *groupMember, error) {
+	g, ok := c.groups[groupID]
+	if !ok {
+		return nil, nil, proto.ErrUnknownConsumerID
+	}
+	m, ok := g.members[memberID]
+	if !ok {
+		return nil, nil, proto.ErrUnknownConsumerID
+	}
+	return g, m, nil
+}
+
+// prepareRebalance waits for all members to join again, failing the members
+// waiting for their assignment.
+func (g *group) prepareRebalance(now time.Time, reason string) {
+	for _, m := range g.members {
+		if m.sync != nil {
+			m.sync <- &proto.SyncGroupResp{Err: proto.ErrRebalanceInProgress}
+			m.sync = nil
+		}
+	}
+	var timeout time.Duration
+	for _, m := range g.members {
+		if m.sessionTimeout > timeout {
+			timeout = m.sessionTimeout
+		}
+	}
+	g.state = GroupPreparingRebalance
+	g.deadline = now.Add(timeout)
+	log.Info("preparing rebalance", "group", g.id, "generation", g.generation, "reason", reason)
+}
+
+// maybeCompleteJoin completes the rebalance once all members joined again, or
+// once its timeout passed, without the members that didn't.
+func (g *group) maybeCompleteJoin(now time.Time) {
+	if g.state != GroupPreparingRebalance {
+		return
+	}
+	for _, m := range g.members {
+		if m.join == nil && now.Before(g.deadline) {
+			return
+		}
+	}
+	for _, m := range g.members {
+		if m.join == nil {
+			log.Info("member did not join again", "group", g.id, "member", m.id)
+			g.removeMember(m)
+		}
+	}
+
+	g.generation++
+	if len(g.members) == 0 {
+		g.state = GroupEmpty
+		g.protocol = ""
+		g.leader = ""
+		log.Info("group empty", "group", g.id, "generation", g.generation)
+		return
+	}
+	if _, ok := g.members[g.leader]; !ok {
+		ids := make([]string, 0, len(g.members))
+		for id := range g.members {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		g.leader = ids[0]
+	}
+	g.protocol = g.selectProtocol()
+	g.state = GroupCompletingRebalance
+	log.Info("rebalance completed", "group", g.id, "generation", g.generation,
+		"leader", g.leader, "members", len(g.members))
+	for _, m := range g.members {
+		m.heartbeat = now
+		m.join <- g.joinResponse(m)
+		m.join = nil
+	}
+}
+
+// joinResponse returns the response to a join request of a member. Only the
+// leader gets the metadata of all members.
+func (g *group) joinResponse(m *groupMember) *proto.JoinGroupResp {
+	resp := &proto.JoinGroupResp{
+		GenerationID:  g.generation,
+		GroupProtocol: g.protocol,
+		LeaderID:      g.leader,
+		MemberID:      m.id,
+		Members:       []proto.GroupMember{},
+	}
+	if m.id != g.leader {
+		return resp
+	}
+	for _, gm := range g.members {
+		for _, p := range gm.protocols {
+			if p.Name == g.protocol {
+				resp.Members = append(resp.Members, proto.GroupMember{MemberID: gm.id, Metadata: p.Metadata})
+			}
+		}
+	}
+	sort.Slice(resp.Members, func(i, j int) bool { return resp.Members[i].MemberID < resp.Members[j].MemberID })
+	return resp
+}
+
+// selectProtocol returns the protocol most preferred by the leader among the
+// ones supported by all members.
+func (g *group) selectProtocol() string {
+	for _, p := range g.members[g.leader].protocols {
+		if g.supportsProtocols([]proto.GroupProtocol{p}) {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// supportsProtocols returns whether all members support one of the protocols.
+func (g *group) supportsProtocols(protocols []proto.GroupProtocol) bool {
+	for _, p := range protocols {
+		supported := true
+		for _, m := range g.members {
+			found := false
+			for _, mp := range m.protocols {
+				if mp.Name == p.Name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				supported = false
+				break
+			}
+		}
+		if supported {
+			return true
+		}
+	}
+	return false
+}
+
+// removeMember removes a member. Its pending requests are answered with
+// proto.ErrUnknownConsumerID.
+func (g *group) removeMember(m *groupMember) {
+	if m.join != nil {
+		m.join <- &proto.JoinGroupResp{Err: proto.ErrUnknownConsumerID, GenerationID: -1}
+		m.join = nil
+	}
+	if m.sync != nil {
+		m.sync <- &proto.SyncGroupResp{Err: proto.ErrUnknownConsumerID}
+		m.sync = nil
+	}
+	delete(g.members, m.id)
+	if g.leader == m.id {
+		g.leader = ""
+	}
+}
+
+func sameProtocols(a, b []proto.GroupProtocol) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !bytes.Equal(a[i].Metadata, b[i].Metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitGroup waits for a response of the coordinator, checking the timeouts of
+// the groups against the clock of the server meanwhile. It returns false if
+// the server was closed before the response came.
+func (s *Server) waitGroup(done func() bool) bool {
+	for !done() {
+		time.Sleep(groupTick)
+		s.mu.RLock()
+		stopped := s.stopped
+		s.mu.RUnlock()
+		if stopped {
+			return false
+		}
+
+		now := s.clock()
+		s.groups.mu.Lock()
+		s.groups.tick(now)
+		s.groups.mu.Unlock()
+	}
+	return true
+}
+
+func (s *Server) handleJoinGroupRequest(
+	nodeID int32, conn net.Conn, req *proto.JoinGroupReq) response {
+
+	ch, err := s.groups.join(s.clock(), req)
+	if err != nil {
+		return &proto.JoinGroupResp{
+			CorrelationID: req.CorrelationID,
+			Err:           err,
+			GenerationID:  -1,
+			MemberID:      req.MemberID,
+		}
+	}
+	var resp *proto.JoinGroupResp
+	ok := s.waitGroup(func() bool {
+		select {
+		case resp = <-ch:
+			return true
+		default:
+			return false
+		}
+	})
+	if !ok {
+		return &proto.JoinGroupResp{
+			CorrelationID: req.CorrelationID,
+			Err:           proto.ErrRebalanceInProgress,
+			GenerationID:  -1,
+			MemberID:      req.MemberID,
+		}
+	}
+	resp.CorrelationID = req.CorrelationID
+	return resp
+}
+
+func (s *Server) handleSyncGroupRequest(
+	nodeID int32, conn net.Conn, req *proto.SyncGroupReq) response {
+
+	ch, err := s.groups.sync(s.clock(), req)
+	if err != nil {
+		return &proto.SyncGroupResp{CorrelationID: req.CorrelationID, Err: err}
+	}
+	var resp *proto.SyncGroupResp
+	ok := s.waitGroup(func() bool {
+		select {
+		case resp = <-ch:
+			return true
+		default:
+			return false
+		}
+	})
+	if !ok {
+		return &proto.SyncGroupResp{CorrelationID: req.CorrelationID, Err: proto.ErrRebalanceInProgress}
+	}
+	resp.CorrelationID = req.CorrelationID
+	return resp
+}
+
+func (s *Server) handleHeartbeatRequest(
+	nodeID int32, conn net.Conn, req *proto.HeartbeatReq) response {
+
+	return &proto.HeartbeatResp{
+		CorrelationID: req.CorrelationID,
+		Err:           s.groups.heartbeat(s.clock(), req),
+	}
+}
+
+func (s *Server) handleLeaveGroupRequest(
+	nodeID int32, conn net.Conn, req *proto.LeaveGroupReq) response {
+
+	return &proto.LeaveGroupResp{
+		CorrelationID: req.CorrelationID,
+		Err:           s.groups.leave(s.clock(), req),
+	}
+}
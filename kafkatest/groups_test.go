@@ -0,0 +1,364 @@
+package kafkatest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&GroupsSuite{})
+
+type GroupsSuite struct {
+	srv   *Server
+	clock *fakeClock
+}
+
+func (s *GroupsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+	s.clock = &fakeClock{now: time.Unix(1000, 0)}
+	s.srv = NewServer()
+	s.srv.SetClock(s.clock.Now)
+	s.srv.MustSpawn()
+}
+
+func (s *GroupsSuite) TearDownTest(c *C) {
+	_ = s.srv.Close()
+}
+
+// testMember sends the requests of a single member on its own connection,
+// as join and sync requests block until the group is ready.
+type testMember struct {
+	conn       net.Conn
+	id         string
+	generation int32
+}
+
+func (s *GroupsSuite) newMember(c *C) *testMember {
+	conn, err := net.Dial("tcp", s.srv.Addr())
+	c.Assert(err, IsNil)
+	return &testMember{conn: conn}
+}
+
+func (m *testMember) roundTrip(req interface {
+	WriteTo(io.Writer) (int64, error)
+}) (*bytes.Buffer, error) {
+	if _, err := req.WriteTo(m.conn); err != nil {
+		return nil, err
+	}
+	_, b, err := proto.ReadResp(m.conn)
+	return bytes.NewBuffer(b), err
+}
+
+func (m *testMember) join(protocols ...string) (*proto.JoinGroupResp, error) {
+	req := &proto.JoinGroupReq{
+		ClientID:       "tester",
+		GroupID:        "group",
+		SessionTimeout: 30 * time.Second,
+		MemberID:       m.id,
+		ProtocolType:   "consumer",
+	}
+	for _, p := range protocols {
+		req.Protocols = append(req.Protocols, proto.GroupProtocol{Name: p, Metadata: []byte(p)})
+	}
+	b, err := m.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := proto.ReadJoinGroupResp(b)
+	if err == nil && resp.Err == nil {
+		m.id = resp.MemberID
+		m.generation = resp.GenerationID
+	}
+	return resp, err
+}
+
+// joinAsync joins in the background, as the response only comes once the
+// rebalance completes.
+func (m *testMember) joinAsync(protocols ...string) <-chan *proto.JoinGroupResp {
+	ch := make(chan *proto.JoinGroupResp, 1)
+	go func() {
+		resp, err := m.join(protocols...)
+		if err != nil {
+			resp = &proto.JoinGroupResp{Err: err}
+		}
+		ch <- resp
+	}()
+	return ch
+}
+
+func (m *testMember) sync(assignments ...proto.GroupAssignment) (*proto.SyncGroupResp, error) {
+	b, err := m.roundTrip(&proto.SyncGroupReq{
+		GroupID:      "group",
+		GenerationID: m.generation,
+		MemberID:     m.id,
+		Assignments:  assignments,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadSyncGroupResp(b)
+}
+
+func (m *testMember) syncAsync() <-chan *proto.SyncGroupResp {
+	ch := make(chan *proto.SyncGroupResp, 1)
+	go func() {
+		resp, err := m.sync()
+		if err != nil {
+			resp = &proto.SyncGroupResp{Err: err}
+		}
+		ch <- resp
+	}()
+	return ch
+}
+
+func (m *testMember) heartbeat() error {
+	b, err := m.roundTrip(&proto.HeartbeatReq{
+		GroupID:      "group",
+		GenerationID: m.generation,
+		MemberID:     m.id,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := proto.ReadHeartbeatResp(b)
+	if err != nil {
+		return err
+	}
+	return resp.Err
+}
+
+func (m *testMember) leave() error {
+	b, err := m.roundTrip(&proto.LeaveGroupReq{GroupID: "group", MemberID: m.id})
+	if err != nil {
+		return err
+	}
+	resp, err := proto.ReadLeaveGroupResp(b)
+	if err != nil {
+		return err
+	}
+	return resp.Err
+}
+
+// joinAlone makes a member join and sync as the only member of the group.
+func (s *GroupsSuite) joinAlone(c *C, m *testMember) {
+	resp, err := m.join("range")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.LeaderID, Equals, m.id)
+	sresp, err := m.sync(proto.GroupAssignment{MemberID: m.id, Assignment: []byte("all")})
+	c.Assert(err, IsNil)
+	c.Assert(sresp.Err, IsNil)
+}
+
+// waitPreparingRebalance waits until the group waits for its members to join
+// again.
+func (s *GroupsSuite) waitPreparingRebalance() {
+	for {
+		if info, _ := s.srv.Group("group"); info.State == GroupPreparingRebalance {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// joinTwo makes two members join and sync, the first one leading.
+func (s *GroupsSuite) joinTwo(c *C, leader, follower *testMember) {
+	s.joinAlone(c, leader)
+	joined := follower.joinAsync("range")
+	s.waitPreparingRebalance()
+	_, err := leader.join("range")
+	c.Assert(err, IsNil)
+	c.Assert((<-joined).Err, IsNil)
+	_, err = leader.sync()
+	c.Assert(err, IsNil)
+	_, err = follower.sync()
+	c.Assert(err, IsNil)
+}
+
+// rebalance makes two members join and sync again, the first one leading.
+func (s *GroupsSuite) rebalance(c *C, leader, follower *testMember) {
+	joined := follower.joinAsync("range")
+	resp, err := leader.join("range")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.LeaderID, Equals, leader.id)
+	c.Assert(resp.Members, HasLen, 2)
+	c.Assert((<-joined).Err, IsNil)
+
+	synced := follower.syncAsync()
+	_, err = leader.sync(
+		proto.GroupAssignment{MemberID: leader.id, Assignment: []byte("first")},
+		proto.GroupAssignment{MemberID: follower.id, Assignment: []byte("second")})
+	c.Assert(err, IsNil)
+	sresp := <-synced
+	c.Assert(sresp.Err, IsNil)
+	c.Assert(string(sresp.Assignment), Equals, "second")
+}
+
+func (s *GroupsSuite) TestJoinAndSync(c *C) {
+	m := s.newMember(c)
+	defer m.conn.Close()
+
+	resp, err := m.join("roundrobin", "range")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.GenerationID, Equals, int32(1))
+	c.Assert(resp.GroupProtocol, Equals, "roundrobin")
+	c.Assert(resp.LeaderID, Equals, resp.MemberID)
+	c.Assert(resp.Members, DeepEquals, []proto.GroupMember{
+		{MemberID: resp.MemberID, Metadata: []byte("roundrobin")},
+	})
+	info, ok := s.srv.Group("group")
+	c.Assert(ok, Equals, true)
+	c.Assert(info.State, Equals, GroupCompletingRebalance)
+
+	sresp, err := m.sync(proto.GroupAssignment{MemberID: m.id, Assignment: []byte("all")})
+	c.Assert(err, IsNil)
+	c.Assert(sresp.Err, IsNil)
+	c.Assert(string(sresp.Assignment), Equals, "all")
+	c.Assert(m.heartbeat(), IsNil)
+
+	info, _ = s.srv.Group("group")
+	c.Assert(info, DeepEquals, GroupInfo{
+		State:        GroupStable,
+		GenerationID: 1,
+		ProtocolType: "consumer",
+		Protocol:     "roundrobin",
+		LeaderID:     m.id,
+		Members:      []string{m.id},
+	})
+
+	// A member that doesn't support the protocol of the group cannot join.
+	other := s.newMember(c)
+	defer other.conn.Close()
+	resp, err = other.join("sticky")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Err, Equals, proto.ErrInconsistentPartitionAssignmentStrategy)
+
+	m.generation = 0
+	c.Assert(m.heartbeat(), Equals, proto.ErrIllegalGeneration)
+	m.id = "unknown"
+	c.Assert(m.heartbeat(), Equals, proto.ErrUnknownConsumerID)
+}
+
+func (s *GroupsSuite) TestNewMember(c *C) {
+	first, second := s.newMember(c), s.newMember(c)
+	defer first.conn.Close()
+	defer second.conn.Close()
+	s.joinAlone(c, first)
+
+	// The new member waits until the first one joins again, which it does
+	// once its heartbeat fails.
+	joined := second.joinAsync("range")
+	s.waitPreparingRebalance()
+	c.Assert(first.heartbeat(), Equals, proto.ErrRebalanceInProgress)
+	resp, err := first.join("range")
+	c.Assert(err, IsNil)
+	c.Assert(resp.GenerationID, Equals, int32(2))
+	c.Assert(resp.LeaderID, Equals, first.id)
+	c.Assert(resp.Members, HasLen, 2)
+	sresp := <-joined
+	c.Assert(sresp.Err, IsNil)
+	c.Assert(sresp.GenerationID, Equals, int32(2))
+	c.Assert(sresp.Members, HasLen, 0)
+
+	synced := second.syncAsync()
+	_, err = first.sync(
+		proto.GroupAssignment{MemberID: first.id, Assignment: []byte("first")},
+		proto.GroupAssignment{MemberID: second.id, Assignment: []byte("second")})
+	c.Assert(err, IsNil)
+	c.Assert(string((<-synced).Assignment), Equals, "second")
+	c.Assert(first.heartbeat(), IsNil)
+	c.Assert(second.heartbeat(), IsNil)
+}
+
+func (s *GroupsSuite) TestForcedRebalance(c *C) {
+	first, second := s.newMember(c), s.newMember(c)
+	defer first.conn.Close()
+	defer second.conn.Close()
+	s.joinTwo(c, first, second)
+
+	c.Assert(s.srv.Rebalance("group"), IsNil)
+	c.Assert(s.srv.Rebalance("unknown"), NotNil)
+	c.Assert(first.heartbeat(), Equals, proto.ErrRebalanceInProgress)
+	c.Assert(second.heartbeat(), Equals, proto.ErrRebalanceInProgress)
+	s.rebalance(c, first, second)
+	info, _ := s.srv.Group("group")
+	c.Assert(info.GenerationID, Equals, int32(3))
+	c.Assert(info.State, Equals, GroupStable)
+}
+
+func (s *GroupsSuite) TestSessionTimeout(c *C) {
+	first, second := s.newMember(c), s.newMember(c)
+	defer first.conn.Close()
+	defer second.conn.Close()
+	s.joinTwo(c, first, second)
+
+	// Only the first member keeps sending heartbeats.
+	s.clock.Add(20 * time.Second)
+	c.Assert(first.heartbeat(), IsNil)
+	s.clock.Add(20 * time.Second)
+	c.Assert(first.heartbeat(), Equals, proto.ErrRebalanceInProgress)
+	info, _ := s.srv.Group("group")
+	c.Assert(info.Members, DeepEquals, []string{first.id})
+	c.Assert(second.heartbeat(), Equals, proto.ErrUnknownConsumerID)
+
+	resp, err := first.join("range")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.Members, HasLen, 1)
+}
+
+func (s *GroupsSuite) TestRebalanceTimeout(c *C) {
+	first, second := s.newMember(c), s.newMember(c)
+	defer first.conn.Close()
+	defer second.conn.Close()
+	s.joinAlone(c, first)
+
+	// The first member never joins again, so it is removed once the
+	// rebalance times out.
+	joined := second.joinAsync("range")
+	s.waitPreparingRebalance()
+	s.clock.Add(31 * time.Second)
+	resp := <-joined
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.LeaderID, Equals, second.id)
+	c.Assert(resp.Members, HasLen, 1)
+	c.Assert(first.heartbeat(), Equals, proto.ErrUnknownConsumerID)
+}
+
+func (s *GroupsSuite) TestCloseWhileJoining(c *C) {
+	first, second := s.newMember(c), s.newMember(c)
+	defer first.conn.Close()
+	defer second.conn.Close()
+	s.joinAlone(c, first)
+
+	// The first member never joins again and the clock doesn't move, so
+	// only closing the server ends the join.
+	joined := second.joinAsync("range")
+	s.waitPreparingRebalance()
+	c.Assert(s.srv.Close(), IsNil)
+	select {
+	case resp := <-joined:
+		c.Assert(resp.Err, Equals, proto.ErrRebalanceInProgress)
+	case <-time.After(time.Second):
+		c.Fatal("join not answered after the server was closed")
+	}
+}
+
+func (s *GroupsSuite) TestLeave(c *C) {
+	m := s.newMember(c)
+	defer m.conn.Close()
+	s.joinAlone(c, m)
+
+	c.Assert(m.leave(), IsNil)
+	info, _ := s.srv.Group("group")
+	c.Assert(info.State, Equals, GroupEmpty)
+	c.Assert(info.GenerationID, Equals, int32(2))
+	c.Assert(info.Members, HasLen, 0)
+	c.Assert(m.leave(), Equals, proto.ErrUnknownConsumerID)
+}
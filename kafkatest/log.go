@@ -1,36 +1,44 @@
 package kafkatest
 
 import (
-	"flag"
+	stdlog "log"
+	"os"
 	"sync"
 
-	"github.com/op/go-logging"
+	"github.com/discord/zorkian-kafka"
 )
 
 var (
-	log *logging.Logger
-	logMu = &sync.Mutex{}
+	defaultLogger kafka.Logger = kafka.NewStdLogger(
+		stdlog.New(os.Stderr, "kafkatest: ", stdlog.LstdFlags), kafka.LogLevelInfo)
+	logMu = &sync.RWMutex{}
 
-	logLevel = flag.Int(
-		"kafkatest.log_level",
-		int(logging.INFO),
-		"Set logging verbosity for kafkatest package.")
+	// log writes to whatever logger is set with SetLogger at the time of the
+	// call.
+	log kafka.Logger = packageLogger{}
 )
 
-func init() {
+// SetLogger sets the logger used by the kafkatest package. By default,
+// messages of level info and above are written to stderr with the standard
+// library logger.
+func SetLogger(l kafka.Logger) {
 	logMu.Lock()
 	defer logMu.Unlock()
 
-	if log != nil {
-		return
-	}
-	log = logging.MustGetLogger("KafkaTest")
-	logging.SetLevel(logging.Level(*logLevel), "KafkaTest")
+	defaultLogger = l
 }
 
-func SetLogger(l *logging.Logger) {
-	logMu.Lock()
-	defer logMu.Unlock()
+func getLogger() kafka.Logger {
+	logMu.RLock()
+	defer logMu.RUnlock()
 
-	log = l
+	return defaultLogger
 }
+
+// packageLogger forwards everything to the logger set with SetLogger.
+type packageLogger struct{}
+
+func (packageLogger) Debug(msg string, keyvals ...interface{}) { getLogger().Debug(msg, keyvals...) }
+func (packageLogger) Info(msg string, keyvals ...interface{})  { getLogger().Info(msg, keyvals...) }
+func (packageLogger) Warn(msg string, keyvals ...interface{})  { getLogger().Warn(msg, keyvals...) }
+func (packageLogger) Error(msg string, keyvals ...interface{}) { getLogger().Error(msg, keyvals...) }
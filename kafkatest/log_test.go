@@ -1,10 +1,9 @@
 package kafkatest
 
 import (
+	"fmt"
 	"sync"
 
-	"github.com/op/go-logging"
-
 	. "gopkg.in/check.v1"
 )
 
@@ -16,12 +15,7 @@ type logTestBackend struct {
 var logTest = &logTestBackend{mu: &sync.Mutex{}}
 
 func init() {
-	logMu.Lock()
-	defer logMu.Unlock()
-
-	log = logging.MustGetLogger("KafkaClient")
-	log.SetBackend(logging.AddModuleLevel(logTest))
-	logging.SetLevel(logging.DEBUG, "KafkaClient")
+	SetLogger(logTest)
 }
 
 func (l *logTestBackend) SetC(c *C) {
@@ -35,10 +29,17 @@ func ResetTestLogger(c *C) {
 	logTest.SetC(c)
 }
 
-func (l *logTestBackend) Log(lvl logging.Level, cd int, rec *logging.Record) error {
+func (l *logTestBackend) Debug(msg string, keyvals ...interface{}) { l.log("DEBUG", msg, keyvals) }
+func (l *logTestBackend) Info(msg string, keyvals ...interface{})  { l.log("INFO", msg, keyvals) }
+func (l *logTestBackend) Warn(msg string, keyvals ...interface{})  { l.log("WARN", msg, keyvals) }
+func (l *logTestBackend) Error(msg string, keyvals ...interface{}) { l.log("ERROR", msg, keyvals) }
+
+func (l *logTestBackend) log(level, msg string, keyvals []interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.c.Log(rec.Formatted(cd))
-	return nil
+	if l.c == nil {
+		return
+	}
+	l.c.Log(level, " ", msg, " ", fmt.Sprint(keyvals...))
 }
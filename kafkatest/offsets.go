@@ -0,0 +1,77 @@
+package kafkatest
+
+import (
+	"time"
+)
+
+// offsetsBefore answers a version 0 offset request like kafka does, for
+// which every batch is a log segment last modified when it was appended. It
+// returns, in descending order, the start offsets of the segments last
+// modified at or before timeMs, starting with the log end offset for the
+// latest offset (-1) and returning only the log start offset for the earliest
+// offset (-2).
+func (l *partitionLog) offsetsBefore(timeMs int64, maxOffsets int32, now time.Time) []int64 {
+	type segment struct {
+		offset int64
+		timeMs int64
+	}
+	segments := make([]segment, 0, len(l.batches)+1)
+	for i, b := range l.batches {
+		offset := b.Messages[0].Offset
+		if i == 0 {
+			offset = l.start
+		}
+		segments = append(segments, segment{offset, millis(b.appended)})
+	}
+	// the active segment, which the next message is appended to
+	segments = append(segments, segment{l.next, millis(now)})
+
+	var i int
+	switch timeMs {
+	case -1: // latest
+		i = len(segments) - 1
+	case -2: // earliest
+		i = 0
+	default:
+		i = len(segments) - 1
+		for i >= 0 && segments[i].timeMs > timeMs {
+			i--
+		}
+	}
+
+	offsets := make([]int64, 0)
+	for ; i >= 0 && len(offsets) < int(maxOffsets); i-- {
+		offsets = append(offsets, segments[i].offset)
+	}
+	return offsets
+}
+
+// offsetForTime answers a version 1 offset request. It returns the earliest
+// offset whose message was appended at or after timeMs, and its append time,
+// or -1 for both if there is none. The latest (-1) and earliest (-2) offsets
+// are returned without timestamp.
+func (l *partitionLog) offsetForTime(timeMs int64) (int64, int64) {
+	switch timeMs {
+	case -1:
+		return l.next, -1
+	case -2:
+		return l.start, -1
+	}
+	for _, b := range l.batches {
+		appended := millis(b.appended)
+		if appended < timeMs {
+			continue
+		}
+		for _, msg := range b.Messages {
+			if msg.Offset >= l.start {
+				return msg.Offset, appended
+			}
+		}
+	}
+	return -1, -1
+}
+
+// millis returns t as milliseconds since the epoch, like kafka timestamps.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
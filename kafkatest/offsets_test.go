@@ -0,0 +1,115 @@
+package kafkatest
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&OffsetsSuite{})
+
+type OffsetsSuite struct {
+	srv   *Server
+	clock *fakeClock
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (s *OffsetsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+	s.clock = &fakeClock{now: time.Unix(1000, 0)}
+	s.srv = NewServer()
+	s.srv.SetClock(s.clock.Now)
+	s.srv.MustSpawn()
+
+	// batches appended at 1000s, 1010s and 1020s
+	for _, values := range [][]string{{"a", "b"}, {"c"}, {"d", "e"}} {
+		msgs := make([]*proto.Message, len(values))
+		for i, value := range values {
+			msgs[i] = &proto.Message{Value: []byte(value)}
+		}
+		s.srv.AddMessages("test", 0, msgs...)
+		s.clock.Add(10 * time.Second)
+	}
+}
+
+func (s *OffsetsSuite) TearDownTest(c *C) {
+	_ = s.srv.Close()
+}
+
+func (s *OffsetsSuite) offsets(c *C, version int16, timeMs int64, maxOffsets int32) proto.OffsetRespPartition {
+	conn, err := net.Dial("tcp", s.srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	req := &proto.OffsetReq{
+		CorrelationID: 1,
+		Version:       version,
+		ReplicaID:     -1,
+		Topics: []proto.OffsetReqTopic{{
+			Name:       "test",
+			Partitions: []proto.OffsetReqPartition{{ID: 0, TimeMs: timeMs, MaxOffsets: maxOffsets}},
+		}},
+	}
+	_, err = req.WriteTo(conn)
+	c.Assert(err, IsNil)
+	_, b, err := proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+	resp, err := proto.ReadVersionedOffsetResp(bytes.NewBuffer(b), version)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	return resp.Topics[0].Partitions[0]
+}
+
+func (s *OffsetsSuite) TestVersion0(c *C) {
+	c.Assert(s.offsets(c, 0, -1, 2).Offsets, DeepEquals, []int64{5, 3})
+	c.Assert(s.offsets(c, 0, -2, 2).Offsets, DeepEquals, []int64{0})
+	c.Assert(s.offsets(c, 0, 1015000, 10).Offsets, DeepEquals, []int64{2, 0})
+	c.Assert(s.offsets(c, 0, 1010000, 1).Offsets, DeepEquals, []int64{2})
+	c.Assert(s.offsets(c, 0, 999000, 10).Offsets, DeepEquals, []int64{})
+	c.Assert(s.offsets(c, 0, 1030000, 10).Offsets, DeepEquals, []int64{5, 3, 2, 0})
+}
+
+func (s *OffsetsSuite) TestVersion1(c *C) {
+	part := s.offsets(c, 1, 1005000, 0)
+	c.Assert(part.Offsets, DeepEquals, []int64{2})
+	c.Assert(part.Timestamp, Equals, int64(1010000))
+
+	part = s.offsets(c, 1, 1020000, 0)
+	c.Assert(part.Offsets, DeepEquals, []int64{3})
+	c.Assert(part.Timestamp, Equals, int64(1020000))
+
+	part = s.offsets(c, 1, 1020001, 0)
+	c.Assert(part.Offsets, DeepEquals, []int64{-1})
+	c.Assert(part.Timestamp, Equals, int64(-1))
+
+	part = s.offsets(c, 1, -1, 0)
+	c.Assert(part.Offsets, DeepEquals, []int64{5})
+	c.Assert(part.Timestamp, Equals, int64(-1))
+
+	// Deleted messages are skipped.
+	c.Assert(s.srv.DeleteRecordsBefore("test", 0, 4), IsNil)
+	c.Assert(s.offsets(c, 1, 0, 0).Offsets, DeepEquals, []int64{4})
+	c.Assert(s.offsets(c, 1, -2, 0).Offsets, DeepEquals, []int64{4})
+	c.Assert(s.offsets(c, 0, -2, 1).Offsets, DeepEquals, []int64{4})
+}
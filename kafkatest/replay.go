@@ -0,0 +1,144 @@
+package kafkatest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/discord/zorkian-kafka"
+)
+
+// Replayer answers requests with the responses of a recording made with
+// kafka.Recorder, so that a session with real brokers can be reproduced in a
+// test. Use its Middleware method as a Server middleware, and set the
+// BrokerAddress of the client configuration so that the brokers advertised
+// by the recorded responses are reached through the server.
+//
+// A request gets the response of the first recorded request of the same kind
+// not replayed yet that has the same content, ignoring the correlation ID.
+// If there is none, it gets the response of the first request of the same
+// kind not replayed yet, as requests such as produce requests carry
+// timestamps. Requests of the kinds left are handled by the server.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []*exchange
+	unmatched int
+}
+
+// exchange is a recorded request with its response.
+type exchange struct {
+	kind     int16
+	request  []byte
+	response []byte
+	replayed bool
+}
+
+// NewReplayer returns a replayer of the given recorded frames, as returned
+// by kafka.ReadRecording. Requests without a response are ignored.
+func NewReplayer(frames []kafka.RecordedFrame) *Replayer {
+	type key struct {
+		connID        int32
+		correlationID int32
+	}
+	pending := make(map[key]*exchange)
+	var exchanges []*exchange
+	for _, f := range frames {
+		if f.Request {
+			if len(f.Data) < 12 {
+				continue
+			}
+			ex := &exchange{
+				kind:    int16(binary.BigEndian.Uint16(f.Data[4:])),
+				request: f.Data,
+			}
+			pending[key{f.ConnID, int32(binary.BigEndian.Uint32(f.Data[8:]))}] = ex
+			exchanges = append(exchanges, ex)
+		} else if len(f.Data) >= 8 {
+			k := key{f.ConnID, int32(binary.BigEndian.Uint32(f.Data[4:]))}
+			if ex, ok := pending[k]; ok {
+				ex.response = f.Data
+				delete(pending, k)
+			}
+		}
+	}
+
+	r := &Replayer{}
+	for _, ex := range exchanges {
+		if ex.response != nil {
+			r.exchanges = append(r.exchanges, ex)
+		}
+	}
+	return r
+}
+
+// Middleware returns the recorded response to a request, with the
+// correlation ID of the request, or nil if no recorded request of the same
+// kind is left.
+func (r *Replayer) Middleware(nodeID int32, requestKind int16, content []byte) Response {
+	if len(content) < 12 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var match *exchange
+	for _, ex := range r.exchanges {
+		if ex.replayed || ex.kind != requestKind {
+			continue
+		}
+		if sameRequest(ex.request, content) {
+			match = ex
+			break
+		}
+		if match == nil {
+			match = ex
+		}
+	}
+	if match == nil {
+		r.unmatched++
+		log.Warn("no recorded response left", "kind", requestKind)
+		return nil
+	}
+	match.replayed = true
+
+	resp := append(replayedResponse(nil), match.response...)
+	copy(resp[4:8], content[8:12])
+	return resp
+}
+
+// Remaining returns the number of recorded requests not replayed yet.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, ex := range r.exchanges {
+		if !ex.replayed {
+			n++
+		}
+	}
+	return n
+}
+
+// Unmatched returns the number of requests that were left to the server as
+// no recorded request of their kind was left.
+func (r *Replayer) Unmatched() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.unmatched
+}
+
+// sameRequest returns whether two requests are equal except for their
+// correlation ID.
+func sameRequest(a, b []byte) bool {
+	return len(a) == len(b) && bytes.Equal(a[:8], b[:8]) && bytes.Equal(a[12:], b[12:])
+}
+
+// replayedResponse is a recorded response, written as is.
+type replayedResponse []byte
+
+func (r replayedResponse) Bytes() ([]byte, error) {
+	return r, nil
+}
@@ -0,0 +1,80 @@
+package kafkatest
+
+import (
+	"bytes"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ReplaySuite{})
+
+type ReplaySuite struct{}
+
+func (s *ReplaySuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// session produces two messages and consumes the partition from the start,
+// returning the produced offset and the consumed values.
+func (s *ReplaySuite) session(c *C, name string, conf kafka.BrokerConf, addr string) (int64, []string) {
+	broker, err := kafka.NewBroker(name, []string{addr}, conf)
+	c.Assert(err, IsNil)
+
+	offset, err := broker.Producer(kafka.NewProducerConf()).Produce("test", 0,
+		&proto.Message{Value: []byte("c")},
+		&proto.Message{Value: []byte("d")})
+	c.Assert(err, IsNil)
+
+	consConf := kafka.NewConsumerConf("test", 0)
+	consConf.StartOffset = kafka.StartOffsetOldest
+	consumer, err := broker.BatchConsumer(consConf)
+	c.Assert(err, IsNil)
+	batch, err := consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	values := make([]string, len(batch))
+	for i, msg := range batch {
+		values[i] = string(msg.Value)
+	}
+	return offset, values
+}
+
+func (s *ReplaySuite) TestRecordAndReplay(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")}, &proto.Message{Value: []byte("b")})
+
+	var recording bytes.Buffer
+	recorder := kafka.NewRecorder(&recording)
+	conf := kafka.NewBrokerConf("tester")
+	conf.ClusterConnectionConf.Dialer = recorder.Dialer(nil)
+	offset, values := s.session(c, "kafkatest-record", conf, srv.Addr())
+	c.Assert(recorder.Err(), IsNil)
+	c.Assert(offset, Equals, int64(3))
+	c.Assert(values, DeepEquals, []string{"a", "b", "c", "d"})
+
+	frames, err := kafka.ReadRecording(&recording)
+	c.Assert(err, IsNil)
+	c.Assert(len(frames) >= 6, Equals, true)
+	c.Assert(frames[0].Request, Equals, true)
+	c.Assert(frames[0].Addr, Equals, srv.Addr())
+
+	// The replay server has no messages, all responses come from the
+	// recording.
+	replayer := NewReplayer(frames)
+	replaySrv := NewServer(replayer.Middleware)
+	replaySrv.MustSpawn()
+	defer replaySrv.Close()
+
+	conf = kafka.NewBrokerConf("tester")
+	conf.ClusterConnectionConf.BrokerAddress = func(nodeID int32, host string, port int32) string {
+		return replaySrv.Addr()
+	}
+	offset, values = s.session(c, "kafkatest-replay", conf, replaySrv.Addr())
+	c.Assert(offset, Equals, int64(3))
+	c.Assert(values, DeepEquals, []string{"a", "b", "c", "d"})
+	c.Assert(replayer.Remaining(), Equals, 0)
+	c.Assert(replayer.Unmatched(), Equals, 0)
+}
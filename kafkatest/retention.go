@@ -0,0 +1,288 @@
+package kafkatest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// RetentionPolicy limits the messages kept in every partition of a topic.
+// Zero fields don't limit anything. Like in kafka, messages are only ever
+// deleted from the start of the log, moving its earliest offset forward.
+type RetentionPolicy struct {
+	// MaxMessages is the number of messages kept in a partition.
+	MaxMessages int
+	// MaxBytes is the total size of the keys and values kept in a partition.
+	MaxBytes int
+	// MaxAge is how long messages are kept after they were appended.
+	MaxAge time.Duration
+}
+
+// partitionLog is the log of a single partition. Messages are stored in the
+// batches they were produced in, so that compressed batches are fetched whole
+// like from a real broker. Offsets of the messages are increasing but not
+// contiguous once the log was compacted.
+type partitionLog struct {
+	batches []*logBatch
+
+	// start is the earliest offset that can be fetched, and next the offset
+	// of the next appended message. The first batch may still contain
+	// messages before start.
+	start int64
+	next  int64
+}
+
+type logBatch struct {
+	proto.MessageBatch
+	appended time.Time
+}
+
+func (b *logBatch) lastOffset() int64 {
+	return b.Messages[len(b.Messages)-1].Offset
+}
+
+func newPartitionLog() *partitionLog {
+	return &partitionLog{}
+}
+
+// append sets the offsets of the messages and appends them to the log as a
+// single batch.
+func (l *partitionLog) append(now time.Time, compression proto.Compression, messages ...*proto.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	for _, msg := range messages {
+		msg.Offset = l.next
+		l.next++
+	}
+	l.batches = append(l.batches, &logBatch{
+		MessageBatch: proto.MessageBatch{
+			Compression: compression,
+			Messages:    messages,
+		},
+		appended: now,
+	})
+}
+
+// messages returns the messages from the earliest offset.
+func (l *partitionLog) messages() []*proto.Message {
+	messages := make([]*proto.Message, 0)
+	for _, b := range l.batches {
+		for _, msg := range b.Messages {
+			if msg.Offset >= l.start {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	return messages
+}
+
+// from returns the batches from the one containing the given offset. Like a
+// broker, compressed batches are returned whole, so the first one may start
+// before the offset.
+func (l *partitionLog) from(offset int64) []proto.MessageBatch {
+	i := sort.Search(len(l.batches), func(i int) bool {
+		return l.batches[i].lastOffset() >= offset
+	})
+	batches := make([]proto.MessageBatch, 0, len(l.batches)-i)
+	for _, b := range l.batches[i:] {
+		batches = append(batches, b.MessageBatch)
+	}
+	if len(batches) > 0 && batches[0].Compression == proto.CompressionNone {
+		first := &batches[0]
+		j := sort.Search(len(first.Messages), func(j int) bool {
+			return first.Messages[j].Offset >= offset
+		})
+		first.Messages = first.Messages[j:]
+	}
+	return batches
+}
+
+// deleteBefore deletes the messages before the given offset, which must not be
+// greater than the next offset. Only the batches whose messages all come
+// before the offset are dropped.
+func (l *partitionLog) deleteBefore(offset int64) {
+	if offset <= l.start {
+		return
+	}
+	i := sort.Search(len(l.batches), func(i int) bool {
+		return l.batches[i].lastOffset() >= offset
+	})
+	l.batches = l.batches[i:]
+	l.start = offset
+}
+
+// deleteFirst deletes the first n messages from the earliest offset.
+func (l *partitionLog) deleteFirst(n int) {
+	messages := l.messages()
+	if n >= len(messages) {
+		l.deleteBefore(l.next)
+	} else if n > 0 {
+		l.deleteBefore(messages[n].Offset)
+	}
+}
+
+// retain deletes the messages not kept by the policy.
+func (l *partitionLog) retain(policy RetentionPolicy, now time.Time) {
+	if policy.MaxAge > 0 {
+		i := sort.Search(len(l.batches), func(i int) bool {
+			return now.Sub(l.batches[i].appended) <= policy.MaxAge
+		})
+		if i == len(l.batches) {
+			l.deleteBefore(l.next)
+		} else if i > 0 {
+			l.deleteBefore(l.batches[i].Messages[0].Offset)
+		}
+	}
+	messages := l.messages()
+	if policy.MaxMessages > 0 && len(messages) > policy.MaxMessages {
+		l.deleteFirst(len(messages) - policy.MaxMessages)
+		messages = l.messages()
+	}
+	if policy.MaxBytes > 0 {
+		size := 0
+		for _, msg := range messages {
+			size += len(msg.Key) + len(msg.Value)
+		}
+		n := 0
+		for ; n < len(messages) && size > policy.MaxBytes; n++ {
+			size -= len(messages[n].Key) + len(messages[n].Value)
+		}
+		l.deleteFirst(n)
+	}
+}
+
+// compact keeps the last message of every key. Messages without key are kept,
+// and so are tombstones unless they were appended before deleteBefore. Batches
+// keep their compression, and are dropped once empty.
+func (l *partitionLog) compact(deleteBefore time.Time) {
+	last := make(map[string]int64)
+	for _, b := range l.batches {
+		for _, msg := range b.Messages {
+			if msg.Key != nil {
+				last[string(msg.Key)] = msg.Offset
+			}
+		}
+	}
+	batches := l.batches[:0]
+	for _, b := range l.batches {
+		expired := b.appended.Before(deleteBefore)
+		messages := make([]*proto.Message, 0, len(b.Messages))
+		for _, msg := range b.Messages {
+			if msg.Key != nil && (last[string(msg.Key)] != msg.Offset || msg.Value == nil && expired) {
+				continue
+			}
+			messages = append(messages, msg)
+		}
+		if len(messages) > 0 {
+			b.Messages = messages
+			batches = append(batches, b)
+		}
+	}
+	for i := len(batches); i < len(l.batches); i++ {
+		l.batches[i] = nil
+	}
+	l.batches = batches
+}
+
+// SetRetention sets the retention policy of a topic, and immediately deletes
+// the messages it doesn't keep. Retention is enforced again every time
+// messages are appended to, fetched from or listed for the topic.
+func (s *Server) SetRetention(topic string, policy RetentionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retention[topic] = policy
+	for _, l := range s.topics[topic] {
+		l.retain(policy, s.now())
+	}
+}
+
+// DeleteRecordsBefore deletes the messages of a partition before the given
+// offset, and makes it the earliest offset, like the DeleteRecords API of
+// kafka. An offset of -1 deletes all messages.
+func (s *Server) DeleteRecordsBefore(topic string, partition int32, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.topics[topic][partition]
+	if !ok {
+		return fmt.Errorf("unknown partition %s:%d", topic, partition)
+	}
+	if offset == -1 {
+		offset = l.next
+	}
+	if offset < 0 || offset > l.next {
+		return fmt.Errorf("offset %d out of range [%d, %d]", offset, l.start, l.next)
+	}
+	l.deleteBefore(offset)
+	log.Info("deleted records", "topic", topic, "partition", partition, "before", offset)
+	return nil
+}
+
+// Compact compacts every partition of a topic, like the log cleaner of a
+// topic with cleanup.policy=compact does: only the last message of every key
+// is kept. Tombstones, that is messages with a nil value, are kept as the last
+// message of their key so that consumers see the delete; use
+// CompactWithDeleteRetention to remove them. Offsets of the remaining
+// messages don't change.
+func (s *Server) Compact(topic string) {
+	s.compact(topic, time.Time{})
+}
+
+// CompactWithDeleteRetention compacts every partition of a topic like
+// Compact, and also removes the tombstones appended more than
+// deleteRetention ago, like kafka does after delete.retention.ms. The age of
+// tombstones is measured with the clock set with SetClock.
+func (s *Server) CompactWithDeleteRetention(topic string, deleteRetention time.Duration) {
+	s.compact(topic, s.clock().Add(-deleteRetention))
+}
+
+func (s *Server) compact(topic string, deleteBefore time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for partition, l := range s.topics[topic] {
+		l.compact(deleteBefore)
+		log.Info("compacted log", "topic", topic, "partition", partition,
+			"batches", len(l.batches))
+	}
+}
+
+// SetRetention sets the retention policy of a topic, see
+// Server.SetRetention.
+func (c *Cluster) SetRetention(topic string, policy RetentionPolicy) {
+	c.server.SetRetention(topic, policy)
+}
+
+// DeleteRecordsBefore deletes the messages of a partition before the given
+// offset, see Server.DeleteRecordsBefore.
+func (c *Cluster) DeleteRecordsBefore(topic string, partition int32, offset int64) error {
+	return c.server.DeleteRecordsBefore(topic, partition, offset)
+}
+
+// Compact compacts every partition of a topic, see Server.Compact.
+func (c *Cluster) Compact(topic string) {
+	c.server.Compact(topic)
+}
+
+// CompactWithDeleteRetention compacts every partition of a topic and removes
+// old tombstones, see Server.CompactWithDeleteRetention.
+func (c *Cluster) CompactWithDeleteRetention(topic string, deleteRetention time.Duration) {
+	c.server.CompactWithDeleteRetention(topic, deleteRetention)
+}
+
+// partitionLog returns the log of a partition after enforcing the retention
+// policy of its topic. Must be called with the mutex held for writing.
+func (s *Server) partitionLog(topic string, partition int32) (*partitionLog, bool) {
+	l, ok := s.topics[topic][partition]
+	if !ok {
+		return nil, false
+	}
+	if policy, ok := s.retention[topic]; ok {
+		l.retain(policy, s.now())
+	}
+	return l, true
+}
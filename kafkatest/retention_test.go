@@ -0,0 +1,169 @@
+package kafkatest
+
+import (
+	"errors"
+	"time"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RetentionSuite{})
+
+type RetentionSuite struct {
+	srv    *Server
+	broker *kafka.Broker
+}
+
+func (s *RetentionSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+	s.srv = NewServer()
+	s.srv.MustSpawn()
+	s.srv.AddMessages("test", 0)
+
+	var err error
+	s.broker, err = kafka.NewBroker("kafkatest-retention", []string{s.srv.Addr()},
+		kafka.NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+}
+
+func (s *RetentionSuite) TearDownTest(c *C) {
+	_ = s.srv.Close()
+}
+
+func (s *RetentionSuite) addMessages(values ...string) {
+	for _, value := range values {
+		s.srv.AddMessages("test", 0, &proto.Message{Value: []byte(value)})
+	}
+}
+
+// consume returns the values of the messages from the given offset.
+func (s *RetentionSuite) consume(c *C, offset int64) ([]string, error) {
+	conf := kafka.NewConsumerConf("test", 0)
+	conf.StartOffset = offset
+	conf.RetryLimit = 0
+	consumer, err := s.broker.BatchConsumer(conf)
+	c.Assert(err, IsNil)
+	batch, err := consumer.ConsumeBatch()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(batch))
+	for i, msg := range batch {
+		values[i] = string(msg.Value)
+	}
+	return values, nil
+}
+
+func (s *RetentionSuite) assertOffsets(c *C, earliest, latest int64) {
+	offset, err := s.broker.OffsetEarliest("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, earliest)
+	offset, err = s.broker.OffsetLatest("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, latest)
+}
+
+func (s *RetentionSuite) TestMaxMessages(c *C) {
+	s.srv.SetRetention("test", RetentionPolicy{MaxMessages: 2})
+	s.addMessages("a", "b", "c", "d")
+	s.assertOffsets(c, 2, 4)
+
+	values, err := s.consume(c, kafka.StartOffsetOldest)
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"c", "d"})
+
+	_, err = s.consume(c, 1)
+	c.Assert(errors.Is(err, proto.ErrOffsetOutOfRange), Equals, true)
+}
+
+func (s *RetentionSuite) TestMaxBytes(c *C) {
+	s.addMessages("aaa", "bbb", "ccc")
+	s.srv.SetRetention("test", RetentionPolicy{MaxBytes: 7})
+	s.assertOffsets(c, 1, 3)
+}
+
+func (s *RetentionSuite) TestMaxAge(c *C) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	s.srv.SetClock(clock.Now)
+	s.srv.SetRetention("test", RetentionPolicy{MaxAge: time.Minute})
+	s.addMessages("a", "b")
+	s.assertOffsets(c, 0, 2)
+
+	clock.Add(time.Minute)
+	s.addMessages("c")
+	s.assertOffsets(c, 0, 3)
+
+	clock.Add(time.Second)
+	s.assertOffsets(c, 2, 3)
+}
+
+func (s *RetentionSuite) TestDeleteRecordsBefore(c *C) {
+	s.addMessages("a", "b", "c")
+	c.Assert(s.srv.DeleteRecordsBefore("test", 0, 2), IsNil)
+	s.assertOffsets(c, 2, 3)
+
+	// The earliest offset never moves back.
+	c.Assert(s.srv.DeleteRecordsBefore("test", 0, 1), IsNil)
+	s.assertOffsets(c, 2, 3)
+
+	c.Assert(s.srv.DeleteRecordsBefore("test", 0, 4), NotNil)
+	c.Assert(s.srv.DeleteRecordsBefore("test", 1, 0), NotNil)
+	c.Assert(s.srv.DeleteRecordsBefore("test", 0, -1), IsNil)
+	s.assertOffsets(c, 3, 3)
+
+	// Produced messages keep the offsets going.
+	producer := s.broker.Producer(kafka.NewProducerConf())
+	offset, err := producer.Produce("test", 0, &proto.Message{Value: []byte("d")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(3))
+	values, err := s.consume(c, kafka.StartOffsetOldest)
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"d"})
+}
+
+func (s *RetentionSuite) TestCompact(c *C) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	s.srv.SetClock(clock.Now)
+	s.srv.AddMessages("test", 0,
+		&proto.Message{Key: []byte("k1"), Value: []byte("a")},
+		&proto.Message{Key: []byte("k2"), Value: []byte("b")},
+		&proto.Message{Value: []byte("no key")},
+		&proto.Message{Key: []byte("k1"), Value: []byte("c")},
+		&proto.Message{Key: []byte("k2"), Value: nil},
+		&proto.Message{Key: []byte("k3"), Value: []byte("d")})
+	s.srv.Compact("test")
+	s.assertOffsets(c, 0, 6)
+
+	conf := kafka.NewConsumerConf("test", 0)
+	conf.RetryLimit = 0
+	consumer, err := s.broker.BatchConsumer(conf)
+	c.Assert(err, IsNil)
+	batch, err := consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch, HasLen, 4)
+	for i, offset := range []int64{2, 3, 4, 5} {
+		c.Assert(batch[i].Offset, Equals, offset)
+	}
+	// The tombstone is kept so that consumers see the delete.
+	c.Assert(string(batch[2].Key), Equals, "k2")
+	c.Assert(batch[2].Value, IsNil)
+
+	// Fetching from an offset removed by compaction returns the next message.
+	values, err := s.consume(c, 1)
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"no key", "c", "", "d"})
+
+	// Tombstones are only removed once older than the delete retention.
+	s.srv.CompactWithDeleteRetention("test", time.Hour)
+	values, err = s.consume(c, 0)
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"no key", "c", "", "d"})
+	clock.Add(2 * time.Hour)
+	s.srv.CompactWithDeleteRetention("test", time.Hour)
+	values, err = s.consume(c, 0)
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"no key", "c", "d"})
+	s.assertOffsets(c, 0, 6)
+}
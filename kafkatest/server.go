@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/discord/zorkian-kafka/proto"
 )
@@ -23,12 +25,23 @@ type topicOffset struct {
 type Server struct {
 	mu          *sync.RWMutex
 	brokers     []proto.MetadataRespBroker
-	topics      map[string]map[int32][]*proto.Message
+	topics      map[string]map[int32]*partitionLog
+	retention   map[string]RetentionPolicy
 	offsets     map[string]map[int32]map[string]*topicOffset
 	ln          net.Listener
 	middlewares []Middleware
+	faults      *faultSet
+	groups      *groupCoordinator
 	started     bool
 	stopped     bool
+
+	// now returns the append time of produced messages, and the current
+	// time for retention and offset requests.
+	now func() time.Time
+
+	// cluster is set when the server is the log store shared by the brokers
+	// of a Cluster, which decides which broker leads each partition.
+	cluster *Cluster
 }
 
 // Middleware is function that is called for every incomming kafka message,
@@ -50,10 +63,14 @@ type Response interface {
 func NewServer(middlewares ...Middleware) *Server {
 	s := &Server{
 		brokers:     make([]proto.MetadataRespBroker, 0),
-		topics:      make(map[string]map[int32][]*proto.Message),
+		topics:      make(map[string]map[int32]*partitionLog),
+		retention:   make(map[string]RetentionPolicy),
 		offsets:     make(map[string]map[int32]map[string]*topicOffset),
 		middlewares: middlewares,
+		faults:      &faultSet{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))},
+		groups:      newGroupCoordinator(),
 		mu:          &sync.RWMutex{},
+		now:         time.Now,
 	}
 	return s
 }
@@ -75,12 +92,29 @@ func (s *Server) Addr() string {
 	panic("server should be running but isn't, no addr available")
 }
 
+// SetClock replaces the clock of the server, which is time.Now by default.
+// Messages keep the append time they got from the previous clock.
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.now = now
+}
+
+// clock returns the current time of the server clock.
+func (s *Server) clock() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.now()
+}
+
 // Reset will clear out local messages and topics.
 func (s *Server) Reset() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.topics = make(map[string]map[int32][]*proto.Message)
+	s.topics = make(map[string]map[int32]*partitionLog)
 	s.offsets = make(map[string]map[int32]map[string]*topicOffset)
 }
 
@@ -92,7 +126,7 @@ func (s *Server) ResetTopic(topic string) {
 
 	if parts, ok := s.topics[topic]; ok {
 		for partitionID := range parts {
-			parts[partitionID] = make([]*proto.Message, 0)
+			parts[partitionID] = newPartitionLog()
 		}
 	}
 	delete(s.offsets, topic)
@@ -120,8 +154,8 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	topics := make(map[string]map[string][]*proto.Message)
 	for name, parts := range s.topics {
 		topics[name] = make(map[string][]*proto.Message)
-		for part, messages := range parts {
-			topics[name][strconv.Itoa(int(part))] = messages
+		for part, l := range parts {
+			topics[name][strconv.Itoa(int(part))] = l.messages()
 		}
 	}
 
@@ -131,7 +165,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"brokers": s.brokers,
 	})
 	if err != nil {
-		log.Errorf("cannot JSON encode state: %s", err)
+		log.Error("cannot JSON encode state", "err", err)
 	}
 }
 
@@ -140,28 +174,37 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // To only create topic/partition, call this method withough giving any
 // message.
 func (s *Server) AddMessages(topic string, partition int32, messages ...*proto.Message) {
+	s.AddBatch(topic, partition, proto.CompressionNone, messages...)
+}
+
+// AddBatch appends messages to given topic/partition as a single batch, like
+// a producer using the given compression does. Fetch responses return
+// compressed batches whole, even when the fetch offset is in the middle of
+// the batch. If topic or partition does not exists, it is being created.
+func (s *Server) AddBatch(topic string, partition int32, compression proto.Compression, messages ...*proto.Message) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	parts, ok := s.topics[topic]
 	if !ok {
-		parts = make(map[int32][]*proto.Message)
+		parts = make(map[int32]*partitionLog)
 		s.topics[topic] = parts
 	}
 
 	for i := int32(0); i <= partition; i++ {
 		if _, ok := parts[i]; !ok {
-			parts[i] = make([]*proto.Message, 0)
+			parts[i] = newPartitionLog()
 		}
 	}
 	if len(messages) > 0 {
-		start := len(parts[partition])
-		for i, msg := range messages {
-			msg.Offset = int64(start + i)
+		for _, msg := range messages {
 			msg.Partition = partition
 			msg.Topic = topic
 		}
-		parts[partition] = append(parts[partition], messages...)
+		parts[partition].append(s.now(), compression, messages...)
+		if policy, ok := s.retention[topic]; ok {
+			parts[partition].retain(policy, s.now())
+		}
 	}
 }
 
@@ -175,13 +218,13 @@ func (s *Server) Run(addr string) error {
 		defer s.mu.Unlock()
 
 		if s.ln != nil {
-			log.Errorf("server already running: %s", s.ln.Addr())
+			log.Error("server already running", "addr", s.ln.Addr())
 			return nil, fmt.Errorf("server already running: %s", s.ln.Addr())
 		}
 
 		ln, err := net.Listen("tcp4", addr)
 		if err != nil {
-			log.Errorf("cannot listen on address %q: %s", addr, err)
+			log.Error("cannot listen", "addr", addr, "err", err)
 			return nil, fmt.Errorf("cannot listen: %s", err)
 		}
 
@@ -189,12 +232,12 @@ func (s *Server) Run(addr string) error {
 		s.started = true
 
 		if host, port, err := net.SplitHostPort(ln.Addr().String()); err != nil {
-			log.Errorf("cannot extract host/port from %q: %s", ln.Addr(), err)
+			log.Error("cannot extract host/port", "addr", ln.Addr(), "err", err)
 			return nil, fmt.Errorf("cannot extract host/port from %q: %s", ln.Addr(), err)
 		} else {
 			prt, err := strconv.Atoi(port)
 			if err != nil {
-				log.Errorf("invalid port %q: %s", port, err)
+				log.Error("invalid port", "port", port, "err", err)
 				return nil, fmt.Errorf("invalid port %q: %s", port, err)
 			}
 			s.brokers = append(s.brokers, proto.MetadataRespBroker{
@@ -217,7 +260,7 @@ func (s *Server) Run(addr string) error {
 		if conn, err := ln.Accept(); err == nil {
 			go s.handleClient(nodeID, conn)
 		} else {
-			log.Errorf("failed to accept: %s", err)
+			log.Error("failed to accept", "err", err)
 			return fmt.Errorf("failed to accept: %s", err)
 		}
 	}
@@ -260,9 +303,11 @@ func (s *Server) MustSpawn() {
 	go func() {
 		for {
 			conn, err := ln.Accept()
-			if err == nil {
-				go s.handleClient(nodeID, conn)
+			if err != nil {
+				// closed
+				return
 			}
+			go s.handleClient(nodeID, conn)
 		}
 	}()
 }
@@ -276,11 +321,16 @@ func (s *Server) handleClient(nodeID int32, conn net.Conn) {
 		kind, b, err := proto.ReadReq(conn)
 		if err != nil {
 			if err != io.EOF {
-				log.Errorf("client read error: %s", err)
+				log.Error("client read error", "node", nodeID, "err", err)
 			}
 			return
 		}
 
+		fault := s.faults.match(nodeID, kind, b)
+		if fault != nil && !fault.applyBefore(conn) {
+			return
+		}
+
 		var resp response
 
 		for _, middleware := range s.middlewares {
@@ -295,68 +345,106 @@ func (s *Server) handleClient(nodeID int32, conn net.Conn) {
 			case proto.ProduceReqKind:
 				req, err := proto.ReadProduceReq(bytes.NewBuffer(b))
 				if err != nil {
-					log.Errorf("cannot parse produce request: %s\n%s", err, b)
+					log.Error("cannot parse produce request", "err", err, "request", b)
 					return
 				}
 				resp = s.handleProduceRequest(nodeID, conn, req)
 			case proto.FetchReqKind:
 				req, err := proto.ReadFetchReq(bytes.NewBuffer(b))
 				if err != nil {
-					log.Errorf("cannot parse fetch request: %s\n%s", err, b)
+					log.Error("cannot parse fetch request", "err", err, "request", b)
 					return
 				}
 				resp = s.handleFetchRequest(nodeID, conn, req)
 			case proto.OffsetReqKind:
 				req, err := proto.ReadOffsetReq(bytes.NewBuffer(b))
 				if err != nil {
-					log.Errorf("cannot parse offset request: %s\n%s", err, b)
+					log.Error("cannot parse offset request", "err", err, "request", b)
 					return
 				}
 				resp = s.handleOffsetRequest(nodeID, conn, req)
 			case proto.MetadataReqKind:
 				req, err := proto.ReadMetadataReq(bytes.NewBuffer(b))
 				if err != nil {
-					log.Errorf("cannot parse metadata request: %s\n%s", err, b)
+					log.Error("cannot parse metadata request", "err", err, "request", b)
 					return
 				}
 				resp = s.handleMetadataRequest(nodeID, conn, req)
 			case proto.OffsetCommitReqKind:
 				req, err := proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
 				if err != nil {
-					log.Errorf("cannot parse offset commit request: %s\n%s", err, b)
+					log.Error("cannot parse offset commit request", "err", err, "request", b)
 					return
 				}
 				resp = s.handleOffsetCommitRequest(nodeID, conn, req)
 			case proto.OffsetFetchReqKind:
 				req, err := proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
 				if err != nil {
-					log.Errorf("cannot parse offset fetch request: %s\n%s", err, b)
+					log.Error("cannot parse offset fetch request", "err", err, "request", b)
 					return
 				}
 				resp = s.handleOffsetFetchRequest(nodeID, conn, req)
 			case proto.GroupCoordinatorReqKind:
 				req, err := proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
 				if err != nil {
-					log.Errorf("cannot parse consumer metadata request: %s\n%s", err, b)
+					log.Error("cannot parse consumer metadata request", "err", err, "request", b)
 					return
 				}
 				resp = s.handleGroupCoordinatorRequest(nodeID, conn, req)
+			case proto.JoinGroupReqKind:
+				req, err := proto.ReadJoinGroupReq(bytes.NewBuffer(b))
+				if err != nil {
+					log.Error("cannot parse join group request", "err", err, "request", b)
+					return
+				}
+				resp = s.handleJoinGroupRequest(nodeID, conn, req)
+			case proto.SyncGroupReqKind:
+				req, err := proto.ReadSyncGroupReq(bytes.NewBuffer(b))
+				if err != nil {
+					log.Error("cannot parse sync group request", "err", err, "request", b)
+					return
+				}
+				resp = s.handleSyncGroupRequest(nodeID, conn, req)
+			case proto.HeartbeatReqKind:
+				req, err := proto.ReadHeartbeatReq(bytes.NewBuffer(b))
+				if err != nil {
+					log.Error("cannot parse heartbeat request", "err", err, "request", b)
+					return
+				}
+				resp = s.handleHeartbeatRequest(nodeID, conn, req)
+			case proto.LeaveGroupReqKind:
+				req, err := proto.ReadLeaveGroupReq(bytes.NewBuffer(b))
+				if err != nil {
+					log.Error("cannot parse leave group request", "err", err, "request", b)
+					return
+				}
+				resp = s.handleLeaveGroupRequest(nodeID, conn, req)
 			default:
-				log.Errorf("unknown request: %d\n%s", kind, b)
+				log.Error("unknown request", "kind", kind, "request", b)
 				return
 			}
 		}
 
 		if resp == nil {
-			log.Errorf("no response for %d", kind)
+			log.Error("no response", "kind", kind)
 			return
 		}
+		if fault != nil && fault.Action == FaultError {
+			fault.applyError(resp)
+		}
 		b, err = resp.Bytes()
 		if err != nil {
-			log.Errorf("cannot serialize %T response: %s", resp, err)
+			log.Error("cannot serialize response", "type", fmt.Sprintf("%T", resp), "err", err)
+		}
+		keepOpen := true
+		if fault != nil {
+			b, keepOpen = fault.applyAfter(b)
 		}
 		if _, err := conn.Write(b); err != nil {
-			log.Errorf("cannot write %T response: %s", resp, err)
+			log.Error("cannot write response", "type", fmt.Sprintf("%T", resp), "err", err)
+			return
+		}
+		if !keepOpen {
 			return
 		}
 	}
@@ -366,6 +454,26 @@ type response interface {
 	Bytes() ([]byte, error)
 }
 
+// leads returns whether the given broker leads the partition. A standalone
+// server leads all partitions.
+func (s *Server) leads(nodeID int32, topic string, partition int32) bool {
+	return s.cluster == nil || s.cluster.leads(nodeID, topic, partition)
+}
+
+// partitionMetadata returns the metadata of a partition as seen by the given
+// broker.
+func (s *Server) partitionMetadata(nodeID int32, topic string, partition int32) proto.MetadataRespPartition {
+	if s.cluster != nil {
+		return s.cluster.partitionMetadata(topic, partition)
+	}
+	return proto.MetadataRespPartition{
+		ID:       partition,
+		Leader:   nodeID,
+		Replicas: []int32{nodeID},
+		Isrs:     []int32{nodeID},
+	}
+}
+
 func (s *Server) handleProduceRequest(
 	nodeID int32, conn net.Conn, req *proto.ProduceReq) response {
 
@@ -380,7 +488,7 @@ func (s *Server) handleProduceRequest(
 	for ti, topic := range req.Topics {
 		t, ok := s.topics[topic.Name]
 		if !ok {
-			t = make(map[int32][]*proto.Message)
+			t = make(map[int32]*partitionLog)
 			s.topics[topic.Name] = t
 		}
 
@@ -389,22 +497,35 @@ func (s *Server) handleProduceRequest(
 		resp.Topics[ti].Partitions = respParts
 
 		for pi, part := range topic.Partitions {
-			p, ok := t[part.ID]
-			if !ok {
-				p = make([]*proto.Message, 0)
-				t[part.ID] = p
+			respParts[pi].ID = part.ID
+			if !s.leads(nodeID, topic.Name, part.ID) {
+				respParts[pi].Err = proto.ErrNotLeaderForPartition
+				continue
 			}
 
-			log.Infof("produced %d messages to %s:%d at offset %d",
-				len(part.Messages), topic.Name, part.ID, len(t[part.ID]))
-			for _, msg := range part.Messages {
-				msg.Offset = int64(len(t[part.ID]))
-				msg.Topic = topic.Name
-				t[part.ID] = append(t[part.ID], msg)
+			l, ok := t[part.ID]
+			if !ok {
+				l = newPartitionLog()
+				t[part.ID] = l
 			}
 
-			respParts[pi].ID = part.ID
-			respParts[pi].Offset = int64(len(t[part.ID])) - 1
+			log.Info("produced messages", "topic", topic.Name, "partition", part.ID,
+				"messages", len(part.Messages), "offset", l.next)
+			batches := part.Batches
+			if batches == nil {
+				batches = []proto.MessageBatch{{Messages: part.Messages}}
+			}
+			for _, batch := range batches {
+				for _, msg := range batch.Messages {
+					msg.Topic = topic.Name
+					msg.Partition = part.ID
+				}
+				l.append(s.now(), batch.Compression, batch.Messages...)
+			}
+			respParts[pi].Offset = l.next - 1
+			if policy, ok := s.retention[topic.Name]; ok {
+				l.retain(policy, s.now())
+			}
 		}
 	}
 	return resp
@@ -413,11 +534,12 @@ func (s *Server) handleProduceRequest(
 func (s *Server) handleFetchRequest(
 	nodeID int32, conn net.Conn, req *proto.FetchReq) response {
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	resp := &proto.FetchResp{
 		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
 		Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
 	}
 	for ti, topic := range req.Topics {
@@ -426,27 +548,33 @@ func (s *Server) handleFetchRequest(
 		resp.Topics[ti].Partitions = respParts
 		for pi, part := range topic.Partitions {
 			respParts[pi].ID = part.ID
+			respParts[pi].PreferredReadReplica = -1
 
-			partitions, ok := s.topics[topic.Name]
+			l, ok := s.partitionLog(topic.Name, part.ID)
 			if !ok {
 				respParts[pi].Err = proto.ErrUnknownTopicOrPartition
 				continue
 			}
-			messages, ok := partitions[part.ID]
-			if !ok {
-				respParts[pi].Err = proto.ErrUnknownTopicOrPartition
+			if !s.leads(nodeID, topic.Name, part.ID) {
+				respParts[pi].Err = proto.ErrNotLeaderForPartition
 				continue
 			}
-			if part.FetchOffset > int64(len(messages)) {
+			respParts[pi].TipOffset = l.next
+			respParts[pi].LastStableOffset = l.next
+			respParts[pi].LogStartOffset = l.start
+			if part.FetchOffset < l.start || part.FetchOffset > l.next {
 				respParts[pi].Err = proto.ErrOffsetOutOfRange
 				continue
 			}
-			respParts[pi].TipOffset = int64(len(messages))
-			respParts[pi].Messages = messages[part.FetchOffset:]
+			respParts[pi].Batches = l.from(part.FetchOffset)
+			respParts[pi].Messages = make([]*proto.Message, 0)
+			for _, batch := range respParts[pi].Batches {
+				respParts[pi].Messages = append(respParts[pi].Messages, batch.Messages...)
+			}
 			numFetched := len(respParts[pi].Messages)
 			if numFetched > 0 || !strings.HasPrefix(topic.Name, "__") {
-				log.Infof("fetched %d messages from %s:%d at offset %d",
-					numFetched, topic.Name, part.ID, part.FetchOffset)
+				log.Info("fetched messages", "topic", topic.Name, "partition", part.ID,
+					"messages", numFetched, "offset", part.FetchOffset)
 			}
 		}
 	}
@@ -457,11 +585,12 @@ func (s *Server) handleFetchRequest(
 func (s *Server) handleOffsetRequest(
 	nodeID int32, conn net.Conn, req *proto.OffsetReq) response {
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	resp := &proto.OffsetResp{
 		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
 		Topics:        make([]proto.OffsetRespTopic, len(req.Topics)),
 	}
 	for ti, topic := range req.Topics {
@@ -470,25 +599,23 @@ func (s *Server) handleOffsetRequest(
 		resp.Topics[ti].Partitions = respPart
 		for pi, part := range topic.Partitions {
 			respPart[pi].ID = part.ID
-			switch part.TimeMs {
-			case -1: // latest
-				msgs := len(s.topics[topic.Name][part.ID])
-				respPart[pi].Offsets = []int64{int64(msgs), 0}
-				log.Infof("requested latest offset from %s:%d, returning %d",
-					topic.Name, part.ID, msgs)
-			case -2: // earliest
-				respPart[pi].Offsets = []int64{0, 0}
-				log.Infof("requested earliest offset from %s:%d, returning %d",
-					topic.Name, part.ID, 0)
-			default:
-				log.Errorf("offset time for %s:%d not supported: %d",
-					topic.Name, part.ID, part.TimeMs)
-				return nil
+			if !s.leads(nodeID, topic.Name, part.ID) {
+				respPart[pi].Err = proto.ErrNotLeaderForPartition
+				continue
 			}
-
-			// Now if they've asked for fewer, cut some off -- unclear if this
-			// is correct but it seems so given what we support right now
-			respPart[pi].Offsets = respPart[pi].Offsets[0:part.MaxOffsets]
+			l, ok := s.partitionLog(topic.Name, part.ID)
+			if !ok {
+				l = newPartitionLog()
+			}
+			if req.Version >= 1 {
+				offset, timestamp := l.offsetForTime(part.TimeMs)
+				respPart[pi].Offsets = []int64{offset}
+				respPart[pi].Timestamp = timestamp
+			} else {
+				respPart[pi].Offsets = l.offsetsBefore(part.TimeMs, part.MaxOffsets, s.now())
+			}
+			log.Info("requested offsets", "topic", topic.Name, "partition", part.ID,
+				"time", part.TimeMs, "offsets", respPart[pi].Offsets)
 		}
 	}
 	return resp
@@ -500,19 +627,27 @@ func (s *Server) handleGroupCoordinatorRequest(
 	// Fetches the read-lock, so try not to do this inside our own RLock
 	// as that can lead to deadlock state if someone happens to try to Lock
 	// while we're inside the first RLock
-	addr := s.Addr()
+	var addr string
+	coordinatorID := int32(0)
+	if s.cluster != nil {
+		// every broker of a cluster coordinates the groups it is asked about
+		addr = s.cluster.Addr(nodeID)
+		coordinatorID = nodeID
+	} else {
+		addr = s.Addr()
+	}
 
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	log.Infof("requested consumer metadata")
+	log.Info("requested consumer metadata")
 
 	addrps := strings.Split(addr, ":")
 	port, _ := strconv.Atoi(addrps[1])
 
 	return &proto.GroupCoordinatorResp{
 		CorrelationID:   req.CorrelationID,
-		CoordinatorID:   0,
+		CoordinatorID:   coordinatorID,
 		CoordinatorHost: addrps[0],
 		CoordinatorPort: int32(port),
 	}
@@ -540,6 +675,20 @@ func (s *Server) getTopicOffset(group, topic string, partID int32) *topicOffset
 	return toffset
 }
 
+// CommittedOffset returns the offset and metadata last committed by a consumer
+// group for a partition. The returned bool is false if the group never
+// committed nor fetched an offset for it.
+func (s *Server) CommittedOffset(group, topic string, partition int32) (int64, string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	toffset, ok := s.offsets[topic][partition][group]
+	if !ok {
+		return 0, "", false
+	}
+	return toffset.offset, toffset.metadata, true
+}
+
 func (s *Server) handleOffsetFetchRequest(
 	nodeID int32, conn net.Conn, req *proto.OffsetFetchReq) response {
 
@@ -559,8 +708,8 @@ func (s *Server) handleOffsetFetchRequest(
 			respPart[pi].ID = part
 			respPart[pi].Metadata = toffset.metadata
 			respPart[pi].Offset = toffset.offset
-			log.Infof("requested committed offset for group %s from %s:%d, returning %d",
-				req.ConsumerGroup, topic.Name, part, toffset.offset)
+			log.Info("requested committed offset", "group", req.ConsumerGroup,
+				"topic", topic.Name, "partition", part, "offset", toffset.offset)
 		}
 	}
 	return resp
@@ -586,8 +735,8 @@ func (s *Server) handleOffsetCommitRequest(
 			toffset.offset = part.Offset
 
 			respPart[pi].ID = part.ID
-			log.Infof("committed offset for group %s from %s:%d, saved %d",
-				req.ConsumerGroup, topic.Name, part.ID, part.Offset)
+			log.Info("committed offset", "group", req.ConsumerGroup,
+				"topic", topic.Name, "partition", part.ID, "offset", part.Offset)
 		}
 	}
 	return resp
@@ -599,31 +748,42 @@ func (s *Server) handleMetadataRequest(
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	log.Infof("requested metadata")
+	log.Info("requested metadata")
 
 	resp := &proto.MetadataResp{
 		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
 		Topics:        make([]proto.MetadataRespTopic, 0, len(s.topics)),
 		Brokers:       s.brokers,
+		ClusterID:     "kafkatest",
+		ControllerID:  nodeID,
+	}
+	if s.cluster != nil {
+		resp.Brokers = s.cluster.runningBrokers()
+		// the broker answering is running, so there is at least one
+		resp.ControllerID = resp.Brokers[0].NodeID
 	}
 
 	if req.Topics != nil && len(req.Topics) > 0 {
 		// if particular topic was requested, create empty log if does not yet exists
 		for _, name := range req.Topics {
 			partitions, ok := s.topics[name]
+			if !ok && req.Version >= 4 && !req.AllowAutoTopicCreation {
+				resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
+					Name: name,
+					Err:  proto.ErrUnknownTopicOrPartition,
+				})
+				continue
+			}
 			if !ok {
-				partitions = make(map[int32][]*proto.Message)
-				partitions[0] = make([]*proto.Message, 0)
+				partitions = make(map[int32]*partitionLog)
+				partitions[0] = newPartitionLog()
 				s.topics[name] = partitions
 			}
 
 			parts := make([]proto.MetadataRespPartition, len(partitions))
 			for pid := range partitions {
-				p := &parts[pid]
-				p.ID = pid
-				p.Leader = nodeID
-				p.Replicas = []int32{nodeID}
-				p.Isrs = []int32{nodeID}
+				parts[pid] = s.partitionMetadata(nodeID, name, pid)
 			}
 			resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
 				Name:       name,
@@ -635,11 +795,7 @@ func (s *Server) handleMetadataRequest(
 		for name, partitions := range s.topics {
 			parts := make([]proto.MetadataRespPartition, len(partitions))
 			for pid := range partitions {
-				p := &parts[pid]
-				p.ID = pid
-				p.Leader = nodeID
-				p.Replicas = []int32{nodeID}
-				p.Isrs = []int32{nodeID}
+				parts[pid] = s.partitionMetadata(nodeID, name, pid)
 			}
 			resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
 				Name:       name,
@@ -0,0 +1,104 @@
+package kafkatest
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/discord/zorkian-kafka"
+	"github.com/discord/zorkian-kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ServerSuite{})
+
+type ServerSuite struct {
+	srv *Server
+}
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+	s.srv = NewServer()
+	s.srv.MustSpawn()
+}
+
+func (s *ServerSuite) TearDownTest(c *C) {
+	_ = s.srv.Close()
+}
+
+// fetch sends a raw fetch request for test:0, so that messages before the
+// fetch offset are not trimmed like the client does.
+func (s *ServerSuite) fetch(c *C, version int16, offset int64) []*proto.Message {
+	conn, err := net.Dial("tcp", s.srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	req := &proto.FetchReq{
+		CorrelationID: 1,
+		Version:       version,
+		MaxWaitTime:   time.Millisecond,
+		Topics: []proto.FetchReqTopic{
+			{Name: "test", Partitions: []proto.FetchReqPartition{{ID: 0, FetchOffset: offset, MaxBytes: 1024}}},
+		},
+	}
+	_, err = req.WriteTo(conn)
+	c.Assert(err, IsNil)
+	_, b, err := proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+	resp, err := proto.ReadVersionedFetchResp(bytes.NewBuffer(b), version)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	return resp.Topics[0].Partitions[0].Messages
+}
+
+func (s *ServerSuite) TestCompressedBatches(c *C) {
+	s.srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")}, &proto.Message{Value: []byte("b")})
+
+	conf := kafka.NewBrokerConf("tester")
+	broker, err := kafka.NewBroker("kafkatest-server-compression", []string{s.srv.Addr()}, conf)
+	c.Assert(err, IsNil)
+	prodConf := kafka.NewProducerConf()
+	prodConf.Compression = proto.CompressionGzip
+	offset, err := broker.Producer(prodConf).Produce("test", 0,
+		&proto.Message{Value: []byte("c")},
+		&proto.Message{Value: []byte("d")},
+		&proto.Message{Value: []byte("e")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(4))
+
+	// Uncompressed messages are returned from the fetch offset, but the
+	// compressed batch is returned whole.
+	for _, version := range []int16{0, 4} {
+		msgs := s.fetch(c, version, 1)
+		c.Assert(msgs, HasLen, 4)
+		c.Assert(msgs[0].Offset, Equals, int64(1))
+		msgs = s.fetch(c, version, 3)
+		c.Assert(msgs, HasLen, 3)
+		c.Assert(msgs[0].Offset, Equals, int64(2))
+		c.Assert(string(msgs[2].Value), Equals, "e")
+	}
+
+	// The client trims the messages before the offset it asked for.
+	consConf := kafka.NewConsumerConf("test", 0)
+	consConf.StartOffset = 3
+	consumer, err := broker.BatchConsumer(consConf)
+	c.Assert(err, IsNil)
+	batch, err := consumer.ConsumeBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch, HasLen, 2)
+	c.Assert(batch[0].Offset, Equals, int64(3))
+	c.Assert(string(batch[0].Value), Equals, "d")
+}
+
+func (s *ServerSuite) TestDeleteRecordsInBatch(c *C) {
+	s.srv.AddBatch("test", 0, proto.CompressionSnappy,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")},
+		&proto.Message{Value: []byte("c")})
+
+	// The batch is kept as long as some of its messages are.
+	c.Assert(s.srv.DeleteRecordsBefore("test", 0, 2), IsNil)
+	msgs := s.fetch(c, 0, 2)
+	c.Assert(msgs, HasLen, 3)
+	c.Assert(msgs[0].Offset, Equals, int64(0))
+}
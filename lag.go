@@ -0,0 +1,316 @@
+package kafka
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+	"github.com/jpillora/backoff"
+)
+
+// PartitionLag describes how far a consumer group is behind the end of a single
+// partition at the time it was measured.
+type PartitionLag struct {
+	Topic     string
+	Partition int32
+
+	// Committed is the offset committed by the consumer group, or -1 if the
+	// group has never committed an offset for this partition.
+	Committed int64
+
+	// HighWatermark is the offset of the next message that will be written to
+	// the partition, or -1 if it could not be determined.
+	HighWatermark int64
+
+	// Lag is the number of messages between Committed and HighWatermark, or -1
+	// if either of them is unknown.
+	Lag int64
+
+	// Time is when the high watermark was read from the partition leader.
+	Time time.Time
+
+	// Err is set if the high watermark or committed offset could not be
+	// fetched for this partition.
+	Err error
+}
+
+// ConsumerGroupLag returns the lag of the consumer group on every partition of
+// the given topics. High watermarks are requested with a single offset request
+// per partition leader and committed offsets with a single offset fetch request
+// to the group coordinator, so this is much cheaper than calling OffsetLatest
+// and OffsetCoordinator.Offset for every partition.
+//
+// Per-partition failures are reported in PartitionLag.Err; an error is only
+// returned if a topic is unknown or the coordinator cannot be reached.
+//
+// Live consumers can get a cheaper lag signal from the TipOffset of fetched
+// messages, which is the high watermark at the time of the fetch.
+func (b *Broker) ConsumerGroupLag(group string, topics ...string) ([]PartitionLag, error) {
+	lags := make([]PartitionLag, 0)
+	for _, topic := range topics {
+		count, err := b.cluster.PartitionCount(topic)
+		if err != nil {
+			if err := b.cluster.RefreshMetadata(); err != nil {
+				return nil, err
+			}
+			if count, err = b.cluster.PartitionCount(topic); err != nil {
+				return nil, proto.ErrUnknownTopicOrPartition
+			}
+		}
+		for partition := int32(0); partition < count; partition++ {
+			lags = append(lags, PartitionLag{
+				Topic:         topic,
+				Partition:     partition,
+				Committed:     -1,
+				HighWatermark: -1,
+				Lag:           -1,
+			})
+		}
+	}
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Topic != lags[j].Topic {
+			return lags[i].Topic < lags[j].Topic
+		}
+		return lags[i].Partition < lags[j].Partition
+	})
+
+	b.fetchHighWatermarks(lags)
+	if err := b.fetchCommittedOffsets(group, lags); err != nil {
+		return nil, err
+	}
+
+	for i := range lags {
+		lag := &lags[i]
+		if lag.Committed < 0 || lag.HighWatermark < 0 {
+			continue
+		}
+		lag.Lag = lag.HighWatermark - lag.Committed
+		if lag.Lag < 0 {
+			lag.Lag = 0
+		}
+	}
+	return lags, nil
+}
+
+// fetchHighWatermarks fills in HighWatermark and Time for every entry in lags,
+// batching the requests by partition leader. Partitions that fail because of
+// stale leadership information are retried after a metadata refresh.
+func (b *Broker) fetchHighWatermarks(lags []PartitionLag) {
+	retry := &backoff.Backoff{Min: b.conf.LeaderRetryWait, Jitter: true}
+	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
+		if try != 0 {
+			time.Sleep(retry.Duration())
+		}
+
+		// Group everything we still need by the leader we currently know about
+		byLeader := make(map[int32][]int)
+		refresh := false
+		for i := range lags {
+			if lags[i].HighWatermark >= 0 {
+				continue
+			}
+			nodeID, err := b.cluster.GetEndpoint(lags[i].Topic, lags[i].Partition)
+			if err != nil {
+				lags[i].Err = proto.ErrLeaderNotAvailable
+				refresh = true
+				continue
+			}
+			byLeader[nodeID] = append(byLeader[nodeID], i)
+		}
+		if len(byLeader) == 0 && !refresh {
+			return
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for nodeID, indexes := range byLeader {
+			wg.Add(1)
+			go func(nodeID int32, indexes []int) {
+				defer wg.Done()
+				if !b.fetchLeaderHighWatermarks(nodeID, indexes, lags) {
+					mu.Lock()
+					refresh = true
+					mu.Unlock()
+				}
+			}(nodeID, indexes)
+		}
+		wg.Wait()
+
+		if !refresh {
+			return
+		}
+		if err := b.cluster.RefreshMetadata(); err != nil {
+			b.conf.Logger.Warn("cannot refresh metadata", "err", err)
+		}
+	}
+}
+
+// fetchLeaderHighWatermarks sends a single offset request for the given lags
+// entries to the node. It returns false if any partition failed in a way that
+// a metadata refresh might fix.
+func (b *Broker) fetchLeaderHighWatermarks(nodeID int32, indexes []int, lags []PartitionLag) bool {
+	setErr := func(err error) {
+		for _, i := range indexes {
+			lags[i].Err = err
+		}
+	}
+
+	addr := b.cluster.GetNodeAddress(nodeID)
+	if addr == "" {
+		setErr(errors.New("unknown broker id"))
+		for _, i := range indexes {
+			b.cluster.ForgetEndpoint(lags[i].Topic, lags[i].Partition)
+		}
+		return false
+	}
+
+	req := &proto.OffsetReq{
+		ClientID:  b.conf.ClientID,
+		ReplicaID: -1, // any client
+	}
+	topicIdx := make(map[string]int)
+	for _, i := range indexes {
+		ti, ok := topicIdx[lags[i].Topic]
+		if !ok {
+			ti = len(req.Topics)
+			topicIdx[lags[i].Topic] = ti
+			req.Topics = append(req.Topics, proto.OffsetReqTopic{Name: lags[i].Topic})
+		}
+		req.Topics[ti].Partitions = append(req.Topics[ti].Partitions, proto.OffsetReqPartition{
+			ID:         lags[i].Partition,
+			TimeMs:     proto.OffsetReqTimeLatest,
+			MaxOffsets: 1,
+		})
+	}
+
+	conn, err := b.conns.GetConnectionByAddr(addr)
+	if err != nil {
+		b.conf.Logger.Warn("cannot connect to leader for high watermarks",
+			"node", nodeID, "broker", addr, "err", err)
+		setErr(err)
+		return true
+	}
+	defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
+
+	resp, err := conn.Offset(req)
+	if err != nil {
+		b.conf.Logger.Warn("cannot fetch high watermarks",
+			"node", nodeID, "broker", addr, "err", err)
+		_ = conn.Close()
+		setErr(err)
+		return true
+	}
+	now := time.Now()
+
+	byPartition := make(map[topicPartition]int, len(indexes))
+	for _, i := range indexes {
+		byPartition[topicPartition{lags[i].Topic, lags[i].Partition}] = i
+	}
+
+	ok := true
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			i, found := byPartition[topicPartition{t.Name, p.ID}]
+			if !found {
+				b.conf.Logger.Warn("offset response with unexpected data",
+					"topic", t.Name, "partition", p.ID, "broker", addr)
+				continue
+			}
+			delete(byPartition, topicPartition{t.Name, p.ID})
+
+			switch {
+			case p.Err == nil:
+			case RequiresMetadataRefresh(p.Err):
+				b.cluster.ForgetEndpoint(t.Name, p.ID)
+				lags[i].Err = p.Err
+				ok = false
+				continue
+			default:
+				lags[i].Err = p.Err
+				continue
+			}
+
+			if len(p.Offsets) == 0 {
+				lags[i].Err = errors.New("no offsets in response")
+				continue
+			}
+			lags[i].HighWatermark = p.Offsets[0]
+			lags[i].Time = now
+			lags[i].Err = nil
+		}
+	}
+	for _, i := range byPartition {
+		lags[i].Err = errors.New("incomplete offset response")
+	}
+	return ok
+}
+
+// fetchCommittedOffsets fills in Committed for every entry in lags with a
+// single offset fetch request to the group coordinator.
+func (b *Broker) fetchCommittedOffsets(group string, lags []PartitionLag) error {
+	req := &proto.OffsetFetchReq{
+		ClientID:      b.conf.ClientID,
+		ConsumerGroup: group,
+	}
+	topicIdx := make(map[string]int)
+	byPartition := make(map[topicPartition]int, len(lags))
+	for i := range lags {
+		ti, ok := topicIdx[lags[i].Topic]
+		if !ok {
+			ti = len(req.Topics)
+			topicIdx[lags[i].Topic] = ti
+			req.Topics = append(req.Topics, proto.OffsetFetchReqTopic{Name: lags[i].Topic})
+		}
+		req.Topics[ti].Partitions = append(req.Topics[ti].Partitions, lags[i].Partition)
+		byPartition[topicPartition{lags[i].Topic, lags[i].Partition}] = i
+	}
+	if len(req.Topics) == 0 {
+		return nil
+	}
+
+	var resErr error
+	retry := &backoff.Backoff{Min: b.conf.LeaderRetryWait, Jitter: true}
+	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
+		if try != 0 {
+			time.Sleep(retry.Duration())
+		}
+
+		conn, err := b.coordinatorConnection(group)
+		if conn == nil {
+			resErr = err
+			continue
+		}
+		defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
+
+		resp, err := conn.OffsetFetch(req)
+		if err != nil {
+			b.conf.Logger.Debug("cannot fetch committed offsets",
+				"group", group, "broker", conn.addr, "try", try, "err", err)
+			_ = conn.Close()
+			resErr = err
+			continue
+		}
+
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				i, ok := byPartition[topicPartition{t.Name, p.ID}]
+				if !ok {
+					b.conf.Logger.Warn("offset fetch response with unexpected data",
+						"topic", t.Name, "partition", p.ID, "broker", conn.addr)
+					continue
+				}
+				if p.Err != nil {
+					if lags[i].Err == nil {
+						lags[i].Err = p.Err
+					}
+					continue
+				}
+				lags[i].Committed = p.Offset
+			}
+		}
+		return nil
+	}
+	return resErr
+}
@@ -0,0 +1,255 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&LagSuite{})
+
+type LagSuite struct{}
+
+func (s *LagSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *LagSuite) TestConsumerGroupLag(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(GroupCoordinatorRequest, func(request Serializable) Serializable {
+		req := request.(*proto.GroupCoordinatorReq)
+		host, port := srv.HostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+
+	offsetRequests := 0
+	var handlerErr error
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		offsetRequests++
+		if len(req.Topics) != 1 || len(req.Topics[0].Partitions) != 2 {
+			handlerErr = fmt.Errorf("expected a single batched request, got %+v", req.Topics)
+		}
+		watermarks := map[int32]int64{0: 10, 1: 7}
+		resp := &proto.OffsetResp{
+			CorrelationID: req.CorrelationID,
+			Topics:        []proto.OffsetRespTopic{{Name: "test"}},
+		}
+		for _, part := range req.Topics[0].Partitions {
+			if part.TimeMs != proto.OffsetReqTimeLatest {
+				handlerErr = fmt.Errorf("expected latest offset, got %d", part.TimeMs)
+			}
+			resp.Topics[0].Partitions = append(resp.Topics[0].Partitions, proto.OffsetRespPartition{
+				ID:      part.ID,
+				Offsets: []int64{watermarks[part.ID]},
+			})
+		}
+		return resp
+	})
+
+	offsetFetches := 0
+	srv.Handle(OffsetFetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetFetchReq)
+		offsetFetches++
+		return &proto.OffsetFetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetFetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetFetchRespPartition{
+						{ID: 0, Offset: 5},
+						{ID: 1, Offset: -1},
+					},
+				},
+			},
+		}
+	})
+
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	conf.LeaderRetryWait = 2 * time.Millisecond
+	broker, err := NewBroker("test-cluster-consumer-group-lag", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	before := time.Now()
+	lags, err := broker.ConsumerGroupLag("test-group", "test")
+	c.Assert(err, IsNil)
+	c.Assert(handlerErr, IsNil)
+	c.Assert(offsetRequests, Equals, 1)
+	c.Assert(offsetFetches, Equals, 1)
+	c.Assert(lags, HasLen, 2)
+
+	c.Assert(lags[0].Partition, Equals, int32(0))
+	c.Assert(lags[0].Err, IsNil)
+	c.Assert(lags[0].HighWatermark, Equals, int64(10))
+	c.Assert(lags[0].Committed, Equals, int64(5))
+	c.Assert(lags[0].Lag, Equals, int64(5))
+	c.Assert(lags[0].Time.Before(before), Equals, false)
+
+	c.Assert(lags[1].Partition, Equals, int32(1))
+	c.Assert(lags[1].Err, IsNil)
+	c.Assert(lags[1].HighWatermark, Equals, int64(7))
+	c.Assert(lags[1].Committed, Equals, int64(-1))
+	c.Assert(lags[1].Lag, Equals, int64(-1))
+
+	_, err = broker.ConsumerGroupLag("test-group", "does-not-exist")
+	c.Assert(err, ErrorIs, proto.ErrUnknownTopicOrPartition)
+}
+
+func (s *LagSuite) TestConsumerGroupLagPerLeader(c *C) {
+	srv1 := NewServer()
+	srv1.Start()
+	defer srv1.Close()
+
+	srv2 := NewServer()
+	srv2.Start()
+	defer srv2.Close()
+
+	// Partitions of both topics are spread over the two brokers.
+	leaders := map[topicPartition]int32{
+		{"a", 0}: 1, {"a", 1}: 2, {"a", 2}: 1,
+		{"b", 0}: 2, {"b", 1}: 1,
+	}
+	metadataHandler := func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		host1, port1 := srv1.HostPort()
+		host2, port2 := srv2.HostPort()
+		resp := &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host1, Port: int32(port1)},
+				{NodeID: 2, Host: host2, Port: int32(port2)},
+			},
+			Topics: []proto.MetadataRespTopic{{Name: "a"}, {Name: "b"}},
+		}
+		for i := range resp.Topics {
+			topic := &resp.Topics[i]
+			for tp, leader := range leaders {
+				if tp.topic != topic.Name {
+					continue
+				}
+				topic.Partitions = append(topic.Partitions, proto.MetadataRespPartition{
+					ID:       tp.partition,
+					Leader:   leader,
+					Replicas: []int32{leader},
+					Isrs:     []int32{leader},
+				})
+			}
+		}
+		return resp
+	}
+	coordinatorHandler := func(request Serializable) Serializable {
+		req := request.(*proto.GroupCoordinatorReq)
+		host, port := srv1.HostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	}
+	for _, srv := range []*Server{srv1, srv2} {
+		srv.Handle(MetadataRequest, metadataHandler)
+		srv.Handle(GroupCoordinatorRequest, coordinatorHandler)
+	}
+
+	// requested are the partitions of every offset request, by node.
+	var mu sync.Mutex
+	requested := make(map[int32][][]topicPartition)
+	offsetHandler := func(nodeID int32) RequestHandler {
+		return func(request Serializable) Serializable {
+			req := request.(*proto.OffsetReq)
+			resp := &proto.OffsetResp{CorrelationID: req.CorrelationID}
+			var partitions []topicPartition
+			for _, t := range req.Topics {
+				respTopic := proto.OffsetRespTopic{Name: t.Name}
+				for _, p := range t.Partitions {
+					partitions = append(partitions, topicPartition{t.Name, p.ID})
+					respTopic.Partitions = append(respTopic.Partitions, proto.OffsetRespPartition{
+						ID:      p.ID,
+						Offsets: []int64{100*int64(nodeID) + int64(p.ID)},
+					})
+				}
+				resp.Topics = append(resp.Topics, respTopic)
+			}
+			mu.Lock()
+			requested[nodeID] = append(requested[nodeID], partitions)
+			mu.Unlock()
+			return resp
+		}
+	}
+	srv1.Handle(OffsetRequest, offsetHandler(1))
+	srv2.Handle(OffsetRequest, offsetHandler(2))
+	srv1.Handle(OffsetFetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetFetchReq)
+		resp := &proto.OffsetFetchResp{CorrelationID: req.CorrelationID}
+		for _, t := range req.Topics {
+			respTopic := proto.OffsetFetchRespTopic{Name: t.Name}
+			for _, p := range t.Partitions {
+				respTopic.Partitions = append(respTopic.Partitions, proto.OffsetFetchRespPartition{
+					ID:     p,
+					Offset: 1,
+				})
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp
+	})
+
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	conf.LeaderRetryWait = 2 * time.Millisecond
+	broker, err := NewBroker("test-cluster-consumer-group-lag-leaders",
+		[]string{srv1.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	lags, err := broker.ConsumerGroupLag("test-group", "a", "b")
+	c.Assert(err, IsNil)
+	c.Assert(lags, HasLen, 5)
+	for _, lag := range lags {
+		leader := leaders[topicPartition{lag.Topic, lag.Partition}]
+		c.Assert(lag.Err, IsNil)
+		c.Assert(lag.HighWatermark, Equals, 100*int64(leader)+int64(lag.Partition))
+		c.Assert(lag.Lag, Equals, lag.HighWatermark-1)
+	}
+
+	// A single request per leader, carrying only the partitions it leads.
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(requested, HasLen, 2)
+	for nodeID, requests := range requested {
+		c.Assert(requests, HasLen, 1)
+		var expected []topicPartition
+		for tp, leader := range leaders {
+			if leader == nodeID {
+				expected = append(expected, tp)
+			}
+		}
+		sortTopicPartitions(expected)
+		sortTopicPartitions(requests[0])
+		c.Assert(requests[0], DeepEquals, expected, Commentf("node %d", nodeID))
+	}
+}
+
+func sortTopicPartitions(tps []topicPartition) {
+	sort.Slice(tps, func(i, j int) bool {
+		if tps[i].topic != tps[j].topic {
+			return tps[i].topic < tps[j].topic
+		}
+		return tps[i].partition < tps[j].partition
+	})
+}
@@ -1,37 +1,155 @@
 package kafka
 
 import (
-	"flag"
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
 	"sync"
+)
+
+// Logger is the interface used by the client to write log messages. keyvals
+// are alternating keys and values giving structured context to the message,
+// such as "topic", "partition", "broker", "try" and "err".
+//
+// The method set matches *slog.Logger, so one can be used directly.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
 
-	"github.com/op/go-logging"
+// LogLevel is the minimum severity of messages written by the adapters in
+// this package.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
 )
 
+// String returns the name of the level as written in log lines.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
 var (
-	log   *logging.Logger
-	logMu = &sync.Mutex{}
+	defaultLogger Logger = NewStdLogger(
+		stdlog.New(os.Stderr, "kafka: ", stdlog.LstdFlags), LogLevelInfo)
+	logMu = &sync.RWMutex{}
 
-	logLevel = flag.Int(
-		"kafka.log_level",
-		int(logging.INFO),
-		"Set logging verbosity for Kafka client.")
+	// log writes to whatever logger is set with SetLogger at the time of the
+	// call. It is used where no BrokerConf.Logger is available.
+	log Logger = packageLogger{}
 )
 
-func init() {
+// SetLogger sets the logger used by brokers whose BrokerConf.Logger is nil and
+// by code that isn't tied to a broker. By default, messages of level info
+// and above are written to stderr with the standard library logger.
+func SetLogger(l Logger) {
 	logMu.Lock()
 	defer logMu.Unlock()
 
-	if log != nil {
+	defaultLogger = l
+}
+
+func getLogger() Logger {
+	logMu.RLock()
+	defer logMu.RUnlock()
+
+	return defaultLogger
+}
+
+// loggerOrDefault returns l, or the package logger if l is nil.
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return log
+	}
+	return l
+}
+
+// packageLogger forwards everything to the logger set with SetLogger.
+type packageLogger struct{}
+
+func (packageLogger) Debug(msg string, keyvals ...interface{}) { getLogger().Debug(msg, keyvals...) }
+func (packageLogger) Info(msg string, keyvals ...interface{})  { getLogger().Info(msg, keyvals...) }
+func (packageLogger) Warn(msg string, keyvals ...interface{})  { getLogger().Warn(msg, keyvals...) }
+func (packageLogger) Error(msg string, keyvals ...interface{}) { getLogger().Error(msg, keyvals...) }
+
+// stdLogger adapts a standard library logger.
+type stdLogger struct {
+	l     *stdlog.Logger
+	level LogLevel
+}
+
+// NewStdLogger returns a Logger writing messages of the given level and above
+// to a standard library logger. Every message is written as a single line,
+// with keyvals appended as key=value pairs.
+func NewStdLogger(l *stdlog.Logger, level LogLevel) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+func (s *stdLogger) Debug(msg string, keyvals ...interface{}) {
+	s.output(LogLevelDebug, msg, keyvals)
+}
+
+func (s *stdLogger) Info(msg string, keyvals ...interface{}) {
+	s.output(LogLevelInfo, msg, keyvals)
+}
+
+func (s *stdLogger) Warn(msg string, keyvals ...interface{}) {
+	s.output(LogLevelWarn, msg, keyvals)
+}
+
+func (s *stdLogger) Error(msg string, keyvals ...interface{}) {
+	s.output(LogLevelError, msg, keyvals)
+}
+
+func (s *stdLogger) output(level LogLevel, msg string, keyvals []interface{}) {
+	if level < s.level {
 		return
 	}
-	log = logging.MustGetLogger("KafkaClient")
-	logging.SetLevel(logging.Level(*logLevel), "KafkaClient")
+	_ = s.l.Output(3, level.String()+" "+formatLogLine(msg, keyvals))
 }
 
-// SetLogger allows overriding the logger being used by Kafka clients.
-func SetLogger(l *logging.Logger) {
-	logMu.Lock()
-	defer logMu.Unlock()
+// formatLogLine returns msg followed by keyvals formatted as key=value pairs.
+// Values that would be ambiguous are quoted. A dangling value is written with
+// the !BADKEY key, like log/slog does.
+func formatLogLine(msg string, keyvals []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, value := "!BADKEY", keyvals[i]
+		if i+1 < len(keyvals) {
+			key, value = fmt.Sprint(keyvals[i]), keyvals[i+1]
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(formatLogValue(value))
+	}
+	return b.String()
+}
 
-	log = l
+func formatLogValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
 }
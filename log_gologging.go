@@ -0,0 +1,34 @@
+package kafka
+
+import (
+	"github.com/op/go-logging"
+)
+
+// goLoggingLogger adapts a github.com/op/go-logging logger.
+type goLoggingLogger struct {
+	l *logging.Logger
+}
+
+// NewGoLoggingLogger returns a Logger writing to a go-logging logger, which is
+// what this package used before Logger existed. keyvals are appended to the
+// message as key=value pairs and levels are filtered by the go-logging
+// backend.
+func NewGoLoggingLogger(l *logging.Logger) Logger {
+	return &goLoggingLogger{l: l}
+}
+
+func (g *goLoggingLogger) Debug(msg string, keyvals ...interface{}) {
+	g.l.Debugf("%s", formatLogLine(msg, keyvals))
+}
+
+func (g *goLoggingLogger) Info(msg string, keyvals ...interface{}) {
+	g.l.Infof("%s", formatLogLine(msg, keyvals))
+}
+
+func (g *goLoggingLogger) Warn(msg string, keyvals ...interface{}) {
+	g.l.Warningf("%s", formatLogLine(msg, keyvals))
+}
+
+func (g *goLoggingLogger) Error(msg string, keyvals ...interface{}) {
+	g.l.Errorf("%s", formatLogLine(msg, keyvals))
+}
@@ -0,0 +1,18 @@
+//go:build go1.21
+// +build go1.21
+
+package kafka
+
+import (
+	"log/slog"
+)
+
+// NewSlogLogger returns a Logger writing to a log/slog logger, or to
+// slog.Default() if l is nil. keyvals are passed to slog unchanged, so they
+// can also be slog.Attr values.
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
@@ -1,31 +1,25 @@
 package kafka
 
 import (
+	"bytes"
+	"errors"
+	stdlog "log"
 	"sync"
-
-	"github.com/op/go-logging"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
 
 type logTestBackend struct {
-	c  *C
-	mu *sync.Mutex
+	c     *C
+	mu    *sync.Mutex
+	quiet bool
 }
 
 var logTest = &logTestBackend{mu: &sync.Mutex{}}
 
 func logInit() {
-	logMu.Lock()
-	defer logMu.Unlock()
-
-	if log != nil {
-		return
-	}
-
-	log = logging.MustGetLogger("KafkaClient")
-	log.SetBackend(logging.AddModuleLevel(logTest))
-	logging.SetLevel(logging.DEBUG, "KafkaClient")
+	SetLogger(logTest)
 }
 
 func (l *logTestBackend) SetC(c *C) {
@@ -35,14 +29,88 @@ func (l *logTestBackend) SetC(c *C) {
 	l.c = c
 }
 
+func (l *logTestBackend) SetQuiet(quiet bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.quiet = quiet
+}
+
 func ResetTestLogger(c *C) {
 	logTest.SetC(c)
 }
 
-func (l *logTestBackend) Log(lvl logging.Level, cd int, rec *logging.Record) error {
+func (l *logTestBackend) Debug(msg string, keyvals ...interface{}) {
+	l.log(LogLevelDebug, msg, keyvals)
+}
+
+func (l *logTestBackend) Info(msg string, keyvals ...interface{}) {
+	l.log(LogLevelInfo, msg, keyvals)
+}
+
+func (l *logTestBackend) Warn(msg string, keyvals ...interface{}) {
+	l.log(LogLevelWarn, msg, keyvals)
+}
+
+func (l *logTestBackend) Error(msg string, keyvals ...interface{}) {
+	l.log(LogLevelError, msg, keyvals)
+}
+
+func (l *logTestBackend) log(level LogLevel, msg string, keyvals []interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.c.Log(rec.Formatted(cd))
-	return nil
+	if l.quiet || l.c == nil {
+		return
+	}
+	l.c.Log(level.String() + " " + formatLogLine(msg, keyvals))
+}
+
+var _ = Suite(&LogSuite{})
+
+type LogSuite struct{}
+
+func (s *LogSuite) TestFormatLogLine(c *C) {
+	line := formatLogLine("cannot fetch messages", []interface{}{
+		"topic", "test", "partition", int32(3), "try", 2,
+		"err", errors.New("connection refused"), "empty", "", "sleep", 500 * time.Millisecond,
+	})
+	c.Assert(line, Equals, `cannot fetch messages topic=test partition=3 try=2 `+
+		`err="connection refused" empty="" sleep=500ms`)
+
+	c.Assert(formatLogLine("dangling", []interface{}{"value"}), Equals, "dangling !BADKEY=value")
+}
+
+func (s *LogSuite) TestStdLogger(c *C) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(stdlog.New(&buf, "", 0), LogLevelWarn)
+
+	logger.Debug("debug message")
+	logger.Info("info message")
+	logger.Warn("warn message", "broker", "localhost:9092")
+	logger.Error("error message", "err", "boom")
+
+	c.Assert(buf.String(), Equals,
+		"WARN warn message broker=localhost:9092\nERROR error message err=boom\n")
+}
+
+func (s *LogSuite) TestBrokerLogger(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	var buf bytes.Buffer
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	conf.LeaderRetryLimit = 1
+	conf.Logger = NewStdLogger(stdlog.New(&buf, "", 0), LogLevelDebug)
+	broker, err := NewBroker("test-cluster-logger", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	_, err = broker.Consumer(NewConsumerConf("does-not-exist", 0))
+	c.Assert(err, NotNil)
+	c.Assert(buf.String(), Matches,
+		`(?s).*WARN unknown topic or partition \(no create\) topic=does-not-exist partition=0\n.*`)
 }
@@ -32,7 +32,7 @@ func getMetadataCache() *MetadataCache {
 	if globalMetadataCache != nil {
 		return globalMetadataCache
 	}
-	log.Infof("Creating metadata without using cache.")
+	log.Info("creating metadata without using cache")
 	return newMetadataCache()
 }
 
@@ -57,11 +57,12 @@ func (g *MetadataCache) getOrCreateMetadata(clusterName string, nodeAddresses []
 	g.lock.Lock()
 	defer g.lock.Unlock()
 
-	log.Infof("Retrieving metadata for cluster %s from LockingMap", clusterName)
+	logger := loggerOrDefault(conf.logger)
+	logger.Info("retrieving metadata from cache", "cluster", clusterName)
 	if clusterMetadata, ok := g.metadataMap[clusterName]; ok {
 		return clusterMetadata, nil
 	}
-	log.Infof("Metadata for cluster being created.")
+	logger.Info("creating metadata", "cluster", clusterName)
 
 	// Metadata requests are limited to 1 per cluster anyway.
 	conf.ConnectionLimit = 1
@@ -0,0 +1,234 @@
+package kafka
+
+import (
+	"encoding/json"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// Metrics is the interface used by the client to report measurements. Tags are
+// given as alternating key and value strings.
+//
+// The client reports the following metrics:
+//
+//	kafka_request_duration_seconds      histogram  api, broker
+//	kafka_request_errors_total          counter    api, broker
+//	kafka_pool_wait_seconds             histogram  broker
+//	kafka_pool_open_connections         gauge      broker
+//	kafka_retries_total                 counter    op
+//	kafka_metadata_refresh_seconds      histogram
+//	kafka_metadata_refresh_errors_total counter
+//	kafka_metadata_seed_fallbacks_total counter
+//	kafka_partition_suspensions_total   counter    topic
+//	kafka_replica_fetch_fallbacks_total counter    topic
+//	kafka_circuit_state                 gauge      broker
+//	kafka_cluster_events_dropped_total  counter
+//
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Counter increments the named counter by delta.
+	Counter(name string, delta int64, tags ...string)
+
+	// Histogram records a single observation of the named distribution.
+	// Durations are always reported in seconds.
+	Histogram(name string, value float64, tags ...string)
+
+	// Gauge sets the named gauge to value.
+	Gauge(name string, value float64, tags ...string)
+}
+
+// NopMetrics is a Metrics implementation that discards everything. It is used
+// when no Metrics is configured.
+type NopMetrics struct{}
+
+// Counter does nothing.
+func (NopMetrics) Counter(name string, delta int64, tags ...string) {}
+
+// Histogram does nothing.
+func (NopMetrics) Histogram(name string, value float64, tags ...string) {}
+
+// Gauge does nothing.
+func (NopMetrics) Gauge(name string, value float64, tags ...string) {}
+
+// metricsOrNop returns m, or NopMetrics if m is nil.
+func metricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return NopMetrics{}
+	}
+	return m
+}
+
+// observeDuration reports the time elapsed since start to the named histogram.
+func observeDuration(m Metrics, name string, start time.Time, tags ...string) {
+	m.Histogram(name, time.Since(start).Seconds(), tags...)
+}
+
+// requestKindName returns the name used in the api tag for the request.
+func requestKindName(req proto.Request) string {
+	switch req.(type) {
+	case *proto.ProduceReq:
+		return "produce"
+	case *proto.FetchReq:
+		return "fetch"
+	case *proto.OffsetReq:
+		return "offset"
+	case *proto.MetadataReq:
+		return "metadata"
+	case *proto.OffsetCommitReq:
+		return "offset_commit"
+	case *proto.OffsetFetchReq:
+		return "offset_fetch"
+	case *proto.GroupCoordinatorReq:
+		return "group_coordinator"
+	default:
+		return "unknown"
+	}
+}
+
+// ExpvarMetrics is a Metrics implementation that publishes everything as
+// expvar variables, grouped in a single map. Every combination of name and
+// tags is a separate entry, keyed as name{key=value,...}. Histograms are
+// summarized by their count, sum, min and max.
+type ExpvarMetrics struct {
+	vars *expvar.Map
+
+	mu     *sync.Mutex
+	gauges map[string]*expvar.Float
+	histos map[string]*expvarHistogram
+}
+
+// expvarMetrics holds the ExpvarMetrics created by NewExpvarMetrics, by name.
+var expvarMetrics = struct {
+	sync.Mutex
+	byName map[string]*ExpvarMetrics
+}{byName: make(map[string]*ExpvarMetrics)}
+
+// NewExpvarMetrics returns an ExpvarMetrics publishing its variables in the
+// expvar map with the given name. Calling it twice with the same name returns
+// the same instance.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	expvarMetrics.Lock()
+	defer expvarMetrics.Unlock()
+
+	if m, ok := expvarMetrics.byName[name]; ok {
+		return m
+	}
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name)
+	}
+	m := &ExpvarMetrics{
+		vars:   vars,
+		mu:     &sync.Mutex{},
+		gauges: make(map[string]*expvar.Float),
+		histos: make(map[string]*expvarHistogram),
+	}
+	expvarMetrics.byName[name] = m
+	return m
+}
+
+// Counter increments the named counter by delta.
+func (m *ExpvarMetrics) Counter(name string, delta int64, tags ...string) {
+	m.vars.Add(expvarKey(name, tags), delta)
+}
+
+// Histogram records a single observation of the named distribution.
+func (m *ExpvarMetrics) Histogram(name string, value float64, tags ...string) {
+	key := expvarKey(name, tags)
+
+	m.mu.Lock()
+	h, ok := m.histos[key]
+	if !ok {
+		h = &expvarHistogram{}
+		m.histos[key] = h
+		m.vars.Set(key, h)
+	}
+	m.mu.Unlock()
+
+	h.observe(value)
+}
+
+// Gauge sets the named gauge to value.
+func (m *ExpvarMetrics) Gauge(name string, value float64, tags ...string) {
+	key := expvarKey(name, tags)
+
+	m.mu.Lock()
+	g, ok := m.gauges[key]
+	if !ok {
+		g = new(expvar.Float)
+		m.gauges[key] = g
+		m.vars.Set(key, g)
+	}
+	m.mu.Unlock()
+
+	g.Set(value)
+}
+
+// Get returns the expvar variable for the given metric, or nil if nothing has
+// been reported for it yet.
+func (m *ExpvarMetrics) Get(name string, tags ...string) expvar.Var {
+	return m.vars.Get(expvarKey(name, tags))
+}
+
+// expvarKey builds the map key for a metric name and its tags.
+func expvarKey(name string, tags []string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(tags); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(tags[i])
+		b.WriteByte('=')
+		b.WriteString(tags[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// expvarHistogram is a summary of observations that can be published with
+// expvar.
+type expvarHistogram struct {
+	mu    sync.Mutex
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (h *expvarHistogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 || value < h.min {
+		h.min = value
+	}
+	if h.count == 0 || value > h.max {
+		h.max = value
+	}
+	h.count++
+	h.sum += value
+}
+
+// String returns the JSON representation of the summary, as required by
+// expvar.Var.
+func (h *expvarHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"count": h.count,
+		"sum":   h.sum,
+		"min":   h.min,
+		"max":   h.max,
+	})
+	return string(b)
+}
@@ -0,0 +1,160 @@
+package kafka
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&MetricsSuite{})
+
+type MetricsSuite struct{}
+
+func (s *MetricsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// recordingMetrics keeps the number of reports received for every metric name.
+type recordingMetrics struct {
+	mu      sync.Mutex
+	reports map[string]int
+	tags    map[string][]string
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		reports: make(map[string]int),
+		tags:    make(map[string][]string),
+	}
+}
+
+func (m *recordingMetrics) record(name string, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reports[name]++
+	m.tags[name] = tags
+}
+
+func (m *recordingMetrics) Counter(name string, delta int64, tags ...string) {
+	m.record(name, tags)
+}
+
+func (m *recordingMetrics) Histogram(name string, value float64, tags ...string) {
+	m.record(name, tags)
+}
+
+func (m *recordingMetrics) Gauge(name string, value float64, tags ...string) {
+	m.record(name, tags)
+}
+
+func (m *recordingMetrics) Reports(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.reports[name]
+}
+
+func (m *recordingMetrics) Tags(name string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.tags[name]
+}
+
+func (s *MetricsSuite) TestExpvarMetrics(c *C) {
+	m := NewExpvarMetrics("kafka_metrics_suite")
+	m.Counter("requests", 1, "api", "fetch")
+	m.Counter("requests", 2, "api", "fetch")
+	m.Gauge("conns", 3, "broker", "a:1")
+	m.Histogram("latency", 0.5)
+	m.Histogram("latency", 1.5)
+
+	c.Assert(m.Get("requests", "api", "fetch").String(), Equals, "3")
+	c.Assert(m.Get("conns", "broker", "a:1").String(), Equals, "3")
+	c.Assert(m.Get("latency").String(), Equals, `{"count":2,"max":1.5,"min":0.5,"sum":2}`)
+	c.Assert(m.Get("requests"), IsNil)
+
+	// Same name shares the published variables
+	same := NewExpvarMetrics("kafka_metrics_suite")
+	same.Histogram("latency", 2.5)
+	same.Gauge("conns", 4, "broker", "a:1")
+	c.Assert(m.Get("latency").String(), Equals, `{"count":3,"max":2.5,"min":0.5,"sum":4.5}`)
+	c.Assert(m.Get("conns", "broker", "a:1").String(), Equals, "4")
+}
+
+func (s *MetricsSuite) TestExpvarMetricsConcurrent(c *C) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewExpvarMetrics("kafka_metrics_concurrent").Counter("calls", 1)
+		}()
+	}
+	wg.Wait()
+	c.Assert(NewExpvarMetrics("kafka_metrics_concurrent").Get("calls").String(), Equals, "10")
+}
+
+func (s *MetricsSuite) TestBrokerMetrics(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.ProduceRespPartition{{ID: 0, Offset: 5}},
+				},
+			},
+		}
+	})
+
+	metrics := newRecordingMetrics()
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	conf.Metrics = metrics
+	broker, err := NewBroker("test-cluster-metrics", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	c.Assert(metrics.Reports("kafka_metadata_refresh_seconds"), Equals, 1)
+
+	_, err = broker.Producer(NewProducerConf()).Produce("test", 0, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+
+	c.Assert(metrics.Reports("kafka_pool_wait_seconds"), Equals, 1)
+	c.Assert(metrics.Reports("kafka_pool_open_connections"), Equals, 1)
+	c.Assert(strings.Join(metrics.Tags("kafka_request_duration_seconds"), ","), Equals,
+		"api,produce,broker,"+srv.Address())
+	c.Assert(metrics.Reports("kafka_request_errors_total"), Equals, 0)
+}
+
+func (s *MetricsSuite) TestPartitionSuspensionMetrics(c *C) {
+	metrics := newRecordingMetrics()
+	conf := NewErrorAverseRRProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{func(string) (int32, error) { return 1, nil }}
+	conf.Producer = newRecordingProducer(map[int32]struct{}{0: {}})
+	conf.ErrorAverseBackoff.Min = time.Millisecond
+	conf.Metrics = metrics
+	producer := NewErrorAverseRRProducer(conf)
+
+	// The partition is suspended when it is handed out after a failure
+	for i := 0; i < 2; i++ {
+		_, _, err := producer.Distribute("topic", &proto.Message{Value: []byte("first")})
+		c.Assert(err, NotNil)
+	}
+
+	for i := 0; i < 100 && metrics.Reports("kafka_partition_suspensions_total") == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(metrics.Reports("kafka_partition_suspensions_total"), Equals, 1)
+	c.Assert(metrics.Tags("kafka_partition_suspensions_total"), DeepEquals, []string{"topic", "topic"})
+}
@@ -0,0 +1,110 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// PartitionMetadata is the cached view of a partition, as of the last metadata
+// refresh.
+type PartitionMetadata struct {
+	Topic string
+	ID    int32
+
+	// Leader is the node ID of the partition leader, or -1 if the partition
+	// has no leader.
+	Leader int32
+
+	// Replicas and Isrs are the node IDs of the assigned and in-sync
+	// replicas. They are shared with the cache and must not be modified.
+	Replicas []int32
+	Isrs     []int32
+
+	// OfflineReplicas are the node IDs of the replicas on failed log
+	// directories. They are only known with MetadataVersion 5 and above.
+	OfflineReplicas []int32
+
+	// Err is the error reported by the broker for this partition, such as
+	// proto.ErrLeaderNotAvailable or proto.ErrReplicaNotAvailable.
+	Err error
+}
+
+// UnderReplicated returns true if some replicas are not in sync.
+func (p PartitionMetadata) UnderReplicated() bool {
+	return len(p.Isrs) < len(p.Replicas)
+}
+
+// Offline returns true if the partition has no leader, so that it can't be
+// produced to or consumed from.
+func (p PartitionMetadata) Offline() bool {
+	return p.Leader < 0
+}
+
+// newTopicMetadata returns the metadata of the partitions of a topic from a
+// metadata response, sorted by partition ID.
+func newTopicMetadata(topic proto.MetadataRespTopic) []PartitionMetadata {
+	parts := make([]PartitionMetadata, 0, len(topic.Partitions))
+	for _, part := range topic.Partitions {
+		parts = append(parts, PartitionMetadata{
+			Topic:    topic.Name,
+			ID:       part.ID,
+			Leader:   part.Leader,
+			Replicas: append([]int32(nil), part.Replicas...),
+			Isrs:     append([]int32(nil), part.Isrs...),
+			Err:      part.Err,
+
+			OfflineReplicas: append([]int32(nil), part.OfflineReplicas...),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].ID < parts[j].ID })
+	return parts
+}
+
+// TopicMetadata returns the cached metadata of every partition of a topic,
+// sorted by partition ID. An error is returned if the topic is not known.
+func (cm *Cluster) TopicMetadata(topic string) ([]PartitionMetadata, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	parts, ok := cm.topicMetadata[topic]
+	if !ok {
+		return nil, fmt.Errorf("topic %s not found in metadata", topic)
+	}
+	return append([]PartitionMetadata(nil), parts...), nil
+}
+
+// UnderReplicatedPartitions returns the cached metadata of all partitions with
+// replicas that are not in sync, sorted by topic and partition ID.
+func (cm *Cluster) UnderReplicatedPartitions() []PartitionMetadata {
+	return cm.filterPartitions(PartitionMetadata.UnderReplicated)
+}
+
+// OfflinePartitions returns the cached metadata of all partitions without a
+// leader, sorted by topic and partition ID.
+func (cm *Cluster) OfflinePartitions() []PartitionMetadata {
+	return cm.filterPartitions(PartitionMetadata.Offline)
+}
+
+// filterPartitions returns the cached metadata of the partitions matching keep.
+func (cm *Cluster) filterPartitions(keep func(PartitionMetadata) bool) []PartitionMetadata {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var parts []PartitionMetadata
+	for _, topicParts := range cm.topicMetadata {
+		for _, part := range topicParts {
+			if keep(part) {
+				parts = append(parts, part)
+			}
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].Topic != parts[j].Topic {
+			return parts[i].Topic < parts[j].Topic
+		}
+		return parts[i].ID < parts[j].ID
+	})
+	return parts
+}
@@ -0,0 +1,81 @@
+package kafka
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&PartitionMetadataSuite{})
+
+type PartitionMetadataSuite struct{}
+
+func (s *PartitionMetadataSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *PartitionMetadataSuite) TestTopicMetadata(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	host, port := srv.HostPort()
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 2, Leader: -1, Replicas: []int32{2, 3}, Isrs: []int32{},
+							Err: proto.ErrLeaderNotAvailable},
+						{ID: 0, Leader: 1, Replicas: []int32{1, 2, 3}, Isrs: []int32{1, 2, 3}},
+						{ID: 1, Leader: 1, Replicas: []int32{1, 2, 3}, Isrs: []int32{1},
+							Err: proto.ErrReplicaNotAvailable},
+					},
+				},
+				{
+					Name: "healthy",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+					},
+				},
+			},
+		}
+	})
+
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-topic-metadata", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	parts, err := broker.TopicMetadata("test")
+	c.Assert(err, IsNil)
+	c.Assert(parts, HasLen, 3)
+	c.Assert(parts[0], DeepEquals, PartitionMetadata{
+		Topic: "test", ID: 0, Leader: 1, Replicas: []int32{1, 2, 3}, Isrs: []int32{1, 2, 3}})
+	c.Assert(parts[1].Err, Equals, proto.ErrReplicaNotAvailable)
+	c.Assert(parts[1].UnderReplicated(), Equals, true)
+	c.Assert(parts[1].Offline(), Equals, false)
+	c.Assert(parts[2].Err, Equals, proto.ErrLeaderNotAvailable)
+	c.Assert(parts[2].Offline(), Equals, true)
+
+	_, err = broker.TopicMetadata("unknown")
+	c.Assert(err, NotNil)
+
+	under := broker.UnderReplicatedPartitions()
+	c.Assert(under, HasLen, 2)
+	c.Assert(under[0].ID, Equals, int32(1))
+	c.Assert(under[1].ID, Equals, int32(2))
+
+	offline := broker.OfflinePartitions()
+	c.Assert(offline, HasLen, 1)
+	c.Assert(offline[0].Topic, Equals, "test")
+	c.Assert(offline[0].ID, Equals, int32(2))
+}
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -18,6 +19,7 @@ var (
 	ErrMessageSizeTooLarge                     = &KafkaError{10, "message size too large"}
 	ErrScaleControllerEpoch                    = &KafkaError{11, "scale controller epoch"}
 	ErrOffsetMetadataTooLarge                  = &KafkaError{12, "offset metadata too large"}
+	ErrNetworkException                        = &KafkaError{13, "[transient] server disconnected before a response was received"}
 	ErrOffsetLoadInProgress                    = &KafkaError{14, "[transient] offsets load in progress"}
 	ErrNoCoordinator                           = &KafkaError{15, "[transient] consumer coordinator not available"}
 	ErrNotCoordinator                          = &KafkaError{16, "[transient] not coordinator for consumer"}
@@ -28,48 +30,226 @@ var (
 	ErrInvalidRequiredAcks                     = &KafkaError{21, "invalid value for required acks"}
 	ErrIllegalGeneration                       = &KafkaError{22, "consumer generation id is not valid"}
 	ErrInconsistentPartitionAssignmentStrategy = &KafkaError{23, "partition assignment strategy does not match that of the group"}
-	ErrUnknownParititonAssignmentStrategy      = &KafkaError{24, "partition assignment strategy is unknown to the broker"}
+	ErrInvalidGroupID                          = &KafkaError{24, "group id is not valid"}
 	ErrUnknownConsumerID                       = &KafkaError{25, "coordinator is not aware of this consumer"}
 	ErrInvalidSessionTimeout                   = &KafkaError{26, "invalid session timeout"}
-	ErrCommitingParitionsNotAssigned           = &KafkaError{27, "committing partitions are not assigned the committer"}
+	ErrRebalanceInProgress                     = &KafkaError{27, "group is rebalancing, rejoin is needed"}
 	ErrInvalidCommitOffsetSize                 = &KafkaError{28, "offset data size is not valid"}
 	ErrAuthorizationFailed                     = &KafkaError{29, "not authorized"}
-	ErrRebalanceInProgress                     = &KafkaError{30, "group is rebalancing, rejoin is needed"}
+	ErrGroupAuthorizationFailed                = &KafkaError{30, "not authorized to access group"}
+	ErrClusterAuthorizationFailed              = &KafkaError{31, "not authorized to use a cluster-level operation"}
+	ErrInvalidTimestamp                        = &KafkaError{32, "timestamp of the message is out of acceptable range"}
+	ErrUnsupportedSaslMechanism                = &KafkaError{33, "broker does not support the requested SASL mechanism"}
+	ErrIllegalSaslState                        = &KafkaError{34, "request is not valid given the current SASL state"}
+	ErrUnsupportedVersion                      = &KafkaError{35, "version of API is not supported"}
+	ErrTopicAlreadyExists                      = &KafkaError{36, "topic already exists"}
+	ErrInvalidPartitions                       = &KafkaError{37, "number of partitions is below 1"}
+	ErrInvalidReplicationFactor                = &KafkaError{38, "replication factor is below 1 or larger than the number of brokers"}
+	ErrInvalidReplicaAssignment                = &KafkaError{39, "replica assignment is invalid"}
+	ErrInvalidConfig                           = &KafkaError{40, "configuration is invalid"}
+	ErrNotController                           = &KafkaError{41, "[transient] not the correct controller for this cluster"}
+	ErrInvalidRequest                          = &KafkaError{42, "request is malformed or not supported by the broker"}
+	ErrUnsupportedForMessageFormat             = &KafkaError{43, "message format version does not support the request"}
+	ErrPolicyViolation                         = &KafkaError{44, "request parameters do not satisfy the configured policy"}
+	ErrOutOfOrderSequenceNumber                = &KafkaError{45, "broker received an out of order sequence number"}
+	ErrDuplicateSequenceNumber                 = &KafkaError{46, "broker received a duplicate sequence number"}
+	ErrInvalidProducerEpoch                    = &KafkaError{47, "producer attempted an operation with an old epoch"}
+	ErrInvalidTxnState                         = &KafkaError{48, "producer attempted a transactional operation in an invalid state"}
+	ErrInvalidProducerIDMapping                = &KafkaError{49, "producer id is not assigned to the transactional id"}
+	ErrInvalidTransactionTimeout               = &KafkaError{50, "transaction timeout is larger than the maximum allowed"}
+	ErrConcurrentTransactions                  = &KafkaError{51, "[transient] producer attempted to update a transaction while another update is in progress"}
+	ErrTransactionCoordinatorFenced            = &KafkaError{52, "transaction coordinator is no longer the current coordinator"}
+	ErrTransactionalIDAuthorizationFailed      = &KafkaError{53, "transactional id authorization failed"}
+	ErrSecurityDisabled                        = &KafkaError{54, "security features are disabled"}
+	ErrOperationNotAttempted                   = &KafkaError{55, "broker did not attempt to execute this operation"}
+	ErrKafkaStorageError                       = &KafkaError{56, "[transient] disk error when trying to access log file"}
+	ErrLogDirNotFound                          = &KafkaError{57, "user-specified log directory is not found"}
+	ErrSaslAuthenticationFailed                = &KafkaError{58, "SASL authentication failed"}
+	ErrUnknownProducerID                       = &KafkaError{59, "broker could not locate the producer metadata"}
+	ErrReassignmentInProgress                  = &KafkaError{60, "partition reassignment is in progress"}
+	ErrDelegationTokenAuthDisabled             = &KafkaError{61, "delegation token feature is not enabled"}
+	ErrDelegationTokenNotFound                 = &KafkaError{62, "delegation token is not found"}
+	ErrDelegationTokenOwnerMismatch            = &KafkaError{63, "principal is not the owner of the delegation token"}
+	ErrDelegationTokenRequestNotAllowed        = &KafkaError{64, "delegation token requests are not allowed on this connection"}
+	ErrDelegationTokenAuthorizationFailed      = &KafkaError{65, "delegation token authorization failed"}
+	ErrDelegationTokenExpired                  = &KafkaError{66, "delegation token is expired"}
+	ErrInvalidPrincipalType                    = &KafkaError{67, "principal type is not supported"}
+	ErrNonEmptyGroup                           = &KafkaError{68, "group is not empty"}
+	ErrGroupIDNotFound                         = &KafkaError{69, "group id does not exist"}
+	ErrFetchSessionIDNotFound                  = &KafkaError{70, "fetch session id was not found"}
+	ErrInvalidFetchSessionEpoch                = &KafkaError{71, "fetch session epoch is invalid"}
+	ErrListenerNotFound                        = &KafkaError{72, "leader has no listener for the request"}
+	ErrTopicDeletionDisabled                   = &KafkaError{73, "topic deletion is disabled"}
+	ErrFencedLeaderEpoch                       = &KafkaError{74, "[transient] leader epoch is older than the broker epoch"}
+	ErrUnknownLeaderEpoch                      = &KafkaError{75, "[transient] leader epoch is newer than the broker epoch"}
+	ErrUnsupportedCompressionType              = &KafkaError{76, "compression type is not supported by the requesting version"}
+	ErrStaleBrokerEpoch                        = &KafkaError{77, "broker epoch has changed"}
+	ErrOffsetNotAvailable                      = &KafkaError{78, "[transient] leader high watermark has not caught up"}
+	ErrMemberIDRequired                        = &KafkaError{79, "group member needs a valid member id"}
+	ErrPreferredLeaderNotAvailable             = &KafkaError{80, "[transient] preferred leader was not available"}
+	ErrGroupMaxSizeReached                     = &KafkaError{81, "group has reached its maximum size"}
+	ErrFencedInstanceID                        = &KafkaError{82, "static consumer fenced by another consumer with the same instance id"}
+	ErrEligibleLeadersNotAvailable             = &KafkaError{83, "[transient] eligible topic partition leaders are not available"}
+	ErrElectionNotNeeded                       = &KafkaError{84, "leader election not needed for topic partition"}
+	ErrNoReassignmentInProgress                = &KafkaError{85, "no partition reassignment is in progress"}
+	ErrGroupSubscribedToTopic                  = &KafkaError{86, "topic is subscribed to by the consumer group"}
+	ErrInvalidRecord                           = &KafkaError{87, "record failed validation on the broker"}
+	ErrUnstableOffsetCommit                    = &KafkaError{88, "[transient] there are unstable offsets that need to be cleared"}
+	ErrThrottlingQuotaExceeded                 = &KafkaError{89, "[transient] throttling quota has been exceeded"}
+	ErrProducerFenced                          = &KafkaError{90, "producer has been fenced by a newer producer instance"}
+	ErrResourceNotFound                        = &KafkaError{91, "resource does not exist"}
+	ErrDuplicateResource                       = &KafkaError{92, "resource already exists"}
+	ErrUnacceptableCredential                  = &KafkaError{93, "credential does not meet the broker requirements"}
+	ErrInconsistentVoterSet                    = &KafkaError{94, "voter set is inconsistent"}
+	ErrInvalidUpdateVersion                    = &KafkaError{95, "update version is invalid"}
+	ErrFeatureUpdateFailed                     = &KafkaError{96, "feature update failed"}
+	ErrPrincipalDeserializationFailure         = &KafkaError{97, "principal data could not be deserialized"}
+	ErrSnapshotNotFound                        = &KafkaError{98, "snapshot was not found"}
+	ErrPositionOutOfRange                      = &KafkaError{99, "position is out of range"}
+	ErrUnknownTopicID                          = &KafkaError{100, "[transient] topic id does not exist on the broker"}
+	ErrDuplicateBrokerRegistration             = &KafkaError{101, "broker registration id already exists"}
+	ErrBrokerIDNotRegistered                   = &KafkaError{102, "broker id is not registered"}
+	ErrInconsistentTopicID                     = &KafkaError{103, "[transient] topic id in the request does not match the topic id in the log"}
+	ErrInconsistentClusterID                   = &KafkaError{104, "cluster id in the request does not match the stored cluster id"}
+	ErrTransactionalIDNotFound                 = &KafkaError{105, "transactional id was not found"}
+	ErrFetchSessionTopicIDError                = &KafkaError{106, "fetch session encountered inconsistent topic id usage"}
+
+	// Deprecated: code 24 is INVALID_GROUP_ID, use ErrInvalidGroupID.
+	ErrUnknownParititonAssignmentStrategy = ErrInvalidGroupID
+	// Deprecated: code 27 is REBALANCE_IN_PROGRESS, use ErrRebalanceInProgress.
+	ErrCommitingParitionsNotAssigned = ErrRebalanceInProgress
 
 	errnoToErr = map[int16]error{
-		-1: ErrUnknown,
-		1:  ErrOffsetOutOfRange,
-		2:  ErrInvalidMessage,
-		3:  ErrUnknownTopicOrPartition,
-		4:  ErrInvalidMessageSize,
-		5:  ErrLeaderNotAvailable,
-		6:  ErrNotLeaderForPartition,
-		7:  ErrRequestTimeout,
-		8:  ErrBrokerNotAvailable,
-		9:  ErrReplicaNotAvailable,
-		10: ErrMessageSizeTooLarge,
-		11: ErrScaleControllerEpoch,
-		12: ErrOffsetMetadataTooLarge,
-		14: ErrOffsetLoadInProgress,
-		15: ErrNoCoordinator,
-		16: ErrNotCoordinator,
-		17: ErrInvalidTopic,
-		18: ErrRecordListTooLarge,
-		19: ErrNotEnoughReplicas,
-		20: ErrNotEnoughReplicasAfterAppend,
-		21: ErrInvalidRequiredAcks,
-		22: ErrIllegalGeneration,
-		23: ErrInconsistentPartitionAssignmentStrategy,
-		24: ErrUnknownParititonAssignmentStrategy,
-		25: ErrUnknownConsumerID,
-		26: ErrInvalidSessionTimeout,
-		27: ErrCommitingParitionsNotAssigned,
-		28: ErrInvalidCommitOffsetSize,
-		29: ErrAuthorizationFailed,
-		30: ErrRebalanceInProgress,
+		-1:  ErrUnknown,
+		1:   ErrOffsetOutOfRange,
+		2:   ErrInvalidMessage,
+		3:   ErrUnknownTopicOrPartition,
+		4:   ErrInvalidMessageSize,
+		5:   ErrLeaderNotAvailable,
+		6:   ErrNotLeaderForPartition,
+		7:   ErrRequestTimeout,
+		8:   ErrBrokerNotAvailable,
+		9:   ErrReplicaNotAvailable,
+		10:  ErrMessageSizeTooLarge,
+		11:  ErrScaleControllerEpoch,
+		12:  ErrOffsetMetadataTooLarge,
+		13:  ErrNetworkException,
+		14:  ErrOffsetLoadInProgress,
+		15:  ErrNoCoordinator,
+		16:  ErrNotCoordinator,
+		17:  ErrInvalidTopic,
+		18:  ErrRecordListTooLarge,
+		19:  ErrNotEnoughReplicas,
+		20:  ErrNotEnoughReplicasAfterAppend,
+		21:  ErrInvalidRequiredAcks,
+		22:  ErrIllegalGeneration,
+		23:  ErrInconsistentPartitionAssignmentStrategy,
+		24:  ErrInvalidGroupID,
+		25:  ErrUnknownConsumerID,
+		26:  ErrInvalidSessionTimeout,
+		27:  ErrRebalanceInProgress,
+		28:  ErrInvalidCommitOffsetSize,
+		29:  ErrAuthorizationFailed,
+		30:  ErrGroupAuthorizationFailed,
+		31:  ErrClusterAuthorizationFailed,
+		32:  ErrInvalidTimestamp,
+		33:  ErrUnsupportedSaslMechanism,
+		34:  ErrIllegalSaslState,
+		35:  ErrUnsupportedVersion,
+		36:  ErrTopicAlreadyExists,
+		37:  ErrInvalidPartitions,
+		38:  ErrInvalidReplicationFactor,
+		39:  ErrInvalidReplicaAssignment,
+		40:  ErrInvalidConfig,
+		41:  ErrNotController,
+		42:  ErrInvalidRequest,
+		43:  ErrUnsupportedForMessageFormat,
+		44:  ErrPolicyViolation,
+		45:  ErrOutOfOrderSequenceNumber,
+		46:  ErrDuplicateSequenceNumber,
+		47:  ErrInvalidProducerEpoch,
+		48:  ErrInvalidTxnState,
+		49:  ErrInvalidProducerIDMapping,
+		50:  ErrInvalidTransactionTimeout,
+		51:  ErrConcurrentTransactions,
+		52:  ErrTransactionCoordinatorFenced,
+		53:  ErrTransactionalIDAuthorizationFailed,
+		54:  ErrSecurityDisabled,
+		55:  ErrOperationNotAttempted,
+		56:  ErrKafkaStorageError,
+		57:  ErrLogDirNotFound,
+		58:  ErrSaslAuthenticationFailed,
+		59:  ErrUnknownProducerID,
+		60:  ErrReassignmentInProgress,
+		61:  ErrDelegationTokenAuthDisabled,
+		62:  ErrDelegationTokenNotFound,
+		63:  ErrDelegationTokenOwnerMismatch,
+		64:  ErrDelegationTokenRequestNotAllowed,
+		65:  ErrDelegationTokenAuthorizationFailed,
+		66:  ErrDelegationTokenExpired,
+		67:  ErrInvalidPrincipalType,
+		68:  ErrNonEmptyGroup,
+		69:  ErrGroupIDNotFound,
+		70:  ErrFetchSessionIDNotFound,
+		71:  ErrInvalidFetchSessionEpoch,
+		72:  ErrListenerNotFound,
+		73:  ErrTopicDeletionDisabled,
+		74:  ErrFencedLeaderEpoch,
+		75:  ErrUnknownLeaderEpoch,
+		76:  ErrUnsupportedCompressionType,
+		77:  ErrStaleBrokerEpoch,
+		78:  ErrOffsetNotAvailable,
+		79:  ErrMemberIDRequired,
+		80:  ErrPreferredLeaderNotAvailable,
+		81:  ErrGroupMaxSizeReached,
+		82:  ErrFencedInstanceID,
+		83:  ErrEligibleLeadersNotAvailable,
+		84:  ErrElectionNotNeeded,
+		85:  ErrNoReassignmentInProgress,
+		86:  ErrGroupSubscribedToTopic,
+		87:  ErrInvalidRecord,
+		88:  ErrUnstableOffsetCommit,
+		89:  ErrThrottlingQuotaExceeded,
+		90:  ErrProducerFenced,
+		91:  ErrResourceNotFound,
+		92:  ErrDuplicateResource,
+		93:  ErrUnacceptableCredential,
+		94:  ErrInconsistentVoterSet,
+		95:  ErrInvalidUpdateVersion,
+		96:  ErrFeatureUpdateFailed,
+		97:  ErrPrincipalDeserializationFailure,
+		98:  ErrSnapshotNotFound,
+		99:  ErrPositionOutOfRange,
+		100: ErrUnknownTopicID,
+		101: ErrDuplicateBrokerRegistration,
+		102: ErrBrokerIDNotRegistered,
+		103: ErrInconsistentTopicID,
+		104: ErrInconsistentClusterID,
+		105: ErrTransactionalIDNotFound,
+		106: ErrFetchSessionTopicIDError,
+	}
+
+	// retriableErrnos are the codes for which sending the same request again,
+	// possibly to another broker, may succeed. This follows the retriable
+	// errors of the protocol documentation, plus broker not available which
+	// usually means the leader moved.
+	retriableErrnos = map[int16]bool{
+		3: true, 5: true, 6: true, 7: true, 8: true, 9: true, 13: true, 14: true,
+		15: true, 16: true, 19: true, 20: true, 41: true, 51: true, 56: true,
+		70: true, 71: true, 72: true, 74: true, 75: true, 78: true, 80: true,
+		83: true, 88: true, 89: true, 100: true, 103: true, 106: true,
+	}
+
+	// metadataErrnos are the codes telling that the cached leadership
+	// information is stale.
+	metadataErrnos = map[int16]bool{
+		3: true, 5: true, 6: true, 8: true, 41: true, 56: true, 72: true,
+		74: true, 80: true, 100: true, 103: true,
 	}
 )
 
+const transientPrefix = "[transient]"
+
 type KafkaError struct {
 	errno   int16
 	message string
@@ -83,6 +263,53 @@ func (err *KafkaError) Errno() int {
 	return int(err.errno)
 }
 
+// Retriable returns true if sending the same request again, possibly to
+// another broker after a metadata refresh, may succeed.
+func (err *KafkaError) Retriable() bool {
+	return retriableErrnos[err.errno]
+}
+
+// Transient returns true if the error is caused by a temporary condition of
+// the cluster that is expected to clear by itself. Those are the errors with
+// a "[transient]" prefix in their message. All transient errors are
+// retriable.
+func (err *KafkaError) Transient() bool {
+	return len(err.message) >= len(transientPrefix) &&
+		err.message[:len(transientPrefix)] == transientPrefix
+}
+
+// RequiresMetadataRefresh returns true if the error means that the cached
+// leadership information for the partition is stale.
+func (err *KafkaError) RequiresMetadataRefresh() bool {
+	return metadataErrnos[err.errno]
+}
+
+// IsRetriable returns true if err is or wraps a retriable KafkaError.
+func IsRetriable(err error) bool {
+	var kerr *KafkaError
+	return errors.As(err, &kerr) && kerr.Retriable()
+}
+
+// IsTransient returns true if err is or wraps a transient KafkaError.
+func IsTransient(err error) bool {
+	var kerr *KafkaError
+	return errors.As(err, &kerr) && kerr.Transient()
+}
+
+// RequiresMetadataRefresh returns true if err is or wraps a KafkaError
+// telling that the cached leadership information is stale.
+func RequiresMetadataRefresh(err error) bool {
+	var kerr *KafkaError
+	return errors.As(err, &kerr) && kerr.RequiresMetadataRefresh()
+}
+
+// ErrorFromNo returns the KafkaError with the given error code, and false if
+// the code is zero or unknown.
+func ErrorFromNo(errno int16) (*KafkaError, bool) {
+	err, ok := errnoToErr[errno].(*KafkaError)
+	return err, ok
+}
+
 func errFromNo(errno int16) error {
 	if errno == 0 {
 		return nil
@@ -0,0 +1,58 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ErrorsSuite{})
+
+type ErrorsSuite struct{}
+
+func (s *ErrorsSuite) TestErrnoToErr(c *C) {
+	for errno, err := range errnoToErr {
+		c.Assert(err.(*KafkaError).Errno(), Equals, int(errno))
+		c.Assert(errFromNo(errno), Equals, err)
+	}
+	for errno := int16(1); errno <= 106; errno++ {
+		c.Assert(errnoToErr[errno], NotNil, Commentf("missing errno %d", errno))
+	}
+	c.Assert(errFromNo(0), IsNil)
+	c.Assert(errFromNo(1000), ErrorMatches, "unknown kafka error 1000")
+
+	kerr, ok := ErrorFromNo(27)
+	c.Assert(ok, Equals, true)
+	c.Assert(kerr, Equals, ErrRebalanceInProgress)
+	_, ok = ErrorFromNo(0)
+	c.Assert(ok, Equals, false)
+	_, ok = ErrorFromNo(1000)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ErrorsSuite) TestClassification(c *C) {
+	for _, err := range errnoToErr {
+		kerr := err.(*KafkaError)
+		if kerr.Transient() {
+			c.Assert(kerr.Retriable(), Equals, true, Commentf("%s", kerr))
+		}
+		if kerr.RequiresMetadataRefresh() {
+			c.Assert(kerr.Retriable(), Equals, true, Commentf("%s", kerr))
+		}
+	}
+
+	c.Assert(ErrNotLeaderForPartition.Transient(), Equals, true)
+	c.Assert(ErrNotLeaderForPartition.RequiresMetadataRefresh(), Equals, true)
+	c.Assert(ErrBrokerNotAvailable.Transient(), Equals, false)
+	c.Assert(ErrBrokerNotAvailable.Retriable(), Equals, true)
+	c.Assert(ErrOffsetOutOfRange.Retriable(), Equals, false)
+	c.Assert(ErrNoCoordinator.RequiresMetadataRefresh(), Equals, false)
+
+	wrapped := fmt.Errorf("commit: %w", ErrNotCoordinator)
+	c.Assert(IsRetriable(wrapped), Equals, true)
+	c.Assert(IsTransient(wrapped), Equals, true)
+	c.Assert(RequiresMetadataRefresh(wrapped), Equals, false)
+	c.Assert(IsRetriable(errors.New("[transient] not a kafka error")), Equals, false)
+	c.Assert(IsRetriable(nil), Equals, false)
+}
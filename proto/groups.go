@@ -0,0 +1,501 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// The group membership API, in its version 0 which requires Kafka 0.9. The
+// coordinator of a group, found with a GroupCoordinatorReq, keeps track of
+// its members and of the generation of the group, which is incremented every
+// time the group rebalances.
+
+type JoinGroupReq struct {
+	CorrelationID  int32
+	ClientID       string
+	GroupID        string
+	SessionTimeout time.Duration
+
+	// MemberID is empty when joining the group for the first time.
+	MemberID     string
+	ProtocolType string
+	Protocols    []GroupProtocol
+}
+
+// GroupProtocol is an assignment protocol supported by a member, with the
+// member metadata for that protocol. Protocols are listed by preference.
+type GroupProtocol struct {
+	Name     string
+	Metadata []byte
+}
+
+func ReadJoinGroupReq(r io.Reader) (*JoinGroupReq, error) {
+	var req JoinGroupReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.GroupID = dec.DecodeString()
+	req.SessionTimeout = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	req.MemberID = dec.DecodeString()
+	req.ProtocolType = dec.DecodeString()
+	req.Protocols = make([]GroupProtocol, dec.DecodeArrayLen())
+	for i := range req.Protocols {
+		req.Protocols[i].Name = dec.DecodeString()
+		req.Protocols[i].Metadata = dec.DecodeBytes()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *JoinGroupReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(JoinGroupReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.GroupID)
+	enc.Encode(int32(r.SessionTimeout / time.Millisecond))
+	enc.Encode(r.MemberID)
+	enc.Encode(r.ProtocolType)
+	enc.EncodeArrayLen(len(r.Protocols))
+	for _, p := range r.Protocols {
+		enc.Encode(p.Name)
+		enc.EncodeBytes(p.Metadata)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *JoinGroupReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type JoinGroupResp struct {
+	CorrelationID int32
+	Err           error
+	GenerationID  int32
+	GroupProtocol string
+	LeaderID      string
+	MemberID      string
+
+	// Members are only returned to the leader, which computes the assignment
+	// of the whole group.
+	Members []GroupMember
+}
+
+// GroupMember is a member of a group, with its metadata for the protocol
+// chosen by the coordinator.
+type GroupMember struct {
+	MemberID string
+	Metadata []byte
+}
+
+func ReadJoinGroupResp(r io.Reader) (*JoinGroupResp, error) {
+	var resp JoinGroupResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.GenerationID = dec.DecodeInt32()
+	resp.GroupProtocol = dec.DecodeString()
+	resp.LeaderID = dec.DecodeString()
+	resp.MemberID = dec.DecodeString()
+	resp.Members = make([]GroupMember, dec.DecodeArrayLen())
+	for i := range resp.Members {
+		resp.Members[i].MemberID = dec.DecodeString()
+		resp.Members[i].Metadata = dec.DecodeBytes()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *JoinGroupResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.Encode(r.GenerationID)
+	enc.Encode(r.GroupProtocol)
+	enc.Encode(r.LeaderID)
+	enc.Encode(r.MemberID)
+	enc.EncodeArrayLen(len(r.Members))
+	for _, m := range r.Members {
+		enc.Encode(m.MemberID)
+		enc.EncodeBytes(m.Metadata)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type SyncGroupReq struct {
+	CorrelationID int32
+	ClientID      string
+	GroupID       string
+	GenerationID  int32
+	MemberID      string
+
+	// Assignments are only sent by the leader, other members send none.
+	Assignments []GroupAssignment
+}
+
+// GroupAssignment is the assignment of a member, whose format depends on the
+// protocol of the group.
+type GroupAssignment struct {
+	MemberID   string
+	Assignment []byte
+}
+
+func ReadSyncGroupReq(r io.Reader) (*SyncGroupReq, error) {
+	var req SyncGroupReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.GroupID = dec.DecodeString()
+	req.GenerationID = dec.DecodeInt32()
+	req.MemberID = dec.DecodeString()
+	req.Assignments = make([]GroupAssignment, dec.DecodeArrayLen())
+	for i := range req.Assignments {
+		req.Assignments[i].MemberID = dec.DecodeString()
+		req.Assignments[i].Assignment = dec.DecodeBytes()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *SyncGroupReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(SyncGroupReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.GroupID)
+	enc.Encode(r.GenerationID)
+	enc.Encode(r.MemberID)
+	enc.EncodeArrayLen(len(r.Assignments))
+	for _, a := range r.Assignments {
+		enc.Encode(a.MemberID)
+		enc.EncodeBytes(a.Assignment)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *SyncGroupReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type SyncGroupResp struct {
+	CorrelationID int32
+	Err           error
+	Assignment    []byte
+}
+
+func ReadSyncGroupResp(r io.Reader) (*SyncGroupResp, error) {
+	var resp SyncGroupResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.Assignment = dec.DecodeBytes()
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *SyncGroupResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.EncodeBytes(r.Assignment)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type HeartbeatReq struct {
+	CorrelationID int32
+	ClientID      string
+	GroupID       string
+	GenerationID  int32
+	MemberID      string
+}
+
+func ReadHeartbeatReq(r io.Reader) (*HeartbeatReq, error) {
+	var req HeartbeatReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.GroupID = dec.DecodeString()
+	req.GenerationID = dec.DecodeInt32()
+	req.MemberID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *HeartbeatReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(HeartbeatReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.GroupID)
+	enc.Encode(r.GenerationID)
+	enc.Encode(r.MemberID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *HeartbeatReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type HeartbeatResp struct {
+	CorrelationID int32
+	Err           error
+}
+
+func ReadHeartbeatResp(r io.Reader) (*HeartbeatResp, error) {
+	var resp HeartbeatResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *HeartbeatResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type LeaveGroupReq struct {
+	CorrelationID int32
+	ClientID      string
+	GroupID       string
+	MemberID      string
+}
+
+func ReadLeaveGroupReq(r io.Reader) (*LeaveGroupReq, error) {
+	var req LeaveGroupReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.GroupID = dec.DecodeString()
+	req.MemberID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *LeaveGroupReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(LeaveGroupReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.GroupID)
+	enc.Encode(r.MemberID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *LeaveGroupReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type LeaveGroupResp struct {
+	CorrelationID int32
+	Err           error
+}
+
+func ReadLeaveGroupResp(r io.Reader) (*LeaveGroupResp, error) {
+	var resp LeaveGroupResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *LeaveGroupResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
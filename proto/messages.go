@@ -9,6 +9,7 @@ import (
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
 	"time"
 
 	"github.com/golang/snappy"
@@ -29,6 +30,10 @@ const (
 	OffsetCommitReqKind     = 8
 	OffsetFetchReqKind      = 9
 	GroupCoordinatorReqKind = 10
+	JoinGroupReqKind        = 11
+	HeartbeatReqKind        = 12
+	LeaveGroupReqKind       = 13
+	SyncGroupReqKind        = 14
 
 	// receive the latest offset (i.e. the offset of the next coming message)
 	OffsetReqTimeLatest = -1
@@ -109,7 +114,26 @@ type Message struct {
 	Crc       uint32 // set when fetching, ignored when producing
 	Topic     string // set when fetching, ignored when producing
 	Partition int32  // set when fetching, ignored when producing
-	TipOffset int64  // set when fetching, ignored when processing
+	TipOffset int64  // set when fetching, ignored when processing; see FetchRespPartition.TipOffset
+
+	// Headers are only carried by the v2 record format, which is read from
+	// and written to fetch responses of version 4 and above. Produce requests
+	// use the v0 format, which silently drops them.
+	Headers []Header
+}
+
+// MessageBatch is a group of messages stored and sent together, as a single
+// compressed wrapper message or record batch. Uncompressed batches are written
+// as individual messages by the v0 message format.
+type MessageBatch struct {
+	Compression Compression
+	Messages    []*Message
+}
+
+// Header is a key/value pair attached to a message.
+type Header struct {
+	Key   string
+	Value []byte
 }
 
 // ComputeCrc returns crc32 hash for given message content.
@@ -272,6 +296,19 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 			}
 			return nil, err
 		}
+		if len(msgbuf) > 4 && msgbuf[4] == recordBatchMagic {
+			msgs, err := readRecordBatch(offset, msgbuf)
+			if err == errRecordBatchCrc {
+				// same as for messages, stop at the first corrupted batch
+				return set, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, msgs...)
+			continue
+		}
+
 		msgdec := NewDecoder(bytes.NewBuffer(msgbuf))
 
 		msg := &Message{
@@ -285,10 +322,11 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 			return set, nil
 		}
 
-		// magic byte
-		_ = msgdec.DecodeInt8()
-
+		magic := msgdec.DecodeInt8()
 		attributes := msgdec.DecodeInt8()
+		if magic == 1 {
+			_ = msgdec.DecodeInt64() // timestamp
+		}
 		switch compression := Compression(attributes & 3); compression {
 		case CompressionNone:
 			msg.Key = msgdec.DecodeBytes()
@@ -333,10 +371,74 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 	}
 }
 
+// readMessageBatches reads a message set like readMessageSet does, but keeps
+// the messages of every compressed wrapper message or record batch together.
+// Consecutive uncompressed messages are returned as a single batch.
+func readMessageBatches(r io.Reader, size int32) ([]MessageBatch, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	var batches []MessageBatch
+	for len(buf) >= 12 {
+		end := 12 + int(binary.BigEndian.Uint32(buf[8:12]))
+		if end > len(buf) || end < 12+6 {
+			// partial message at the end of the set
+			break
+		}
+		msgbuf := buf[12:end]
+		var compression Compression
+		if msgbuf[4] == recordBatchMagic {
+			if len(msgbuf) < 11 {
+				break
+			}
+			compression = Compression(binary.BigEndian.Uint16(msgbuf[9:11]) & 7)
+		} else {
+			compression = Compression(msgbuf[5] & 3)
+		}
+		msgs, err := readMessageSet(bytes.NewReader(buf[:end]), int32(end))
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[end:]
+		if len(msgs) == 0 {
+			// corrupted, do not process anything more
+			break
+		}
+
+		last := len(batches) - 1
+		if compression == CompressionNone && last >= 0 && batches[last].Compression == CompressionNone {
+			batches[last].Messages = append(batches[last].Messages, msgs...)
+			continue
+		}
+		batches = append(batches, MessageBatch{Compression: compression, Messages: msgs})
+	}
+	return batches, nil
+}
+
+// MetadataMaxVersion is the highest version of the Metadata API supported by
+// MetadataReq and MetadataResp.
+const MetadataMaxVersion = 5
+
 type MetadataReq struct {
 	CorrelationID int32
 	ClientID      string
-	Topics        []string
+
+	// Version is the API version of the request, from 0 to
+	// MetadataMaxVersion. Version 1 requires Kafka 0.10.0 and adds the
+	// controller ID, broker racks and internal topics to the response. The
+	// response must be read with the same version.
+	Version int16
+
+	// Topics to return the metadata of, or all topics if empty.
+	Topics []string
+
+	// AllowAutoTopicCreation is only sent by version 4 and above. Earlier
+	// versions let the broker configuration decide.
+	AllowAutoTopicCreation bool
 }
 
 func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
@@ -345,13 +447,22 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
-	req.Topics = make([]string, dec.DecodeArrayLen())
-	for i := range req.Topics {
-		req.Topics[i] = dec.DecodeString()
+	// Version 1 and above use a null array for all topics.
+	if n := dec.DecodeArrayLen(); n > 0 {
+		req.Topics = make([]string, n)
+		for i := range req.Topics {
+			req.Topics[i] = dec.DecodeString()
+		}
+	} else if n == 0 && req.Version == 0 {
+		req.Topics = []string{}
+	}
+	if req.Version >= 4 {
+		req.AllowAutoTopicCreation = dec.DecodeInt8() != 0
 	}
 
 	if dec.Err() != nil {
@@ -361,19 +472,31 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 }
 
 func (r *MetadataReq) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > MetadataMaxVersion {
+		return nil, fmt.Errorf("unsupported metadata version %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(MetadataReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, name := range r.Topics {
-		enc.Encode(name)
+	if len(r.Topics) == 0 && r.Version >= 1 {
+		// An empty array means no topics since version 1, null means all.
+		enc.EncodeArrayLen(-1)
+	} else {
+		enc.EncodeArrayLen(len(r.Topics))
+		for _, name := range r.Topics {
+			enc.Encode(name)
+		}
+	}
+	if r.Version >= 4 {
+		enc.EncodeInt8(boolToInt8(r.AllowAutoTopicCreation))
 	}
 
 	if enc.Err() != nil {
@@ -398,19 +521,43 @@ func (r *MetadataReq) WriteTo(w io.Writer) (int64, error) {
 
 type MetadataResp struct {
 	CorrelationID int32
-	Brokers       []MetadataRespBroker
-	Topics        []MetadataRespTopic
+
+	// Version is the API version the response is encoded with; it must be the
+	// version of the request.
+	Version int16
+
+	// ThrottleTime is only set by version 3 and above.
+	ThrottleTime time.Duration
+
+	Brokers []MetadataRespBroker
+
+	// ClusterID is only set by version 2 and above.
+	ClusterID string
+
+	// ControllerID is only set by version 1 and above. It is -1 if there is
+	// no controller.
+	ControllerID int32
+
+	Topics []MetadataRespTopic
 }
 
 type MetadataRespBroker struct {
 	NodeID int32
 	Host   string
 	Port   int32
+
+	// Rack is only set by version 1 and above, and empty if the broker has no
+	// rack configured.
+	Rack string
 }
 
 type MetadataRespTopic struct {
-	Name       string
-	Err        error
+	Name string
+	Err  error
+
+	// IsInternal is only set by version 1 and above.
+	IsInternal bool
+
 	Partitions []MetadataRespPartition
 }
 
@@ -420,25 +567,47 @@ type MetadataRespPartition struct {
 	Leader   int32
 	Replicas []int32
 	Isrs     []int32
+
+	// OfflineReplicas is only set by version 5 and above.
+	OfflineReplicas []int32
 }
 
 func (r *MetadataResp) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > MetadataMaxVersion {
+		return nil, fmt.Errorf("unsupported metadata version %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 3 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeArrayLen(len(r.Brokers))
 	for _, broker := range r.Brokers {
 		enc.Encode(broker.NodeID)
 		enc.Encode(broker.Host)
 		enc.Encode(broker.Port)
+		if r.Version >= 1 {
+			enc.EncodeNullableString(broker.Rack)
+		}
+	}
+	if r.Version >= 2 {
+		enc.EncodeNullableString(r.ClusterID)
+	}
+	if r.Version >= 1 {
+		enc.Encode(r.ControllerID)
 	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.EncodeError(topic.Err)
 		enc.Encode(topic.Name)
+		if r.Version >= 1 {
+			enc.EncodeInt8(boolToInt8(topic.IsInternal))
+		}
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.EncodeError(part.Err)
@@ -446,6 +615,9 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 			enc.Encode(part.Leader)
 			enc.Encode(part.Replicas)
 			enc.Encode(part.Isrs)
+			if r.Version >= 5 {
+				enc.Encode(part.OfflineReplicas)
+			}
 		}
 	}
 
@@ -460,13 +632,28 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// ReadMetadataResp reads a version 0 metadata response.
 func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
+	return ReadVersionedMetadataResp(r, 0)
+}
+
+// ReadVersionedMetadataResp reads a metadata response to a request of the
+// given version.
+func ReadVersionedMetadataResp(r io.Reader, version int16) (*MetadataResp, error) {
+	if version < 0 || version > MetadataMaxVersion {
+		return nil, fmt.Errorf("unsupported metadata version %d", version)
+	}
+
 	var resp MetadataResp
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	resp.Version = version
+	if version >= 3 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 
 	resp.Brokers = make([]MetadataRespBroker, dec.DecodeArrayLen())
 	for i := range resp.Brokers {
@@ -474,6 +661,15 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		b.NodeID = dec.DecodeInt32()
 		b.Host = dec.DecodeString()
 		b.Port = dec.DecodeInt32()
+		if version >= 1 {
+			b.Rack = dec.DecodeString()
+		}
+	}
+	if version >= 2 {
+		resp.ClusterID = dec.DecodeString()
+	}
+	if version >= 1 {
+		resp.ControllerID = dec.DecodeInt32()
 	}
 
 	resp.Topics = make([]MetadataRespTopic, dec.DecodeArrayLen())
@@ -481,6 +677,9 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		var t = &resp.Topics[ti]
 		t.Err = errFromNo(dec.DecodeInt16())
 		t.Name = dec.DecodeString()
+		if version >= 1 {
+			t.IsInternal = dec.DecodeInt8() != 0
+		}
 		t.Partitions = make([]MetadataRespPartition, dec.DecodeArrayLen())
 		for pi := range t.Partitions {
 			var p = &t.Partitions[pi]
@@ -497,6 +696,13 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 			for ii := range p.Isrs {
 				p.Isrs[ii] = dec.DecodeInt32()
 			}
+
+			if version >= 5 {
+				p.OfflineReplicas = make([]int32, dec.DecodeArrayLen())
+				for oi := range p.OfflineReplicas {
+					p.OfflineReplicas[oi] = dec.DecodeInt32()
+				}
+			}
 		}
 	}
 
@@ -506,13 +712,30 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 	return &resp, nil
 }
 
+// FetchMaxVersion is the highest version of the Fetch API supported by
+// FetchReq and FetchResp.
+const FetchMaxVersion = 11
+
 type FetchReq struct {
 	CorrelationID int32
 	ClientID      string
-	MaxWaitTime   time.Duration
-	MinBytes      int32
+
+	// Version is the API version of the request, from 0 to FetchMaxVersion.
+	// Version 4 requires Kafka 0.11 and returns messages in the v2 record
+	// format, which carries headers. Version 11 requires Kafka 2.4 and adds
+	// RackID. The response must be read with the same version.
+	Version int16
+
+	MaxWaitTime time.Duration
+	MinBytes    int32
 
 	Topics []FetchReqTopic
+
+	// RackID is the rack of the client, only sent by version 11 and above.
+	// Brokers configured with a replica selector use it to point the client
+	// to a replica in the same rack, see
+	// FetchRespPartition.PreferredReadReplica.
+	RackID string
 }
 
 type FetchReqTopic struct {
@@ -532,14 +755,25 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	// replica id
 	_ = dec.DecodeInt32()
 	req.MaxWaitTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.MinBytes = dec.DecodeInt32()
+	if req.Version >= 3 {
+		_ = dec.DecodeInt32() // max bytes
+	}
+	if req.Version >= 4 {
+		_ = dec.DecodeInt8() // isolation level
+	}
+	if req.Version >= 7 {
+		_ = dec.DecodeInt32() // session id
+		_ = dec.DecodeInt32() // session epoch
+	}
 	req.Topics = make([]FetchReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
@@ -548,10 +782,28 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 		for pi := range topic.Partitions {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
+			if req.Version >= 9 {
+				_ = dec.DecodeInt32() // current leader epoch
+			}
 			part.FetchOffset = dec.DecodeInt64()
+			if req.Version >= 5 {
+				_ = dec.DecodeInt64() // log start offset
+			}
 			part.MaxBytes = dec.DecodeInt32()
 		}
 	}
+	if req.Version >= 7 {
+		// forgotten topics, only used by incremental fetch sessions
+		for i, n := 0, dec.DecodeArrayLen(); i < n && dec.Err() == nil; i++ {
+			_ = dec.DecodeString()
+			for j, m := 0, dec.DecodeArrayLen(); j < m && dec.Err() == nil; j++ {
+				_ = dec.DecodeInt32()
+			}
+		}
+	}
+	if req.Version >= 11 {
+		req.RackID = dec.DecodeString()
+	}
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -560,13 +812,17 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 }
 
 func (r *FetchReq) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > FetchMaxVersion {
+		return nil, fmt.Errorf("unsupported fetch version %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(FetchReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -574,6 +830,19 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	enc.Encode(int32(-1))
 	enc.Encode(int32(r.MaxWaitTime / time.Millisecond))
 	enc.Encode(r.MinBytes)
+	if r.Version >= 3 {
+		// max bytes, the partitions' MaxBytes are the only limit
+		enc.Encode(int32(math.MaxInt32))
+	}
+	if r.Version >= 4 {
+		enc.EncodeInt8(0) // isolation level: read uncommitted
+	}
+	if r.Version >= 7 {
+		// Fetch sessions aren't used: session ID 0 and epoch -1 ask for a
+		// full fetch without creating one.
+		enc.Encode(int32(0))
+		enc.Encode(int32(-1))
+	}
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -581,10 +850,22 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
+			if r.Version >= 9 {
+				enc.Encode(int32(-1)) // current leader epoch: unknown
+			}
 			enc.Encode(part.FetchOffset)
+			if r.Version >= 5 {
+				enc.Encode(int64(-1)) // log start offset: only used by followers
+			}
 			enc.Encode(part.MaxBytes)
 		}
 	}
+	if r.Version >= 7 {
+		enc.EncodeArrayLen(0) // forgotten topics
+	}
+	if r.Version >= 11 {
+		enc.Encode(r.RackID)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -608,7 +889,19 @@ func (r *FetchReq) WriteTo(w io.Writer) (int64, error) {
 
 type FetchResp struct {
 	CorrelationID int32
-	Topics        []FetchRespTopic
+
+	// Version is the API version the response is encoded with; it must be the
+	// version of the request.
+	Version int16
+
+	// ThrottleTime is only set by version 1 and above.
+	ThrottleTime time.Duration
+
+	// Err is only set by version 7 and above, for errors that aren't specific
+	// to a partition.
+	Err error
+
+	Topics []FetchRespTopic
 }
 
 type FetchRespTopic struct {
@@ -617,18 +910,52 @@ type FetchRespTopic struct {
 }
 
 type FetchRespPartition struct {
-	ID        int32
-	Err       error
+	ID  int32
+	Err error
+
+	// TipOffset is the high watermark of the partition: the offset of the next
+	// message that will be written to it. A consumer that has just processed
+	// the message at offset N is TipOffset-N-1 messages behind, which makes
+	// this a cheap lag signal that doesn't need an extra request.
 	TipOffset int64
-	Messages  []*Message
+
+	// LastStableOffset is only set by version 4 and above, and
+	// LogStartOffset by version 5 and above.
+	LastStableOffset int64
+	LogStartOffset   int64
+
+	// PreferredReadReplica is only set by version 11 and above. It is the
+	// node ID of the replica the client should fetch from instead, or -1 to
+	// keep fetching from the same broker. Responses of earlier versions are
+	// read with -1. Brokers don't return messages
+	// along with a preferred replica.
+	PreferredReadReplica int32
+
+	Messages []*Message
+
+	// Batches are only used when writing a response. If set, they are written
+	// instead of Messages, keeping their compression, like a broker returns
+	// batches as they were produced.
+	Batches []MessageBatch
 }
 
 func (r *FetchResp) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > FetchMaxVersion {
+		return nil, fmt.Errorf("unsupported fetch version %d", r.Version)
+	}
+
 	var buf buffer
 	enc := NewEncoder(&buf)
 
 	enc.Encode(int32(0)) // placeholder
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
+	if r.Version >= 7 {
+		enc.EncodeError(r.Err)
+		enc.Encode(int32(0)) // session id
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -637,15 +964,39 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.TipOffset)
+			if r.Version >= 4 {
+				enc.Encode(part.LastStableOffset)
+			}
+			if r.Version >= 5 {
+				enc.Encode(part.LogStartOffset)
+			}
+			if r.Version >= 4 {
+				enc.EncodeArrayLen(-1) // aborted transactions
+			}
+			if r.Version >= 11 {
+				enc.Encode(part.PreferredReadReplica)
+			}
 			i := len(buf)
 			enc.Encode(int32(0)) // placeholder
-			// NOTE(caleb): writing compressed fetch response isn't implemented
-			// for now, since that's not needed for clients.
-			n, err := writeMessageSet(&buf, part.Messages, CompressionNone)
-			if err != nil {
-				return nil, err
+			batches := part.Batches
+			if batches == nil {
+				batches = []MessageBatch{{Compression: CompressionNone, Messages: part.Messages}}
 			}
-			binary.BigEndian.PutUint32(buf[i:i+4], uint32(n))
+			size := 0
+			for _, batch := range batches {
+				var n int
+				var err error
+				if r.Version >= 4 {
+					n, err = writeRecordBatch(&buf, batch.Messages, batch.Compression)
+				} else {
+					n, err = writeMessageSet(&buf, batch.Messages, batch.Compression)
+				}
+				if err != nil {
+					return nil, err
+				}
+				size += n
+			}
+			binary.BigEndian.PutUint32(buf[i:i+4], uint32(size))
 		}
 	}
 
@@ -657,7 +1008,18 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 	return []byte(buf), nil
 }
 
+// ReadFetchResp reads a version 0 fetch response.
 func ReadFetchResp(r io.Reader) (*FetchResp, error) {
+	return ReadVersionedFetchResp(r, 0)
+}
+
+// ReadVersionedFetchResp reads a fetch response to a request of the given
+// version.
+func ReadVersionedFetchResp(r io.Reader, version int16) (*FetchResp, error) {
+	if version < 0 || version > FetchMaxVersion {
+		return nil, fmt.Errorf("unsupported fetch version %d", version)
+	}
+
 	var err error
 	var resp FetchResp
 
@@ -666,6 +1028,14 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	resp.Version = version
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
+	if version >= 7 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+		_ = dec.DecodeInt32() // session id
+	}
 
 	resp.Topics = make([]FetchRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
@@ -677,6 +1047,24 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 			part.ID = dec.DecodeInt32()
 			part.Err = errFromNo(dec.DecodeInt16())
 			part.TipOffset = dec.DecodeInt64()
+			if version >= 4 {
+				part.LastStableOffset = dec.DecodeInt64()
+			}
+			if version >= 5 {
+				part.LogStartOffset = dec.DecodeInt64()
+			}
+			if version >= 4 {
+				// aborted transactions: producer id and first offset
+				for i, n := 0, dec.DecodeArrayLen(); i < n && dec.Err() == nil; i++ {
+					_ = dec.DecodeInt64()
+					_ = dec.DecodeInt64()
+				}
+			}
+			if version >= 11 {
+				part.PreferredReadReplica = dec.DecodeInt32()
+			} else {
+				part.PreferredReadReplica = -1
+			}
 			if dec.Err() != nil {
 				return nil, dec.Err()
 			}
@@ -1149,6 +1537,11 @@ type ProduceReqTopic struct {
 type ProduceReqPartition struct {
 	ID       int32
 	Messages []*Message
+
+	// Batches are set when reading a request, and group the messages as
+	// they were compressed by the producer. They are ignored when writing a
+	// request, which compresses all messages of a partition together.
+	Batches []MessageBatch
 }
 
 func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
@@ -1179,9 +1572,13 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 				return nil, dec.Err()
 			}
 			var err error
-			if part.Messages, err = readMessageSet(r, msgSetSize); err != nil {
+			if part.Batches, err = readMessageBatches(r, msgSetSize); err != nil {
 				return nil, err
 			}
+			part.Messages = make([]*Message, 0)
+			for _, batch := range part.Batches {
+				part.Messages = append(part.Messages, batch.Messages...)
+			}
 		}
 	}
 
@@ -1307,11 +1704,23 @@ func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
 	return &resp, nil
 }
 
+// OffsetMaxVersion is the highest version of the ListOffsets API supported
+// by OffsetReq and OffsetResp.
+const OffsetMaxVersion = 1
+
 type OffsetReq struct {
 	CorrelationID int32
 	ClientID      string
-	ReplicaID     int32
-	Topics        []OffsetReqTopic
+
+	// Version is the API version of the request, from 0 to OffsetMaxVersion.
+	// Version 1 requires Kafka 0.10.1 and returns the earliest offset whose
+	// timestamp is at or after TimeMs, instead of the offsets of the log
+	// segments last written before it. The response must be read with the
+	// same version.
+	Version int16
+
+	ReplicaID int32
+	Topics    []OffsetReqTopic
 }
 
 type OffsetReqTopic struct {
@@ -1322,7 +1731,7 @@ type OffsetReqTopic struct {
 type OffsetReqPartition struct {
 	ID         int32
 	TimeMs     int64 // cannot be time.Time because of negative values
-	MaxOffsets int32
+	MaxOffsets int32 // only sent by version 0
 }
 
 func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
@@ -1331,8 +1740,9 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ReplicaID = dec.DecodeInt32()
@@ -1345,7 +1755,9 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
 			part.TimeMs = dec.DecodeInt64()
-			part.MaxOffsets = dec.DecodeInt32()
+			if req.Version == 0 {
+				part.MaxOffsets = dec.DecodeInt32()
+			}
 		}
 	}
 
@@ -1356,13 +1768,17 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 }
 
 func (r *OffsetReq) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > OffsetMaxVersion {
+		return nil, fmt.Errorf("unsupported offset version %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(OffsetReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -1374,7 +1790,9 @@ func (r *OffsetReq) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.Encode(part.TimeMs)
-			enc.Encode(part.MaxOffsets)
+			if r.Version == 0 {
+				enc.Encode(part.MaxOffsets)
+			}
 		}
 	}
 
@@ -1400,7 +1818,11 @@ func (r *OffsetReq) WriteTo(w io.Writer) (int64, error) {
 
 type OffsetResp struct {
 	CorrelationID int32
-	Topics        []OffsetRespTopic
+
+	// Version is the API version of the request the response is for.
+	Version int16
+
+	Topics []OffsetRespTopic
 }
 
 type OffsetRespTopic struct {
@@ -1409,13 +1831,32 @@ type OffsetRespTopic struct {
 }
 
 type OffsetRespPartition struct {
-	ID      int32
-	Err     error
+	ID  int32
+	Err error
+
+	// Timestamp is only set by version 1, to the timestamp of the message at
+	// the returned offset, or -1 for the earliest and latest offsets.
+	Timestamp int64
+
+	// Offsets are in descending order. Version 1 always returns a single
+	// offset, which is -1 if no message has a timestamp at or after the
+	// requested one.
 	Offsets []int64
 }
 
+// ReadOffsetResp reads a version 0 offset response.
 func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
-	var resp OffsetResp
+	return ReadVersionedOffsetResp(r, 0)
+}
+
+// ReadVersionedOffsetResp reads an offset response to a request of the given
+// version.
+func ReadVersionedOffsetResp(r io.Reader, version int16) (*OffsetResp, error) {
+	if version < 0 || version > OffsetMaxVersion {
+		return nil, fmt.Errorf("unsupported offset version %d", version)
+	}
+
+	resp := OffsetResp{Version: version}
 	dec := NewDecoder(r)
 
 	// total message size
@@ -1430,9 +1871,14 @@ func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
 			var p = &t.Partitions[pi]
 			p.ID = dec.DecodeInt32()
 			p.Err = errFromNo(dec.DecodeInt16())
-			p.Offsets = make([]int64, dec.DecodeArrayLen())
-			for oi := range p.Offsets {
-				p.Offsets[oi] = dec.DecodeInt64()
+			if version >= 1 {
+				p.Timestamp = dec.DecodeInt64()
+				p.Offsets = []int64{dec.DecodeInt64()}
+			} else {
+				p.Offsets = make([]int64, dec.DecodeArrayLen())
+				for oi := range p.Offsets {
+					p.Offsets[oi] = dec.DecodeInt64()
+				}
 			}
 		}
 	}
@@ -1444,6 +1890,10 @@ func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
 }
 
 func (r *OffsetResp) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > OffsetMaxVersion {
+		return nil, fmt.Errorf("unsupported offset version %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
@@ -1457,6 +1907,15 @@ func (r *OffsetResp) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
+			if r.Version >= 1 {
+				offset := int64(-1)
+				if len(part.Offsets) > 0 {
+					offset = part.Offsets[0]
+				}
+				enc.Encode(part.Timestamp)
+				enc.Encode(offset)
+				continue
+			}
 			enc.EncodeArrayLen(len(part.Offsets))
 			for _, off := range part.Offsets {
 				enc.Encode(off)
@@ -132,6 +132,74 @@ func (s *MessagesSuite) TestMetadataResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestMetadataVersions(c *C) {
+	for version := int16(0); version <= MetadataMaxVersion; version++ {
+		req := &MetadataReq{
+			CorrelationID:          123,
+			ClientID:               "testcli",
+			Version:                version,
+			AllowAutoTopicCreation: version >= 4,
+		}
+		testRequestSerialization(c, req)
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		r, err := ReadMetadataReq(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		if version == 0 {
+			req.Topics = []string{}
+		}
+		c.Assert(r, DeepEquals, req, Commentf("version %d", version))
+
+		resp := &MetadataResp{
+			CorrelationID: 123,
+			Version:       version,
+			Brokers: []MetadataRespBroker{
+				{NodeID: 1, Host: "a", Port: 9092},
+				{NodeID: 2, Host: "b", Port: 9092, Rack: "rack-b"},
+			},
+			Topics: []MetadataRespTopic{
+				{
+					Name: "foo",
+					Partitions: []MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1, 2}, Isrs: []int32{1}},
+					},
+				},
+			},
+		}
+		if version >= 1 {
+			resp.ControllerID = 2
+			resp.Topics = append(resp.Topics, MetadataRespTopic{
+				Name:       "__consumer_offsets",
+				IsInternal: true,
+				Partitions: []MetadataRespPartition{},
+			})
+		} else {
+			resp.Brokers[1].Rack = ""
+		}
+		if version >= 2 {
+			resp.ClusterID = "cluster"
+		}
+		if version >= 3 {
+			resp.ThrottleTime = 10 * time.Millisecond
+		}
+		if version >= 5 {
+			resp.Topics[0].Partitions[0].OfflineReplicas = []int32{2}
+		}
+
+		b, err = resp.Bytes()
+		c.Assert(err, IsNil)
+		got, err := ReadVersionedMetadataResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+		if version < 5 {
+			got.Topics[0].Partitions[0].OfflineReplicas = nil
+		}
+		c.Assert(got, DeepEquals, resp, Commentf("version %d", version))
+	}
+
+	_, err := (&MetadataReq{Version: MetadataMaxVersion + 1}).Bytes()
+	c.Assert(err, NotNil)
+}
+
 func getGoMinorVersion() string {
 	min := strings.Split(runtime.Version(), ".")[1]
 	return strings.Split(min, "beta")[0]
@@ -200,6 +268,14 @@ func (s *MessagesSuite) TestProduceRequest(c *C) {
 
 		r, _ := ReadProduceReq(bytes.NewBuffer(tt.Expected))
 		req.Compression = CompressionNone // isn't set on deserialization
+		for _, t := range r.Topics {
+			for pi := range t.Partitions {
+				// batches keep the compression instead
+				c.Assert(t.Partitions[pi].Batches, HasLen, 1)
+				c.Assert(t.Partitions[pi].Batches[0].Compression, Equals, tt.Compression)
+				t.Partitions[pi].Batches = nil
+			}
+		}
 		if !reflect.DeepEqual(r, req) {
 			c.Fatalf("malformed request: %#v", r)
 		}
@@ -309,19 +385,21 @@ func (s *MessagesSuite) TestFetchResponse(c *C) {
 				Name: "foo",
 				Partitions: []FetchRespPartition{
 					{
-						ID:        0,
-						Err:       error(nil),
-						TipOffset: 4,
+						ID:                   0,
+						Err:                  error(nil),
+						TipOffset:            4,
+						PreferredReadReplica: -1,
 						Messages: []*Message{
 							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
 							{Offset: 3, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
 						},
 					},
 					{
-						ID:        1,
-						Err:       ErrUnknownTopicOrPartition,
-						TipOffset: -1,
-						Messages:  []*Message{},
+						ID:                   1,
+						Err:                  ErrUnknownTopicOrPartition,
+						TipOffset:            -1,
+						PreferredReadReplica: -1,
+						Messages:             []*Message{},
 					},
 				},
 			},
@@ -358,22 +436,25 @@ func (s *MessagesSuite) TestFetchResponse(c *C) {
 						Name: "test",
 						Partitions: []FetchRespPartition{
 							{
-								ID:        0,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  []*Message{},
+								ID:                   0,
+								Err:                  ErrUnknownTopicOrPartition,
+								TipOffset:            -1,
+								PreferredReadReplica: -1,
+								Messages:             []*Message{},
 							},
 							{
-								ID:        1,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  []*Message{},
+								ID:                   1,
+								Err:                  ErrUnknownTopicOrPartition,
+								TipOffset:            -1,
+								PreferredReadReplica: -1,
+								Messages:             []*Message{},
 							},
 							{
-								ID:        8,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  []*Message{},
+								ID:                   8,
+								Err:                  ErrUnknownTopicOrPartition,
+								TipOffset:            -1,
+								PreferredReadReplica: -1,
+								Messages:             []*Message{},
 							},
 						},
 					},
@@ -402,6 +483,307 @@ func (s *MessagesSuite) TestFetchResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestFetchVersions(c *C) {
+	for version := int16(0); version <= FetchMaxVersion; version++ {
+		req := &FetchReq{
+			CorrelationID: 241,
+			ClientID:      "test",
+			Version:       version,
+			MaxWaitTime:   time.Second,
+			MinBytes:      1,
+			Topics: []FetchReqTopic{
+				{
+					Name: "foo",
+					Partitions: []FetchReqPartition{
+						{ID: 1, FetchOffset: 10, MaxBytes: 1024},
+					},
+				},
+			},
+		}
+		if version >= 11 {
+			req.RackID = "rack-a"
+		}
+		testRequestSerialization(c, req)
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		r, err := ReadFetchReq(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(r, DeepEquals, req, Commentf("version %d", version))
+
+		resp := &FetchResp{
+			CorrelationID: 241,
+			Version:       version,
+			Topics: []FetchRespTopic{
+				{
+					Name: "foo",
+					Partitions: []FetchRespPartition{
+						{
+							ID:        1,
+							TipOffset: 12,
+							Messages: []*Message{
+								{Offset: 10, Key: []byte("k"), Value: []byte("v1")},
+								{Offset: 11, Value: []byte("v2")},
+							},
+						},
+					},
+				},
+			},
+		}
+		part := &resp.Topics[0].Partitions[0]
+		if version >= 1 {
+			resp.ThrottleTime = 5 * time.Millisecond
+		}
+		if version >= 4 {
+			part.LastStableOffset = 12
+			part.Messages[1].Headers = []Header{{Key: "h", Value: []byte("hv")}}
+		}
+		if version >= 5 {
+			part.LogStartOffset = 3
+		}
+		// read as -1 from versions that don't have it
+		part.PreferredReadReplica = -1
+
+		b, err = resp.Bytes()
+		c.Assert(err, IsNil)
+		got, err := ReadVersionedFetchResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+		for _, msg := range got.Topics[0].Partitions[0].Messages {
+			c.Assert(msg.Topic, Equals, "foo")
+			c.Assert(msg.TipOffset, Equals, int64(12))
+			msg.Crc, msg.Topic, msg.Partition, msg.TipOffset = 0, "", 0, 0
+		}
+		c.Assert(got, DeepEquals, resp, Commentf("version %d", version))
+	}
+
+	_, err := (&FetchReq{Version: FetchMaxVersion + 1}).Bytes()
+	c.Assert(err, NotNil)
+}
+
+func (s *MessagesSuite) TestOffsetVersions(c *C) {
+	for version := int16(0); version <= OffsetMaxVersion; version++ {
+		req := &OffsetReq{
+			CorrelationID: 241,
+			ClientID:      "test",
+			Version:       version,
+			ReplicaID:     -1,
+			Topics: []OffsetReqTopic{
+				{
+					Name:       "foo",
+					Partitions: []OffsetReqPartition{{ID: 1, TimeMs: 1500000000000}},
+				},
+			},
+		}
+		if version == 0 {
+			req.Topics[0].Partitions[0].MaxOffsets = 2
+		}
+		testRequestSerialization(c, req)
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		gotReq, err := ReadOffsetReq(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		c.Assert(gotReq, DeepEquals, req, Commentf("version %d", version))
+
+		resp := &OffsetResp{
+			CorrelationID: 241,
+			Version:       version,
+			Topics: []OffsetRespTopic{
+				{
+					Name:       "foo",
+					Partitions: []OffsetRespPartition{{ID: 1, Offsets: []int64{12, 3}}},
+				},
+			},
+		}
+		if version >= 1 {
+			resp.Topics[0].Partitions[0].Offsets = []int64{12}
+			resp.Topics[0].Partitions[0].Timestamp = 1500000000001
+		}
+		b, err = resp.Bytes()
+		c.Assert(err, IsNil)
+		got, err := ReadVersionedOffsetResp(bytes.NewReader(b), version)
+		c.Assert(err, IsNil)
+		c.Assert(got, DeepEquals, resp, Commentf("version %d", version))
+	}
+
+	_, err := (&OffsetReq{Version: OffsetMaxVersion + 1}).Bytes()
+	c.Assert(err, NotNil)
+}
+
+func (s *MessagesSuite) TestGroupMessages(c *C) {
+	joinReq := &JoinGroupReq{
+		CorrelationID:  3,
+		ClientID:       "test",
+		GroupID:        "group",
+		SessionTimeout: 30 * time.Second,
+		ProtocolType:   "consumer",
+		Protocols:      []GroupProtocol{{Name: "range", Metadata: []byte{1, 2}}},
+	}
+	testRequestSerialization(c, joinReq)
+	b, err := joinReq.Bytes()
+	c.Assert(err, IsNil)
+	gotJoinReq, err := ReadJoinGroupReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotJoinReq, DeepEquals, joinReq)
+
+	joinResp := &JoinGroupResp{
+		CorrelationID: 3,
+		Err:           ErrRebalanceInProgress,
+		GenerationID:  2,
+		GroupProtocol: "range",
+		LeaderID:      "test-1",
+		MemberID:      "test-1",
+		Members:       []GroupMember{{MemberID: "test-1", Metadata: []byte{1, 2}}},
+	}
+	b, err = joinResp.Bytes()
+	c.Assert(err, IsNil)
+	gotJoinResp, err := ReadJoinGroupResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotJoinResp, DeepEquals, joinResp)
+
+	syncReq := &SyncGroupReq{
+		CorrelationID: 4,
+		ClientID:      "test",
+		GroupID:       "group",
+		GenerationID:  2,
+		MemberID:      "test-1",
+		Assignments:   []GroupAssignment{{MemberID: "test-1", Assignment: []byte{3}}},
+	}
+	testRequestSerialization(c, syncReq)
+	b, err = syncReq.Bytes()
+	c.Assert(err, IsNil)
+	gotSyncReq, err := ReadSyncGroupReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotSyncReq, DeepEquals, syncReq)
+
+	syncResp := &SyncGroupResp{CorrelationID: 4, Assignment: []byte{3}}
+	b, err = syncResp.Bytes()
+	c.Assert(err, IsNil)
+	gotSyncResp, err := ReadSyncGroupResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotSyncResp, DeepEquals, syncResp)
+
+	hbReq := &HeartbeatReq{CorrelationID: 5, ClientID: "test", GroupID: "group", GenerationID: 2, MemberID: "test-1"}
+	testRequestSerialization(c, hbReq)
+	b, err = hbReq.Bytes()
+	c.Assert(err, IsNil)
+	gotHbReq, err := ReadHeartbeatReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotHbReq, DeepEquals, hbReq)
+
+	hbResp := &HeartbeatResp{CorrelationID: 5, Err: ErrIllegalGeneration}
+	b, err = hbResp.Bytes()
+	c.Assert(err, IsNil)
+	gotHbResp, err := ReadHeartbeatResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotHbResp, DeepEquals, hbResp)
+
+	leaveReq := &LeaveGroupReq{CorrelationID: 6, ClientID: "test", GroupID: "group", MemberID: "test-1"}
+	testRequestSerialization(c, leaveReq)
+	b, err = leaveReq.Bytes()
+	c.Assert(err, IsNil)
+	gotLeaveReq, err := ReadLeaveGroupReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotLeaveReq, DeepEquals, leaveReq)
+
+	leaveResp := &LeaveGroupResp{CorrelationID: 6}
+	b, err = leaveResp.Bytes()
+	c.Assert(err, IsNil)
+	gotLeaveResp, err := ReadLeaveGroupResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotLeaveResp, DeepEquals, leaveResp)
+}
+
+func (s *MessagesSuite) TestReadRecordBatch(c *C) {
+	messages := []*Message{
+		{Offset: 7, Key: []byte("a"), Value: []byte("1")},
+		{Offset: 8, Value: []byte("2"), Headers: []Header{{Key: "trace", Value: []byte("x")}}},
+	}
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		var buf bytes.Buffer
+		n, err := writeRecordBatch(&buf, messages, compression)
+		c.Assert(err, IsNil)
+		// a legacy message follows the batch in the same set
+		_, err = writeMessageSet(&buf, []*Message{{Offset: 9, Value: []byte("3")}}, CompressionNone)
+		c.Assert(err, IsNil)
+
+		got, err := readMessageSet(bytes.NewReader(buf.Bytes()), int32(buf.Len()))
+		c.Assert(err, IsNil)
+		c.Assert(got, HasLen, 3, Commentf("compression %d", compression))
+		c.Assert(got[0].Offset, Equals, int64(7))
+		c.Assert(got[0].Key, DeepEquals, []byte("a"))
+		c.Assert(got[1].Offset, Equals, int64(8))
+		c.Assert(got[1].Key, IsNil)
+		c.Assert(got[1].Headers, DeepEquals, messages[1].Headers)
+		c.Assert(got[2].Offset, Equals, int64(9))
+		c.Assert(got[2].Value, DeepEquals, []byte("3"))
+
+		// a truncated batch is ignored, like a truncated message
+		got, err = readMessageSet(bytes.NewReader(buf.Bytes()[:n-1]), int32(n-1))
+		c.Assert(err, IsNil)
+		c.Assert(got, HasLen, 0)
+
+		// as is a corrupted one
+		corrupted := append([]byte(nil), buf.Bytes()...)
+		corrupted[n-1] ^= 0xff
+		got, err = readMessageSet(bytes.NewReader(corrupted), int32(len(corrupted)))
+		c.Assert(err, IsNil)
+		c.Assert(got, HasLen, 0)
+	}
+}
+
+func (s *MessagesSuite) TestMessageBatches(c *C) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{{Offset: 0, Value: []byte("a")}}, CompressionNone)
+	c.Assert(err, IsNil)
+	_, err = writeMessageSet(&buf, []*Message{{Offset: 1, Value: []byte("b")}}, CompressionNone)
+	c.Assert(err, IsNil)
+	_, err = writeMessageSet(&buf, []*Message{
+		{Offset: 2, Value: []byte("c")},
+		{Offset: 3, Value: []byte("d")},
+	}, CompressionGzip)
+	c.Assert(err, IsNil)
+	_, err = writeRecordBatch(&buf, []*Message{{Offset: 4, Value: []byte("e")}}, CompressionSnappy)
+	c.Assert(err, IsNil)
+
+	batches, err := readMessageBatches(bytes.NewReader(buf.Bytes()), int32(buf.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(batches, HasLen, 3)
+	c.Assert(batches[0].Compression, Equals, CompressionNone)
+	c.Assert(batches[0].Messages, HasLen, 2)
+	c.Assert(batches[1].Compression, Equals, CompressionGzip)
+	c.Assert(batches[1].Messages, HasLen, 2)
+	c.Assert(batches[1].Messages[0].Offset, Equals, int64(2))
+	c.Assert(batches[2].Compression, Equals, CompressionSnappy)
+	c.Assert(batches[2].Messages, HasLen, 1)
+
+	// a truncated batch is ignored
+	batches, err = readMessageBatches(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), int32(buf.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(batches, HasLen, 2)
+
+	// fetch responses write batches with their compression
+	for _, version := range []int16{0, 4} {
+		resp := &FetchResp{
+			CorrelationID: 1,
+			Version:       version,
+			Topics: []FetchRespTopic{{
+				Name: "foo",
+				Partitions: []FetchRespPartition{{
+					ID:      1,
+					Batches: []MessageBatch{{Compression: CompressionGzip, Messages: batches[1].Messages}},
+				}},
+			}},
+		}
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+		got, err := ReadVersionedFetchResp(bytes.NewReader(b), version)
+		c.Assert(err, IsNil)
+		msgs := got.Topics[0].Partitions[0].Messages
+		c.Assert(msgs, HasLen, 2, Commentf("version %d", version))
+		c.Assert(msgs[1].Offset, Equals, int64(3))
+		c.Assert(msgs[1].Value, DeepEquals, []byte("d"))
+	}
+}
+
 func (s *MessagesSuite) TestSerializeEmptyMessageSet(c *C) {
 	var buf bytes.Buffer
 	messages := []*Message{}
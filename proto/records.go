@@ -0,0 +1,239 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// castagnoli is the crc32c table used to checksum v2 record batches.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	// recordBatchMagic is the magic byte of the v2 record format, introduced
+	// in Kafka 0.11.
+	recordBatchMagic = 2
+
+	// recordBatchHeaderSize is the size of a record batch header following
+	// the base offset and batch length, up to and including the record count.
+	recordBatchHeaderSize = 4 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4 + 4
+
+	// batchControlFlag marks batches holding transaction markers instead of
+	// messages.
+	batchControlFlag = 0x20
+)
+
+var (
+	errShortRecord    = errors.New("record too short")
+	errRecordBatchCrc = errors.New("record batch crc mismatch")
+)
+
+// readRecordBatch decodes the v2 record batch in buf, which starts with the
+// partition leader epoch, right after the base offset and batch length.
+// Control batches decode to no messages.
+func readRecordBatch(baseOffset int64, buf []byte) ([]*Message, error) {
+	if len(buf) < recordBatchHeaderSize {
+		return nil, errShortRecord
+	}
+	crc := binary.BigEndian.Uint32(buf[5:9])
+	if crc != crc32.Checksum(buf[9:], castagnoli) {
+		return nil, errRecordBatchCrc
+	}
+	attributes := int16(binary.BigEndian.Uint16(buf[9:11]))
+	count := int32(binary.BigEndian.Uint32(buf[recordBatchHeaderSize-4 : recordBatchHeaderSize]))
+	if attributes&batchControlFlag != 0 {
+		return nil, nil
+	}
+
+	records := buf[recordBatchHeaderSize:]
+	switch compression := Compression(attributes & 7); compression {
+	case CompressionNone:
+	case CompressionGzip:
+		cr, err := gzip.NewReader(bytes.NewReader(records))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding gzip record batch: %s", err)
+		}
+		if records, err = ioutil.ReadAll(cr); err != nil {
+			return nil, fmt.Errorf("error decoding gzip record batch: %s", err)
+		}
+		_ = cr.Close()
+	case CompressionSnappy:
+		var err error
+		if records, err = snappyDecode(records); err != nil {
+			return nil, fmt.Errorf("error decoding snappy record batch: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("cannot handle compression method: %d", compression)
+	}
+
+	if count < 0 {
+		return nil, fmt.Errorf("invalid record count %d", count)
+	}
+	// Don't trust count for the allocation, records are at least 7 bytes.
+	if max := int32(len(records) / 7); count > max {
+		count = max
+	}
+	set := make([]*Message, 0, count)
+	rd := &varintReader{buf: records}
+	for i := int32(0); i < count; i++ {
+		msg, err := rd.readRecord(baseOffset, crc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode record: %s", err)
+		}
+		set = append(set, msg)
+	}
+	return set, nil
+}
+
+// varintReader decodes the varint encoded fields of v2 records.
+type varintReader struct {
+	buf []byte
+	err error
+}
+
+func (r *varintReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errShortRecord
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// bytes returns the next varint length prefixed field, or nil if it is null.
+func (r *varintReader) bytes() []byte {
+	size := r.varint()
+	if r.err != nil || size < 0 {
+		return nil
+	}
+	if int64(len(r.buf)) < size {
+		r.err = errShortRecord
+		return nil
+	}
+	b := make([]byte, size)
+	copy(b, r.buf)
+	r.buf = r.buf[size:]
+	return b
+}
+
+func (r *varintReader) readRecord(baseOffset int64, crc uint32) (*Message, error) {
+	size := r.varint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if size < 1 || int64(len(r.buf)) < size {
+		return nil, errShortRecord
+	}
+	rec := &varintReader{buf: r.buf[1:size]} // skip the unused attributes
+	r.buf = r.buf[size:]
+
+	_ = rec.varint() // timestamp delta
+	msg := &Message{
+		Offset: baseOffset + rec.varint(),
+		Crc:    crc,
+		Key:    rec.bytes(),
+		Value:  rec.bytes(),
+	}
+	if n := rec.varint(); n > 0 {
+		msg.Headers = make([]Header, 0, n)
+		for i := int64(0); i < n && rec.err == nil; i++ {
+			key := rec.bytes()
+			msg.Headers = append(msg.Headers, Header{Key: string(key), Value: rec.bytes()})
+		}
+	}
+	if rec.err != nil {
+		return nil, rec.err
+	}
+	return msg, nil
+}
+
+// writeRecordBatch writes messages as a single v2 record batch into w. The
+// offsets of the messages must be increasing. It returns the number of bytes
+// written and any error.
+func writeRecordBatch(w io.Writer, messages []*Message, compression Compression) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	baseOffset := messages[0].Offset
+
+	var records []byte
+	var vbuf [binary.MaxVarintLen64]byte
+	putVarint := func(b []byte, v int64) []byte {
+		return append(b, vbuf[:binary.PutVarint(vbuf[:], v)]...)
+	}
+	putBytes := func(b []byte, val []byte) []byte {
+		if val == nil {
+			return putVarint(b, -1)
+		}
+		return append(putVarint(b, int64(len(val))), val...)
+	}
+	var rec []byte
+	for _, msg := range messages {
+		rec = append(rec[:0], 0) // attributes
+		rec = putVarint(rec, 0)  // timestamp delta
+		rec = putVarint(rec, msg.Offset-baseOffset)
+		rec = putBytes(rec, msg.Key)
+		rec = putBytes(rec, msg.Value)
+		rec = putVarint(rec, int64(len(msg.Headers)))
+		for _, h := range msg.Headers {
+			rec = putBytes(rec, []byte(h.Key))
+			rec = putBytes(rec, h.Value)
+		}
+		records = putVarint(records, int64(len(rec)))
+		records = append(records, rec...)
+	}
+
+	switch compression {
+	case CompressionNone:
+	case CompressionGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(records); err != nil {
+			return 0, err
+		}
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
+		records = buf.Bytes()
+	case CompressionSnappy:
+		records = snappy.Encode(nil, records)
+	default:
+		return 0, fmt.Errorf("cannot handle compression method: %d", compression)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt64(baseOffset)
+	enc.EncodeInt32(int32(recordBatchHeaderSize + len(records)))
+	enc.EncodeInt32(-1) // partition leader epoch
+	enc.EncodeInt8(recordBatchMagic)
+	enc.EncodeUint32(0) // crc32c placeholder
+	enc.EncodeInt16(int16(compression))
+	enc.EncodeInt32(int32(messages[len(messages)-1].Offset - baseOffset))
+	enc.EncodeInt64(-1) // first timestamp
+	enc.EncodeInt64(-1) // max timestamp
+	enc.EncodeInt64(-1) // producer ID
+	enc.EncodeInt16(-1) // producer epoch
+	enc.EncodeInt32(-1) // base sequence
+	enc.EncodeInt32(int32(len(messages)))
+	if err := enc.Err(); err != nil {
+		return 0, err
+	}
+	buf.Write(records)
+
+	const crcoff = 8 + 4 + 4 + 1 // base offset + batch length + leader epoch + magic
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[crcoff:crcoff+4], crc32.Checksum(b[crcoff+4:], castagnoli))
+	return w.Write(b)
+}
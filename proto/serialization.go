@@ -327,6 +327,15 @@ func (e *encoder) EncodeString(val string) {
 	}
 }
 
+// EncodeNullableString encodes an empty string as null.
+func (e *encoder) EncodeNullableString(val string) {
+	if val == "" {
+		e.EncodeInt16(-1)
+		return
+	}
+	e.EncodeString(val)
+}
+
 func (e *encoder) EncodeError(err error) {
 	b := e.buf[:2]
 
@@ -362,3 +371,10 @@ func writeAll(w io.Writer, b []byte) error {
 	}
 	return nil
 }
+
+func boolToInt8(val bool) int8 {
+	if val {
+		return 1
+	}
+	return 0
+}
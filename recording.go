@@ -0,0 +1,219 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// recordingMagic starts every recording, followed by the version of the
+// format.
+const (
+	recordingMagic   = "KREC"
+	recordingVersion = 1
+)
+
+// RecordedFrame is a request or a response as it was sent over a connection
+// to a broker.
+type RecordedFrame struct {
+	// Time is when the whole frame was written or read.
+	Time time.Time
+	// ConnID identifies the connection within the recording. Connections
+	// are numbered from 1 in the order they were dialed.
+	ConnID int32
+	// Addr is the address of the broker.
+	Addr string
+	// Request is true for frames sent to the broker.
+	Request bool
+	// Data is the whole frame, including its size, as read by proto.ReadReq
+	// or proto.ReadResp.
+	Data []byte
+}
+
+// Recorder writes the frames exchanged with brokers to a recording, which
+// can be read with ReadRecording. Set the Dialer of ClusterConnectionConf to
+// the result of Recorder.Dialer to record all connections of a Broker.
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.Writer
+	err    error
+	connID int32
+}
+
+// NewRecorder returns a recorder writing to w. Writes to w are serialized.
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{w: w}
+	var header [len(recordingMagic) + 2]byte
+	copy(header[:], recordingMagic)
+	binary.BigEndian.PutUint16(header[len(recordingMagic):], recordingVersion)
+	_, r.err = w.Write(header[:])
+	return r
+}
+
+// Err returns the first error that happened while writing the recording.
+// Frames are not written anymore after an error.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// Dialer returns a dialer recording the connections established with d, or
+// with a net.Dialer if d is nil.
+func (r *Recorder) Dialer(d Dialer) Dialer {
+	return &recorderDialer{recorder: r, dialer: dialerOrDefault(d)}
+}
+
+// write appends a frame to the recording.
+func (r *Recorder) write(f RecordedFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	b := make([]byte, 0, 17+len(f.Addr)+len(f.Data))
+	b = appendUint64(b, uint64(f.Time.UnixNano()))
+	b = appendUint32(b, uint32(f.ConnID))
+	if f.Request {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+	}
+	b = appendUint32(b, uint32(len(f.Addr)))
+	b = append(b, f.Addr...)
+	b = append(b, f.Data...)
+	if _, err := r.w.Write(b); err != nil {
+		r.err = err
+	}
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// ReadRecording reads all frames of a recording written by a Recorder.
+func ReadRecording(r io.Reader) ([]RecordedFrame, error) {
+	rd := bufio.NewReader(r)
+
+	var header [len(recordingMagic) + 2]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		return nil, fmt.Errorf("cannot read recording header: %s", err)
+	}
+	if string(header[:len(recordingMagic)]) != recordingMagic {
+		return nil, errors.New("not a recording")
+	}
+	if v := binary.BigEndian.Uint16(header[len(recordingMagic):]); v != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", v)
+	}
+
+	var frames []RecordedFrame
+	for {
+		var fixed [17]byte
+		if _, err := io.ReadFull(rd, fixed[:]); err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return frames, fmt.Errorf("cannot read frame %d: %s", len(frames), err)
+		}
+		f := RecordedFrame{
+			Time:    time.Unix(0, int64(binary.BigEndian.Uint64(fixed[0:]))),
+			ConnID:  int32(binary.BigEndian.Uint32(fixed[8:])),
+			Request: fixed[12] == 0,
+		}
+		addr := make([]byte, binary.BigEndian.Uint32(fixed[13:]))
+		if _, err := io.ReadFull(rd, addr); err != nil {
+			return frames, fmt.Errorf("cannot read frame %d: %s", len(frames), err)
+		}
+		f.Addr = string(addr)
+		var size [4]byte
+		if _, err := io.ReadFull(rd, size[:]); err != nil {
+			return frames, fmt.Errorf("cannot read frame %d: %s", len(frames), err)
+		}
+		f.Data = make([]byte, 4+binary.BigEndian.Uint32(size[:]))
+		copy(f.Data, size[:])
+		if _, err := io.ReadFull(rd, f.Data[4:]); err != nil {
+			return frames, fmt.Errorf("cannot read frame %d: %s", len(frames), err)
+		}
+		frames = append(frames, f)
+	}
+}
+
+type recorderDialer struct {
+	recorder *Recorder
+	dialer   Dialer
+}
+
+func (d *recorderDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	d.recorder.mu.Lock()
+	d.recorder.connID++
+	id := d.recorder.connID
+	d.recorder.mu.Unlock()
+
+	return &recorderConn{Conn: conn, recorder: d.recorder, id: id, addr: addr}, nil
+}
+
+// recorderConn splits the bytes written and read into frames, using the size
+// each frame starts with, and records them once complete.
+type recorderConn struct {
+	net.Conn
+	recorder *Recorder
+	id       int32
+	addr     string
+
+	written []byte
+	read    []byte
+}
+
+func (c *recorderConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written = c.record(append(c.written, b[:n]...), true)
+	return n, err
+}
+
+func (c *recorderConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read = c.record(append(c.read, b[:n]...), false)
+	return n, err
+}
+
+// record records the complete frames at the start of buf and returns the
+// rest.
+func (c *recorderConn) record(buf []byte, request bool) []byte {
+	for len(buf) >= 4 {
+		size := 4 + int(binary.BigEndian.Uint32(buf))
+		if len(buf) < size {
+			break
+		}
+		c.recorder.write(RecordedFrame{
+			Time:    time.Now(),
+			ConnID:  c.id,
+			Addr:    c.addr,
+			Request: request,
+			Data:    append([]byte(nil), buf[:size]...),
+		})
+		buf = buf[size:]
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return buf
+}
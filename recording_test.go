@@ -0,0 +1,96 @@
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	"net"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&RecordingSuite{})
+
+type RecordingSuite struct{}
+
+func (s *RecordingSuite) TestFrames(c *C) {
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &recorderConn{Conn: client, recorder: recorder, id: 1, addr: "broker:9092"}
+
+	req, err := (&proto.MetadataReq{CorrelationID: 7, ClientID: "test"}).Bytes()
+	c.Assert(err, IsNil)
+	resp, err := (&proto.MetadataResp{CorrelationID: 7}).Bytes()
+	c.Assert(err, IsNil)
+
+	// Frames are recorded once complete, whatever the size of the writes and
+	// reads.
+	go func() {
+		b := make([]byte, len(req)*2)
+		_, _ = server.Read(b)
+		_, _ = server.Write(resp[:3])
+		_, _ = server.Write(append(resp[3:], resp...))
+	}()
+	_, err = conn.Write(append(append([]byte(nil), req...), req[:5]...))
+	c.Assert(err, IsNil)
+	got := make([]byte, 2*len(resp))
+	n := 0
+	for n < len(got) {
+		m, err := conn.Read(got[n:])
+		c.Assert(err, IsNil)
+		n += m
+	}
+	c.Assert(recorder.Err(), IsNil)
+
+	frames, err := ReadRecording(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(frames, HasLen, 3)
+	for i, f := range frames {
+		c.Assert(f.ConnID, Equals, int32(1))
+		c.Assert(f.Addr, Equals, "broker:9092")
+		c.Assert(f.Request, Equals, i == 0)
+	}
+	c.Assert(frames[0].Data, DeepEquals, req)
+	c.Assert(frames[1].Data, DeepEquals, resp)
+	c.Assert(frames[2].Data, DeepEquals, resp)
+	c.Assert(conn.written, DeepEquals, req[:5])
+	c.Assert(conn.read, IsNil)
+}
+
+func (s *RecordingSuite) TestReadRecording(c *C) {
+	_, err := ReadRecording(bytes.NewReader([]byte("KREC")))
+	c.Assert(err, ErrorMatches, "cannot read recording header: .*")
+	_, err = ReadRecording(bytes.NewReader([]byte("PCAP\x00\x01")))
+	c.Assert(err, ErrorMatches, "not a recording")
+	_, err = ReadRecording(bytes.NewReader([]byte("KREC\x00\x02")))
+	c.Assert(err, ErrorMatches, "unsupported recording version 2")
+
+	frames, err := ReadRecording(bytes.NewReader([]byte("KREC\x00\x01")))
+	c.Assert(err, IsNil)
+	c.Assert(frames, HasLen, 0)
+
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+	recorder.write(RecordedFrame{ConnID: 1, Data: []byte{0, 0, 0, 2, 1, 2}})
+	b := buf.Bytes()
+	frames, err = ReadRecording(bytes.NewReader(b[:len(b)-1]))
+	c.Assert(err, ErrorMatches, "cannot read frame 0: .*")
+	c.Assert(frames, HasLen, 0)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (s *RecordingSuite) TestWriteError(c *C) {
+	recorder := NewRecorder(failingWriter{})
+	c.Assert(recorder.Err(), ErrorMatches, "disk full")
+	recorder.write(RecordedFrame{Data: []byte{0, 0, 0, 0}})
+	c.Assert(recorder.Err(), ErrorMatches, "disk full")
+}
@@ -0,0 +1,175 @@
+package kafka
+
+import (
+	"strconv"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// ProduceInterceptor is called around every Producer.Produce call.
+type ProduceInterceptor interface {
+	// BeforeProduce is called before the messages are sent. messages is a
+	// copy of the slice given to Produce, whose elements may be replaced to
+	// change what is sent; the messages themselves belong to the caller and
+	// should not be modified. The returned function, if not nil, is called
+	// with the result of the call once it is known.
+	BeforeProduce(topic string, partition int32, messages []*proto.Message) func(offset int64, err error)
+}
+
+// ConsumeInterceptor is called around every batch of messages read by a
+// Consumer or BatchConsumer.
+type ConsumeInterceptor interface {
+	// BeforeConsume is called before the consumer starts fetching. The
+	// returned function, if not nil, is called with the fetched messages or
+	// the error, before they are handed to the caller.
+	BeforeConsume(topic string, partition int32) func(messages []*proto.Message, err error)
+}
+
+// CommitInterceptor is called around every OffsetCoordinator.Commit and
+// CommitFull call.
+type CommitInterceptor interface {
+	// BeforeCommit is called before the offset is sent to the coordinator.
+	// The returned function, if not nil, is called with the result.
+	BeforeCommit(consumerGroup, topic string, partition int32, offset int64) func(err error)
+}
+
+// Tracer starts spans. It is implemented by adapters to a tracing library so
+// that this package does not depend on any of them.
+type Tracer interface {
+	// StartSpan starts a span for the named operation. If carrier is not nil
+	// and holds a trace context written by Span.Inject, the span continues
+	// that trace.
+	StartSpan(operation string, carrier HeaderCarrier) Span
+}
+
+// Span is a single traced operation started by a Tracer.
+type Span interface {
+	// SetTag attaches a key/value pair to the span.
+	SetTag(key, value string)
+
+	// Inject writes the trace context of the span into carrier.
+	Inject(carrier HeaderCarrier)
+
+	// Finish ends the span. err is the result of the traced operation.
+	Finish(err error)
+}
+
+// HeaderCarrier gives a Tracer access to the headers of a message.
+type HeaderCarrier interface {
+	// Get returns the value of the first header with the given key.
+	Get(key string) (string, bool)
+
+	// Set replaces all headers with the given key by a single one.
+	Set(key, value string)
+}
+
+// MessageCarrier returns a HeaderCarrier reading and writing the headers of
+// msg. Consumers can use it to continue the trace of a consumed message.
+func MessageCarrier(msg *proto.Message) HeaderCarrier {
+	return messageCarrier{msg}
+}
+
+type messageCarrier struct {
+	msg *proto.Message
+}
+
+func (c messageCarrier) Get(key string) (string, bool) {
+	for _, h := range c.msg.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+func (c messageCarrier) Set(key, value string) {
+	headers := c.msg.Headers[:0]
+	for _, h := range c.msg.Headers {
+		if h.Key != key {
+			headers = append(headers, h)
+		}
+	}
+	c.msg.Headers = append(headers, proto.Header{Key: key, Value: []byte(value)})
+}
+
+// TracingInterceptor implements ProduceInterceptor, ConsumeInterceptor and
+// CommitInterceptor by starting a span around every call.
+//
+// On produce, the trace context is injected into the headers of a copy of
+// every message, so that the caller's messages are left unchanged. On
+// consume, every message carrying headers gets a "kafka.receive" span
+// continuing the trace of its producer, and the context of that span is
+// injected back into the message so that the application can continue it with
+// MessageCarrier. Headers only survive the round trip through Kafka when the
+// record format supports them; with the v0 format used by this package they
+// are dropped on the wire and consumed messages start new traces.
+type TracingInterceptor struct {
+	tracer Tracer
+}
+
+// NewTracingInterceptor returns a TracingInterceptor starting spans with the
+// given tracer.
+func NewTracingInterceptor(tracer Tracer) *TracingInterceptor {
+	return &TracingInterceptor{tracer: tracer}
+}
+
+// BeforeProduce starts a "kafka.produce" span and replaces messages by
+// copies carrying it in their headers.
+func (t *TracingInterceptor) BeforeProduce(
+	topic string, partition int32, messages []*proto.Message) func(int64, error) {
+
+	span := t.tracer.StartSpan("kafka.produce", nil)
+	setPartitionTags(span, topic, partition)
+	span.SetTag("kafka.messages", strconv.Itoa(len(messages)))
+	for i, msg := range messages {
+		traced := *msg
+		traced.Headers = append([]proto.Header(nil), msg.Headers...)
+		span.Inject(MessageCarrier(&traced))
+		messages[i] = &traced
+	}
+	return func(offset int64, err error) {
+		if err == nil {
+			span.SetTag("kafka.offset", strconv.FormatInt(offset, 10))
+		}
+		span.Finish(err)
+	}
+}
+
+// BeforeConsume starts a "kafka.consume" span, and a "kafka.receive" span for
+// every consumed message carrying headers.
+func (t *TracingInterceptor) BeforeConsume(topic string, partition int32) func([]*proto.Message, error) {
+	span := t.tracer.StartSpan("kafka.consume", nil)
+	setPartitionTags(span, topic, partition)
+	return func(messages []*proto.Message, err error) {
+		span.SetTag("kafka.messages", strconv.Itoa(len(messages)))
+		span.Finish(err)
+
+		for _, msg := range messages {
+			if len(msg.Headers) == 0 {
+				continue
+			}
+			carrier := MessageCarrier(msg)
+			recv := t.tracer.StartSpan("kafka.receive", carrier)
+			setPartitionTags(recv, topic, partition)
+			recv.SetTag("kafka.offset", strconv.FormatInt(msg.Offset, 10))
+			recv.Inject(carrier)
+			recv.Finish(nil)
+		}
+	}
+}
+
+// BeforeCommit starts a "kafka.commit" span.
+func (t *TracingInterceptor) BeforeCommit(
+	consumerGroup, topic string, partition int32, offset int64) func(error) {
+
+	span := t.tracer.StartSpan("kafka.commit", nil)
+	setPartitionTags(span, topic, partition)
+	span.SetTag("kafka.consumer_group", consumerGroup)
+	span.SetTag("kafka.offset", strconv.FormatInt(offset, 10))
+	return span.Finish
+}
+
+func setPartitionTags(span Span, topic string, partition int32) {
+	span.SetTag("kafka.topic", topic)
+	span.SetTag("kafka.partition", strconv.FormatInt(int64(partition), 10))
+}
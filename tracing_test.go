@@ -0,0 +1,192 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&TracingSuite{})
+
+type TracingSuite struct{}
+
+func (s *TracingSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// recordingTracer propagates span IDs through the "trace-id" header and keeps
+// every finished span.
+type recordingTracer struct {
+	mu    sync.Mutex
+	next  int
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	tracer    *recordingTracer
+	operation string
+	id        string
+	parent    string
+	tags      map[string]string
+	finished  bool
+	err       error
+}
+
+func (t *recordingTracer) StartSpan(operation string, carrier HeaderCarrier) Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	span := &recordingSpan{
+		tracer:    t,
+		operation: operation,
+		id:        fmt.Sprintf("span-%d", t.next),
+		tags:      make(map[string]string),
+	}
+	if carrier != nil {
+		span.parent, _ = carrier.Get("trace-id")
+	}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (s *recordingSpan) SetTag(key, value string) {
+	s.tags[key] = value
+}
+
+func (s *recordingSpan) Inject(carrier HeaderCarrier) {
+	carrier.Set("trace-id", s.id)
+}
+
+func (s *recordingSpan) Finish(err error) {
+	s.finished = true
+	s.err = err
+}
+
+func (s *TracingSuite) TestMessageCarrier(c *C) {
+	msg := &proto.Message{Headers: []proto.Header{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+	}}
+	carrier := MessageCarrier(msg)
+
+	value, ok := carrier.Get("b")
+	c.Assert(ok, Equals, true)
+	c.Assert(value, Equals, "2")
+	_, ok = carrier.Get("c")
+	c.Assert(ok, Equals, false)
+
+	carrier.Set("a", "3")
+	c.Assert(msg.Headers, DeepEquals, []proto.Header{
+		{Key: "b", Value: []byte("2")},
+		{Key: "a", Value: []byte("3")},
+	})
+}
+
+func (s *TracingSuite) TestProduceSpan(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.ProduceRespPartition{{ID: 0, Offset: 5}},
+				},
+			},
+		}
+	})
+
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-tracing", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	tracer := &recordingTracer{}
+	prodConf := NewProducerConf()
+	prodConf.Interceptor = NewTracingInterceptor(tracer)
+	msgs := []*proto.Message{{Value: []byte("first")}, {Value: []byte("second")}}
+	_, err = broker.Producer(prodConf).Produce("test", 0, msgs...)
+	c.Assert(err, IsNil)
+
+	c.Assert(tracer.spans, HasLen, 1)
+	span := tracer.spans[0]
+	c.Assert(span.operation, Equals, "kafka.produce")
+	c.Assert(span.finished, Equals, true)
+	c.Assert(span.err, IsNil)
+	c.Assert(span.tags, DeepEquals, map[string]string{
+		"kafka.topic":     "test",
+		"kafka.partition": "0",
+		"kafka.messages":  "2",
+		"kafka.offset":    "5",
+	})
+	// The caller's messages only get their offset
+	for i, msg := range msgs {
+		c.Assert(msg.Headers, IsNil)
+		c.Assert(msg.Offset, Equals, int64(5+i))
+	}
+}
+
+func (s *TracingSuite) TestConsumeSpans(c *C) {
+	tracer := &recordingTracer{}
+	interceptor := NewTracingInterceptor(tracer)
+
+	original := &proto.Message{Value: []byte("first"), Headers: []proto.Header{{Key: "k", Value: []byte("v")}}}
+	produced := []*proto.Message{original}
+	interceptor.BeforeProduce("test", 1, produced)(3, nil)
+	c.Assert(produced[0], Not(Equals), original)
+	c.Assert(original.Headers, HasLen, 1)
+	c.Assert(produced[0].Headers, HasLen, 2)
+
+	consumed := []*proto.Message{
+		{Value: []byte("first"), Offset: 3, Headers: produced[0].Headers},
+		{Value: []byte("second"), Offset: 4},
+	}
+	interceptor.BeforeConsume("test", 1)(consumed, nil)
+
+	c.Assert(tracer.spans, HasLen, 3)
+	c.Assert(tracer.spans[1].operation, Equals, "kafka.consume")
+	c.Assert(tracer.spans[1].tags["kafka.messages"], Equals, "2")
+	c.Assert(tracer.spans[1].finished, Equals, true)
+
+	// Only the message carrying headers continues the producer trace
+	recv := tracer.spans[2]
+	c.Assert(recv.operation, Equals, "kafka.receive")
+	c.Assert(recv.parent, Equals, tracer.spans[0].id)
+	c.Assert(recv.tags["kafka.offset"], Equals, "3")
+	id, _ := MessageCarrier(consumed[0]).Get("trace-id")
+	c.Assert(id, Equals, recv.id)
+	c.Assert(consumed[1].Headers, IsNil)
+}
+
+func (s *TracingSuite) TestCommitSpan(c *C) {
+	tracer := &recordingTracer{}
+	broker := &Broker{conf: NewBrokerConf("tester")}
+	conf := NewOffsetCoordinatorConf("test-group")
+	conf.Interceptor = NewTracingInterceptor(tracer)
+	coord, err := broker.OffsetCoordinator(conf)
+	c.Assert(err, IsNil)
+
+	// Negative offsets are rejected before anything is sent
+	c.Assert(coord.Commit("test", 0, -1), NotNil)
+	c.Assert(tracer.spans, HasLen, 0)
+
+	interceptor := conf.Interceptor
+	errCommit := errors.New("commit failed")
+	interceptor.BeforeCommit("test-group", "test", 0, 7)(errCommit)
+	c.Assert(tracer.spans, HasLen, 1)
+	c.Assert(tracer.spans[0].operation, Equals, "kafka.commit")
+	c.Assert(tracer.spans[0].tags["kafka.consumer_group"], Equals, "test-group")
+	c.Assert(tracer.spans[0].tags["kafka.offset"], Equals, "7")
+	c.Assert(tracer.spans[0].err, Equals, errCommit)
+}